@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ApiKeyScopeShorten = "shorten" // Generate and store keys
+	ApiKeyScopeManage  = "manage"
+	ApiKeyScopeStats   = "stats"
+	ApiKeyScopeAdmin   = "admin" // Mint and revoke API keys, implies all scopes
+
+	ApiKeyPrefix = "kgk_"
+)
+
+var knownApiKeyScopes = []string{
+	ApiKeyScopeShorten, ApiKeyScopeManage, ApiKeyScopeStats, ApiKeyScopeAdmin,
+}
+
+var (
+	ErrApiKeyNotFound       = errors.New("api key not found")
+	ErrApiKeyRevoked        = errors.New("api key revoked")
+	ErrCouldNotVerifyApiKey = errors.New("could not verify api key")
+	ErrCouldNotMintApiKey   = errors.New("could not mint api key")
+	ErrCouldNotRevokeApiKey = errors.New("could not revoke api key")
+)
+
+type apiKey struct {
+	Name      string
+	Scopes    []string
+	Hosts     []string
+	RevokedAt *time.Time
+}
+
+func (k apiKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope || granted == ApiKeyScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts are matched against source names, which callers set to their short
+// host. Keys without hosts may act for any source.
+func (k apiKey) AllowsSource(sourceName string) bool {
+	if len(k.Hosts) == 0 {
+		return true
+	}
+	for _, host := range k.Hosts {
+		if host == sourceName {
+			return true
+		}
+	}
+	return false
+}
+
+type ApiKeyService interface {
+	MintApiKey(ctx context.Context, name string, scopes []string, hosts []string) (string, string, error)
+	AuthenticateApiKey(ctx context.Context, rawKey string) (apiKey, error)
+	RevokeApiKey(ctx context.Context, id string) error
+}
+
+type apiKeyService struct {
+	Db             PostgresDb
+	AdminKeyHash   string
+	ShortenKeyHash string
+}
+
+// The admin key, when set, is accepted without being stored so that the
+// first keys can be minted. So is the shorten key, which holds only the
+// shorten scope, so that url-shorten-app can be configured without minting.
+func NewApiKeyService(db PostgresDb, adminKey string, shortenKey string) ApiKeyService {
+	adminKeyHash, shortenKeyHash := "", ""
+	if adminKey != "" {
+		adminKeyHash = apiKeyIdForRawKey(adminKey)
+	}
+	if shortenKey != "" {
+		shortenKeyHash = apiKeyIdForRawKey(shortenKey)
+	}
+	return &apiKeyService{Db: db, AdminKeyHash: adminKeyHash, ShortenKeyHash: shortenKeyHash}
+}
+
+// Keys are random and long, so a fast hash is enough to store them safely
+func apiKeyIdForRawKey(rawKey string) string {
+	hash := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(hash[:])
+}
+
+// Returns the raw key, which is not stored and cannot be recovered, and its id
+func (s apiKeyService) MintApiKey(ctx context.Context, name string, scopes []string, hosts []string) (string, string, error) {
+	buff := make([]byte, 32)
+	_, _ = rand.Read(buff)
+	rawKey := ApiKeyPrefix + base64.RawURLEncoding.EncodeToString(buff)
+	id := apiKeyIdForRawKey(rawKey)
+
+	if hosts == nil {
+		hosts = []string{}
+	}
+	_, err := s.Db.queryInt(
+		ctx,
+		"INSERT INTO api_keys (name, key_hash, scopes, hosts) VALUES ($1, $2, $3, $4) RETURNING id",
+		name,
+		id,
+		scopes,
+		hosts,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error inserting API key", "name", name, "error", err)
+		return "", "", ErrCouldNotMintApiKey
+	}
+
+	slog.InfoContext(ctx, "Minted API key", "name", name, "id", id)
+	return rawKey, id, nil
+}
+
+func (s apiKeyService) AuthenticateApiKey(ctx context.Context, rawKey string) (apiKey, error) {
+	id := apiKeyIdForRawKey(rawKey)
+	if s.AdminKeyHash != "" && subtle.ConstantTimeCompare([]byte(id), []byte(s.AdminKeyHash)) == 1 {
+		return apiKey{Name: "admin", Scopes: []string{ApiKeyScopeAdmin}}, nil
+	}
+	if s.ShortenKeyHash != "" && subtle.ConstantTimeCompare([]byte(id), []byte(s.ShortenKeyHash)) == 1 {
+		return apiKey{Name: "shorten", Scopes: []string{ApiKeyScopeShorten}}, nil
+	}
+
+	var key apiKey
+	err := s.Db.queryRow(
+		ctx,
+		"SELECT name, scopes, hosts, revoked_at FROM api_keys WHERE key_hash = $1",
+		id,
+	).Scan(&key.Name, &key.Scopes, &key.Hosts, &key.RevokedAt)
+	if err == pgx.ErrNoRows {
+		return apiKey{}, ErrApiKeyNotFound
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error retrieving API key", "id", id, "error", err)
+		return apiKey{}, ErrCouldNotVerifyApiKey
+	}
+	if key.RevokedAt != nil {
+		return apiKey{}, ErrApiKeyRevoked
+	}
+
+	return key, nil
+}
+
+func (s apiKeyService) RevokeApiKey(ctx context.Context, id string) error {
+	rowsAffected, err := s.Db.exec(
+		ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP) WHERE key_hash = $1",
+		id,
+	)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error revoking API key", "id", id, "error", err)
+		return ErrCouldNotRevokeApiKey
+	}
+	if rowsAffected == 0 {
+		return ErrApiKeyNotFound
+	}
+
+	slog.InfoContext(ctx, "Revoked API key", "id", id)
+	return nil
+}
+
+// Middleware
+
+type apiKeyContextKey struct{}
+
+// Returns the key that authenticated the request, if any
+func apiKeyFromRequest(r *http.Request) (apiKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(apiKey)
+	return key, ok
+}
+
+// Rejects requests without a valid, unrevoked key holding the scope
+func requireApiKey(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		rawKey := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+		if !strings.HasPrefix(authorization, "Bearer ") || rawKey == "" {
+			slog.WarnContext(r.Context(), "API key missing")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "API key required.", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := App.Ak.AuthenticateApiKey(r.Context(), rawKey)
+		if err == ErrApiKeyNotFound || err == ErrApiKeyRevoked {
+			slog.WarnContext(r.Context(), "API key rejected", "error", err)
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			http.Error(w, "API key is invalid or revoked.", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not verify API key.", http.StatusServiceUnavailable)
+			return
+		}
+		if !key.HasScope(scope) {
+			slog.WarnContext(r.Context(), "API key is missing the scope", "name", key.Name, "scope", scope)
+			http.Error(
+				w,
+				fmt.Sprintf("API key is missing the %s scope.", scope),
+				http.StatusForbidden,
+			)
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// Rejects requests whose key is restricted to other sources
+func isSourceAllowed(w http.ResponseWriter, r *http.Request, sourceName string) bool {
+	if key, ok := apiKeyFromRequest(r); ok && !key.AllowsSource(sourceName) {
+		slog.WarnContext(r.Context(), "API key is not allowed for source", "name", key.Name, "source_name", sourceName)
+		http.Error(
+			w,
+			fmt.Sprintf("API key is not allowed for source %s.", sourceName),
+			http.StatusForbidden,
+		)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type MockAkService struct {
+	key   apiKey
+	error error
+}
+
+func (m MockAkService) MintApiKey(_ context.Context, _ string, _ []string, _ []string) (string, string, error) {
+	return "kgk_mock", apiKeyIdForRawKey("kgk_mock"), m.error
+}
+
+func (m MockAkService) AuthenticateApiKey(_ context.Context, rawKey string) (apiKey, error) {
+	if rawKey != "kgk_mock" {
+		return apiKey{}, ErrApiKeyNotFound
+	}
+	return m.key, m.error
+}
+
+func (m MockAkService) RevokeApiKey(_ context.Context, _ string) error {
+	return m.error
+}
+
+func TestApiKeyService_AuthenticateApiKey(t *testing.T) {
+	t.Run("returns admin key for the configured admin key", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{errors.New("failed")}, id: 0}
+		akSvc := NewApiKeyService(mockDb, "secret", "")
+		key, err := akSvc.AuthenticateApiKey(context.Background(), "secret")
+		if err != nil || !key.HasScope(ApiKeyScopeShorten) {
+			t.Errorf("Received %v and %s, expected admin key", key, err)
+		}
+	})
+	t.Run("returns key with only the shorten scope for the configured shorten key", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{errors.New("failed")}, id: 0}
+		akSvc := NewApiKeyService(mockDb, "secret", "shorten-secret")
+		key, err := akSvc.AuthenticateApiKey(context.Background(), "shorten-secret")
+		if err != nil || !key.HasScope(ApiKeyScopeShorten) {
+			t.Errorf("Received %v and %s, expected shorten key", key, err)
+		}
+		if key.HasScope(ApiKeyScopeAdmin) || key.HasScope(ApiKeyScopeManage) {
+			t.Errorf("Received %v, expected only the %s scope", key.Scopes, ApiKeyScopeShorten)
+		}
+	})
+	t.Run("returns error if key does not exist", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{pgx.ErrNoRows}, id: 0}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		_, err := akSvc.AuthenticateApiKey(context.Background(), "kgk_unknown")
+		if err != ErrApiKeyNotFound {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyNotFound)
+		}
+	})
+	t.Run("returns error if key is revoked", func(t *testing.T) {
+		callCount = 0
+		revokedAt := time.Now()
+		mockDb := MockPostgresDb{
+			errors: []error{nil},
+			row:    []interface{}{"ci", []string{ApiKeyScopeShorten}, []string{}, &revokedAt},
+		}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		_, err := akSvc.AuthenticateApiKey(context.Background(), "kgk_revoked")
+		if err != ErrApiKeyRevoked {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyRevoked)
+		}
+	})
+	t.Run("returns key if successful", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{
+			errors: []error{nil},
+			row:    []interface{}{"ci", []string{ApiKeyScopeShorten}, []string{"http://shrt.url"}, (*time.Time)(nil)},
+		}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		key, err := akSvc.AuthenticateApiKey(context.Background(), "kgk_valid")
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+		if !key.AllowsSource("http://shrt.url") || key.AllowsSource("http://other.url") {
+			t.Errorf("Received hosts %v, expected only %s", key.Hosts, "http://shrt.url")
+		}
+	})
+}
+
+func TestApiKeyService_MintApiKey(t *testing.T) {
+	t.Run("returns error if key cannot be saved", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{errors.New("failed")}, id: 0}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		_, _, err := akSvc.MintApiKey(context.Background(), "ci", []string{ApiKeyScopeShorten}, nil)
+		if err != ErrCouldNotMintApiKey {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotMintApiKey)
+		}
+	})
+	t.Run("returns prefixed key and its hash as id if successful", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{nil}, id: 1}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		rawKey, id, err := akSvc.MintApiKey(context.Background(), "ci", []string{ApiKeyScopeShorten}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(rawKey, ApiKeyPrefix) || id != apiKeyIdForRawKey(rawKey) {
+			t.Errorf("Received %s with id %s, expected prefixed key and its hash", rawKey, id)
+		}
+	})
+}
+
+func TestApiKeyService_RevokeApiKey(t *testing.T) {
+	t.Run("returns error if key does not exist", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{nil}, id: 0}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		if err := akSvc.RevokeApiKey(context.Background(), "abc"); err != ErrApiKeyNotFound {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyNotFound)
+		}
+	})
+	t.Run("returns nil if successful", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{errors: []error{nil}, id: 1}
+		akSvc := NewApiKeyService(mockDb, "", "")
+		if err := akSvc.RevokeApiKey(context.Background(), "abc"); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
+
+func TestRequireApiKey(t *testing.T) {
+	originalAkService := App.Ak
+	defer func() { App.Ak = originalAkService }()
+	h := requireApiKey(ApiKeyScopeShorten, HandleGenerateKeyRequest)
+
+	t.Run("returns 401 Unauthorized when key is missing", func(t *testing.T) {
+		App.Ak = MockAkService{key: apiKey{Scopes: []string{ApiKeyScopeShorten}}}
+		req, err := http.NewRequest("POST", "/key/generate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("returns 403 Forbidden when key lacks the scope", func(t *testing.T) {
+		App.Ak = MockAkService{key: apiKey{Scopes: []string{ApiKeyScopeStats}}}
+		req, err := http.NewRequest("POST", "/key/generate", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer kgk_mock")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+	})
+	t.Run("returns 403 Forbidden when key is restricted to other sources", func(t *testing.T) {
+		App.Ak = MockAkService{
+			key: apiKey{Scopes: []string{ApiKeyScopeShorten}, Hosts: []string{"http://other.url"}},
+		}
+		App.Kg = MockKgService{key: "12345678", error: nil}
+		req, err := http.NewRequest(
+			"POST",
+			"/key/generate",
+			strings.NewReader(`{"source_name": "http://shrt.url", "key_length": 8}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer kgk_mock")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+		App.Kg = OriginalKgService
+	})
+	t.Run("passes through when key is allowed", func(t *testing.T) {
+		App.Ak = MockAkService{
+			key: apiKey{Scopes: []string{ApiKeyScopeShorten}, Hosts: []string{"http://shrt.url"}},
+		}
+		App.Kg = MockKgService{key: "12345678", error: nil}
+		req, err := http.NewRequest(
+			"POST",
+			"/key/generate",
+			strings.NewReader(`{"source_name": "http://shrt.url", "key_length": 8}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer kgk_mock")
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusCreated {
+			t.Errorf("Received %d, expected %d", status, http.StatusCreated)
+		}
+		App.Kg = OriginalKgService
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+// Typed configuration, layered from defaults, a YAML or TOML file, env vars
+// and flags, each overriding the last. Every setting has a key, such as
+// minimum_key_length, read as is from the file, upper-cased from env vars
+// and dashed from flags, so MINIMUM_KEY_LENGTH and -minimum-key-length.
+// Settings tagged reload are read again on SIGHUP; the rest need a restart.
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ConfigFileEnvVar = "CONFIG_FILE"
+	ConfigFileFlag   = "config"
+)
+
+var (
+	ErrConfigFileFormat     = errors.New("config file is neither YAML nor TOML")
+	ErrConfigUnknownSetting = errors.New("unknown setting")
+	ErrConfigNotScalar      = errors.New("not a string or number")
+	ErrConfigNotInteger     = errors.New("not an integer")
+	ErrConfigNotBoolean     = errors.New("not true or false")
+	ErrConfigNotSet         = errors.New("not set")
+	ErrConfigOutOfRange     = errors.New("out of range")
+	ErrConfigUnknownValue   = errors.New("not one of the known values")
+)
+
+type Config struct {
+	LogLevel            string `config:"log_level" reload:"true"`
+	TracesExporter      string `config:"traces_exporter"`
+	OtlpTracesEndpoint  string `config:"otlp_traces_endpoint"`
+	TracesFilePath      string `config:"traces_file_path"`
+	DbConnStr           string `config:"postgres_connection_string"`
+	MaxKeyLength        int    `config:"maximum_key_length" reload:"true"`
+	MinKeyLength        int    `config:"minimum_key_length" reload:"true"`
+	MinSourceNameLength int    `config:"minimum_source_name_length" reload:"true"`
+	AdminApiKey         string `config:"admin_api_key"`
+	ShortenApiKey       string `config:"shorten_api_key"`
+	SharedSecret        string `config:"service_shared_secret"`
+	// For development only, where urlshortenapp may run without the secret
+	AllowUnsignedRequests bool `config:"allow_unsigned_requests"`
+}
+
+// Lists every invalid setting, rather than stopping at the first
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(key string, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", key, err))
+	}
+
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		invalid("log_level", err)
+	}
+	switch c.TracesExporter {
+	case TracesExporterNone, TracesExporterStdout:
+	case TracesExporterOtlp:
+		if c.OtlpTracesEndpoint == "" {
+			invalid("otlp_traces_endpoint", ErrConfigNotSet)
+		}
+	case TracesExporterFile:
+		if c.TracesFilePath == "" {
+			invalid("traces_file_path", ErrConfigNotSet)
+		}
+	default:
+		invalid("traces_exporter", ErrConfigUnknownValue)
+	}
+
+	if c.DbConnStr == "" {
+		invalid("postgres_connection_string", ErrConfigNotSet)
+	}
+	if c.MinKeyLength < 1 {
+		invalid("minimum_key_length", ErrConfigOutOfRange)
+	}
+	if c.MaxKeyLength < c.MinKeyLength {
+		invalid("maximum_key_length", ErrConfigOutOfRange)
+	}
+	if c.MinSourceNameLength < 1 {
+		invalid("minimum_source_name_length", ErrConfigOutOfRange)
+	}
+	if c.SharedSecret == "" && !c.AllowUnsignedRequests {
+		invalid("service_shared_secret", ErrConfigNotSet)
+	}
+	return errors.Join(errs...)
+}
+
+// Where config is read from, kept so that it can be read again on SIGHUP
+type ConfigLoader struct {
+	Path   string
+	Getenv func(string) string
+	// Only flags given on the command line, by key
+	Flags map[string]string
+}
+
+// Registers a flag per setting, plus one for the config file, returning a
+// loader to call once flags are parsed
+func NewConfigLoader(flags *flag.FlagSet, config any) func() ConfigLoader {
+	path := flags.String(ConfigFileFlag, "", fmt.Sprintf("YAML or TOML config file, or %s", ConfigFileEnvVar))
+	keys := map[string]string{}
+	for _, field := range configFields(config) {
+		key := field.Tag.Get("config")
+		flagName := strings.ReplaceAll(key, "_", "-")
+		keys[flagName] = key
+		flags.String(flagName, "", fmt.Sprintf("Overrides %s", strings.ToUpper(key)))
+	}
+
+	return func() ConfigLoader {
+		loader := ConfigLoader{Path: *path, Getenv: os.Getenv, Flags: map[string]string{}}
+		flags.Visit(func(f *flag.Flag) {
+			if key, ok := keys[f.Name]; ok {
+				loader.Flags[key] = f.Value.String()
+			}
+		})
+		return loader
+	}
+}
+
+func (l ConfigLoader) Load() (Config, error) {
+	var config Config
+	if err := loadConfig(&config, l.Path, l.Getenv, l.Flags); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+// Fills config from defaults, then the file, env vars and flags. Lists
+// every value that cannot be read, rather than stopping at the first.
+func loadConfig(config any, path string, getenv func(string) string, flagValues map[string]string) error {
+	fields := configFields(config)
+	values := map[string]string{}
+	for _, field := range fields {
+		values[field.Tag.Get("config")] = field.Tag.Get("default")
+	}
+
+	// Read the file, when given
+	var errs []error
+	if path == "" {
+		path = getenv(ConfigFileEnvVar)
+	}
+	if path != "" {
+		fileValues, fileErr := readConfigFile(path)
+		if fileErr != nil {
+			return fileErr
+		}
+		for _, key := range sortedKeys(fileValues) {
+			value := fileValues[key]
+			if _, ok := values[key]; !ok {
+				errs = append(errs, fmt.Errorf("%s: %w", key, ErrConfigUnknownSetting))
+				continue
+			}
+			switch value.(type) {
+			case nil:
+			case string, int, int64, uint64, float64, bool:
+				values[key] = fmt.Sprint(value)
+			default:
+				errs = append(errs, fmt.Errorf("%s: %w", key, ErrConfigNotScalar))
+			}
+		}
+	}
+
+	// Override with env vars, then flags
+	for _, field := range fields {
+		key := field.Tag.Get("config")
+		if value := getenv(strings.ToUpper(key)); value != "" {
+			values[key] = value
+		}
+		if value, ok := flagValues[key]; ok {
+			values[key] = value
+		}
+	}
+
+	// Set fields
+	target := reflect.ValueOf(config).Elem()
+	for _, field := range fields {
+		key := field.Tag.Get("config")
+		value := values[key]
+		switch field.Type.Kind() {
+		case reflect.String:
+			target.FieldByIndex(field.Index).SetString(value)
+		case reflect.Int:
+			if value == "" {
+				continue
+			}
+			intValue, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, ErrConfigNotInteger))
+				continue
+			}
+			target.FieldByIndex(field.Index).SetInt(int64(intValue))
+		case reflect.Bool:
+			if value == "" {
+				continue
+			}
+			boolValue, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, ErrConfigNotBoolean))
+				continue
+			}
+			target.FieldByIndex(field.Index).SetBool(boolValue)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readConfigFile(path string) (map[string]any, error) {
+	content, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	values := map[string]any{}
+	var parseErr error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parseErr = yaml.Unmarshal(content, &values)
+	case ".toml":
+		parseErr = toml.Unmarshal(content, &values)
+	default:
+		return nil, ErrConfigFileFormat
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("%s: %w", path, parseErr)
+	}
+	return values, nil
+}
+
+// Fields with a key, in the order declared
+func configFields(config any) []reflect.StructField {
+	var fields []reflect.StructField
+	configType := reflect.TypeOf(config)
+	if configType.Kind() == reflect.Pointer {
+		configType = configType.Elem()
+	}
+	for _, field := range reflect.VisibleFields(configType) {
+		if field.Tag.Get("config") != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func sortedKeys(values map[string]any) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Copies settings tagged reload from loaded into config, returning the keys
+// of those that changed, and of those that changed but need a restart
+func mergeReloadableConfig(config any, loaded any) (reloaded []string, ignored []string) {
+	target := reflect.ValueOf(config).Elem()
+	source := reflect.ValueOf(loaded).Elem()
+	for _, field := range configFields(config) {
+		key := field.Tag.Get("config")
+		current := target.FieldByIndex(field.Index)
+		value := source.FieldByIndex(field.Index)
+		if current.Equal(value) {
+			continue
+		}
+		if field.Tag.Get("reload") != "true" {
+			ignored = append(ignored, key)
+			continue
+		}
+		current.Set(value)
+		reloaded = append(reloaded, key)
+	}
+	return reloaded, ignored
+}
+
+// Reads config again, applying the settings that can change while serving.
+// Leaves config as it was when any setting is invalid.
+func (a *KeyGenSvc) ReloadConfig() error {
+	loaded, loadErr := a.ConfigLoader.Load()
+	if loadErr != nil {
+		return loadErr
+	}
+	config := *a.Config()
+	reloaded, ignored := mergeReloadableConfig(&config, &loaded)
+	if len(ignored) > 0 {
+		slog.Warn("Changed settings need a restart to apply", "settings", ignored)
+	}
+
+	// Apply the log level, then the rest by storing config
+	logLevel, _ := parseLogLevel(config.LogLevel)
+	a.LogLevel.Set(logLevel)
+	a.config.Store(&config)
+	slog.Info("Config reloaded", "settings", reloaded)
+	return nil
+}
+
+// Reloads config on every signal, until the channel is closed
+func (a *KeyGenSvc) ReloadConfigOn(signals <-chan os.Signal) {
+	for range signals {
+		if reloadErr := a.ReloadConfig(); reloadErr != nil {
+			slog.Error("Could not reload config, keeping the last", "error", reloadErr)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func getenvFrom(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Run("returns the file overridden by env vars, then flags", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		content := "postgres_connection_string: postgres://localhost/keystore\n" +
+			"minimum_key_length: 4\nmaximum_key_length: 36\nminimum_source_name_length: 4\n"
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		loader := ConfigLoader{
+			Path: path,
+			Getenv: getenvFrom(map[string]string{
+				"MINIMUM_KEY_LENGTH": "6", "MAXIMUM_KEY_LENGTH": "24", "SERVICE_SHARED_SECRET": "secret",
+			}),
+			Flags: map[string]string{"maximum_key_length": "12"},
+		}
+
+		config, err := loader.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.DbConnStr != "postgres://localhost/keystore" {
+			t.Errorf("Received %s, expected %s", config.DbConnStr, "postgres://localhost/keystore")
+		}
+		if config.MinKeyLength != 6 {
+			t.Errorf("Received %d, expected %d", config.MinKeyLength, 6)
+		}
+		if config.MaxKeyLength != 12 {
+			t.Errorf("Received %d, expected %d", config.MaxKeyLength, 12)
+		}
+	})
+
+	t.Run("returns every invalid setting at once", func(t *testing.T) {
+		loader := ConfigLoader{
+			Getenv: getenvFrom(map[string]string{"MINIMUM_KEY_LENGTH": "8", "MAXIMUM_KEY_LENGTH": "6"}),
+		}
+
+		_, err := loader.Load()
+		expected := "postgres_connection_string: not set\n" +
+			"maximum_key_length: out of range\n" +
+			"minimum_source_name_length: out of range\n" +
+			"service_shared_secret: not set"
+		if err == nil || err.Error() != expected {
+			t.Errorf("Received %v, expected %s", err, expected)
+		}
+	})
+
+	t.Run("returns config without a secret only when unsigned requests are allowed", func(t *testing.T) {
+		env := map[string]string{
+			"POSTGRES_CONNECTION_STRING": "postgres://localhost/keystore",
+			"MINIMUM_KEY_LENGTH":         "4",
+			"MAXIMUM_KEY_LENGTH":         "36",
+			"MINIMUM_SOURCE_NAME_LENGTH": "4",
+		}
+		loader := ConfigLoader{Getenv: getenvFrom(env), Flags: map[string]string{"allow_unsigned_requests": "true"}}
+
+		config, err := loader.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !config.AllowUnsignedRequests {
+			t.Errorf("Received %t, expected %t", config.AllowUnsignedRequests, true)
+		}
+
+		loader.Flags["allow_unsigned_requests"] = "sometimes"
+		_, err = loader.Load()
+		if !errors.Is(err, ErrConfigNotBoolean) {
+			t.Errorf("Received %s, expected %s", err, ErrConfigNotBoolean)
+		}
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	originalConfig := App.Config()
+	defer App.config.Store(originalConfig)
+	defer func(original ConfigLoader) { App.ConfigLoader = original }(App.ConfigLoader)
+	defer App.LogLevel.Set(App.LogLevel.Level())
+
+	t.Run("applies reloadable settings and keeps the rest until restarted", func(t *testing.T) {
+		App.ConfigLoader = ConfigLoader{Getenv: getenvFrom(map[string]string{
+			"LOG_LEVEL":                  "debug",
+			"POSTGRES_CONNECTION_STRING": "postgres://elsewhere/keystore",
+			"MINIMUM_KEY_LENGTH":         "8",
+			"MAXIMUM_KEY_LENGTH":         "36",
+			"MINIMUM_SOURCE_NAME_LENGTH": "4",
+			"SERVICE_SHARED_SECRET":      "test-shared-secret",
+		})}
+
+		if err := App.ReloadConfig(); err != nil {
+			t.Fatal(err)
+		}
+		if App.Config().MinKeyLength != 8 {
+			t.Errorf("Received %d, expected %d", App.Config().MinKeyLength, 8)
+		}
+		if App.Config().DbConnStr != originalConfig.DbConnStr {
+			t.Errorf("Received %s, expected %s", App.Config().DbConnStr, originalConfig.DbConnStr)
+		}
+		if App.LogLevel.Level() != slog.LevelDebug {
+			t.Errorf("Received %s, expected %s", App.LogLevel.Level(), slog.LevelDebug)
+		}
+	})
+
+	t.Run("returns error and keeps config when a setting is invalid", func(t *testing.T) {
+		App.config.Store(originalConfig)
+		App.ConfigLoader = ConfigLoader{Getenv: getenvFrom(map[string]string{"MINIMUM_KEY_LENGTH": "0"})}
+
+		err := App.ReloadConfig()
+		if !errors.Is(err, ErrConfigOutOfRange) {
+			t.Errorf("Received %s, expected %s", err, ErrConfigOutOfRange)
+		}
+		if App.Config() != originalConfig {
+			t.Errorf("Received %v, expected %v", App.Config(), originalConfig)
+		}
+	})
+}
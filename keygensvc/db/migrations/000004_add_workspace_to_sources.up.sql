@@ -0,0 +1,3 @@
+BEGIN;
+ALTER TABLE sources ADD COLUMN IF NOT EXISTS workspace VARCHAR(64);
+COMMIT;
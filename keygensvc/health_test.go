@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthChecker_Readiness(t *testing.T) {
+	t.Run("caches results until they are stale", func(t *testing.T) {
+		calls := 0
+		checker := NewHealthChecker(time.Minute, time.Second)
+		checker.AddCheck("postgres", func(_ context.Context) (string, error) { calls++; return "", nil })
+		now := time.Now()
+		checker.now = func() time.Time { return now }
+		checker.Readiness(context.Background())
+		checker.Readiness(context.Background())
+		if calls != 1 {
+			t.Errorf("Received %d, expected %d", calls, 1)
+		}
+		now = now.Add(2 * time.Minute)
+		checker.Readiness(context.Background())
+		if calls != 2 {
+			t.Errorf("Received %d, expected %d", calls, 2)
+		}
+	})
+}
+
+func TestPostgresHealthCheck(t *testing.T) {
+	t.Run("returns error when Postgres is unreachable", func(t *testing.T) {
+		callCount = 0
+		check := postgresHealthCheck(MockPostgresDb{errors: []error{errors.New("failed")}}, 4)
+		if _, err := check(context.Background()); err == nil {
+			t.Errorf("Received nil, expected error")
+		}
+	})
+	t.Run("returns error when migrations are pending", func(t *testing.T) {
+		callCount = 0
+		check := postgresHealthCheck(MockPostgresDb{errors: []error{nil}, id: 3}, 4)
+		detail, err := check(context.Background())
+		if err != ErrPostgresMigrationsPending {
+			t.Errorf("Received %s, expected %s", err, ErrPostgresMigrationsPending)
+		}
+		if detail != "migration version 3" {
+			t.Errorf("Received %s, expected %s", detail, "migration version 3")
+		}
+	})
+	t.Run("returns nil when migrated to the latest version", func(t *testing.T) {
+		callCount = 0
+		check := postgresHealthCheck(MockPostgresDb{errors: []error{nil}, id: 4}, 4)
+		if _, err := check(context.Background()); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
+
+func TestLatestMigrationVersion(t *testing.T) {
+	t.Run("returns the version of the last up migration", func(t *testing.T) {
+		version, err := latestMigrationVersion(MigrationsPath)
+		if err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+		if version != 4 {
+			t.Errorf("Received %d, expected %d", version, 4)
+		}
+	})
+}
+
+func TestHandleReadinessRequest(t *testing.T) {
+	originalHealth := App.Health
+	defer func() { App.Health = originalHealth }()
+
+	t.Run("returns 503 Service Unavailable with dependencies when not ready", func(t *testing.T) {
+		App.Health = NewHealthChecker(time.Minute, time.Second)
+		App.Health.AddCheck("postgres", func(_ context.Context) (string, error) {
+			return "migration version 3", ErrPostgresMigrationsPending
+		})
+		res := httptest.NewRecorder()
+		HandleReadinessRequest(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if res.Code != http.StatusServiceUnavailable {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusServiceUnavailable)
+		}
+		var readiness readinessJson
+		_ = json.Unmarshal(res.Body.Bytes(), &readiness)
+		if readiness.Dependencies["postgres"].Error != ErrPostgresMigrationsPending.Error() {
+			t.Errorf("Received %s, expected %s", res.Body.String(), ErrPostgresMigrationsPending)
+		}
+	})
+	t.Run("returns 200 OK when ready", func(t *testing.T) {
+		App.Health = NewHealthChecker(time.Minute, time.Second)
+		App.Health.AddCheck("postgres", func(_ context.Context) (string, error) { return "", nil })
+		res := httptest.NewRecorder()
+		HandleReadinessRequest(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+	})
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"regexp"
 )
 
 type generateKeyRequestJson struct {
 	SourceName string `json:"source_name"`
+	Workspace  string `json:"workspace"`
 	KeyLength  int    `json:"key_length"`
 }
 
@@ -18,15 +20,13 @@ type generateKeyResponseJson struct {
 }
 
 func HandleGenerateKeyRequest(w http.ResponseWriter, r *http.Request) {
-	log.Print("/key/generate hit")
-
 	// Check method for validity
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
 	}
-	log.Printf("%s /key/generate allowed", r.Method)
+	slog.DebugContext(r.Context(), "Method allowed", "method", r.Method)
 
 	// Parse request
 	var bodyBuff bytes.Buffer
@@ -34,50 +34,57 @@ func HandleGenerateKeyRequest(w http.ResponseWriter, r *http.Request) {
 	var requestJson generateKeyRequestJson
 	jsonUnmarshalErr := json.Unmarshal([]byte(bodyBuff.String()), &requestJson)
 	if jsonUnmarshalErr != nil {
-		log.Printf(
-			"Error parsing the generate key request JSON: %s", jsonUnmarshalErr,
-		)
+		slog.WarnContext(r.Context(), "Error parsing the generate key request JSON", "error", jsonUnmarshalErr)
 		http.Error(
 			w, "Could not parse request JSON.", http.StatusUnprocessableEntity,
 		)
 		return
 	}
-	log.Print("Request JSON parsed")
+	slog.DebugContext(r.Context(), "Request JSON parsed")
 
 	// Validate request
-	if requestJson.KeyLength < App.EnvVars.MinKeyLength ||
-				requestJson.KeyLength > App.EnvVars.MaxKeyLength {
-		log.Print("Key length invalid")
+	if requestJson.KeyLength < App.Config().MinKeyLength ||
+				requestJson.KeyLength > App.Config().MaxKeyLength {
+		slog.InfoContext(r.Context(), "Key length invalid")
 		http.Error(
 			w,
 			fmt.Sprintf(
 				"Key length is invalid, must be >%d and <%d",
-				App.EnvVars.MinKeyLength,
-				App.EnvVars.MaxKeyLength,
+				App.Config().MinKeyLength,
+				App.Config().MaxKeyLength,
 			),
 			http.StatusBadRequest,
 		)
 		return
 	}
-	if len(requestJson.SourceName) < App.EnvVars.MinSourceNameLength {
-		log.Print("Source name length invalid")
+	if len(requestJson.SourceName) < App.Config().MinSourceNameLength {
+		slog.InfoContext(r.Context(), "Source name length invalid")
 		http.Error(
 			w,
 			fmt.Sprintf(
 				"Source name length is invalid, must be >%d",
-				App.EnvVars.MinSourceNameLength,
+				App.Config().MinSourceNameLength,
 			),
 			http.StatusBadRequest,
 		)
 		return
 	}
-	log.Print("Request JSON validated")
+	slog.DebugContext(r.Context(), "Request JSON validated")
+	if !isSourceAllowed(w, r, requestJson.SourceName) {
+		return
+	}
 
 	// Get generated key
-	log.Print("Getting generated key...")
-	key, err := App.Kg.GetGeneratedKey(requestJson.SourceName, requestJson.KeyLength)
+	slog.DebugContext(r.Context(), "Getting generated key...")
+	key, err := App.Kg.GetGeneratedKey(
+		r.Context(), requestJson.SourceName, requestJson.Workspace, requestJson.KeyLength,
+	)
+	if err == ErrSourceInOtherWorkspace {
+		http.Error(w, "Source belongs to another workspace.", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		log.Printf("Error getting generated key: %s", err)
+		slog.ErrorContext(r.Context(), "Error getting generated key", "error", err)
 		http.Error(
 			w,
 			"Internal server error: Failed to process request.",
@@ -85,11 +92,11 @@ func HandleGenerateKeyRequest(w http.ResponseWriter, r *http.Request) {
 		)
 		return
 	}
-	log.Print("Key generated")
+	slog.DebugContext(r.Context(), "Key generated")
 
 	// Encode response JSON
 	encodedJson, _ := json.Marshal(generateKeyResponseJson{Key: key})
-	log.Print("Response encoded")
+	slog.DebugContext(r.Context(), "Response encoded")
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
@@ -99,12 +106,11 @@ func HandleGenerateKeyRequest(w http.ResponseWriter, r *http.Request) {
 
 type newKeyRequestJson struct {
 	SourceName string `json:"source_name"`
+	Workspace  string `json:"workspace"`
 	Key        string `json:"key"`
 }
 
 func HandleNewKeyRequest(w http.ResponseWriter, r *http.Request) {
-	log.Print("/key/new hit")
-
 	// Check method for validity
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
@@ -118,9 +124,7 @@ func HandleNewKeyRequest(w http.ResponseWriter, r *http.Request) {
 	var requestJson newKeyRequestJson
 	jsonUnmarshalErr := json.Unmarshal([]byte(bodyBuff.String()), &requestJson)
 	if jsonUnmarshalErr != nil {
-		log.Printf(
-			"Error parsing the new key request JSON: %s", jsonUnmarshalErr,
-		)
+		slog.WarnContext(r.Context(), "Error parsing the new key request JSON", "error", jsonUnmarshalErr)
 		http.Error(
 			w, "Could not parse request JSON.", http.StatusUnprocessableEntity,
 		)
@@ -128,39 +132,52 @@ func HandleNewKeyRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate request
-	if len(requestJson.Key) < App.EnvVars.MinKeyLength ||
-				len(requestJson.Key) > App.EnvVars.MaxKeyLength {
-		log.Print("Key length invalid")
+	if len(requestJson.Key) < App.Config().MinKeyLength ||
+				len(requestJson.Key) > App.Config().MaxKeyLength {
+		slog.InfoContext(r.Context(), "Key length invalid")
 		http.Error(
 			w,
 			fmt.Sprintf(
 				"Key length is invalid, must be >%d and <%d",
-				App.EnvVars.MinKeyLength,
-				App.EnvVars.MaxKeyLength,
+				App.Config().MinKeyLength,
+				App.Config().MaxKeyLength,
 			),
 			http.StatusBadRequest,
 		)
 		return
 	}
 	if requestJson.SourceName != "" &&
-				len(requestJson.SourceName) < App.EnvVars.MinSourceNameLength {
-		log.Print("Source name length invalid")
+				len(requestJson.SourceName) < App.Config().MinSourceNameLength {
+		slog.InfoContext(r.Context(), "Source name length invalid")
 		http.Error(
 			w,
 			fmt.Sprintf(
 				"Source name length is invalid, must be >%d",
-				App.EnvVars.MinSourceNameLength,
+				App.Config().MinSourceNameLength,
 			),
 			http.StatusBadRequest,
 		)
 		return
 	}
-	log.Print("Request JSON validated")
+	slog.DebugContext(r.Context(), "Request JSON validated")
+	if !isSourceAllowed(w, r, requestJson.SourceName) {
+		return
+	}
 
 	// Store custom key
-	err := App.Kg.StoreCustomKey(requestJson.SourceName, requestJson.Key)
+	err := App.Kg.StoreCustomKey(
+		r.Context(), requestJson.SourceName, requestJson.Workspace, requestJson.Key,
+	)
+	if err == ErrSourceInOtherWorkspace {
+		http.Error(w, "Source belongs to another workspace.", http.StatusForbidden)
+		return
+	}
+	if err == ErrKeyAlreadyExists {
+		http.Error(w, "Key already exists.", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		log.Printf("Error storing custom key: %s", err)
+		slog.ErrorContext(r.Context(), "Error storing custom key", "error", err)
 		http.Error(
 			w,
 			"Internal server error: Failed to process request.",
@@ -171,3 +188,160 @@ func HandleNewKeyRequest(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusCreated)
 }
+
+type apiKeyMintRequestJson struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Hosts  []string `json:"hosts"`
+}
+
+type apiKeyMintResponseJson struct {
+	Id     string   `json:"id"`
+	Key    string   `json:"key"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Hosts  []string `json:"hosts"`
+}
+
+func HandleApiKeyMintRequest(w http.ResponseWriter, r *http.Request) {
+	// Check method for validity
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse request
+	var bodyBuff bytes.Buffer
+	bodyBuff.ReadFrom(r.Body)
+	var requestJson apiKeyMintRequestJson
+	jsonUnmarshalErr := json.Unmarshal([]byte(bodyBuff.String()), &requestJson)
+	if jsonUnmarshalErr != nil {
+		slog.WarnContext(r.Context(), "Error parsing the API key mint request JSON", "error", jsonUnmarshalErr)
+		http.Error(
+			w, "Could not parse request JSON.", http.StatusUnprocessableEntity,
+		)
+		return
+	}
+
+	// Validate request
+	if len(requestJson.Name) < 1 || len(requestJson.Name) > 64 {
+		slog.InfoContext(r.Context(), "Name length invalid")
+		http.Error(w, "Name length is invalid, must be >0 and <65", http.StatusBadRequest)
+		return
+	}
+	if len(requestJson.Scopes) == 0 {
+		slog.InfoContext(r.Context(), "Scopes empty")
+		http.Error(w, "Scopes are empty, at least one is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range requestJson.Scopes {
+		known := false
+		for _, knownScope := range knownApiKeyScopes {
+			known = known || scope == knownScope
+		}
+		if !known {
+			slog.InfoContext(r.Context(), "Scope invalid", "scope", scope)
+			http.Error(
+				w,
+				fmt.Sprintf("Scope %s is invalid, must be one of %v", scope, knownApiKeyScopes),
+				http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	for _, host := range requestJson.Hosts {
+		if len(host) < App.Config().MinSourceNameLength {
+			slog.InfoContext(r.Context(), "Host invalid", "host", host)
+			http.Error(
+				w,
+				fmt.Sprintf(
+					"Host length is invalid, must be >%d",
+					App.Config().MinSourceNameLength,
+				),
+				http.StatusBadRequest,
+			)
+			return
+		}
+	}
+	slog.DebugContext(r.Context(), "Request JSON validated")
+
+	// Mint key
+	rawKey, id, err := App.Ak.MintApiKey(
+		r.Context(), requestJson.Name, requestJson.Scopes, requestJson.Hosts,
+	)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error minting API key", "error", err)
+		http.Error(
+			w,
+			"Internal server error: Failed to process request.",
+			http.StatusInternalServerError,
+		)
+		return
+	}
+
+	// Encode response JSON, the only time the raw key is revealed
+	encodedJson, _ := json.Marshal(apiKeyMintResponseJson{
+		Id:     id,
+		Key:    rawKey,
+		Name:   requestJson.Name,
+		Scopes: requestJson.Scopes,
+		Hosts:  requestJson.Hosts,
+	})
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(encodedJson)
+}
+
+type apiKeyRevokeRequestJson struct {
+	Id string `json:"id"`
+}
+
+func HandleApiKeyRevokeRequest(w http.ResponseWriter, r *http.Request) {
+	// Check method for validity
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse request
+	var bodyBuff bytes.Buffer
+	bodyBuff.ReadFrom(r.Body)
+	var requestJson apiKeyRevokeRequestJson
+	jsonUnmarshalErr := json.Unmarshal([]byte(bodyBuff.String()), &requestJson)
+	if jsonUnmarshalErr != nil {
+		slog.WarnContext(r.Context(), "Error parsing the API key revoke request JSON", "error", jsonUnmarshalErr)
+		http.Error(
+			w, "Could not parse request JSON.", http.StatusUnprocessableEntity,
+		)
+		return
+	}
+
+	// Validate request
+	if !regexp.MustCompile("^[a-f0-9]{64}$").MatchString(requestJson.Id) {
+		slog.InfoContext(r.Context(), "API key id invalid")
+		http.Error(w, "API key id is invalid", http.StatusBadRequest)
+		return
+	}
+
+	// Revoke key
+	err := App.Ak.RevokeApiKey(r.Context(), requestJson.Id)
+	if err == ErrApiKeyNotFound {
+		http.Error(w, "API key not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error revoking API key", "error", err)
+		http.Error(
+			w,
+			"Internal server error: Failed to process request.",
+			http.StatusInternalServerError,
+		)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -13,18 +14,15 @@ type MockKgService struct {
 	error error
 }
 
-func (m MockKgService) GetGeneratedKey(_ string, _ int) (string, error) {
+func (m MockKgService) GetGeneratedKey(_ context.Context, _ string, _ string, _ int) (string, error) {
 	return m.key, m.error
 }
 
-func (m MockKgService) StoreCustomKey(_ string, _ string) error {
+func (m MockKgService) StoreCustomKey(_ context.Context, _ string, _ string, _ string) error {
 	return m.error
 }
 var OriginalKgService KeyGenService
-
-func init() {
-	OriginalKgService = App.Kg
-}
+var OriginalAkService ApiKeyService
 
 func TestHandleGenerateKeyRequest(t *testing.T) {
 	t.Run("returns 405 Method Not Allowed when disallowed method is detected", func(t *testing.T) {
@@ -245,6 +243,24 @@ func TestHandleNewKeyRequest(t *testing.T) {
 		}
 		App.Kg = OriginalKgService
 	})
+	t.Run("returns 409 Conflict when new key already exists", func(t *testing.T) {
+		App.Kg = MockKgService{key: "", error: ErrKeyAlreadyExists}
+		req, err := http.NewRequest(
+			"POST",
+			"/key/new",
+			strings.NewReader(`{"key": "12345678"}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h := http.HandlerFunc(HandleNewKeyRequest)
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusConflict {
+			t.Errorf("Received %d, expected %d", status, http.StatusConflict)
+		}
+		App.Kg = OriginalKgService
+	})
 	t.Run("returns 201 Created when new key storage is successful", func(t *testing.T) {
 		App.Kg = MockKgService{key: "", error: nil}
 		req, err := http.NewRequest(
@@ -267,3 +283,101 @@ func TestHandleNewKeyRequest(t *testing.T) {
 		App.Kg = OriginalKgService
 	})
 }
+
+func TestHandleApiKeyMintRequest(t *testing.T) {
+	t.Run("returns 400 Bad Request when scope is invalid", func(t *testing.T) {
+		App.Ak = MockAkService{}
+		req, err := http.NewRequest(
+			"POST", "/admin/apikeys", strings.NewReader(`{"name": "ci", "scopes": ["everything"]}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h := http.HandlerFunc(HandleApiKeyMintRequest)
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+		App.Ak = OriginalAkService
+	})
+	t.Run("returns 201 Created when key is minted", func(t *testing.T) {
+		App.Ak = MockAkService{}
+		req, err := http.NewRequest(
+			"POST", "/admin/apikeys", strings.NewReader(`{"name": "ci", "scopes": ["shorten"]}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h := http.HandlerFunc(HandleApiKeyMintRequest)
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusCreated {
+			t.Errorf("Received %d, expected %d", status, http.StatusCreated)
+		}
+		if !strings.Contains(res.Body.String(), "kgk_mock") {
+			t.Errorf("Received %s, expected key %s", res.Body.String(), "kgk_mock")
+		}
+		App.Ak = OriginalAkService
+	})
+}
+
+func TestHandleApiKeyRevokeRequest(t *testing.T) {
+	t.Run("returns 404 Not Found when key does not exist", func(t *testing.T) {
+		App.Ak = MockAkService{error: ErrApiKeyNotFound}
+		req, err := http.NewRequest(
+			"POST",
+			"/admin/apikeys/revoke",
+			strings.NewReader(`{"id": "` + strings.Repeat("a", 64) + `"}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h := http.HandlerFunc(HandleApiKeyRevokeRequest)
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		App.Ak = OriginalAkService
+	})
+	t.Run("returns 204 No Content when key is revoked", func(t *testing.T) {
+		App.Ak = MockAkService{}
+		req, err := http.NewRequest(
+			"POST",
+			"/admin/apikeys/revoke",
+			strings.NewReader(`{"id": "` + strings.Repeat("a", 64) + `"}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h := http.HandlerFunc(HandleApiKeyRevokeRequest)
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNoContent {
+			t.Errorf("Received %d, expected %d", status, http.StatusNoContent)
+		}
+		App.Ak = OriginalAkService
+	})
+}
+
+func TestHandleGenerateKeyRequest_Workspace(t *testing.T) {
+	t.Run("returns 403 Forbidden when source belongs to another workspace", func(t *testing.T) {
+		App.Kg = MockKgService{key: "", error: ErrSourceInOtherWorkspace}
+		req, err := http.NewRequest(
+			"POST",
+			"/key/generate",
+			strings.NewReader(`{"source_name": "http://shrt.url", "workspace": "team-b", "key_length": 8}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h := http.HandlerFunc(HandleGenerateKeyRequest)
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+		App.Kg = OriginalKgService
+	})
+}
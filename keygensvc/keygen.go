@@ -1,16 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
-	"log"
+	"github.com/jackc/pgx/v4"
+	"log/slog"
 	"math"
 )
 
 type KeyGenService interface {
-	GetGeneratedKey(sourceName string, keyLength int) (string, error)
-	StoreCustomKey(sourceName string, customKey string) error
+	GetGeneratedKey(ctx context.Context, sourceName string, workspace string, keyLength int) (string, error)
+	StoreCustomKey(ctx context.Context, sourceName string, workspace string, customKey string) error
 }
 
 type keyGenService struct {
@@ -32,6 +34,7 @@ var (
 	ErrCouldNotAddNewSource       = errors.New("could not add new source")
 	ErrKeyAlreadyExists			  = errors.New("key already exists")
 	ErrCouldNotSaveNewKey		  = errors.New("could not save new key")
+	ErrSourceInOtherWorkspace     = errors.New("source belongs to another workspace")
 )
 
 // https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go
@@ -42,17 +45,18 @@ func (_ keyGenService) generateUniqueKey(keyLength int) string {
 	return base64.RawURLEncoding.EncodeToString(buff)
 }
 
-func (kg keyGenService) GetGeneratedKey(sourceName string, keyLength int) (string, error) {
+func (kg keyGenService) GetGeneratedKey(ctx context.Context, sourceName string, workspace string, keyLength int) (string, error) {
 	if keyLength < 1 {
 		return "", ErrKeyLengthMustBePositive
 	}
 
 	// Create source in DB if it does not exist
-	sourceId, getErr := kg.getSourceId(sourceName)
+	sourceId, getErr := kg.getSourceId(ctx, sourceName, workspace)
+	if getErr == ErrSourceInOtherWorkspace {
+		return "", getErr
+	}
 	if getErr != nil {
-		log.Printf(
-			"Error getting source id for %s: %s", sourceName, getErr,
-		)
+		slog.ErrorContext(ctx, "Error getting source id", "source_name", sourceName, "error", getErr)
 		return "", ErrCouldNotVerifySourceForKey
 	}
 
@@ -60,106 +64,103 @@ func (kg keyGenService) GetGeneratedKey(sourceName string, keyLength int) (strin
 	key := kg.generateUniqueKey(keyLength)
 
 	// Store key
-	createErr := kg.createKey(sourceId, key)
+	createErr := kg.createKey(ctx, sourceId, key)
+	if createErr == ErrKeyAlreadyExists {
+		keyCollisionsTotal.WithLabelValues(KeyKindGenerated).Inc()
+	}
 	if createErr != nil {
-		log.Printf(
-			"Error saving key %s for %s: %s", key, sourceName, createErr,
-		)
+		slog.ErrorContext(ctx, "Error saving key", "key", key, "source_name", sourceName, "error", createErr)
 		return "", ErrCouldNotSaveKeyForSource
 	}
 
 	return key, nil
 }
 
-func (kg keyGenService) StoreCustomKey(sourceName string, customKey string) error {
+func (kg keyGenService) StoreCustomKey(ctx context.Context, sourceName string, workspace string, customKey string) error {
 	if customKey == "" {
 		return ErrCustomKeyCannotBeEmpty
 	}
 
 	// Create source in DB if it does not exist
-	sourceId, getErr := kg.getSourceId(sourceName)
+	sourceId, getErr := kg.getSourceId(ctx, sourceName, workspace)
+	if getErr == ErrSourceInOtherWorkspace {
+		return getErr
+	}
 	if getErr != nil {
-		log.Printf(
-			"Error getting source id for %s: %s", sourceName, getErr,
-		)
+		slog.ErrorContext(ctx, "Error getting source id", "source_name", sourceName, "error", getErr)
 		return ErrCouldNotVerifySourceForKey
 	}
 
 	// Store key
-	createErr := kg.createKey(sourceId, customKey)
+	createErr := kg.createKey(ctx, sourceId, customKey)
+	if createErr == ErrKeyAlreadyExists {
+		keyCollisionsTotal.WithLabelValues(KeyKindCustom).Inc()
+		return createErr
+	}
 	if createErr != nil {
-		log.Printf(
-			"Error saving key %s for %s: %s", customKey, sourceName, createErr,
-		)
+		slog.ErrorContext(ctx, "Error saving key", "key", customKey, "source_name", sourceName, "error", createErr)
 		return ErrCouldNotSaveKeyForSource
 	}
 
 	return nil
 }
 
-func (kg keyGenService) getSourceId(sourceName string) (int, error) {
-	var err error
-	err = kg.Db.connect()
-	if err != nil {
-		log.Printf("Failed to connect to Postgres DB: %s", err)
-		return -1, ErrCouldNotConnectToPostgres
-	}
-	defer kg.Db.close()
-
-	var sourceId int
-	sourceId, err = kg.Db.queryInt(
-		"INSERT INTO sources (name) VALUES ($1) RETURNING id", sourceName,
+// Sources created for a workspace belong to it, and other workspaces cannot
+// draw keys from them. Sources created without one are shared.
+func (kg keyGenService) getSourceId(ctx context.Context, sourceName string, workspace string) (int, error) {
+	sourceId, err := kg.Db.queryInt(
+		ctx,
+		"INSERT INTO sources (name, workspace) VALUES ($1, NULLIF($2, '')) RETURNING id",
+		sourceName,
+		workspace,
 	)
 	if err != nil {
 		if isDuplicateKeyError(err) {
-			log.Printf("Source already exists for %s, retrieving id...", sourceName)
+			slog.DebugContext(ctx, "Source already exists, retrieving id...", "source_name", sourceName)
 			sourceId, err = kg.Db.queryInt(
-				"SELECT id FROM sources WHERE name = $1 AND is_active IS TRUE",
+				ctx,
+				"SELECT id FROM sources WHERE name = $1 AND is_active IS TRUE " +
+					"AND (workspace IS NULL OR $2 = '' OR workspace = $2)",
 				sourceName,
+				workspace,
 			)
+			if err == pgx.ErrNoRows {
+				slog.WarnContext(ctx, "Source does not belong to workspace", "source_name", sourceName, "workspace", workspace)
+				return -1, ErrSourceInOtherWorkspace
+			}
 			if err != nil {
-				log.Printf("Error retrieving source id: %s", err)
+				slog.ErrorContext(ctx, "Error retrieving source id", "error", err)
 				return -1, ErrCouldNotRetrieveSourceId
 			}
 		} else {
-			log.Printf("Error adding new source: %s", err)
+			slog.ErrorContext(ctx, "Error adding new source", "error", err)
 			return -1, ErrCouldNotAddNewSource
 		}
 	} else {
-		log.Printf("Inserted new source: id %d for %s", sourceId, sourceName)
+		slog.InfoContext(ctx, "Inserted new source", "source_id", sourceId, "source_name", sourceName)
 	}
 
-	log.Printf("Returning id %d for source %s", sourceId, sourceName)
+	slog.DebugContext(ctx, "Returning id for source", "source_id", sourceId, "source_name", sourceName)
 	return sourceId, nil
 }
 
-func (kg keyGenService) createKey(sourceId int, key string) error {
-	var err error
-	err = kg.Db.connect()
-	if err != nil {
-		log.Printf("Error establishing connection to DB: %s", err)
-		return ErrCouldNotConnectToPostgres
-	}
-	defer kg.Db.close()
-
-	var keyId int
-	keyId, err = kg.Db.queryInt(
+func (kg keyGenService) createKey(ctx context.Context, sourceId int, key string) error {
+	keyId, err := kg.Db.queryInt(
+		ctx,
 		"INSERT INTO keys (raw_key, source_id) VALUES ($1, $2) RETURNING id",
 		key,
 		sourceId,
 	)
 	if err != nil {
 		if isDuplicateKeyError(err) {
-			log.Printf("Key %s already exists for source %d", key, sourceId)
+			slog.WarnContext(ctx, "Key already exists for source", "key", key, "source_id", sourceId)
 			return ErrKeyAlreadyExists
 		} else {
-			log.Printf("Error inserting new key: %s", err)
+			slog.ErrorContext(ctx, "Error inserting new key", "error", err)
 			return ErrCouldNotSaveNewKey
 		}
 	}
 
-	log.Printf(
-		"Inserted new source: id %d for source %d and key %s", keyId, sourceId, key,
-	)
+	slog.DebugContext(ctx, "Inserted new key", "key_id", keyId, "source_id", sourceId, "key", key)
 	return nil
 }
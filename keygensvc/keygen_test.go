@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"reflect"
 	"testing"
 )
 
@@ -10,70 +14,90 @@ var callCount int
 type MockPostgresDb struct {
 	errors    []error
 	id		  int
+	row       []interface{}
+}
+
+// Scans the given values into destinations of matching types
+type MockRow struct {
+	values []interface{}
+	error  error
+}
+
+func (m MockRow) Scan(dest ...interface{}) error {
+	if m.error != nil {
+		return m.error
+	}
+	for i, value := range m.values {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
 }
 
 func (_ MockPostgresDb) Refresh() {
 	return
 }
 
-func (m MockPostgresDb) connect() error {
+func (m MockPostgresDb) queryInt(_ context.Context, _ string, _ ...interface{}) (int, error) {
 	err := m.errors[callCount]
 	callCount++
-	return err
+	return m.id, err
 }
 
-func (m MockPostgresDb) queryInt(_ string, _ ...interface{}) (int, error) {
+func (m MockPostgresDb) queryRow(_ context.Context, _ string, _ ...interface{}) pgx.Row {
 	err := m.errors[callCount]
 	callCount++
-	return m.id, err
+	return MockRow{values: m.row, error: err}
+}
+
+func (m MockPostgresDb) exec(_ context.Context, _ string, _ ...interface{}) (int64, error) {
+	err := m.errors[callCount]
+	callCount++
+	return int64(m.id), err
 }
 
 func (_ MockPostgresDb) close() {
 	return
 }
 
+func (m MockPostgresDb) migrationVersion(_ context.Context) (uint, bool, error) {
+	err := m.errors[callCount]
+	callCount++
+	return uint(m.id), false, err
+}
+
 func TestKeyGenService_GetGeneratedKey(t *testing.T) {
 	t.Run("returns error if key length is 0 or negative", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, nil, nil, nil}, id: 0}
+		mockDb := MockPostgresDb{errors: []error{nil, nil}, id: 0}
 		kgSvc := NewKeyGenService(mockDb)
-		_, err := kgSvc.GetGeneratedKey("some-source", 0)
+		_, err := kgSvc.GetGeneratedKey(context.Background(), "some-source", "", 0)
 		if err != ErrKeyLengthMustBePositive {
 			t.Errorf("Received %s, expected %s", err, ErrKeyLengthMustBePositive)
 		}
 	})
-	t.Run("returns error if cannot connect to db", func(t *testing.T) {
-		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{errors.New("failed"), nil, nil, nil}, id: 0}
-		kgSvc := NewKeyGenService(mockDb)
-		_, err := kgSvc.GetGeneratedKey("some-source", 8)
-		if err != ErrCouldNotVerifySourceForKey {
-			t.Errorf("Received %s, expected %s", err, ErrCouldNotVerifySourceForKey)
-		}
-	})
 	t.Run("returns error if source id cannot be retrieved", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, errors.New("failed"), nil, nil}, id: 0}
+		mockDb := MockPostgresDb{errors: []error{errors.New("failed"), nil}, id: 0}
 		kgSvc := NewKeyGenService(mockDb)
-		_, err := kgSvc.GetGeneratedKey("some-source", 8)
+		_, err := kgSvc.GetGeneratedKey(context.Background(), "some-source", "", 8)
 		if err != ErrCouldNotVerifySourceForKey {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotVerifySourceForKey)
 		}
 	})
 	t.Run("returns error if key cannot be saved for source", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, nil, nil, errors.New("failed")}, id: 0}
+		mockDb := MockPostgresDb{errors: []error{nil, errors.New("failed")}, id: 0}
 		kgSvc := NewKeyGenService(mockDb)
-		_, err := kgSvc.GetGeneratedKey("some-source", 8)
+		_, err := kgSvc.GetGeneratedKey(context.Background(), "some-source", "", 8)
 		if err != ErrCouldNotSaveKeyForSource {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotSaveKeyForSource)
 		}
 	})
 	t.Run("returns key if successful", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, nil, nil, nil}, id: 123}
+		mockDb := MockPostgresDb{errors: []error{nil, nil}, id: 123}
 		kgSvc := NewKeyGenService(mockDb)
-		key, err := kgSvc.GetGeneratedKey("some-source", 8)
+		key, err := kgSvc.GetGeneratedKey(context.Background(), "some-source", "", 8)
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
 		}
@@ -86,47 +110,76 @@ func TestKeyGenService_GetGeneratedKey(t *testing.T) {
 func TestKeyGenService_StoreCustomKey(t *testing.T) {
 	t.Run("returns error if custom key is empty", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, nil, nil, nil}, id: 0}
+		mockDb := MockPostgresDb{errors: []error{nil, nil}, id: 0}
 		kgSvc := NewKeyGenService(mockDb)
-		err := kgSvc.StoreCustomKey("some-source", "")
+		err := kgSvc.StoreCustomKey(context.Background(), "some-source", "", "")
 		if err != ErrCustomKeyCannotBeEmpty {
 			t.Errorf("Received %s, expected %s", err, ErrCustomKeyCannotBeEmpty)
 		}
 	})
-	t.Run("returns error if cannot connect to db", func(t *testing.T) {
-		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{errors.New("failed"), nil, nil, nil}, id: 0}
-		kgSvc := NewKeyGenService(mockDb)
-		err := kgSvc.StoreCustomKey("some-source", "some-key")
-		if err != ErrCouldNotVerifySourceForKey {
-			t.Errorf("Received %s, expected %s", err, ErrCouldNotVerifySourceForKey)
-		}
-	})
 	t.Run("returns error if source id cannot be retrieved", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, errors.New("failed"), nil, nil}, id: 0}
+		mockDb := MockPostgresDb{errors: []error{errors.New("failed"), nil}, id: 0}
 		kgSvc := NewKeyGenService(mockDb)
-		err := kgSvc.StoreCustomKey("some-source", "some-key")
+		err := kgSvc.StoreCustomKey(context.Background(), "some-source", "", "some-key")
 		if err != ErrCouldNotVerifySourceForKey {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotVerifySourceForKey)
 		}
 	})
 	t.Run("returns error if key cannot be saved for source", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, nil, nil, errors.New("failed")}, id: 0}
+		mockDb := MockPostgresDb{errors: []error{nil, errors.New("failed")}, id: 0}
 		kgSvc := NewKeyGenService(mockDb)
-		err := kgSvc.StoreCustomKey("some-source", "some-key")
+		err := kgSvc.StoreCustomKey(context.Background(), "some-source", "", "some-key")
 		if err != ErrCouldNotSaveKeyForSource {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotSaveKeyForSource)
 		}
 	})
+	t.Run("returns error if key already exists for source", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{
+			errors: []error{nil, &pgconn.PgError{Code: PgErrCodeUniqueViolation}},
+			id:     0,
+		}
+		kgSvc := NewKeyGenService(mockDb)
+		err := kgSvc.StoreCustomKey(context.Background(), "some-source", "", "some-key")
+		if err != ErrKeyAlreadyExists {
+			t.Errorf("Received %s, expected %s", err, ErrKeyAlreadyExists)
+		}
+	})
 	t.Run("returns nil if successful", func(t *testing.T) {
 		callCount = 0
-		mockDb := MockPostgresDb{errors: []error{nil, nil, nil, nil}, id: 123}
+		mockDb := MockPostgresDb{errors: []error{nil, nil}, id: 123}
 		kgSvc := NewKeyGenService(mockDb)
-		err := kgSvc.StoreCustomKey("some-source", "some-key")
+		err := kgSvc.StoreCustomKey(context.Background(), "some-source", "", "some-key")
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
 		}
 	})
-}
\ No newline at end of file
+}
+func TestKeyGenService_getSourceId(t *testing.T) {
+	t.Run("returns error if source belongs to another workspace", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{
+			errors: []error{&pgconn.PgError{Code: PgErrCodeUniqueViolation}, pgx.ErrNoRows},
+			id:     0,
+		}
+		kgSvc := keyGenService{Db: mockDb}
+		_, err := kgSvc.getSourceId(context.Background(), "http://shrt.url", "team-b")
+		if err != ErrSourceInOtherWorkspace {
+			t.Errorf("Received %s, expected %s", err, ErrSourceInOtherWorkspace)
+		}
+	})
+	t.Run("returns existing source id if workspace may use it", func(t *testing.T) {
+		callCount = 0
+		mockDb := MockPostgresDb{
+			errors: []error{&pgconn.PgError{Code: PgErrCodeUniqueViolation}, nil},
+			id:     7,
+		}
+		kgSvc := keyGenService{Db: mockDb}
+		sourceId, err := kgSvc.getSourceId(context.Background(), "http://shrt.url", "team-a")
+		if err != nil || sourceId != 7 {
+			t.Errorf("Received %d and %s, expected %d", sourceId, err, 7)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRequestId(t *testing.T) {
+	var contextRequestId string
+	handler := withRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contextRequestId = requestIdFromContext(r.Context())
+	}))
+
+	t.Run("keeps the request id sent by the caller", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/key/generate", nil)
+		r.Header.Set(RequestIdHeader, "some-request-id")
+		handler.ServeHTTP(w, r)
+		if contextRequestId != "some-request-id" {
+			t.Errorf("Received %s, expected %s", contextRequestId, "some-request-id")
+		}
+		if responseId := w.Header().Get(RequestIdHeader); responseId != "some-request-id" {
+			t.Errorf("Received %s, expected %s", responseId, "some-request-id")
+		}
+	})
+	t.Run("generates a request id when the caller sends an invalid one", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/key/generate", nil)
+		r.Header.Set(RequestIdHeader, "some request id\nwith a new line")
+		handler.ServeHTTP(w, r)
+		if !requestIdPattern.MatchString(contextRequestId) {
+			t.Errorf("Received %s, expected a generated request id", contextRequestId)
+		}
+		if responseId := w.Header().Get(RequestIdHeader); responseId != contextRequestId {
+			t.Errorf("Received %s, expected %s", responseId, contextRequestId)
+		}
+	})
+}
+
+func TestNewLogger(t *testing.T) {
+	t.Run("logs the request id of the context", func(t *testing.T) {
+		var buff bytes.Buffer
+		logger := NewLogger(&buff, slog.LevelInfo).With("component", "test")
+		logger.InfoContext(contextWithRequestId(context.Background(), "some-request-id"), "Served request")
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(buff.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line["request_id"] != "some-request-id" {
+			t.Errorf("Received %v, expected %s", line["request_id"], "some-request-id")
+		}
+	})
+	t.Run("does not log lines below its level", func(t *testing.T) {
+		var buff bytes.Buffer
+		NewLogger(&buff, slog.LevelInfo).Debug("Request JSON parsed")
+		if buff.Len() != 0 {
+			t.Errorf("Received %s, expected no lines", buff.String())
+		}
+	})
+}
+
+func TestParseLogLevel(t *testing.T) {
+	t.Run("defaults to info", func(t *testing.T) {
+		level, err := parseLogLevel("")
+		if err != nil || level != slog.LevelInfo {
+			t.Errorf("Received %s, expected %s", level, slog.LevelInfo)
+		}
+	})
+	t.Run("accepts lower case levels", func(t *testing.T) {
+		level, err := parseLogLevel("debug")
+		if err != nil || level != slog.LevelDebug {
+			t.Errorf("Received %s, expected %s", level, slog.LevelDebug)
+		}
+	})
+	t.Run("returns error when the level is unknown", func(t *testing.T) {
+		if _, err := parseLogLevel("verbose"); err == nil {
+			t.Errorf("Received nil, expected error")
+		}
+	})
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 )
 
 // App
@@ -15,73 +22,171 @@ type KeyGenSvc struct {
 	Flags struct {
 		RefreshDb *bool
 	}
-	EnvVars struct {
-		DbConnStr string
-		MaxKeyLength int
-		MinKeyLength int
-		MinSourceNameLength int
-	}
+	// Read through Config, as settings can be reloaded while serving
+	ConfigLoader ConfigLoader
+	config atomic.Pointer[Config]
+	LogLevel *slog.LevelVar
+
 	Db PostgresDb
 	Kg KeyGenService
+	Ak ApiKeyService
+	Health *HealthChecker
+	Tracing *sdktrace.TracerProvider
+
+	Nonces *nonceCache
 }
 
 var App KeyGenSvc
 
-// Env Handlers
+func (a *KeyGenSvc) Config() *Config {
+	return a.config.Load()
+}
+
+// Setup
 
-func HandleGetenvString(key string, required bool) string {
-	envVar := os.Getenv(key)
-	if required && envVar == "" {
-		panic(fmt.Sprintf("Environment variable %s is not set", key))
+// Instantiates services from config, once it is loaded and valid
+func setup(config Config) {
+	App.config.Store(&config)
+
+	// Log structured lines from the start, leveled so that steps of every
+	// request can be turned on when needed
+	logLevel, _ := parseLogLevel(config.LogLevel)
+	App.LogLevel = new(slog.LevelVar)
+	App.LogLevel.Set(logLevel)
+	slog.SetDefault(NewLogger(os.Stderr, App.LogLevel))
+
+	// Trace requests when an exporter is set, continuing urlshortenapp's
+	// traces either way
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if config.TracesExporter != TracesExporterNone {
+		destination := config.OtlpTracesEndpoint
+		if config.TracesExporter == TracesExporterFile {
+			destination = config.TracesFilePath
+		}
+		tracing, tracingErr := NewTracerProvider("keygensvc", config.TracesExporter, destination)
+		if tracingErr != nil {
+			logFatal("Could not instantiate tracer provider", "traces_exporter", config.TracesExporter, "error", tracingErr)
+		}
+		otel.SetTracerProvider(tracing)
+		App.Tracing = tracing
 	}
-	return envVar
-}
 
-func HandleGetenvInt(key string, required bool) int {
-	envVar := HandleGetenvString(key, required)
-	intVar, err := strconv.Atoi(envVar)
-	if err != nil {
-		panic(fmt.Sprintf("Enviroment variable %s is not an integer", key))
+	db, dbErr := NewPostgresDb(config.DbConnStr)
+	if dbErr != nil {
+		logFatal("Could not instantiate Postgres connection pool", "error", dbErr)
 	}
-	return intVar
-}
+	App.Db = db
+	App.Kg = NewKeyGenService(App.Db)
+	App.Ak = NewApiKeyService(App.Db, config.AdminApiKey, config.ShortenApiKey)
+	App.Nonces = newNonceCache(2 * MaxSignatureClockSkew)
 
-// Init
+	// Ready once Postgres is reachable and migrated to the latest migration
+	latestVersion, latestErr := latestMigrationVersion(MigrationsPath)
+	if latestErr != nil {
+		slog.Warn("Could not read migrations, readiness will not check they ran", "error", latestErr)
+	}
+	App.Health = NewHealthChecker(ReadinessCacheTtl, ReadinessCheckTimeout)
+	App.Health.AddCheck("postgres", postgresHealthCheck(App.Db, latestVersion))
+	slog.Info("Service layer established")
+}
 
-func init() {
-	App.Flags.RefreshDb = flag.Bool(
-		"refresh-database",
-		false,
-		"Runs database migration down and migration up.",
-	)
-	log.Print("Flags established")
+// Runs once requests in flight are done. Closing the pool waits for
+// connections still in use, so is given up on once the context ends.
+func (a *KeyGenSvc) Shutdown(ctx context.Context) {
+	db, closed := a.Db, make(chan struct{})
+	go func() {
+		db.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		slog.Error("Gave up closing Postgres connection pool", "error", ctx.Err())
+	}
+	if a.Tracing != nil {
+		if tracingErr := a.Tracing.Shutdown(ctx); tracingErr != nil {
+			slog.Error("Error exporting remaining spans", "error", tracingErr)
+		}
+	}
+}
 
-	App.EnvVars.MaxKeyLength = HandleGetenvInt("MAXIMUM_KEY_LENGTH", true)
-	App.EnvVars.MinKeyLength = HandleGetenvInt("MINIMUM_KEY_LENGTH", true)
-	App.EnvVars.MinSourceNameLength = HandleGetenvInt("MINIMUM_SOURCE_NAME_LENGTH", true)
-	App.EnvVars.DbConnStr    = HandleGetenvString("POSTGRES_CONNECTION_STRING", true)
-	log.Print("Environment established")
+// Routes
 
-	App.Db = NewPostgresDb(App.EnvVars.DbConnStr)
-	App.Kg = NewKeyGenService(App.Db)
-	log.Print("Service layer established")
+// Traces, counts, times and logs every request to the route
+func handleRoute(route string, handler http.HandlerFunc) {
+	http.HandleFunc(route, traceHttpRequests(route, observeHttpRequests(route, handler)))
 }
 
 // Main
 
 func main() {
-	// Parse and handle command-line flags
+	// Parse command-line flags, then load config, listing every invalid
+	// setting at once
+	App.Flags.RefreshDb = flag.Bool(
+		"refresh-database",
+		false,
+		"Runs database migration down and migration up.",
+	)
+	configLoader := NewConfigLoader(flag.CommandLine, Config{})
 	flag.Parse()
-	log.Print("Flags parsed, handling...")
+	App.ConfigLoader = configLoader()
+	config, configErr := App.ConfigLoader.Load()
+	if configErr != nil {
+		slog.Error("Invalid config", "errors", strings.Split(configErr.Error(), "\n"))
+		os.Exit(2)
+	}
+	setup(config)
+
+	// Handle command-line flags
+	slog.Debug("Flags parsed, handling...")
 	if App.Flags.RefreshDb != nil && *App.Flags.RefreshDb {
 		App.Db.Refresh()
-		log.Printf("Successfully refreshed database")
+		slog.Info("Successfully refreshed database")
 		return
 	}
 
-	// Instantiate routes and HTTP server
-	http.HandleFunc("/key/generate", HandleGenerateKeyRequest)
-	http.HandleFunc("/key/new", HandleNewKeyRequest)
-	log.Print("Routes established, listening...")
-	log.Fatal(http.ListenAndServe(":5000", nil))
+	// Instantiate routes
+	// Key routes are only for urlshortenapp, which signs its requests
+	if config.SharedSecret == "" {
+		slog.Warn("SERVICE_SHARED_SECRET is not set and ALLOW_UNSIGNED_REQUESTS is, key requests will not be signed")
+	}
+	handleRoute("/key/generate", requireSignature(
+		config.SharedSecret,
+		App.Nonces,
+		requireApiKey(ApiKeyScopeShorten, HandleGenerateKeyRequest),
+	))
+	handleRoute("/key/new", requireSignature(
+		config.SharedSecret,
+		App.Nonces,
+		requireApiKey(ApiKeyScopeShorten, HandleNewKeyRequest),
+	))
+	handleRoute("/admin/apikeys", requireApiKey(ApiKeyScopeAdmin, HandleApiKeyMintRequest))
+	handleRoute("/admin/apikeys/revoke", requireApiKey(ApiKeyScopeAdmin, HandleApiKeyRevokeRequest))
+	http.HandleFunc("/metrics", HandleMetricsRequest)
+	handleRoute("/livez", HandleLivenessRequest)
+	handleRoute("/readyz", HandleReadinessRequest)
+
+	// Instantiate HTTP server, failing readiness then draining requests in
+	// flight on SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	// Reload settings that can change while serving on SIGHUP
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go App.ReloadConfigOn(reloads)
+	listener, listenErr := net.Listen("tcp", ":5000")
+	if listenErr != nil {
+		logFatal("Could not listen", "error", listenErr)
+	}
+	server := GracefulServer{
+		Server:          NewHttpServer(withRequestId(http.DefaultServeMux)),
+		ReadinessDelay:  ShutdownReadinessDelay,
+		ShutdownTimeout: ShutdownTimeout,
+		OnSignal:        App.Health.Drain,
+		OnDrained:       App.Shutdown,
+	}
+	slog.Info("Routes established, listening...")
+	if serveErr := server.Serve(listener, signals); serveErr != nil {
+		logFatal("Stopped serving", "error", serveErr)
+	}
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Instantiates services the way main does, from config rather than env vars.
+// Postgres is not up, so tests swap in mocks.
+func testConfig() Config {
+	return Config{
+		DbConnStr:           "postgres://postgres@localhost:5432/keystore?sslmode=disable",
+		MaxKeyLength:        36,
+		MinKeyLength:        6,
+		MinSourceNameLength: 4,
+		SharedSecret:        "test-shared-secret",
+	}
+}
+
+func TestMain(m *testing.M) {
+	setup(testConfig())
+	OriginalKgService = App.Kg
+	OriginalAkService = App.Ak
+	os.Exit(m.Run())
+}
+
+// Blocks closing until released
+type MockBlockingPostgresDb struct {
+	MockPostgresDb
+	release chan struct{}
+	closed  *atomic.Bool
+}
+
+func (m MockBlockingPostgresDb) close() {
+	<-m.release
+	m.closed.Store(true)
+}
+
+func TestKeyGenSvc_Shutdown(t *testing.T) {
+	originalDb := App.Db
+	defer func() { App.Db = originalDb }()
+
+	t.Run("closes the Postgres pool", func(t *testing.T) {
+		db := MockBlockingPostgresDb{release: make(chan struct{}), closed: &atomic.Bool{}}
+		close(db.release)
+		App.Db = db
+		App.Shutdown(context.Background())
+		if !db.closed.Load() {
+			t.Errorf("Received %t, expected %t", db.closed.Load(), true)
+		}
+	})
+	t.Run("gives up closing the Postgres pool when the context ends", func(t *testing.T) {
+		db := MockBlockingPostgresDb{release: make(chan struct{}), closed: &atomic.Bool{}}
+		defer close(db.release)
+		App.Db = db
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		startTime := time.Now()
+		App.Shutdown(ctx)
+		if elapsed := time.Since(startTime); elapsed >= time.Second {
+			t.Errorf("Received %s, expected less than %s", elapsed, time.Second)
+		}
+	})
+}
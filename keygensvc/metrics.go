@@ -0,0 +1,95 @@
+package main
+
+// Prometheus metrics, served on /metrics
+
+import (
+	"github.com/jackc/pgx/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	KeyKindGenerated = "generated"
+	KeyKindCustom    = "custom"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygensvc_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "keygensvc_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	postgresQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "keygensvc_postgres_query_duration_seconds",
+		Help:    "Time taken by Postgres queries by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	keyCollisionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "keygensvc_key_collisions_total",
+		Help: "Keys that already existed when stored, by whether they were generated or custom.",
+	}, []string{"kind"})
+)
+
+// Serves every registered metric, along with Go runtime and process metrics
+var HandleMetricsRequest = promhttp.Handler().ServeHTTP
+
+// Records the status code written by a handler, which is 200 unless set
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Wraps the handler of a route, counting, timing and logging its requests
+func observeHttpRequests(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		startTime := time.Now()
+		handler(recorder, r)
+		duration := time.Since(startTime)
+		httpRequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+		httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.statusCode)).Inc()
+		slog.InfoContext(
+			r.Context(), "Served request",
+			"route", route, "method", r.Method, "status", recorder.statusCode, "duration", duration,
+		)
+	}
+}
+
+func observePostgresQuery(operation string, startTime time.Time) {
+	postgresQueryDuration.WithLabelValues(operation).Observe(time.Since(startTime).Seconds())
+}
+
+// Rows are only read on Scan, so that is when the query is timed and its
+// span ended
+type observedRow struct {
+	row       pgx.Row
+	operation string
+	startTime time.Time
+	span      trace.Span
+}
+
+func (r observedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	observePostgresQuery(r.operation, r.startTime)
+	if err == pgx.ErrNoRows {
+		r.span.End()
+	} else {
+		endSpan(r.span, err)
+	}
+	return err
+}
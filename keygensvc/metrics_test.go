@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestObserveHttpRequests(t *testing.T) {
+	t.Run("counts requests by route, method and status code", func(t *testing.T) {
+		handler := observeHttpRequests("/test/observed", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+		})
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/observed", nil))
+		counted := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/test/observed", http.MethodPost, "409"))
+		if counted != 1 {
+			t.Errorf("Received %v, expected %v", counted, 1)
+		}
+	})
+}
+
+func TestKeyGenService_KeyCollisions(t *testing.T) {
+	t.Run("counts custom keys that already exist", func(t *testing.T) {
+		callCount = 0
+		before := testutil.ToFloat64(keyCollisionsTotal.WithLabelValues(KeyKindCustom))
+		mockDb := MockPostgresDb{
+			errors: []error{nil, &pgconn.PgError{Code: PgErrCodeUniqueViolation}},
+			id:     0,
+		}
+		_ = NewKeyGenService(mockDb).StoreCustomKey(context.Background(), "some-source", "", "some-key")
+		after := testutil.ToFloat64(keyCollisionsTotal.WithLabelValues(KeyKindCustom))
+		if after != before+1 {
+			t.Errorf("Received %v, expected %v", after, before+1)
+		}
+	})
+}
+
+func TestHandleMetricsRequest(t *testing.T) {
+	t.Run("serves metrics in the Prometheus text format", func(t *testing.T) {
+		keyCollisionsTotal.WithLabelValues(KeyKindGenerated).Add(0)
+		w := httptest.NewRecorder()
+		HandleMetricsRequest(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "keygensvc_key_collisions_total") {
+			t.Errorf("Received %d, expected %d with key collisions", w.Code, http.StatusOK)
+		}
+	})
+}
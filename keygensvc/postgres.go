@@ -8,25 +8,51 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
-	"log"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
 )
 
-const PgErrCodeUniqueViolation = "23505"
+const (
+	PgErrCodeUniqueViolation = "23505"
+	MigrationsPath           = "db/migrations"
+)
+
+var migrationFilePattern = regexp.MustCompile(`^([0-9]+)_.*\.up\.sql$`)
 
 type PostgresDb interface {
 	Refresh()
-	connect() error
-	queryInt(sql string, params ...interface{}) (int, error)
+	queryInt(ctx context.Context, sql string, params ...interface{}) (int, error)
+	queryRow(ctx context.Context, sql string, params ...interface{}) pgx.Row
+	exec(ctx context.Context, sql string, params ...interface{}) (int64, error)
+	// Waits for connections in use to be released
 	close()
+	migrationVersion(ctx context.Context) (uint, bool, error)
 }
 
 type postgresDb struct {
 	connStr string
-	Conn *pgx.Conn
+	Pool    *pgxpool.Pool
 }
 
-func NewPostgresDb(connStr string) PostgresDb {
-	return &postgresDb{connStr: connStr}
+// Connects lazily, so that the service can start before Postgres is ready
+// and wait for it in the readiness check
+func NewPostgresDb(connStr string) (PostgresDb, error) {
+	config, parseErr := pgxpool.ParseConfig(connStr)
+	if parseErr != nil {
+		slog.Error("Error parsing Postgres connection string", "error", parseErr)
+		return nil, ErrCouldNotConnectToPostgres
+	}
+	config.LazyConnect = true
+	pool, connectErr := pgxpool.ConnectConfig(context.Background(), config)
+	if connectErr != nil {
+		slog.Error("Error connecting to Postgres", "error", connectErr)
+		return nil, ErrCouldNotConnectToPostgres
+	}
+	return &postgresDb{connStr: connStr, Pool: pool}, nil
 }
 
 func isMigrationNoChangeError(err error) bool {
@@ -42,42 +68,87 @@ func isDuplicateKeyError(err error) bool {
 }
 
 func (db postgresDb) Refresh() {
-	m, err := migrate.New("file://db/migrations", db.connStr)
+	m, err := migrate.New("file://"+MigrationsPath, db.connStr)
 	if err != nil {
-		log.Fatalf("Error initiating migrations: %s", err)
+		logFatal("Error initiating migrations", "error", err)
 	}
 	if downErr := m.Down(); downErr != nil && !isMigrationNoChangeError(downErr) {
-		log.Fatalf("Error running migrations down: %s", downErr)
+		logFatal("Error running migrations down", "error", downErr)
 	}
 	if upErr := m.Up(); upErr != nil && !isMigrationNoChangeError(upErr) {
-		log.Fatalf("Error running migrations up: %s", upErr)
+		logFatal("Error running migrations up", "error", upErr)
 	}
 }
 
-func (db *postgresDb) connect() error {
-	conn, err := pgx.Connect(context.Background(), db.connStr)
+func (db *postgresDb) queryInt(ctx context.Context, sql string, params ...interface{}) (int, error) {
+	var receiver int
+	err := db.queryRow(ctx, sql, params...).Scan(&receiver)
 	if err != nil {
-		log.Printf("Error connecting to Postgres database: %s", err)
-		return err
+		slog.ErrorContext(ctx, "Error running query returning int", "error", err)
+		return 0, err
 	}
+	return receiver, nil
+}
 
-	db.Conn = conn
-	return nil
+func (db *postgresDb) queryRow(ctx context.Context, sql string, params ...interface{}) pgx.Row {
+	ctx, span := startPostgresSpan(ctx, "query", sql)
+	return observedRow{
+		row:       db.Pool.QueryRow(ctx, sql, params...),
+		operation: "query",
+		startTime: time.Now(),
+		span:      span,
+	}
 }
 
-func (db *postgresDb) queryInt(sql string, params ...interface{}) (int, error) {
-	var receiver int
-	err := db.Conn.QueryRow(context.Background(), sql, params...).Scan(&receiver)
+// Returns the number of rows affected
+func (db *postgresDb) exec(ctx context.Context, sql string, params ...interface{}) (int64, error) {
+	ctx, span := startPostgresSpan(ctx, "exec", sql)
+	startTime := time.Now()
+	tag, err := db.Pool.Exec(ctx, sql, params...)
+	observePostgresQuery("exec", startTime)
+	endSpan(span, err)
 	if err != nil {
-		log.Printf("Error running query returning int: %s", err)
+		slog.ErrorContext(ctx, "Error running statement", "error", err)
 		return 0, err
 	}
-	return receiver, nil
+	return tag.RowsAffected(), nil
 }
 
 func (db *postgresDb) close() {
-	if db.Conn != nil {
-		db.Conn.Close(context.Background())
-		db.Conn = nil
+	db.Pool.Close()
+}
+
+// Returns the version golang-migrate recorded, and whether a migration to it
+// failed part way
+func (db *postgresDb) migrationVersion(ctx context.Context) (uint, bool, error) {
+	sql := "SELECT version, dirty FROM schema_migrations LIMIT 1"
+	ctx, span := startPostgresSpan(ctx, "query", sql)
+	var version int64
+	var dirty bool
+	err := db.Pool.QueryRow(ctx, sql).Scan(&version, &dirty)
+	endSpan(span, err)
+	if err != nil {
+		return 0, false, err
+	}
+	return uint(version), dirty, nil
+}
+
+// Returns the version of the last migration in the directory
+func latestMigrationVersion(path string) (uint, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	var latest uint
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, parseErr := strconv.ParseUint(match[1], 10, 64)
+		if parseErr == nil && uint(version) > latest {
+			latest = uint(version)
+		}
 	}
+	return latest, nil
 }
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewPostgresDb(t *testing.T) {
+	t.Run("returns error when the connection string is invalid", func(t *testing.T) {
+		_, err := NewPostgresDb("postgres://localhost:notaport/keystore")
+		if err != ErrCouldNotConnectToPostgres {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotConnectToPostgres)
+		}
+	})
+	t.Run("returns pool without connecting until first used", func(t *testing.T) {
+		db, err := NewPostgresDb("postgres://user@127.0.0.1:1/keystore?connect_timeout=1")
+		if err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+		db.close()
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGracefulServer_Serve(t *testing.T) {
+	t.Run("fails readiness, then waits for requests in flight before cleaning up", func(t *testing.T) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		started := make(chan struct{})
+		release := make(chan struct{})
+		steps := make(chan string, 3)
+		server := GracefulServer{
+			Server: NewHttpServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				steps <- "served"
+			})),
+			ShutdownTimeout: time.Second,
+			OnSignal:        func() { steps <- "signalled" },
+			OnDrained:       func(_ context.Context) { steps <- "drained" },
+		}
+		signals := make(chan os.Signal, 1)
+		serveErrs := make(chan error, 1)
+		go func() { serveErrs <- server.Serve(listener, signals) }()
+
+		responses := make(chan *http.Response, 1)
+		go func() {
+			response, _ := http.Get("http://" + listener.Addr().String())
+			responses <- response
+		}()
+		<-started
+		signals <- syscall.SIGTERM
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+
+		if response := <-responses; response == nil || response.StatusCode != http.StatusOK {
+			t.Errorf("Received %v, expected %d", response, http.StatusOK)
+		}
+		if serveErr := <-serveErrs; serveErr != nil {
+			t.Errorf("Received %s, expected nil", serveErr)
+		}
+		for _, expected := range []string{"signalled", "served", "drained"} {
+			if step := <-steps; step != expected {
+				t.Errorf("Received %s, expected %s", step, expected)
+			}
+		}
+	})
+	t.Run("returns error when it cannot serve", func(t *testing.T) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		listener.Close()
+		server := GracefulServer{Server: NewHttpServer(http.NotFoundHandler())}
+		if serveErr := server.Serve(listener, make(chan os.Signal)); serveErr == nil {
+			t.Errorf("Received nil, expected error")
+		}
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+// HMAC signing of requests from and responses to urlshortenapp. Requests are
+// signed over their method, path, timestamp, nonce and body; responses over
+// their status, the request nonce and body, so each side proves it holds the
+// shared secret and a response cannot be replayed against another request.
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+	MaxSignatureClockSkew    = 5 * time.Minute
+)
+
+var (
+	ErrSignatureMissing   = errors.New("signature missing")
+	ErrSignatureExpired   = errors.New("signature timestamp outside allowed skew")
+	ErrSignatureReplayed  = errors.New("signature nonce already used")
+	ErrSignatureIncorrect = errors.New("signature incorrect")
+)
+
+func signMessage(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func bodyDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return hex.EncodeToString(digest[:])
+}
+
+func signRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	return signMessage(secret, "request", method, path, timestamp, nonce, bodyDigest(body))
+}
+
+func signResponse(secret string, statusCode int, nonce string, body []byte) string {
+	return signMessage(secret, "response", strconv.Itoa(statusCode), nonce, bodyDigest(body))
+}
+
+type nonceExpiry struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// Remembers nonces for as long as their timestamps are accepted. Every nonce
+// is kept for the same time, so they expire in the order they were used and
+// only the oldest need checking.
+type nonceCache struct {
+	Ttl    time.Duration
+	mutex  sync.Mutex
+	nonces map[string]struct{}
+	queue  []nonceExpiry
+	now    func() time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{Ttl: ttl, nonces: map[string]struct{}{}, now: time.Now}
+}
+
+// Records the nonce, returning false if it was already recorded
+func (c *nonceCache) Use(nonce string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	for len(c.queue) > 0 && !now.Before(c.queue[0].expiresAt) {
+		delete(c.nonces, c.queue[0].nonce)
+		c.queue = c.queue[1:]
+	}
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = struct{}{}
+	c.queue = append(c.queue, nonceExpiry{nonce: nonce, expiresAt: now.Add(c.Ttl)})
+	return true
+}
+
+func verifyRequestSignature(secret string, nonces *nonceCache, r *http.Request, body []byte) error {
+	signature := r.Header.Get(SignatureHeader)
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	nonce := r.Header.Get(SignatureNonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return ErrSignatureMissing
+	}
+
+	// Reject stale timestamps, which bounds how long nonces must be kept
+	unixTimestamp, parseErr := strconv.ParseInt(timestamp, 10, 64)
+	if parseErr != nil {
+		return ErrSignatureExpired
+	}
+	skew := time.Since(time.Unix(unixTimestamp, 0))
+	if skew > MaxSignatureClockSkew || skew < -MaxSignatureClockSkew {
+		return ErrSignatureExpired
+	}
+
+	expected := signRequest(secret, r.Method, r.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrSignatureIncorrect
+	}
+	if !nonces.Use(nonce) {
+		return ErrSignatureReplayed
+	}
+	return nil
+}
+
+// Buffers the response so it can be signed before it is sent
+type signingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *signingResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+func (w *signingResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// Rejects unsigned, incorrectly signed or replayed requests, and signs
+// responses to the rest. Does nothing without a secret, which config only
+// allows when unsigned requests are explicitly allowed.
+func requireSignature(secret string, nonces *nonceCache, handler http.HandlerFunc) http.HandlerFunc {
+	if secret == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var bodyBuff bytes.Buffer
+		bodyBuff.ReadFrom(r.Body)
+		body := bodyBuff.Bytes()
+
+		if err := verifyRequestSignature(secret, nonces, r, body); err != nil {
+			slog.WarnContext(r.Context(), "Rejected request signature", "path", r.URL.Path, "error", err)
+			http.Error(
+				w,
+				fmt.Sprintf("Request signature rejected: %s.", err),
+				http.StatusUnauthorized,
+			)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		signingWriter := &signingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(signingWriter, r)
+
+		nonce := r.Header.Get(SignatureNonceHeader)
+		w.Header().Set(
+			SignatureHeader,
+			signResponse(secret, signingWriter.statusCode, nonce, signingWriter.body.Bytes()),
+		)
+		w.WriteHeader(signingWriter.statusCode)
+		w.Write(signingWriter.body.Bytes())
+	}
+}
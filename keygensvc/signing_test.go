@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSignedRequest(t *testing.T, secret string, timestamp time.Time, nonce string, body string) *http.Request {
+	req, err := http.NewRequest("POST", "/key/generate", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixTimestamp := strconv.FormatInt(timestamp.Unix(), 10)
+	req.Header.Set(SignatureTimestampHeader, unixTimestamp)
+	req.Header.Set(SignatureNonceHeader, nonce)
+	req.Header.Set(
+		SignatureHeader,
+		signRequest(secret, "POST", "/key/generate", unixTimestamp, nonce, []byte(body)),
+	)
+	return req
+}
+
+func TestRequireSignature(t *testing.T) {
+	h := requireSignature("secret", newNonceCache(time.Minute), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		var bodyBuff bytes.Buffer
+		bodyBuff.ReadFrom(r.Body)
+		w.Write(bodyBuff.Bytes())
+	})
+
+	t.Run("returns 401 Unauthorized when request is unsigned", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/key/generate", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("returns 401 Unauthorized when signed with another secret", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, newSignedRequest(t, "other", time.Now(), "nonce-1", "{}"))
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("returns 401 Unauthorized when timestamp is stale", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, newSignedRequest(t, "secret", time.Now().Add(-time.Hour), "nonce-2", "{}"))
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("passes through and signs response when signature is correct", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, newSignedRequest(t, "secret", time.Now(), "nonce-3", `{"a": 1}`))
+		if status := res.Code; status != http.StatusCreated {
+			t.Errorf("Received %d, expected %d", status, http.StatusCreated)
+		}
+		if res.Body.String() != `{"a": 1}` {
+			t.Errorf("Received %s, expected %s", res.Body.String(), `{"a": 1}`)
+		}
+		expected := signResponse("secret", http.StatusCreated, "nonce-3", []byte(`{"a": 1}`))
+		if signature := res.Header().Get(SignatureHeader); signature != expected {
+			t.Errorf("Received %s, expected %s", signature, expected)
+		}
+	})
+	t.Run("returns 401 Unauthorized when nonce is replayed", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, newSignedRequest(t, "secret", time.Now(), "nonce-3", `{"a": 1}`))
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestNonceCache(t *testing.T) {
+	t.Run("rejects nonces until they expire, then forgets them", func(t *testing.T) {
+		now := time.Now()
+		cache := newNonceCache(time.Minute)
+		cache.now = func() time.Time { return now }
+		if !cache.Use("nonce-1") {
+			t.Error("Received false, expected first use to be accepted")
+		}
+		now = now.Add(30 * time.Second)
+		cache.Use("nonce-2")
+		if cache.Use("nonce-1") {
+			t.Error("Received true, expected replay to be rejected")
+		}
+
+		now = now.Add(45 * time.Second)
+		cache.Use("nonce-3")
+		if len(cache.nonces) != 2 || len(cache.queue) != 2 {
+			t.Errorf("Received %d nonces and %d queued, expected %d", len(cache.nonces), len(cache.queue), 2)
+		}
+		if !cache.Use("nonce-1") {
+			t.Error("Received false, expected expired nonce to be forgotten")
+		}
+	})
+}
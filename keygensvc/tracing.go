@@ -0,0 +1,113 @@
+package main
+
+// OpenTelemetry tracing of requests, continuing the traces of urlshortenapp
+// down to Postgres
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+)
+
+const (
+	TracesExporterNone   = ""
+	TracesExporterOtlp   = "otlp"
+	TracesExporterStdout = "stdout"
+	TracesExporterFile   = "file"
+)
+
+var (
+	ErrUnknownTracesExporter = errors.New("unknown traces exporter")
+)
+
+// Spans are dropped until a tracer provider is set
+var tracer = otel.Tracer("keygensvc")
+
+// The destination is the OTLP/HTTP traces URL, or the path of the file
+func NewTracerProvider(serviceName string, exporter string, destination string) (*sdktrace.TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case TracesExporterOtlp:
+		otlpExporter, otlpErr := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(destination))
+		if otlpErr != nil {
+			return nil, otlpErr
+		}
+		spanExporter = otlpExporter
+	case TracesExporterStdout:
+		stdoutExporter, stdoutErr := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if stdoutErr != nil {
+			return nil, stdoutErr
+		}
+		spanExporter = stdoutExporter
+	case TracesExporterFile:
+		file, openErr := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if openErr != nil {
+			return nil, openErr
+		}
+		fileExporter, fileErr := stdouttrace.New(stdouttrace.WithWriter(file))
+		if fileErr != nil {
+			return nil, fileErr
+		}
+		spanExporter = fileExporter
+	default:
+		return nil, ErrUnknownTracesExporter
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	), nil
+}
+
+// Wraps the handler of a route, continuing the trace of the caller. The span
+// wraps the access log line, so that it carries the trace.
+func traceHttpRequests(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(
+			ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.HTTPRoute(route)),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		handler(recorder, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.statusCode))
+		if recorder.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.statusCode))
+		}
+	}
+}
+
+// Starts a span for a call to Postgres, with the statement when there is one
+func startPostgresSpan(ctx context.Context, operation string, sql string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(
+		ctx, "Postgres "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperationName(operation)),
+	)
+	if sql != "" {
+		span.SetAttributes(semconv.DBQueryText(sql))
+	}
+	return ctx, span
+}
+
+// Ends a span, failing it on an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Records the spans ended by the test, in place of the exported ones
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previousTracer := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("keygensvc")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { tracer = previousTracer })
+	return recorder
+}
+
+func TestTraceHttpRequests(t *testing.T) {
+	t.Run("continues the trace of urlshortenapp", func(t *testing.T) {
+		recorder := recordSpans(t)
+		handler := traceHttpRequests("/key/new", func(w http.ResponseWriter, r *http.Request) {})
+		request := httptest.NewRequest(http.MethodPost, "/key/new", nil)
+		request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		handler(httptest.NewRecorder(), request)
+
+		spans := recorder.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("Received %d spans, expected %d", len(spans), 1)
+		}
+		traceId := spans[0].SpanContext().TraceID().String()
+		if traceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Received %s, expected %s", traceId, "4bf92f3577b34da6a3ce929d0e0e4736")
+		}
+	})
+	t.Run("fails spans of requests ending in server errors", func(t *testing.T) {
+		recorder := recordSpans(t)
+		handler := traceHttpRequests("/key/new", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/key/new", nil))
+
+		spans := recorder.Ended()
+		if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+			t.Errorf("Received %v, expected a single failed span", spans)
+		}
+	})
+}
+
+func TestObservedRow_Scan_Tracing(t *testing.T) {
+	t.Run("does not fail spans of queries returning no rows", func(t *testing.T) {
+		recorder := recordSpans(t)
+		_, span := startPostgresSpan(context.Background(), "query", "SELECT 1")
+		row := observedRow{row: MockRow{error: pgx.ErrNoRows}, operation: "query", startTime: time.Now(), span: span}
+		_ = row.Scan()
+
+		spans := recorder.Ended()
+		if len(spans) != 1 || spans[0].Status().Code == codes.Error {
+			t.Errorf("Received %v, expected a single unfailed span", spans)
+		}
+	})
+	t.Run("fails spans of failed queries", func(t *testing.T) {
+		recorder := recordSpans(t)
+		_, span := startPostgresSpan(context.Background(), "query", "SELECT 1")
+		row := observedRow{row: MockRow{error: errors.New("unavailable")}, operation: "query", startTime: time.Now(), span: span}
+		_ = row.Scan()
+
+		spans := recorder.Ended()
+		if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+			t.Errorf("Received %v, expected a single failed span", spans)
+		}
+	})
+}
+
+func TestNewTracerProvider_Otlp(t *testing.T) {
+	t.Run("exports spans to the OTLP/HTTP traces URL", func(t *testing.T) {
+		var path string
+		var body coltracepb.ExportTraceServiceRequest
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			encoded, _ := io.ReadAll(r.Body)
+			_ = proto.Unmarshal(encoded, &body)
+		}))
+		defer server.Close()
+
+		provider, err := NewTracerProvider("keygensvc", TracesExporterOtlp, server.URL+"/v1/traces")
+		if err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+		_, span := provider.Tracer("keygensvc").Start(context.Background(), "test")
+		span.End()
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+
+		if path != "/v1/traces" {
+			t.Errorf("Received %s, expected %s", path, "/v1/traces")
+		}
+		if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+			t.Fatalf("Received %v, expected spans of a single scope", body.ResourceSpans)
+		}
+		exported := body.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		if hex.EncodeToString(exported.TraceId) != span.SpanContext().TraceID().String() {
+			t.Errorf("Received %x, expected %s", exported.TraceId, span.SpanContext().TraceID())
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+// Buffered recording of redirect events to Elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type clickEvent struct {
+	ShortUrl       string    `json:"short_url"`
+	DestinationUrl string    `json:"destination_url"`
+	Variant        string    `json:"variant,omitempty"`
+	Platform       string    `json:"platform"`
+	Country        string    `json:"country,omitempty"`
+	Referrer       string    `json:"referrer,omitempty"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+type AnalyticsService interface {
+	RecordClick(event clickEvent)
+	Flush() error
+	FlushEvery(interval time.Duration)
+}
+
+type analyticsService struct {
+	EsIndex    string
+	EsService  EsService
+	BufferSize int
+	mutex      sync.Mutex
+	buffer     []clickEvent
+}
+
+var (
+	ErrCouldNotFlushClickEvents = errors.New("could not flush click events")
+)
+
+func NewAnalyticsService(
+	esIndex string, esService EsService, bufferSize int,
+) AnalyticsService {
+	return &analyticsService{
+		EsIndex:    esIndex,
+		EsService:  esService,
+		BufferSize: bufferSize,
+	}
+}
+
+// RecordClick buffers the event, flushing in the background once the buffer
+// is full so redirects never wait on Elasticsearch.
+func (s *analyticsService) RecordClick(event clickEvent) {
+	s.mutex.Lock()
+	s.buffer = append(s.buffer, event)
+	full := len(s.buffer) >= s.BufferSize
+	s.mutex.Unlock()
+
+	if full {
+		go func() { _ = s.Flush() }()
+	}
+}
+
+func (s *analyticsService) Flush() error {
+	// Take ownership of buffered events
+	s.mutex.Lock()
+	events := s.buffer
+	s.buffer = nil
+	s.mutex.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	// Without Elasticsearch there is nowhere to keep events
+	if s.EsService == nil {
+		return nil
+	}
+
+	// Store events in Elasticsearch
+	documents := make([]Document, 0, len(events))
+	for _, event := range events {
+		content, _ := json.Marshal(event)
+		documents = append(documents, Document{Content: content})
+	}
+	if bulkErr := s.EsService.BulkIndexDocuments(context.Background(), s.EsIndex, documents); bulkErr != nil {
+		slog.Error("Error flushing click events", "count", len(events), "error", bulkErr)
+		return ErrCouldNotFlushClickEvents
+	}
+	slog.Debug("Flushed click events", "count", len(events))
+
+	return nil
+}
+
+func (s *analyticsService) FlushEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		_ = s.Flush()
+	}
+}
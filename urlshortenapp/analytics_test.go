@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type MockAnalyticsService struct {
+	events []clickEvent
+}
+
+func (m *MockAnalyticsService) RecordClick(event clickEvent) {
+	m.events = append(m.events, event)
+}
+
+func (_ *MockAnalyticsService) Flush() error {
+	return nil
+}
+
+func (_ *MockAnalyticsService) FlushEvery(_ time.Duration) {
+	return
+}
+
+func TestAnalyticsService_Flush(t *testing.T) {
+	t.Run("returns nil when there is nothing to flush", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{}, errors.New("failed")}
+		analyticsSvc := NewAnalyticsService("some-index", mockEsService, 10)
+		if err := analyticsSvc.Flush(); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+	t.Run("returns error when events cannot be stored", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{}, errors.New("failed")}
+		analyticsSvc := NewAnalyticsService("some-index", mockEsService, 10)
+		analyticsSvc.RecordClick(clickEvent{ShortUrl: "http://shrt.url/abc123"})
+		if err := analyticsSvc.Flush(); err != ErrCouldNotFlushClickEvents {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotFlushClickEvents)
+		}
+	})
+	t.Run("returns nil when successful", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{}, nil}
+		analyticsSvc := NewAnalyticsService("some-index", mockEsService, 10)
+		analyticsSvc.RecordClick(clickEvent{ShortUrl: "http://shrt.url/abc123"})
+		if err := analyticsSvc.Flush(); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+// API keys for the management API, stored hashed in Elasticsearch
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ApiKeyScopeShorten = "shorten" // Create short URLs
+	ApiKeyScopeManage  = "manage"  // Update existing short URLs
+	ApiKeyScopeStats   = "stats"   // Look up short URLs and their details
+	ApiKeyScopeAdmin   = "admin"   // Mint and revoke keys, implies all scopes
+
+	ApiKeyPrefix = "usk_"
+)
+
+var knownApiKeyScopes = []string{
+	ApiKeyScopeShorten, ApiKeyScopeManage, ApiKeyScopeStats, ApiKeyScopeAdmin,
+}
+
+var (
+	ErrApiKeyNotFound          = errors.New("api key not found")
+	ErrApiKeyRevoked           = errors.New("api key revoked")
+	ErrCouldNotVerifyApiKey    = errors.New("could not verify api key")
+	ErrCouldNotMintApiKey      = errors.New("could not mint api key")
+	ErrCouldNotRevokeApiKey    = errors.New("could not revoke api key")
+	ErrCouldNotParseApiKeyJson = errors.New("could not parse api key json")
+)
+
+// Keys without a workspace act across all workspaces, which is meant for
+// admins and keys minted before workspaces existed
+type apiKey struct {
+	Id        string     `json:"-"`
+	Name      string     `json:"name"`
+	Workspace string     `json:"workspace,omitempty"`
+	Scopes    []string   `json:"scopes"`
+	Hosts     []string   `json:"hosts,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k apiKey) HasScope(scope string) bool {
+	return containsString(k.Scopes, scope) || containsString(k.Scopes, ApiKeyScopeAdmin)
+}
+
+// Keys without hosts may act on any short host
+func (k apiKey) AllowsHost(shortHost string) bool {
+	return len(k.Hosts) == 0 || containsString(k.Hosts, strings.TrimSuffix(shortHost, "/"))
+}
+
+func (k apiKey) IsRevoked() bool {
+	return k.RevokedAt != nil
+}
+
+type ApiKeyService interface {
+	MintApiKey(ctx context.Context, name string, workspace string, scopes []string, hosts []string) (string, string, error)
+	AuthenticateApiKey(ctx context.Context, rawKey string) (apiKey, error)
+	// Keys outside the workspace, when one is given, are not found
+	RevokeApiKey(ctx context.Context, id string, workspace string) error
+}
+
+type apiKeyService struct {
+	EsIndex      string
+	EsService    EsService
+	AdminKeyHash string
+}
+
+// The admin key, when set, is accepted without being stored so that the
+// first keys can be minted. Without Elasticsearch it is the only key.
+func NewApiKeyService(esIndex string, esService EsService, adminKey string) ApiKeyService {
+	adminKeyHash := ""
+	if adminKey != "" {
+		adminKeyHash = apiKeyIdForRawKey(adminKey)
+	}
+	return &apiKeyService{
+		EsIndex:      esIndex,
+		EsService:    esService,
+		AdminKeyHash: adminKeyHash,
+	}
+}
+
+// Keys are random and long, so a fast hash is enough to store them safely
+func apiKeyIdForRawKey(rawKey string) string {
+	hash := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateRawApiKey() string {
+	buff := make([]byte, 32)
+	_, _ = rand.Read(buff)
+	return ApiKeyPrefix + base64.RawURLEncoding.EncodeToString(buff)
+}
+
+// Returns the raw key, which is not stored and cannot be recovered, and its id
+func (s apiKeyService) MintApiKey(
+	ctx context.Context,
+	name string, workspace string, scopes []string, hosts []string,
+) (string, string, error) {
+	if s.EsService == nil {
+		slog.Warn("Cannot mint API key without Elasticsearch to store it in", "name", name)
+		return "", "", ErrCouldNotMintApiKey
+	}
+	rawKey := generateRawApiKey()
+	id := apiKeyIdForRawKey(rawKey)
+
+	content, _ := json.Marshal(apiKey{
+		Name:      name,
+		Workspace: workspace,
+		Scopes:    scopes,
+		Hosts:     hosts,
+		CreatedAt: time.Now().UTC(),
+	})
+	if _, indexErr := s.EsService.IndexDocument(ctx, s.EsIndex, Document{Id: id, Content: content}); indexErr != nil {
+		slog.Error("Error storing API key", "name", name, "error", indexErr)
+		return "", "", ErrCouldNotMintApiKey
+	}
+	slog.Info("Minted API key", "name", name, "id", id)
+
+	return rawKey, id, nil
+}
+
+func (s apiKeyService) AuthenticateApiKey(ctx context.Context, rawKey string) (apiKey, error) {
+	id := apiKeyIdForRawKey(rawKey)
+	if s.AdminKeyHash != "" && subtle.ConstantTimeCompare([]byte(id), []byte(s.AdminKeyHash)) == 1 {
+		return apiKey{Id: id, Name: "admin", Scopes: []string{ApiKeyScopeAdmin}}, nil
+	}
+
+	if s.EsService == nil {
+		return apiKey{}, ErrApiKeyNotFound
+	}
+
+	// Fetch document from Elasticsearch
+	document, getErr := s.EsService.GetDocumentById(ctx, s.EsIndex, id)
+	if getErr == ErrEsDoesNotContainDocument {
+		return apiKey{}, ErrApiKeyNotFound
+	}
+	if getErr != nil {
+		slog.Error("Error fetching API key", "id", id, "error", getErr)
+		return apiKey{}, ErrCouldNotVerifyApiKey
+	}
+
+	// Parse document content
+	var key apiKey
+	if parseErr := json.Unmarshal(document.Content, &key); parseErr != nil {
+		slog.Error("Error parsing API key", "id", id, "error", parseErr)
+		return apiKey{}, ErrCouldNotParseApiKeyJson
+	}
+	if key.IsRevoked() {
+		return apiKey{}, ErrApiKeyRevoked
+	}
+	key.Id = id
+
+	return key, nil
+}
+
+const revokeApiKeyScript = `
+if (ctx._source.revoked_at != null) {
+	ctx.op = 'noop';
+} else {
+	ctx._source.revoked_at = params.revoked_at;
+}`
+
+func (s apiKeyService) RevokeApiKey(ctx context.Context, id string, workspace string) error {
+	if s.EsService == nil {
+		return ErrApiKeyNotFound
+	}
+	if workspace != "" {
+		document, getErr := s.EsService.GetDocumentById(ctx, s.EsIndex, id)
+		if getErr == ErrEsDoesNotContainDocument {
+			return ErrApiKeyNotFound
+		}
+		if getErr != nil {
+			slog.Error("Error fetching API key", "id", id, "error", getErr)
+			return ErrCouldNotRevokeApiKey
+		}
+		var key apiKey
+		if parseErr := json.Unmarshal(document.Content, &key); parseErr != nil {
+			slog.Error("Error parsing API key", "id", id, "error", parseErr)
+			return ErrCouldNotRevokeApiKey
+		}
+		if key.Workspace != workspace {
+			return ErrApiKeyNotFound
+		}
+	}
+	_, updateErr := s.EsService.UpdateDocumentWithScript(
+		ctx, s.EsIndex,
+		id,
+		revokeApiKeyScript,
+		map[string]interface{}{"revoked_at": time.Now().UTC()},
+	)
+	if updateErr == ErrEsDoesNotContainDocument {
+		return ErrApiKeyNotFound
+	}
+	if updateErr != nil {
+		slog.Error("Error revoking API key", "id", id, "error", updateErr)
+		return ErrCouldNotRevokeApiKey
+	}
+	slog.Info("Revoked API key", "id", id)
+
+	return nil
+}
+
+// Middleware
+
+type apiKeyContextKey struct{}
+
+// Returns the key that authenticated the request, if any
+func apiKeyFromRequest(r *http.Request) (apiKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(apiKey)
+	return key, ok
+}
+
+// Returns the workspace the caller is confined to, empty for unconfined
+// callers and requests without a key, such as public redirects
+func workspaceFromRequest(r *http.Request) string {
+	key, _ := apiKeyFromRequest(r)
+	return key.Workspace
+}
+
+func rawApiKeyFromRequest(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+// Rejects requests without a valid, unrevoked key holding the scope
+func requireApiKey(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rawKey := rawApiKeyFromRequest(r)
+		if rawKey == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			handleUnauthorized(w, ResApiKeyRequired)
+			return
+		}
+
+		key, authErr := App.ApiKeys.AuthenticateApiKey(r.Context(), rawKey)
+		if authErr == ErrApiKeyNotFound || authErr == ErrApiKeyRevoked {
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			handleUnauthorized(w, ResApiKeyInvalid)
+			return
+		}
+		if authErr != nil {
+			handleServiceUnavailable(w, ResCouldNotVerifyApiKey)
+			return
+		}
+		if !key.HasScope(scope) {
+			handleForbidden(w, fmt.Sprintf("API key is missing the %s scope", scope))
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// Rejects requests whose key is restricted to other short hosts
+func isShortHostAllowed(w http.ResponseWriter, r *http.Request, shortHost string) bool {
+	if key, ok := apiKeyFromRequest(r); ok && !key.AllowsHost(shortHost) {
+		handleForbidden(w, fmt.Sprintf("API key is not allowed for short host %s", shortHost))
+		return false
+	}
+	return true
+}
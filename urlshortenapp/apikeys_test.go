@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKey_HasScope(t *testing.T) {
+	t.Run("returns true for granted scopes only", func(t *testing.T) {
+		key := apiKey{Scopes: []string{ApiKeyScopeShorten}}
+		if !key.HasScope(ApiKeyScopeShorten) {
+			t.Errorf("Received %t, expected %t", false, true)
+		}
+		if key.HasScope(ApiKeyScopeManage) {
+			t.Errorf("Received %t, expected %t", true, false)
+		}
+	})
+	t.Run("returns true for any scope when admin", func(t *testing.T) {
+		key := apiKey{Scopes: []string{ApiKeyScopeAdmin}}
+		if !key.HasScope(ApiKeyScopeStats) {
+			t.Errorf("Received %t, expected %t", false, true)
+		}
+	})
+}
+
+func TestApiKey_AllowsHost(t *testing.T) {
+	t.Run("allows any host when unrestricted", func(t *testing.T) {
+		if !(apiKey{}).AllowsHost("http://shrt.url") {
+			t.Errorf("Received %t, expected %t", false, true)
+		}
+	})
+	t.Run("allows listed hosts only", func(t *testing.T) {
+		key := apiKey{Hosts: []string{"http://shrt.url"}}
+		if !key.AllowsHost("http://shrt.url/") {
+			t.Errorf("Received %t, expected %t", false, true)
+		}
+		if key.AllowsHost("http://other.url") {
+			t.Errorf("Received %t, expected %t", true, false)
+		}
+	})
+}
+
+func TestApiKeyService_MintApiKey(t *testing.T) {
+	t.Run("returns error when key cannot be stored", func(t *testing.T) {
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{}, errors.New("failed")}, "")
+		_, _, err := apiKeySvc.MintApiKey(context.Background(), "ci", "", []string{ApiKeyScopeShorten}, nil)
+		if err != ErrCouldNotMintApiKey {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotMintApiKey)
+		}
+	})
+	t.Run("returns prefixed key and its hash as id", func(t *testing.T) {
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{}, nil}, "")
+		rawKey, id, err := apiKeySvc.MintApiKey(context.Background(), "ci", "", []string{ApiKeyScopeShorten}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(rawKey, ApiKeyPrefix) {
+			t.Errorf("Received %s, expected prefix %s", rawKey, ApiKeyPrefix)
+		}
+		if id != apiKeyIdForRawKey(rawKey) {
+			t.Errorf("Received %s, expected %s", id, apiKeyIdForRawKey(rawKey))
+		}
+	})
+}
+
+func TestApiKeyService_AuthenticateApiKey(t *testing.T) {
+	t.Run("returns admin key for the configured admin key", func(t *testing.T) {
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{}, errors.New("failed")}, "secret")
+		key, err := apiKeySvc.AuthenticateApiKey(context.Background(), "secret")
+		if err != nil || !key.HasScope(ApiKeyScopeAdmin) {
+			t.Errorf("Received %v and %s, expected admin key", key, err)
+		}
+	})
+	t.Run("returns error when key does not exist", func(t *testing.T) {
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{}, ErrEsDoesNotContainDocument}, "")
+		_, err := apiKeySvc.AuthenticateApiKey(context.Background(), "usk_unknown")
+		if err != ErrApiKeyNotFound {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyNotFound)
+		}
+	})
+	t.Run("returns error when key is revoked", func(t *testing.T) {
+		revokedAt := time.Now()
+		content, _ := json.Marshal(apiKey{Name: "ci", Scopes: []string{ApiKeyScopeShorten}, RevokedAt: &revokedAt})
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{Content: content}, nil}, "")
+		_, err := apiKeySvc.AuthenticateApiKey(context.Background(), "usk_revoked")
+		if err != ErrApiKeyRevoked {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyRevoked)
+		}
+	})
+	t.Run("returns stored key when successful", func(t *testing.T) {
+		content, _ := json.Marshal(apiKey{Name: "ci", Scopes: []string{ApiKeyScopeShorten}})
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{Content: content}, nil}, "")
+		key, err := apiKeySvc.AuthenticateApiKey(context.Background(), "usk_valid")
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+		if key.Name != "ci" {
+			t.Errorf("Received %s, expected %s", key.Name, "ci")
+		}
+	})
+}
+
+func TestApiKeyService_RevokeApiKey(t *testing.T) {
+	t.Run("returns error when key does not exist", func(t *testing.T) {
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"", Document{}, ErrEsDoesNotContainDocument}, "")
+		if err := apiKeySvc.RevokeApiKey(context.Background(), "abc", ""); err != ErrApiKeyNotFound {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyNotFound)
+		}
+	})
+	t.Run("returns error when key is in another workspace", func(t *testing.T) {
+		document := Document{Id: "abc", Content: json.RawMessage(`{"name": "ci", "workspace": "team-a"}`)}
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"updated", document, nil}, "")
+		if err := apiKeySvc.RevokeApiKey(context.Background(), "abc", "team-b"); err != ErrApiKeyNotFound {
+			t.Errorf("Received %s, expected %s", err, ErrApiKeyNotFound)
+		}
+	})
+	t.Run("returns nil when successful", func(t *testing.T) {
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"updated", Document{}, nil}, "")
+		if err := apiKeySvc.RevokeApiKey(context.Background(), "abc", ""); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+	t.Run("returns nil when key is in the workspace", func(t *testing.T) {
+		document := Document{Id: "abc", Content: json.RawMessage(`{"name": "ci", "workspace": "team-b"}`)}
+		apiKeySvc := NewApiKeyService("keys", MockEsService{"updated", document, nil}, "")
+		if err := apiKeySvc.RevokeApiKey(context.Background(), "abc", "team-b"); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
+
+func TestRequireApiKey(t *testing.T) {
+	originalApiKeys := App.ApiKeys
+	defer func() { App.ApiKeys = originalApiKeys }()
+
+	t.Run("returns 401 Unauthorized when key is missing", func(t *testing.T) {
+		App.ApiKeys = MockApiKeyService{key: apiKey{Scopes: []string{ApiKeyScopeAdmin}}}
+		req, err := http.NewRequest("POST", "/url/shorten", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("returns 401 Unauthorized when key is unknown", func(t *testing.T) {
+		App.ApiKeys = MockApiKeyService{key: apiKey{Scopes: []string{ApiKeyScopeAdmin}}}
+		req, err := http.NewRequest("POST", "/url/shorten", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer usk_unknown")
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+	})
+	t.Run("returns 403 Forbidden when key lacks the scope", func(t *testing.T) {
+		App.ApiKeys = MockApiKeyService{key: apiKey{Scopes: []string{ApiKeyScopeStats}}}
+		req, err := http.NewRequest("POST", "/url/shorten", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+	})
+	t.Run("returns 403 Forbidden when key is restricted to other hosts", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
+		App.ApiKeys = MockApiKeyService{
+			key: apiKey{Scopes: []string{ApiKeyScopeManage}, Hosts: []string{"http://other.url"}},
+		}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/update",
+			strings.NewReader(`{"short_url": "http://short.url/someslug", "max_clicks": 5}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+		App.UsService = OriginalUsService
+	})
+}
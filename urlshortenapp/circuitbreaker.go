@@ -0,0 +1,103 @@
+package main
+
+// Circuit breaker for calls to a dependency. Once enough calls in a row fail,
+// calls fail fast for a cooldown, rather than each waiting out a timeout.
+// Then one trial call is let through, which closes the circuit on success or
+// opens it again on failure.
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+type circuitBreaker struct {
+	// Zero never opens the circuit
+	failureThreshold int
+	cooldown         time.Duration
+	onStateChange    func(state string)
+
+	mutex         sync.Mutex
+	state         string
+	failures      int
+	openedAt      time.Time
+	trialInFlight bool
+	now           func() time.Time
+}
+
+func newCircuitBreaker(failureThreshold int, cooldown time.Duration, onStateChange func(state string)) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		onStateChange:    onStateChange,
+		state:            CircuitClosed,
+		now:              time.Now,
+	}
+}
+
+// Whether a call may be made. Every call allowed must be followed by Record
+// or Abandon.
+func (b *circuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(CircuitHalfOpen)
+		b.trialInFlight = true
+		return true
+	case CircuitHalfOpen:
+		if b.trialInFlight {
+			return false
+		}
+		b.trialInFlight = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) Record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trialInFlight = false
+	if success {
+		b.failures = 0
+		b.setState(CircuitClosed)
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || (b.failureThreshold > 0 && b.failures >= b.failureThreshold) {
+		b.openedAt = b.now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// For calls the caller gave up on, which say nothing about the dependency
+func (b *circuitBreaker) Abandon() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.trialInFlight = false
+}
+
+func (b *circuitBreaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(state)
+	}
+}
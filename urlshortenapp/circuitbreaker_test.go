@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	newBreaker := func(now *time.Time) *circuitBreaker {
+		breaker := newCircuitBreaker(2, time.Minute, nil)
+		breaker.now = func() time.Time { return *now }
+		return breaker
+	}
+
+	t.Run("opens once failures in a row reach the threshold", func(t *testing.T) {
+		now := time.Now()
+		breaker := newBreaker(&now)
+		breaker.Record(false)
+		breaker.Record(true)
+		breaker.Record(false)
+		if state := breaker.State(); state != CircuitClosed {
+			t.Errorf("Received %s, expected %s", state, CircuitClosed)
+		}
+
+		breaker.Record(false)
+		if state := breaker.State(); state != CircuitOpen {
+			t.Errorf("Received %s, expected %s", state, CircuitOpen)
+		}
+		if breaker.Allow() {
+			t.Errorf("Received allowed, expected refused while open")
+		}
+	})
+	t.Run("lets one trial through after the cooldown, closing on success", func(t *testing.T) {
+		now := time.Now()
+		breaker := newBreaker(&now)
+		breaker.Record(false)
+		breaker.Record(false)
+
+		now = now.Add(time.Minute)
+		if !breaker.Allow() {
+			t.Errorf("Received refused, expected trial allowed")
+		}
+		if breaker.Allow() {
+			t.Errorf("Received allowed, expected refused while trial is in flight")
+		}
+		breaker.Record(true)
+		if state := breaker.State(); state != CircuitClosed {
+			t.Errorf("Received %s, expected %s", state, CircuitClosed)
+		}
+		if !breaker.Allow() {
+			t.Errorf("Received refused, expected allowed once closed")
+		}
+	})
+	t.Run("opens again when the trial fails", func(t *testing.T) {
+		now := time.Now()
+		breaker := newBreaker(&now)
+		breaker.Record(false)
+		breaker.Record(false)
+
+		now = now.Add(time.Minute)
+		breaker.Allow()
+		breaker.Record(false)
+		if state := breaker.State(); state != CircuitOpen {
+			t.Errorf("Received %s, expected %s", state, CircuitOpen)
+		}
+		if breaker.Allow() {
+			t.Errorf("Received allowed, expected refused for another cooldown")
+		}
+	})
+	t.Run("lets another trial through when one is abandoned", func(t *testing.T) {
+		now := time.Now()
+		breaker := newBreaker(&now)
+		breaker.Record(false)
+		breaker.Record(false)
+
+		now = now.Add(time.Minute)
+		breaker.Allow()
+		breaker.Abandon()
+		if !breaker.Allow() {
+			t.Errorf("Received refused, expected another trial allowed")
+		}
+	})
+	t.Run("never opens when the threshold is zero", func(t *testing.T) {
+		breaker := newCircuitBreaker(0, time.Minute, nil)
+		for i := 0; i < 10; i++ {
+			breaker.Record(false)
+		}
+		if !breaker.Allow() {
+			t.Errorf("Received refused, expected allowed")
+		}
+	})
+}
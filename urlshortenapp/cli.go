@@ -0,0 +1,216 @@
+package main
+
+// Admin subcommands, run as `main <command>` instead of serving
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownCommand          = errors.New("unknown command")
+	ErrDeleteNotConfirmed      = errors.New("delete requires --confirm")
+	ErrSnapshotRepoMissing     = errors.New("snapshot requires --repository")
+	ErrUnknownLinkFormat       = errors.New("unknown link format")
+	ErrUnknownImportConflict   = errors.New("unknown import conflict policy")
+	ErrImportFileMissing       = errors.New("import requires a file")
+	ErrCouldNotParseImportFile = errors.New("could not parse import file")
+)
+
+const commandUsage = `Usage: main <command> [flags]
+
+Commands:
+  index create     Create the index and its alias unless they exist
+  index status     Show the indices behind the alias and their link counts
+  index migrate    Copy links into an index with the current mappings and switch the alias to it
+  index snapshot   Snapshot the indices behind the alias to a registered repository
+  index delete     Delete the indices behind the alias, requires --confirm and, if they hold links, --force
+  export           Write every link to stdout or --output as JSON Lines or CSV
+  import <file>    Import links from a JSON Lines or CSV file, reserving their slugs`
+
+// Parses a subcommand and its flags up front, returning a function that runs
+// it once Elasticsearch is reachable. No arguments means serve as usual.
+// Results are written to stdout, usage and flag errors to stderr.
+func parseCommand(args []string, stdout io.Writer, stderr io.Writer) (func() error, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	var command string
+	var commandArgs []string
+	switch {
+	case args[0] == "index" && len(args) >= 2:
+		command, commandArgs = "index "+args[1], args[2:]
+	case args[0] == "export" || args[0] == "import":
+		command, commandArgs = args[0], args[1:]
+	default:
+		fmt.Fprintln(stderr, commandUsage)
+		return nil, ErrUnknownCommand
+	}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var run func() error
+	var repository, name, format, conflict *string
+	var confirm, force *bool
+	var arguments int
+
+	switch command {
+	case "index create":
+		run = func() error {
+			return App.UsService.EnsureElasticsearchIndex()
+		}
+	case "index status":
+		run = func() error {
+			status, statusErr := App.UsService.GetElasticsearchIndexStatus()
+			if statusErr != nil {
+				return statusErr
+			}
+			printIndexStatus(stdout, status)
+			return nil
+		}
+	case "index migrate":
+		run = func() error {
+			return App.UsService.MigrateElasticsearchIndex()
+		}
+	case "index snapshot":
+		repository = flags.String("repository", "", "Snapshot repository registered with the cluster.")
+		name = flags.String("name", "", "Snapshot name, defaults to the alias and current time.")
+		run = func() error {
+			snapshot := *name
+			if snapshot == "" {
+				snapshot = fmt.Sprintf("%s-%s", App.Config().EsIndex, time.Now().UTC().Format("20060102-150405"))
+			}
+			return App.UsService.SnapshotElasticsearchIndex(*repository, snapshot)
+		}
+	case "index delete":
+		confirm = flags.Bool("confirm", false, "Confirms the indices should be deleted.")
+		force = flags.Bool("force", false, "Deletes the indices even if they hold links.")
+		run = func() error {
+			return App.UsService.DeleteElasticsearchIndex(*force)
+		}
+	case "export":
+		format = flags.String("format", LinkFormatJsonl, "Link format, jsonl or csv.")
+		workspace := flags.String("workspace", "", "Only export links in this workspace.")
+		output := flags.String("output", "", "File to write links to, defaults to stdout.")
+		run = func() error {
+			return runExportCommand(*format, *workspace, *output, stdout)
+		}
+	case "import":
+		format = flags.String("format", LinkFormatJsonl, "Link format, jsonl or csv.")
+		conflict = flags.String("conflict", ImportConflictFail, "What to do with links that exist: skip, overwrite or fail.")
+		dryRun := flags.Bool("dry-run", false, "Report what would be imported without changing anything.")
+		arguments = 1
+		run = func() error {
+			return runImportCommand(flags.Arg(0), *format, urlImportOptions{Conflict: *conflict, DryRun: *dryRun}, stdout, stderr)
+		}
+	default:
+		fmt.Fprintln(stderr, commandUsage)
+		return nil, ErrUnknownCommand
+	}
+
+	if parseErr := flags.Parse(commandArgs); parseErr != nil {
+		return nil, parseErr
+	}
+	if flags.NArg() < arguments {
+		return nil, ErrImportFileMissing
+	}
+	if flags.NArg() > arguments {
+		fmt.Fprintf(stderr, "Unexpected arguments: %s\n", strings.Join(flags.Args()[arguments:], " "))
+		return nil, ErrUnknownCommand
+	}
+
+	if confirm != nil && !*confirm {
+		return nil, ErrDeleteNotConfirmed
+	}
+	if repository != nil && *repository == "" {
+		return nil, ErrSnapshotRepoMissing
+	}
+	if format != nil && !containsString(knownLinkFormats, *format) {
+		return nil, ErrUnknownLinkFormat
+	}
+	if conflict != nil && !containsString(knownImportConflicts, *conflict) {
+		return nil, ErrUnknownImportConflict
+	}
+
+	return run, nil
+}
+
+func printIndexStatus(output io.Writer, status esIndexStatus) {
+	if len(status.Indices) == 0 {
+		fmt.Fprintf(output, "%s does not exist, current index is %s\n", status.Alias, status.CurrentIndex)
+		return
+	}
+
+	kind := "index created before aliases"
+	if status.IsAlias {
+		kind = "alias"
+	}
+	state := "out of date, run index migrate"
+	if status.IsCurrent() {
+		state = "up to date"
+	}
+	fmt.Fprintf(output, "%s is an %s, %s with %s\n", status.Alias, kind, state, status.CurrentIndex)
+
+	var indices []string
+	for index := range status.Indices {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	for _, index := range indices {
+		fmt.Fprintf(output, "  %s: %d links\n", index, status.Indices[index])
+	}
+}
+
+func runExportCommand(format string, workspace string, output string, stdout io.Writer) error {
+	destination := stdout
+	if output != "" {
+		file, createErr := os.Create(output)
+		if createErr != nil {
+			return createErr
+		}
+		defer file.Close()
+		destination = file
+	}
+
+	encoder := newLinkEncoder(format, destination)
+	_, exportErr := App.UsService.ExportShortUrls(context.Background(), workspace, encoder.Encode)
+	if flushErr := encoder.Flush(); exportErr == nil {
+		exportErr = flushErr
+	}
+	return exportErr
+}
+
+// Prints what was or would be imported as JSON, along with any lines that
+// could not be parsed or links that already exist
+func runImportCommand(
+	path string, format string, options urlImportOptions, stdout io.Writer, stderr io.Writer,
+) error {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+
+	var validation Validation
+	links := decodeLinks(format, file, &validation)
+	validateImportedLinks(&validation, links)
+	if validation.Fails() {
+		for _, message := range validation.Errors {
+			fmt.Fprintln(stderr, message)
+		}
+		return ErrCouldNotParseImportFile
+	}
+
+	result, importErr := App.UsService.ImportShortUrls(context.Background(), links, options)
+	encodedJson, _ := json.MarshalIndent(newUrlImportResponseJson(result, options), "", "  ")
+	fmt.Fprintln(stdout, string(encodedJson))
+	return importErr
+}
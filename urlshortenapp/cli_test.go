@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Records which index operation a command ran
+type MockIndexUsService struct {
+	MockUsService
+	calls *[]string
+}
+
+func (m MockIndexUsService) EnsureElasticsearchIndex() error {
+	*m.calls = append(*m.calls, "create")
+	return m.error
+}
+
+func (m MockIndexUsService) GetElasticsearchIndexStatus() (esIndexStatus, error) {
+	*m.calls = append(*m.calls, "status")
+	return esIndexStatus{
+		Alias: "urlstore", IsAlias: true, CurrentIndex: "urlstore_v2", Indices: map[string]int{"urlstore_v2": 7},
+	}, m.error
+}
+
+func (m MockIndexUsService) SnapshotElasticsearchIndex(repository string, snapshot string) error {
+	*m.calls = append(*m.calls, "snapshot "+repository+" "+snapshot)
+	return m.error
+}
+
+func (m MockIndexUsService) DeleteElasticsearchIndex(force bool) error {
+	if force {
+		*m.calls = append(*m.calls, "delete forced")
+	} else {
+		*m.calls = append(*m.calls, "delete")
+	}
+	return m.error
+}
+
+func TestParseCommand(t *testing.T) {
+	var calls []string
+	App.UsService = MockIndexUsService{calls: &calls}
+	defer func() { App.UsService = OriginalUsService }()
+
+	t.Run("serves when no command is given", func(t *testing.T) {
+		run, err := parseCommand(nil, &bytes.Buffer{}, &bytes.Buffer{})
+		if run != nil || err != nil {
+			t.Errorf("Received %s, expected no command and nil", err)
+		}
+	})
+	for _, args := range [][]string{
+		{"refresh"},
+		{"index"},
+		{"index", "refresh"},
+		{"index", "create", "extra"},
+		{"index", "delete", "--yes"},
+		{"export", "links.jsonl"},
+		{"import", "a.jsonl", "b.jsonl"},
+	} {
+		t.Run("returns error for "+strings.Join(args, " "), func(t *testing.T) {
+			run, err := parseCommand(args, &bytes.Buffer{}, &bytes.Buffer{})
+			if run != nil || err == nil {
+				t.Errorf("Received %s, expected an error", err)
+			}
+		})
+	}
+	t.Run("returns error when delete is not confirmed", func(t *testing.T) {
+		_, err := parseCommand([]string{"index", "delete", "--force"}, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != ErrDeleteNotConfirmed {
+			t.Errorf("Received %s, expected %s", err, ErrDeleteNotConfirmed)
+		}
+	})
+	t.Run("returns error when snapshot has no repository", func(t *testing.T) {
+		_, err := parseCommand([]string{"index", "snapshot"}, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != ErrSnapshotRepoMissing {
+			t.Errorf("Received %s, expected %s", err, ErrSnapshotRepoMissing)
+		}
+	})
+	t.Run("returns error when import has no file", func(t *testing.T) {
+		_, err := parseCommand([]string{"import", "--dry-run"}, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != ErrImportFileMissing {
+			t.Errorf("Received %s, expected %s", err, ErrImportFileMissing)
+		}
+	})
+	t.Run("returns error when format or conflict policy is unknown", func(t *testing.T) {
+		_, err := parseCommand([]string{"export", "--format", "xml"}, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != ErrUnknownLinkFormat {
+			t.Errorf("Received %s, expected %s", err, ErrUnknownLinkFormat)
+		}
+		_, err = parseCommand([]string{"import", "--conflict", "merge", "links.jsonl"}, &bytes.Buffer{}, &bytes.Buffer{})
+		if err != ErrUnknownImportConflict {
+			t.Errorf("Received %s, expected %s", err, ErrUnknownImportConflict)
+		}
+	})
+	t.Run("exports links to stdout", func(t *testing.T) {
+		App.UsService = MockIndexUsService{
+			MockUsService: MockUsService{shortUrl: "http://shrt.url/abc123", originalUrl: "http://example.com"}, calls: &calls,
+		}
+		var stdout bytes.Buffer
+		run, _ := parseCommand([]string{"export"}, &stdout, &bytes.Buffer{})
+		if runErr := run(); runErr != nil {
+			t.Fatal(runErr)
+		}
+		expected := "{\"original_url\":\"http://example.com\",\"short_url\":\"http://shrt.url/abc123\"}\n"
+		if stdout.String() != expected {
+			t.Errorf("Received %q, expected %q", stdout.String(), expected)
+		}
+		App.UsService = MockIndexUsService{calls: &calls}
+	})
+	t.Run("imports links from a file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "links.csv")
+		csv := "short_url,original_url\nhttp://shrt.url/abc123,http://example.com\n"
+		if writeErr := os.WriteFile(path, []byte(csv), 0600); writeErr != nil {
+			t.Fatal(writeErr)
+		}
+		var stdout bytes.Buffer
+		run, _ := parseCommand([]string{"import", "--format", "csv", "--dry-run", path}, &stdout, &bytes.Buffer{})
+		if runErr := run(); runErr != nil {
+			t.Fatal(runErr)
+		}
+		if !strings.Contains(stdout.String(), "\"created\": 1") || !strings.Contains(stdout.String(), "\"dry_run\": true") {
+			t.Errorf("Received %s, expected one link created on a dry run", stdout.String())
+		}
+	})
+	t.Run("runs commands with their flags", func(t *testing.T) {
+		calls = nil
+		for _, args := range [][]string{
+			{"index", "create"},
+			{"index", "delete", "--confirm"},
+			{"index", "delete", "--confirm", "--force"},
+			{"index", "snapshot", "--repository", "backups", "--name", "nightly"},
+		} {
+			run, err := parseCommand(args, &bytes.Buffer{}, &bytes.Buffer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if runErr := run(); runErr != nil {
+				t.Fatal(runErr)
+			}
+		}
+		expected := "create,delete,delete forced,snapshot backups nightly"
+		if received := strings.Join(calls, ","); received != expected {
+			t.Errorf("Received %s, expected %s", received, expected)
+		}
+	})
+	t.Run("prints status", func(t *testing.T) {
+		var stdout bytes.Buffer
+		run, _ := parseCommand([]string{"index", "status"}, &stdout, &bytes.Buffer{})
+		if runErr := run(); runErr != nil {
+			t.Fatal(runErr)
+		}
+		expected := "urlstore is an alias, up to date with urlstore_v2\n  urlstore_v2: 7 links\n"
+		if stdout.String() != expected {
+			t.Errorf("Received %q, expected %q", stdout.String(), expected)
+		}
+	})
+}
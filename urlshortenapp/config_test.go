@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func getenvFrom(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	required := map[string]string{
+		"ELASTICSEARCH_ADDRESSES":       "http://localhost:9200",
+		"ELASTICSEARCH_INDEX":           "urlstore",
+		"INIT_MAXIMUM_ATTEMPTS":         "6",
+		"KEYGENSVC_URL":                 "http://localhost:5000",
+		"INTERNAL_SHORT_HOST":           "http://localhost:8080",
+		"MINIMUM_SHORT_URL_PATH_LENGTH": "6",
+		"MAXIMUM_SHORT_URL_PATH_LENGTH": "12",
+	}
+
+	t.Run("returns defaults overridden by the file, then env vars, then flags", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", "link_cache_size: 500\nlink_cache_ttl_seconds: 30\nelasticsearch_shards: 3\n")
+		env := map[string]string{"LINK_CACHE_TTL_SECONDS": "20", "ELASTICSEARCH_SHARDS": "4"}
+		for key, value := range required {
+			env[key] = value
+		}
+		loader := ConfigLoader{
+			Path:   path,
+			Getenv: getenvFrom(env),
+			Flags:  map[string]string{"elasticsearch_shards": "5"},
+		}
+
+		config, err := loader.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.LinkStore != LinkStoreElasticsearch {
+			t.Errorf("Received %s, expected %s", config.LinkStore, LinkStoreElasticsearch)
+		}
+		if config.LinkCacheSize != 500 {
+			t.Errorf("Received %d, expected %d", config.LinkCacheSize, 500)
+		}
+		if config.LinkCacheTtl != 20 {
+			t.Errorf("Received %d, expected %d", config.LinkCacheTtl, 20)
+		}
+		if config.EsShards != 5 {
+			t.Errorf("Received %d, expected %d", config.EsShards, 5)
+		}
+	})
+
+	t.Run("returns settings read from TOML files named by CONFIG_FILE", func(t *testing.T) {
+		env := map[string]string{
+			ConfigFileEnvVar: writeConfigFile(t, "config.toml", "rate_limits = \"redirect.ip=50/100\"\nlink_cache_size = 0\n"),
+		}
+		for key, value := range required {
+			env[key] = value
+		}
+
+		config, err := ConfigLoader{Getenv: getenvFrom(env)}.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.RateLimits != "redirect.ip=50/100" {
+			t.Errorf("Received %s, expected %s", config.RateLimits, "redirect.ip=50/100")
+		}
+		if config.LinkCacheSize != 0 {
+			t.Errorf("Received %d, expected %d", config.LinkCacheSize, 0)
+		}
+	})
+
+	t.Run("returns every unreadable setting at once", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yml", "link_cache_sise: 500\nelasticsearch_shards: [1]\n")
+		loader := ConfigLoader{
+			Path:   path,
+			Getenv: getenvFrom(map[string]string{"LINK_CACHE_SIZE": "many"}),
+		}
+
+		_, err := loader.Load()
+		for _, expected := range []error{ErrConfigUnknownSetting, ErrConfigNotScalar, ErrConfigNotInteger} {
+			if !errors.Is(err, expected) {
+				t.Errorf("Received %s, expected %s", err, expected)
+			}
+		}
+	})
+
+	t.Run("returns booleans read from the file, then flags", func(t *testing.T) {
+		var config struct {
+			Enabled  bool `config:"enabled"`
+			Disabled bool `config:"disabled" default:"true"`
+		}
+		path := writeConfigFile(t, "config.yaml", "enabled: true\n")
+
+		err := loadConfig(&config, path, getenvFrom(nil), map[string]string{"disabled": "false"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !config.Enabled || config.Disabled {
+			t.Errorf("Received %+v, expected enabled and not disabled", config)
+		}
+
+		err = loadConfig(&config, "", getenvFrom(map[string]string{"ENABLED": "sometimes"}), nil)
+		if !errors.Is(err, ErrConfigNotBoolean) {
+			t.Errorf("Received %s, expected %s", err, ErrConfigNotBoolean)
+		}
+	})
+
+	t.Run("returns error when the file is neither YAML nor TOML", func(t *testing.T) {
+		path := writeConfigFile(t, "config.json", "{}")
+
+		_, err := ConfigLoader{Path: path, Getenv: getenvFrom(required)}.Load()
+		if !errors.Is(err, ErrConfigFileFormat) {
+			t.Errorf("Received %s, expected %s", err, ErrConfigFileFormat)
+		}
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Run("returns nil when every setting is valid", func(t *testing.T) {
+		if err := testConfig().Validate(); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+
+	t.Run("returns every invalid setting at once", func(t *testing.T) {
+		config := testConfig()
+		config.LinkStore = LinkStorePostgres
+		config.KgsUrl = ""
+		config.MaxShortUrlPathLength = 4
+		config.RateLimits = "redirect"
+
+		err := config.Validate()
+		expected := "postgres_connection_string: not set\n" +
+			"keygensvc_url: not set\n" +
+			"maximum_short_url_path_length: out of range\n" +
+			"rate_limits: could not parse rate limits"
+		if err == nil || err.Error() != expected {
+			t.Errorf("Received %v, expected %s", err, expected)
+		}
+	})
+}
+
+func TestNewConfigLoader(t *testing.T) {
+	t.Run("returns only settings given as flags", func(t *testing.T) {
+		flags := flag.NewFlagSet("urlshortenapp", flag.ContinueOnError)
+		loader := NewConfigLoader(flags, Config{})
+		if err := flags.Parse([]string{"-config", "config.yaml", "-link-cache-size", "0", "index"}); err != nil {
+			t.Fatal(err)
+		}
+
+		received := loader()
+		if received.Path != "config.yaml" {
+			t.Errorf("Received %s, expected %s", received.Path, "config.yaml")
+		}
+		if len(received.Flags) != 1 || received.Flags["link_cache_size"] != "0" {
+			t.Errorf("Received %v, expected %v", received.Flags, map[string]string{"link_cache_size": "0"})
+		}
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	originalConfig := App.Config()
+	defer App.config.Store(originalConfig)
+	defer func(original ConfigLoader) { App.ConfigLoader = original }(App.ConfigLoader)
+	defer func(original *RateLimiter) { App.RateLimiter = original }(App.RateLimiter)
+	defer App.LogLevel.Set(App.LogLevel.Level())
+
+	reloadWith := func(settings map[string]string) error {
+		env := map[string]string{
+			"ELASTICSEARCH_ADDRESSES":       originalConfig.EsAddresses,
+			"ELASTICSEARCH_INDEX":           originalConfig.EsIndex,
+			"INIT_MAXIMUM_ATTEMPTS":         "1",
+			"KEYGENSVC_URL":                 originalConfig.KgsUrl,
+			"INTERNAL_SHORT_HOST":           originalConfig.InternalShortHost,
+			"MINIMUM_SHORT_URL_PATH_LENGTH": "6",
+			"MAXIMUM_SHORT_URL_PATH_LENGTH": "12",
+		}
+		for key, value := range settings {
+			env[key] = value
+		}
+		App.ConfigLoader = ConfigLoader{Getenv: getenvFrom(env)}
+		return App.ReloadConfig()
+	}
+
+	t.Run("applies reloadable settings and keeps the rest until restarted", func(t *testing.T) {
+		App.config.Store(originalConfig)
+		App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), DefaultRateLimits)
+
+		err := reloadWith(map[string]string{
+			"LOG_LEVEL":                     "debug",
+			"MINIMUM_SHORT_URL_PATH_LENGTH": "8",
+			"RATE_LIMITS":                   "redirect.ip=50/100",
+			"KEYGENSVC_URL":                 "http://keygensvc:5000",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if App.Config().MinShortUrlPathLength != 8 {
+			t.Errorf("Received %d, expected %d", App.Config().MinShortUrlPathLength, 8)
+		}
+		if App.Config().KgsUrl != originalConfig.KgsUrl {
+			t.Errorf("Received %s, expected %s", App.Config().KgsUrl, originalConfig.KgsUrl)
+		}
+		if App.LogLevel.Level() != slog.LevelDebug {
+			t.Errorf("Received %s, expected %s", App.LogLevel.Level(), slog.LevelDebug)
+		}
+		expected := RateLimit{Rate: 50, Burst: 100}
+		if received := App.RateLimiter.limits["redirect"].PerIp; received != expected {
+			t.Errorf("Received %v, expected %v", received, expected)
+		}
+	})
+
+	t.Run("returns error and keeps config when a setting is invalid", func(t *testing.T) {
+		App.config.Store(originalConfig)
+
+		err := reloadWith(map[string]string{"MINIMUM_SHORT_URL_PATH_LENGTH": "20"})
+		if !errors.Is(err, ErrConfigOutOfRange) {
+			t.Errorf("Received %s, expected %s", err, ErrConfigOutOfRange)
+		}
+		if App.Config() != originalConfig {
+			t.Errorf("Received %v, expected %v", App.Config(), originalConfig)
+		}
+	})
+}
@@ -3,68 +3,251 @@ package main
 // Generic module for REST interaction with Elasticsearch
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"github.com/elastic/go-elasticsearch/esapi"
 	es "github.com/elastic/go-elasticsearch/v7"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
 	"strings"
+	"time"
 )
 
 type EsService interface {
-	PrintInfo() error
-	RefreshIndices(indices []string) error
-	IndexDocument(index string, document Document) (string, error)
-	GetDocumentById(index string, id string) (Document, error)
+	PrintInfo(ctx context.Context) error
+	ClusterHealth(ctx context.Context) (string, error)
+	DeleteIndices(ctx context.Context, indices []string) error
+	CreateIndex(ctx context.Context, index string, body json.RawMessage) error
+	ResolveIndex(ctx context.Context, name string) ([]string, bool, error)
+	UpdateAliases(ctx context.Context, actions []AliasAction) error
+	Reindex(ctx context.Context, sourceIndex string, destIndex string) (int, error)
+	CountDocuments(ctx context.Context, index string) (int, error)
+	CreateSnapshot(ctx context.Context, repository string, snapshot string, indices []string) error
+	IndexDocument(ctx context.Context, index string, document Document) (string, error)
+	GetDocumentById(ctx context.Context, index string, id string) (Document, error)
+	DeleteDocument(ctx context.Context, index string, id string) error
+	BulkIndexDocuments(ctx context.Context, index string, documents []Document) error
+	UpdateDocumentWithScript(ctx context.Context, index string, id string, script string, params map[string]interface{}) (string, error)
+	Search(ctx context.Context, index string, query json.RawMessage) (SearchResult, error)
+	ScrollDocuments(ctx context.Context, index string, query json.RawMessage, handlePage func([]Document) error) error
 }
 
 type esService struct {
 	EsClient *es.Client
 	EsApi EsApi
+	// Per operation, cut short by any earlier deadline of the caller. Zero
+	// leaves operations to the caller's deadline alone.
+	Timeout time.Duration
 }
 
 type EsApi interface {
-	Info(s *esService) (*esapi.Response, error)
-	IndicesDelete(s *esService, indices []string) (*esapi.Response, error)
-	IndicesCreate(s *esService, index string) (*esapi.Response, error)
-	Index(s *esService, index string, json io.Reader, id string) (*esapi.Response, error)
-	Get(s *esService, index string, id string) (*esapi.Response, error)
+	Info(ctx context.Context, s *esService) (*esapi.Response, error)
+	ClusterHealth(ctx context.Context, s *esService) (*esapi.Response, error)
+	IndicesDelete(ctx context.Context, s *esService, indices []string) (*esapi.Response, error)
+	IndicesCreate(ctx context.Context, s *esService, index string, body io.Reader) (*esapi.Response, error)
+	IndicesExists(ctx context.Context, s *esService, index string) (*esapi.Response, error)
+	IndicesGetAlias(ctx context.Context, s *esService, alias string) (*esapi.Response, error)
+	IndicesUpdateAliases(ctx context.Context, s *esService, json io.Reader) (*esapi.Response, error)
+	Reindex(ctx context.Context, s *esService, json io.Reader) (*esapi.Response, error)
+	Count(ctx context.Context, s *esService, index string) (*esapi.Response, error)
+	SnapshotCreate(ctx context.Context, s *esService, repository string, snapshot string, json io.Reader) (*esapi.Response, error)
+	Index(ctx context.Context, s *esService, index string, json io.Reader, id string, ifSeqNo *int, ifPrimaryTerm *int) (*esapi.Response, error)
+	Get(ctx context.Context, s *esService, index string, id string) (*esapi.Response, error)
+	Delete(ctx context.Context, s *esService, index string, id string) (*esapi.Response, error)
+	Bulk(ctx context.Context, s *esService, index string, ndjson io.Reader) (*esapi.Response, error)
+	Update(ctx context.Context, s *esService, index string, id string, json io.Reader) (*esapi.Response, error)
+	Search(ctx context.Context, s *esService, index string, json io.Reader) (*esapi.Response, error)
+	SearchWithScroll(ctx context.Context, s *esService, index string, json io.Reader, keepAlive time.Duration) (*esapi.Response, error)
+	Scroll(ctx context.Context, s *esService, json io.Reader) (*esapi.Response, error)
+	ClearScroll(ctx context.Context, s *esService, scrollId string) (*esapi.Response, error)
 }
 
 type esApi struct {}
 
-func (_ *esApi) Info(s *esService) (*esapi.Response, error) {
-	res, err := esapi.InfoRequest{}.Do(context.Background(), s.EsClient)
+func (_ *esApi) Info(ctx context.Context, s *esService) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Info", s, esapi.InfoRequest{})
 	return res, err
 }
 
-func (_ *esApi) IndicesDelete(s *esService, indices []string) (*esapi.Response, error) {
-	res, err := esapi.IndicesDeleteRequest{Index: indices}.Do(context.Background(), s.EsClient)
+func (_ *esApi) ClusterHealth(ctx context.Context, s *esService) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "ClusterHealth", s, esapi.ClusterHealthRequest{})
 	return res, err
 }
 
-func (_ *esApi) IndicesCreate(s *esService, index string) (*esapi.Response, error) {
-	res, err := esapi.IndicesCreateRequest{Index: index}.Do(context.Background(), s.EsClient)
+func (_ *esApi) IndicesDelete(ctx context.Context, s *esService, indices []string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "IndicesDelete", s, esapi.IndicesDeleteRequest{Index: indices})
 	return res, err
 }
 
-func (_ *esApi) Index(s *esService, index string, json io.Reader, id string) (*esapi.Response, error) {
-	res, err := esapi.IndexRequest{
+func (_ *esApi) IndicesCreate(ctx context.Context, s *esService, index string, body io.Reader) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "IndicesCreate", s, esapi.IndicesCreateRequest{Index: index, Body: body})
+	return res, err
+}
+
+func (_ *esApi) IndicesExists(ctx context.Context, s *esService, index string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "IndicesExists", s, esapi.IndicesExistsRequest{Index: []string{index}})
+	return res, err
+}
+
+func (_ *esApi) IndicesGetAlias(ctx context.Context, s *esService, alias string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "IndicesGetAlias", s, esapi.IndicesGetAliasRequest{Name: []string{alias}})
+	return res, err
+}
+
+func (_ *esApi) IndicesUpdateAliases(ctx context.Context, s *esService, json io.Reader) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "IndicesUpdateAliases", s, esapi.IndicesUpdateAliasesRequest{Body: json})
+	return res, err
+}
+
+// Waits for the copy to finish, which for large indices can take a while
+func (_ *esApi) Reindex(ctx context.Context, s *esService, json io.Reader) (*esapi.Response, error) {
+	waitForCompletion := true
+	refresh := true
+	res, err := doEsRequest(ctx, "Reindex", s, esapi.ReindexRequest{
+		Body: json,
+		WaitForCompletion: &waitForCompletion,
+		Refresh: &refresh,
+	})
+	return res, err
+}
+
+func (_ *esApi) Count(ctx context.Context, s *esService, index string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Count", s, esapi.CountRequest{Index: []string{index}})
+	return res, err
+}
+
+func (_ *esApi) SnapshotCreate(
+	ctx context.Context,
+	s *esService, repository string, snapshot string, json io.Reader,
+) (*esapi.Response, error) {
+	waitForCompletion := true
+	res, err := doEsRequest(ctx, "SnapshotCreate", s, esapi.SnapshotCreateRequest{
+		Repository: repository,
+		Snapshot: snapshot,
+		Body: json,
+		WaitForCompletion: &waitForCompletion,
+	})
+	return res, err
+}
+
+func (_ *esApi) Index(
+	ctx context.Context,
+	s *esService, index string, json io.Reader, id string, ifSeqNo *int, ifPrimaryTerm *int,
+) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Index", s, esapi.IndexRequest{
 		Index: index,
 		Body: json,
 		DocumentID: id,
+		IfSeqNo: ifSeqNo,
+		IfPrimaryTerm: ifPrimaryTerm,
+		Refresh: "true",
+	})
+	return res, err
+}
+
+func (_ *esApi) Get(ctx context.Context, s *esService, index string, id string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Get", s, esapi.GetRequest{
+		Index: index,
+		DocumentID: id,
+	})
+	return res, err
+}
+
+func (_ *esApi) Delete(ctx context.Context, s *esService, index string, id string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Delete", s, esapi.DeleteRequest{
+		Index: index,
+		DocumentID: id,
 		Refresh: "true",
-	}.Do(context.Background(), s.EsClient)
+	})
+	return res, err
+}
+
+func (_ *esApi) Bulk(ctx context.Context, s *esService, index string, ndjson io.Reader) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Bulk", s, esapi.BulkRequest{
+		Index: index,
+		Body: ndjson,
+	})
 	return res, err
 }
 
-func (_ *esApi) Get(s *esService, index string, id string) (*esapi.Response, error) {
-	res, err := esapi.GetRequest{
+func (_ *esApi) Update(ctx context.Context, s *esService, index string, id string, json io.Reader) (*esapi.Response, error) {
+	retryOnConflict := 3
+	res, err := doEsRequest(ctx, "Update", s, esapi.UpdateRequest{
 		Index: index,
 		DocumentID: id,
-	}.Do(context.Background(), s.EsClient)
+		Body: json,
+		RetryOnConflict: &retryOnConflict,
+	})
+	return res, err
+}
+
+func (_ *esApi) Search(ctx context.Context, s *esService, index string, json io.Reader) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Search", s, esapi.SearchRequest{
+		Index: []string{index},
+		Body: json,
+	})
+	return res, err
+}
+
+// This version of esapi multiplies Scroll by a millisecond when encoding it
+func (_ *esApi) SearchWithScroll(
+	ctx context.Context,
+	s *esService, index string, json io.Reader, keepAlive time.Duration,
+) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "SearchWithScroll", s, esapi.SearchRequest{
+		Index: []string{index},
+		Body: json,
+		Scroll: keepAlive / time.Millisecond,
+	})
+	return res, err
+}
+
+func (_ *esApi) Scroll(ctx context.Context, s *esService, json io.Reader) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "Scroll", s, esapi.ScrollRequest{Body: json})
+	return res, err
+}
+
+func (_ *esApi) ClearScroll(ctx context.Context, s *esService, scrollId string) (*esapi.Response, error) {
+	res, err := doEsRequest(ctx, "ClearScroll", s, esapi.ClearScrollRequest{ScrollID: []string{scrollId}})
+	return res, err
+}
+
+// Operations that wait for completion, which for large indices can take far
+// longer than any timeout fit for a request
+var esLongRunningOperations = map[string]bool{"Reindex": true, "SnapshotCreate": true}
+
+// Every request is timed and traced, labelled with the EsApi method making it.
+// Retries are made by the client, so are part of the same span.
+func doEsRequest(ctx context.Context, method string, s *esService, request esapi.Request) (*esapi.Response, error) {
+	ctx, span := startClientSpan(
+		ctx, "Elasticsearch "+method, semconv.DBSystemElasticsearch, semconv.DBOperationName(method),
+	)
+	if s.Timeout > 0 && !esLongRunningOperations[method] {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	startTime := time.Now()
+	res, err := request.Do(ctx, s.EsClient)
+	if err == nil {
+		// Read the body before the timeout cancels it
+		var body []byte
+		body, err = io.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	observeEsRequest(method, startTime, res, err)
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+	endClientSpan(span, statusCode, err)
 	return res, err
 }
 
@@ -79,19 +262,88 @@ var (
 	ErrEsCouldNotDeleteIndices    = errors.New("elasticsearch could not delete indices")
 	ErrEsCouldNotCreateIndex      = errors.New("elasticsearch could not create Index")
 	ErrEsDoesNotContainDocument   = errors.New("elasticsearch does not contain document")
+	ErrEsCouldNotDeleteDocument   = errors.New("elasticsearch could not delete document")
+	ErrEsCouldNotIndexDocument    = errors.New("elasticsearch could not index document")
+	ErrEsCouldNotIndexAllDocuments = errors.New("elasticsearch could not index all documents")
+	ErrEsDocumentVersionConflict  = errors.New("elasticsearch document was changed concurrently")
+	ErrEsCouldNotSearch           = errors.New("elasticsearch could not search")
+	ErrEsCouldNotResolveIndex     = errors.New("elasticsearch could not resolve index")
+	ErrEsCouldNotUpdateAliases    = errors.New("elasticsearch could not update aliases")
+	ErrEsCouldNotReindex          = errors.New("elasticsearch could not reindex")
+	ErrEsCouldNotCountDocuments   = errors.New("elasticsearch could not count documents")
+	ErrEsCouldNotCreateSnapshot   = errors.New("elasticsearch could not create snapshot")
+	ErrEsCouldNotScroll           = errors.New("elasticsearch could not scroll")
+	ErrEsCouldNotGetClusterHealth = errors.New("elasticsearch could not get cluster health")
+	ErrEsClusterHealthRed         = errors.New("elasticsearch cluster health is red")
 )
 
+// SeqNo and PrimaryTerm are set on retrieved documents. Indexing a document
+// that has them only succeeds if it has not changed since it was retrieved.
 type Document struct {
-	Id      string
-	Content json.RawMessage
+	Id          string
+	Content     json.RawMessage
+	SeqNo       *int
+	PrimaryTerm *int
 }
 
-func NewEsService(esAddresses []string, esApi EsApi) (EsService, error) {
-	esClient, clientErr := es.NewClient(es.Config{Addresses: esAddresses})
+const (
+	EsRetryBaseDelay = 100 * time.Millisecond
+	EsRetryMaxDelay  = 5 * time.Second
+)
+
+// Only rejections Elasticsearch made before doing anything are retried, so
+// that writes are never applied twice
+var esRetryOnStatus = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+
+// The client also retries requests that failed on the connection, whatever
+// their method. Writes may have been applied by then, a scripted click
+// increment among them, so their errors are hidden from it unless they
+// never reached Elasticsearch.
+type esWriteTransport struct {
+	http.RoundTripper
+}
+
+type esWriteError struct {
+	error
+}
+
+func (e esWriteError) Unwrap() error {
+	return e.error
+}
+
+func (t esWriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	httpResponse, err := t.RoundTripper.RoundTrip(r)
+	if err == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return httpResponse, err
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return httpResponse, err
+	}
+	return httpResponse, esWriteError{err}
+}
+
+type EsServiceOptions struct {
+	Timeout    time.Duration
+	MaxRetries int
+}
+
+func NewEsService(esAddresses []string, esApi EsApi, options EsServiceOptions) (EsService, error) {
+	esClient, clientErr := es.NewClient(es.Config{
+		Addresses:     esAddresses,
+		Transport:     esWriteTransport{http.DefaultTransport},
+		RetryOnStatus: esRetryOnStatus,
+		DisableRetry:  options.MaxRetries == 0,
+		MaxRetries:    options.MaxRetries,
+		RetryBackoff: func(attempt int) time.Duration {
+			esRetriesTotal.Inc()
+			return jitteredBackoff(attempt-1, EsRetryBaseDelay, EsRetryMaxDelay)
+		},
+	})
 	if clientErr != nil {
 		return nil, ErrEsClientNotInstantiated
 	}
-	return &esService{EsClient: esClient, EsApi: esApi}, nil
+	return &esService{EsClient: esClient, EsApi: esApi, Timeout: options.Timeout}, nil
 }
 
 type infoResponseJson struct {
@@ -100,14 +352,18 @@ type infoResponseJson struct {
 	} `json:"version"`
 }
 
-func (s *esService) PrintInfo() error {
+func (s *esService) PrintInfo(ctx context.Context) error {
 	// Make Info request
-	httpResponse, err := s.EsApi.Info(s)
+	httpResponse, err := s.EsApi.Info(ctx, s)
 	if err != nil {
-		log.Printf("Error printing info: %s", err)
+		slog.Error("Error printing info", "error", err)
 		return ErrEsCouldNotFulfillRequest
 	}
 	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error("Could not get info", "status", httpResponse.StatusCode)
+		return ErrEsCouldNotFulfillRequest
+	}
 
 	// Parse response
 	var responseJson infoResponseJson
@@ -116,62 +372,297 @@ func (s *esService) PrintInfo() error {
 		&responseJson,
 	)
 	if jsonErr != nil {
-		log.Printf("Error parsing the info response body: %s", jsonErr)
+		slog.Error("Error parsing the info response body", "error", jsonErr)
 		return ErrCouldNotParseResponseJson_
 	}
 
 	// Print version info
-	log.Print("Successfully connected to Elasticsearch cluster")
-	log.Printf("Client: %s", es.Version)
-	log.Printf("Server: %s", responseJson.Version.Number)
+	slog.Info("Successfully connected to Elasticsearch cluster")
+	slog.Info("Elasticsearch versions", "client", es.Version, "server", responseJson.Version.Number)
 
 	return nil
 }
 
-func (s *esService) RefreshIndices(indices []string) error {
+type clusterHealthResponseJson struct {
+	Status string `json:"status"`
+}
+
+// Returns the health colour of the cluster, which is red when some primary
+// shards are unassigned and reads or writes to them fail
+func (s *esService) ClusterHealth(ctx context.Context) (string, error) {
+	// Make ClusterHealth request
+	httpResponse, err := s.EsApi.ClusterHealth(ctx, s)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting cluster health", "error", err)
+		return "", ErrEsCouldNotGetClusterHealth
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "Could not get cluster health", "status", httpResponse.StatusCode)
+		return "", ErrEsCouldNotGetClusterHealth
+	}
+
+	// Parse response
+	var responseJson clusterHealthResponseJson
+	jsonErr := json.Unmarshal(parseRawJsonFromHttpBody(httpResponse.Body), &responseJson)
+	if jsonErr != nil {
+		slog.ErrorContext(ctx, "Error parsing the cluster health response body", "error", jsonErr)
+		return "", ErrCouldNotParseResponseJson_
+	}
+	if responseJson.Status == "red" {
+		return responseJson.Status, ErrEsClusterHealthRed
+	}
+
+	return responseJson.Status, nil
+}
+
+func (s *esService) DeleteIndices(ctx context.Context, indices []string) error {
 	// Make IndicesDelete request
-	_, indicesDeleteErr := s.EsApi.IndicesDelete(s, indices)
-	if indicesDeleteErr != nil {
-		log.Printf("Error deleting indices: %s", indicesDeleteErr)
+	httpResponse, err := s.EsApi.IndicesDelete(ctx, s, indices)
+	if err != nil {
+		slog.Error("Error deleting indices", "error", err)
 		return ErrEsCouldNotDeleteIndices
 	}
-	log.Printf("Deleted indices: [%s]", strings.Join(indices, ", "))
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices && httpResponse.StatusCode != http.StatusNotFound {
+		slog.Error("Could not delete indices", "status", httpResponse.StatusCode, "indices", indices)
+		return ErrEsCouldNotDeleteIndices
+	}
+	slog.Info("Deleted indices", "indices", indices)
+
+	return nil
+}
+
+// The body holds the index settings and mappings. Elasticsearch defaults
+// are used when it is nil.
+func (s *esService) CreateIndex(ctx context.Context, index string, body json.RawMessage) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = strings.NewReader(string(body))
+	}
 
-	// Make IndicesCreate requests
-	for _, index := range indices {
-		_, indicesCreateError := s.EsApi.IndicesCreate(s, index)
-		if indicesCreateError != nil {
-			log.Printf("Error creating index %s: %s", index, indicesCreateError)
-			return ErrEsCouldNotCreateIndex
+	// Make IndicesCreate request
+	httpResponse, err := s.EsApi.IndicesCreate(ctx, s, index, bodyReader)
+	if err != nil {
+		slog.Error("Error creating index", "index", index, "error", err)
+		return ErrEsCouldNotCreateIndex
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error(
+			"Could not create index",
+			"status", httpResponse.StatusCode, "index", index, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return ErrEsCouldNotCreateIndex
+	}
+	slog.Info("Created index", "index", index)
+
+	return nil
+}
+
+// Returns the concrete indices a name refers to, and whether it is an alias.
+// Returns no indices when nothing by that name exists.
+func (s *esService) ResolveIndex(ctx context.Context, name string) ([]string, bool, error) {
+	// Make IndicesGetAlias request
+	aliasResponse, err := s.EsApi.IndicesGetAlias(ctx, s, name)
+	if err != nil {
+		slog.Error("Error getting alias", "name", name, "error", err)
+		return nil, false, ErrEsCouldNotResolveIndex
+	}
+	defer aliasResponse.Body.Close()
+
+	// Return indices behind alias
+	if aliasResponse.StatusCode == http.StatusOK {
+		var responseJson map[string]json.RawMessage
+		jsonErr := json.Unmarshal(parseRawJsonFromHttpBody(aliasResponse.Body), &responseJson)
+		if jsonErr != nil {
+			slog.Error("Error parsing the get alias response body", "error", jsonErr)
+			return nil, false, ErrCouldNotParseResponseJson_
+		}
+		var indices []string
+		for index := range responseJson {
+			indices = append(indices, index)
 		}
-		log.Printf("Created index: %s", index)
+		sort.Strings(indices)
+		return indices, true, nil
+	}
+	if aliasResponse.StatusCode != http.StatusNotFound {
+		slog.Error("Could not get alias", "status", aliasResponse.StatusCode, "name", name)
+		return nil, false, ErrEsCouldNotResolveIndex
+	}
+
+	// Make IndicesExists request, for indices created before aliases
+	existsResponse, err := s.EsApi.IndicesExists(ctx, s, name)
+	if err != nil {
+		slog.Error("Error checking index exists", "name", name, "error", err)
+		return nil, false, ErrEsCouldNotResolveIndex
+	}
+	defer existsResponse.Body.Close()
+	switch existsResponse.StatusCode {
+	case http.StatusOK:
+		return []string{name}, false, nil
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		slog.Error("Could not check index exists", "status", existsResponse.StatusCode, "name", name)
+		return nil, false, ErrEsCouldNotResolveIndex
+	}
+}
+
+type aliasActionTarget struct {
+	Index string `json:"index"`
+	Alias string `json:"alias,omitempty"`
+}
+
+// One of add, remove or remove_index. Actions sent together are applied
+// atomically, so readers never see an alias missing or doubled.
+type AliasAction struct {
+	Add         *aliasActionTarget `json:"add,omitempty"`
+	Remove      *aliasActionTarget `json:"remove,omitempty"`
+	RemoveIndex *aliasActionTarget `json:"remove_index,omitempty"`
+}
+
+func AddAlias(index string, alias string) AliasAction {
+	return AliasAction{Add: &aliasActionTarget{Index: index, Alias: alias}}
+}
+
+func RemoveAlias(index string, alias string) AliasAction {
+	return AliasAction{Remove: &aliasActionTarget{Index: index, Alias: alias}}
+}
+
+func RemoveIndex(index string) AliasAction {
+	return AliasAction{RemoveIndex: &aliasActionTarget{Index: index}}
+}
+
+func (s *esService) UpdateAliases(ctx context.Context, actions []AliasAction) error {
+	// Encode update aliases request
+	encodedJson, _ := json.Marshal(map[string][]AliasAction{"actions": actions})
+
+	// Make IndicesUpdateAliases request
+	httpResponse, err := s.EsApi.IndicesUpdateAliases(ctx, s, strings.NewReader(string(encodedJson)))
+	if err != nil {
+		slog.Error("Error updating aliases", "error", err)
+		return ErrEsCouldNotUpdateAliases
 	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error(
+			"Could not update aliases",
+			"status", httpResponse.StatusCode, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return ErrEsCouldNotUpdateAliases
+	}
+	slog.Info("Updated aliases", "status", httpResponse.StatusCode, "actions", actions)
 
 	return nil
 }
 
+type reindexResponseJson struct {
+	Total            int               `json:"total"`
+	Created          int               `json:"created"`
+	Updated          int               `json:"updated"`
+	VersionConflicts int               `json:"version_conflicts"`
+	Failures         []json.RawMessage `json:"failures"`
+}
+
+// Copies documents keeping their versions, so documents already in the
+// destination are only overwritten by newer ones. Running it again copies
+// what changed in the source since. Returns how many documents were written.
+func (s *esService) Reindex(ctx context.Context, sourceIndex string, destIndex string) (int, error) {
+	// Encode reindex request
+	var requestJson struct {
+		Conflicts string `json:"conflicts"`
+		Source    struct {
+			Index string `json:"index"`
+		} `json:"source"`
+		Dest struct {
+			Index       string `json:"index"`
+			VersionType string `json:"version_type"`
+		} `json:"dest"`
+	}
+	requestJson.Conflicts = "proceed"
+	requestJson.Source.Index = sourceIndex
+	requestJson.Dest.Index = destIndex
+	requestJson.Dest.VersionType = "external"
+	encodedJson, _ := json.Marshal(requestJson)
+
+	// Make Reindex request
+	httpResponse, err := s.EsApi.Reindex(ctx, s, strings.NewReader(string(encodedJson)))
+	if err != nil {
+		slog.Error("Error reindexing", "source_index", sourceIndex, "dest_index", destIndex, "error", err)
+		return 0, ErrEsCouldNotReindex
+	}
+	defer httpResponse.Body.Close()
+
+	// Parse response
+	rawJson := parseRawJsonFromHttpBody(httpResponse.Body)
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error(
+			"Could not reindex",
+			"status", httpResponse.StatusCode, "source_index", sourceIndex, "dest_index", destIndex, "response", string(rawJson),
+		)
+		return 0, ErrEsCouldNotReindex
+	}
+	var responseJson reindexResponseJson
+	if jsonErr := json.Unmarshal(rawJson, &responseJson); jsonErr != nil {
+		slog.Error("Error parsing the reindex response body", "error", jsonErr)
+		return 0, ErrCouldNotParseResponseJson_
+	}
+	if len(responseJson.Failures) > 0 {
+		slog.Error(
+			"Reindexing failed for some documents",
+			"status", httpResponse.StatusCode, "source_index", sourceIndex, "dest_index", destIndex,
+			"failed", len(responseJson.Failures), "first_failure", responseJson.Failures[0],
+		)
+		return 0, ErrEsCouldNotReindex
+	}
+
+	slog.Info(
+		"Reindexed",
+		"status", httpResponse.StatusCode, "source_index", sourceIndex, "dest_index", destIndex,
+		"created", responseJson.Created, "updated", responseJson.Updated, "already_newer", responseJson.VersionConflicts,
+	)
+	return responseJson.Created + responseJson.Updated, nil
+}
+
 type indexResponseJson struct {
 	Result  string `json:"result"`
 	Id      string `json:"_id"`
 	Version int    `json:"_version"`
 }
 
-func (s *esService) IndexDocument(index string, document Document) (string, error) {
+func (s *esService) IndexDocument(ctx context.Context, index string, document Document) (string, error) {
 	// Encode document content and construct Index request
 	encodedContent, _ := document.Content.MarshalJSON()
 
 	// Make Index request
 	httpResponse, err := s.EsApi.Index(
-		s, index, strings.NewReader(string(encodedContent)), document.Id,
+		ctx, s,
+		index,
+		strings.NewReader(string(encodedContent)),
+		document.Id,
+		document.SeqNo,
+		document.PrimaryTerm,
 	)
 	if err != nil {
-		log.Printf(
-			"Error indexing document for id %s: %s", document.Id, err,
-		)
+		slog.Error("Error indexing document", "id", document.Id, "error", err)
 		return "", ErrEsCouldNotFulfillRequest
 	}
 	defer httpResponse.Body.Close()
-	log.Print("Received response from Elasticsearch for index request")
+	slog.Debug("Received response from Elasticsearch for index request")
+
+	// Handle document changed since it was retrieved
+	if httpResponse.StatusCode == http.StatusConflict {
+		slog.Warn("Version conflict indexing document", "status", httpResponse.StatusCode, "id", document.Id)
+		return "", ErrEsDocumentVersionConflict
+	}
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.ErrorContext(
+			ctx, "Could not index document",
+			"status", httpResponse.StatusCode, "id", document.Id, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return "", ErrEsCouldNotIndexDocument
+	}
 
 	// Parse response
 	var responseJson indexResponseJson
@@ -180,38 +671,47 @@ func (s *esService) IndexDocument(index string, document Document) (string, erro
 		&responseJson,
 	)
 	if jsonErr != nil {
-		log.Printf("Error parsing the index response body: %s", jsonErr)
+		slog.Error("Error parsing the index response body", "error", jsonErr)
 		return "", ErrCouldNotParseResponseJson_
 	}
-	log.Print("No errors in response to index request")
+	slog.Debug("No errors in response to index request")
 
 	// Return document Id
-	log.Printf(
-		"[%d] Response for index request parsed: %s; id=%s version=%d",
-		httpResponse.StatusCode,
-		responseJson.Result,
-		responseJson.Id,
-		responseJson.Version,
+	slog.Debug(
+		"Response for index request parsed",
+		"status", httpResponse.StatusCode, "result", responseJson.Result, "id", responseJson.Id, "version", responseJson.Version,
 	)
 	return responseJson.Id, nil
 }
 
 type getResponseJson struct {
-	Found   bool   			`json:"found"`
-	Id      string 			`json:"_id"`
-	Version int   			`json:"_version"`
-	Source  json.RawMessage `json:"_source"`
+	Found       bool   			`json:"found"`
+	Id          string 			`json:"_id"`
+	Version     int   			`json:"_version"`
+	SeqNo       *int            `json:"_seq_no"`
+	PrimaryTerm *int            `json:"_primary_term"`
+	Source      json.RawMessage `json:"_source"`
 }
 
-func (s *esService) GetDocumentById(index string, id string) (Document, error) {
+func (s *esService) GetDocumentById(ctx context.Context, index string, id string) (Document, error) {
 	// Make Get request
-	httpResponse, err := s.EsApi.Get(s, index, id)
+	httpResponse, err := s.EsApi.Get(ctx, s, index, id)
 	if err != nil {
-		log.Printf("Error in get response: %s", err)
+		slog.Error("Error in get response", "error", err)
 		return Document{}, ErrEsCouldNotFulfillRequest
 	}
 	defer httpResponse.Body.Close()
-	log.Print("No errors in response to get request")
+
+	// Handle failures, which are not the same as a missing document. Missing
+	// documents are 404 Not Found with found set to false.
+	if httpResponse.StatusCode >= http.StatusMultipleChoices && httpResponse.StatusCode != http.StatusNotFound {
+		slog.ErrorContext(
+			ctx, "Could not get document",
+			"status", httpResponse.StatusCode, "id", id, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return Document{}, ErrEsCouldNotFulfillRequest
+	}
+	slog.Debug("No errors in response to get request")
 
 	// Parse response
 	var responseJson getResponseJson
@@ -220,25 +720,427 @@ func (s *esService) GetDocumentById(index string, id string) (Document, error) {
 		&responseJson,
 	)
 	if jsonErr != nil {
-		log.Printf("Error parsing the get response body: %s", jsonErr)
+		slog.Error("Error parsing the get response body", "error", jsonErr)
 		return Document{}, ErrCouldNotParseResponseJson_
 	}
-	log.Printf("[%d] Response to get request parsed", httpResponse.StatusCode)
+	slog.Debug("Response to get request parsed", "status", httpResponse.StatusCode)
 
 	// Handle document not found
 	if !responseJson.Found {
-		log.Printf(
-			"[%d] Document not found for id %s", httpResponse.StatusCode, id,
-		)
+		slog.Debug("Document not found", "status", httpResponse.StatusCode, "id", id)
 		return Document{}, ErrEsDoesNotContainDocument
 	}
 
 	// Return document
-	log.Printf(
-		"[%d] Retrieved document for id %s", httpResponse.StatusCode, id,
-	)
+	slog.Debug("Retrieved document", "status", httpResponse.StatusCode, "id", id)
 	return Document{
-		Id:      responseJson.Id,
-		Content: responseJson.Source,
+		Id:          responseJson.Id,
+		Content:     responseJson.Source,
+		SeqNo:       responseJson.SeqNo,
+		PrimaryTerm: responseJson.PrimaryTerm,
 	}, nil
 }
+
+func (s *esService) DeleteDocument(ctx context.Context, index string, id string) error {
+	// Make Delete request
+	httpResponse, err := s.EsApi.Delete(ctx, s, index, id)
+	if err != nil {
+		slog.Error("Error deleting document", "id", id, "error", err)
+		return ErrEsCouldNotFulfillRequest
+	}
+	defer httpResponse.Body.Close()
+
+	// Handle document not found
+	if httpResponse.StatusCode == http.StatusNotFound {
+		slog.Debug("Document not found", "status", httpResponse.StatusCode, "id", id)
+		return ErrEsDoesNotContainDocument
+	}
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error("Could not delete document", "status", httpResponse.StatusCode, "id", id)
+		return ErrEsCouldNotDeleteDocument
+	}
+	slog.Info("Deleted document", "status", httpResponse.StatusCode, "id", id)
+
+	return nil
+}
+
+type bulkResponseJson struct {
+	Errors bool `json:"errors"`
+	Items  []struct {
+		Index struct {
+			Id     string `json:"_id"`
+			Status int    `json:"status"`
+		} `json:"index"`
+	} `json:"items"`
+}
+
+func (s *esService) BulkIndexDocuments(ctx context.Context, index string, documents []Document) error {
+	// Encode documents as newline-delimited action and source pairs
+	var body strings.Builder
+	for _, document := range documents {
+		action := map[string]map[string]string{"index": {}}
+		if document.Id != "" {
+			action["index"]["_id"] = document.Id
+		}
+		encodedAction, _ := json.Marshal(action)
+		encodedContent, _ := document.Content.MarshalJSON()
+		body.Write(encodedAction)
+		body.WriteString("\n")
+		body.Write(encodedContent)
+		body.WriteString("\n")
+	}
+
+	// Make Bulk request
+	httpResponse, err := s.EsApi.Bulk(ctx, s, index, strings.NewReader(body.String()))
+	if err != nil {
+		slog.Error("Error bulk indexing documents", "count", len(documents), "error", err)
+		return ErrEsCouldNotFulfillRequest
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.ErrorContext(
+			ctx, "Could not bulk index documents",
+			"status", httpResponse.StatusCode, "count", len(documents), "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return ErrEsCouldNotIndexAllDocuments
+	}
+
+	// Parse response
+	var responseJson bulkResponseJson
+	jsonErr := json.Unmarshal(
+		parseRawJsonFromHttpBody(httpResponse.Body),
+		&responseJson,
+	)
+	if jsonErr != nil {
+		slog.Error("Error parsing the bulk response body", "error", jsonErr)
+		return ErrCouldNotParseResponseJson_
+	}
+
+	// Report documents that were not indexed
+	if responseJson.Errors {
+		failed := 0
+		for _, item := range responseJson.Items {
+			if item.Index.Status >= 300 {
+				failed++
+			}
+		}
+		slog.Error("Bulk request failed for some documents", "status", httpResponse.StatusCode, "failed", failed, "count", len(documents))
+		return ErrEsCouldNotIndexAllDocuments
+	}
+
+	slog.Info("Bulk indexed documents", "status", httpResponse.StatusCode, "count", len(documents))
+	return nil
+}
+
+type updateRequestJson struct {
+	Script struct {
+		Source string                 `json:"source"`
+		Lang   string                 `json:"lang"`
+		Params map[string]interface{} `json:"params,omitempty"`
+	} `json:"script"`
+}
+
+type updateResponseJson struct {
+	Result string `json:"result"`
+	Id     string `json:"_id"`
+}
+
+// UpdateDocumentWithScript runs a painless script against a document in
+// place, which Elasticsearch applies atomically. Returns the update result,
+// "updated" or "noop" when the script sets ctx.op to noop.
+func (s *esService) UpdateDocumentWithScript(
+	ctx context.Context,
+	index string, id string, script string, params map[string]interface{},
+) (string, error) {
+	// Encode update request
+	var requestJson updateRequestJson
+	requestJson.Script.Source = script
+	requestJson.Script.Lang = "painless"
+	requestJson.Script.Params = params
+	encodedJson, _ := json.Marshal(requestJson)
+
+	// Make Update request
+	httpResponse, err := s.EsApi.Update(ctx, s, index, id, strings.NewReader(string(encodedJson)))
+	if err != nil {
+		slog.Error("Error updating document", "id", id, "error", err)
+		return "", ErrEsCouldNotFulfillRequest
+	}
+	defer httpResponse.Body.Close()
+
+	// Handle document not found
+	if httpResponse.StatusCode == http.StatusNotFound {
+		slog.Debug("Document not found", "status", httpResponse.StatusCode, "id", id)
+		return "", ErrEsDoesNotContainDocument
+	}
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.ErrorContext(
+			ctx, "Could not update document",
+			"status", httpResponse.StatusCode, "id", id, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return "", ErrEsCouldNotFulfillRequest
+	}
+
+	// Parse response
+	var responseJson updateResponseJson
+	jsonErr := json.Unmarshal(
+		parseRawJsonFromHttpBody(httpResponse.Body),
+		&responseJson,
+	)
+	if jsonErr != nil {
+		slog.Error("Error parsing the update response body", "error", jsonErr)
+		return "", ErrCouldNotParseResponseJson_
+	}
+	if responseJson.Result == "" {
+		slog.Warn("Update was not applied", "status", httpResponse.StatusCode, "id", id)
+		return "", ErrEsCouldNotFulfillRequest
+	}
+
+	slog.Debug("Updated document", "status", httpResponse.StatusCode, "id", id, "result", responseJson.Result)
+	return responseJson.Result, nil
+}
+
+type searchResponseJson struct {
+	Hits struct {
+		Total struct {
+			Value int `json:"value"`
+		} `json:"total"`
+		Hits []struct {
+			Id     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+			Sort   json.RawMessage `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Sort values of the last hit are kept as returned, so they can be passed
+// back as search_after without losing precision
+type SearchResult struct {
+	Total     int
+	Documents []Document
+	LastSort  json.RawMessage
+}
+
+func (s *esService) Search(ctx context.Context, index string, query json.RawMessage) (SearchResult, error) {
+	// Make Search request
+	httpResponse, err := s.EsApi.Search(ctx, s, index, strings.NewReader(string(query)))
+	if err != nil {
+		slog.Error("Error searching index", "index", index, "error", err)
+		return SearchResult{}, ErrEsCouldNotFulfillRequest
+	}
+	defer httpResponse.Body.Close()
+
+	// Handle rejected queries and missing indices
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error(
+			"Search of index failed",
+			"status", httpResponse.StatusCode, "index", index, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)),
+		)
+		return SearchResult{}, ErrEsCouldNotSearch
+	}
+
+	// Parse response
+	var responseJson searchResponseJson
+	jsonErr := json.Unmarshal(
+		parseRawJsonFromHttpBody(httpResponse.Body),
+		&responseJson,
+	)
+	if jsonErr != nil {
+		slog.Error("Error parsing the search response body", "error", jsonErr)
+		return SearchResult{}, ErrCouldNotParseResponseJson_
+	}
+
+	// Return matching documents
+	result := SearchResult{Total: responseJson.Hits.Total.Value}
+	for _, hit := range responseJson.Hits.Hits {
+		result.Documents = append(result.Documents, Document{Id: hit.Id, Content: hit.Source})
+		result.LastSort = hit.Sort
+	}
+	slog.Debug(
+		"Search of index returned documents",
+		"status", httpResponse.StatusCode, "index", index, "count", len(result.Documents), "total", result.Total,
+	)
+	return result, nil
+}
+
+type countResponseJson struct {
+	Count int `json:"count"`
+}
+
+func (s *esService) CountDocuments(ctx context.Context, index string) (int, error) {
+	// Make Count request
+	httpResponse, err := s.EsApi.Count(ctx, s, index)
+	if err != nil {
+		slog.Error("Error counting documents", "index", index, "error", err)
+		return 0, ErrEsCouldNotCountDocuments
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error("Could not count documents", "status", httpResponse.StatusCode, "index", index)
+		return 0, ErrEsCouldNotCountDocuments
+	}
+
+	// Parse response
+	var responseJson countResponseJson
+	jsonErr := json.Unmarshal(
+		parseRawJsonFromHttpBody(httpResponse.Body),
+		&responseJson,
+	)
+	if jsonErr != nil {
+		slog.Error("Error parsing the count response body", "error", jsonErr)
+		return 0, ErrCouldNotParseResponseJson_
+	}
+
+	return responseJson.Count, nil
+}
+
+type snapshotResponseJson struct {
+	Snapshot struct {
+		State  string `json:"state"`
+		Shards struct {
+			Failed int `json:"failed"`
+		} `json:"shards"`
+	} `json:"snapshot"`
+}
+
+// Waits for the snapshot to finish. The repository must already be
+// registered with the cluster.
+func (s *esService) CreateSnapshot(ctx context.Context, repository string, snapshot string, indices []string) error {
+	// Encode snapshot request
+	encodedJson, _ := json.Marshal(map[string]interface{}{
+		"indices":              strings.Join(indices, ","),
+		"include_global_state": false,
+	})
+
+	// Make SnapshotCreate request
+	httpResponse, err := s.EsApi.SnapshotCreate(ctx, s, repository, snapshot, strings.NewReader(string(encodedJson)))
+	if err != nil {
+		slog.Error("Error creating snapshot", "snapshot", snapshot, "repository", repository, "error", err)
+		return ErrEsCouldNotCreateSnapshot
+	}
+	defer httpResponse.Body.Close()
+
+	// Parse response
+	rawJson := parseRawJsonFromHttpBody(httpResponse.Body)
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error(
+			"Could not create snapshot",
+			"status", httpResponse.StatusCode, "snapshot", snapshot, "repository", repository, "response", string(rawJson),
+		)
+		return ErrEsCouldNotCreateSnapshot
+	}
+	var responseJson snapshotResponseJson
+	if jsonErr := json.Unmarshal(rawJson, &responseJson); jsonErr != nil {
+		slog.Error("Error parsing the snapshot response body", "error", jsonErr)
+		return ErrCouldNotParseResponseJson_
+	}
+	if responseJson.Snapshot.State != "SUCCESS" {
+		slog.Error(
+			"Snapshot ended with failed shards",
+			"status", httpResponse.StatusCode, "snapshot", snapshot, "repository", repository,
+			"state", responseJson.Snapshot.State, "failed_shards", responseJson.Snapshot.Shards.Failed,
+		)
+		return ErrEsCouldNotCreateSnapshot
+	}
+
+	slog.Info("Created snapshot", "status", httpResponse.StatusCode, "snapshot", snapshot, "repository", repository)
+	return nil
+}
+
+// How long Elasticsearch keeps a scroll open between pages. Kept under a
+// minute, as longer durations format as units Elasticsearch cannot parse.
+const esScrollKeepAlive = 30 * time.Second
+
+type scrollResponseJson struct {
+	ScrollId string `json:"_scroll_id"`
+	searchResponseJson
+}
+
+func (s *esService) parseScrollResponse(httpResponse *esapi.Response) (scrollResponseJson, error) {
+	defer httpResponse.Body.Close()
+
+	// Handle rejected queries, missing indices and expired scrolls
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		slog.Error("Scroll failed", "status", httpResponse.StatusCode, "response", string(parseRawJsonFromHttpBody(httpResponse.Body)))
+		return scrollResponseJson{}, ErrEsCouldNotScroll
+	}
+
+	// Parse response
+	var responseJson scrollResponseJson
+	jsonErr := json.Unmarshal(
+		parseRawJsonFromHttpBody(httpResponse.Body),
+		&responseJson,
+	)
+	if jsonErr != nil {
+		slog.Error("Error parsing the scroll response body", "error", jsonErr)
+		return scrollResponseJson{}, ErrCouldNotParseResponseJson_
+	}
+	return responseJson, nil
+}
+
+// Walks every document matching the query, handing over one page at a time.
+// The query sets the page size; sorting on _doc is the cheapest order. The
+// scroll sees the index as it was when the walk started.
+func (s *esService) ScrollDocuments(
+	ctx context.Context,
+	index string, query json.RawMessage, handlePage func([]Document) error,
+) error {
+	// Make initial Search request, opening the scroll
+	httpResponse, err := s.EsApi.SearchWithScroll(ctx, s, index, strings.NewReader(string(query)), esScrollKeepAlive)
+	if err != nil {
+		slog.Error("Error opening scroll", "index", index, "error", err)
+		return ErrEsCouldNotFulfillRequest
+	}
+	responseJson, parseErr := s.parseScrollResponse(httpResponse)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	// Release the scroll however the walk ends, rather than waiting for it to expire
+	defer func() {
+		if responseJson.ScrollId == "" {
+			return
+		}
+		clearResponse, clearErr := s.EsApi.ClearScroll(ctx, s, responseJson.ScrollId)
+		if clearErr != nil {
+			slog.Error("Error clearing scroll", "index", index, "error", clearErr)
+			return
+		}
+		clearResponse.Body.Close()
+	}()
+
+	pages, total := 0, 0
+	for len(responseJson.Hits.Hits) > 0 {
+		// Hand over page
+		var documents []Document
+		for _, hit := range responseJson.Hits.Hits {
+			documents = append(documents, Document{Id: hit.Id, Content: hit.Source})
+		}
+		if handleErr := handlePage(documents); handleErr != nil {
+			return handleErr
+		}
+		pages++
+		total += len(documents)
+
+		// Make Scroll request for the next page
+		scrollJson, _ := json.Marshal(map[string]string{
+			"scroll":    esScrollKeepAlive.String(),
+			"scroll_id": responseJson.ScrollId,
+		})
+		httpResponse, err = s.EsApi.Scroll(ctx, s, strings.NewReader(string(scrollJson)))
+		if err != nil {
+			slog.Error("Error scrolling index", "index", index, "error", err)
+			return ErrEsCouldNotFulfillRequest
+		}
+		nextJson, nextErr := s.parseScrollResponse(httpResponse)
+		if nextErr != nil {
+			return nextErr
+		}
+		if nextJson.ScrollId != "" {
+			responseJson.ScrollId = nextJson.ScrollId
+		}
+		responseJson.Hits = nextJson.Hits
+	}
+
+	slog.Info("Scrolled documents", "count", total, "pages", pages, "index", index)
+	return nil
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/elastic/go-elasticsearch/esapi"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type MockEsApi struct {
@@ -16,26 +20,82 @@ type MockEsApi struct {
 	bodies      []io.ReadCloser
 }
 
-func (m MockEsApi) Info(_ *esService) (*esapi.Response, error) {
+func (m MockEsApi) Info(_ context.Context, _ *esService) (*esapi.Response, error) {
 	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
 }
 
-func (m MockEsApi) IndicesDelete(_ *esService, _ []string) (*esapi.Response, error) {
+func (m MockEsApi) ClusterHealth(_ context.Context, _ *esService) (*esapi.Response, error) {
 	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
 }
 
-func (m MockEsApi) IndicesCreate(_ *esService, _ string) (*esapi.Response, error) {
+func (m MockEsApi) IndicesDelete(_ context.Context, _ *esService, _ []string) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) IndicesCreate(_ context.Context, _ *esService, _ string, _ io.Reader) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[1], Body: m.bodies[1]}, m.errors[1]
+}
+
+func (m MockEsApi) IndicesExists(_ context.Context, _ *esService, _ string) (*esapi.Response, error) {
 	return &esapi.Response{StatusCode: m.statusCodes[1], Body: m.bodies[1]}, m.errors[1]
 }
 
-func (m MockEsApi) Index(_ *esService, _ string, _ io.Reader, _ string) (*esapi.Response, error) {
+func (m MockEsApi) IndicesGetAlias(_ context.Context, _ *esService, _ string) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) IndicesUpdateAliases(_ context.Context, _ *esService, _ io.Reader) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Reindex(_ context.Context, _ *esService, _ io.Reader) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Count(_ context.Context, _ *esService, _ string) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) SnapshotCreate(_ context.Context, _ *esService, _ string, _ string, _ io.Reader) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Index(_ context.Context, _ *esService, _ string, _ io.Reader, _ string, _ *int, _ *int) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Get(_ context.Context, _ *esService, _ string, _ string) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Delete(_ context.Context, _ *esService, _ string, _ string) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Bulk(_ context.Context, _ *esService, _ string, _ io.Reader) (*esapi.Response, error) {
 	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
 }
 
-func (m MockEsApi) Get(_ *esService, _ string, _ string) (*esapi.Response, error) {
+func (m MockEsApi) Search(_ context.Context, _ *esService, _ string, _ io.Reader) (*esapi.Response, error) {
 	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
 }
 
+func (m MockEsApi) Update(_ context.Context, _ *esService, _ string, _ string, _ io.Reader) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) SearchWithScroll(_ context.Context, _ *esService, _ string, _ io.Reader, _ time.Duration) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[0], Body: m.bodies[0]}, m.errors[0]
+}
+
+func (m MockEsApi) Scroll(_ context.Context, _ *esService, _ io.Reader) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[1], Body: m.bodies[1]}, m.errors[1]
+}
+
+func (m MockEsApi) ClearScroll(_ context.Context, _ *esService, _ string) (*esapi.Response, error) {
+	return &esapi.Response{StatusCode: m.statusCodes[2], Body: m.bodies[2]}, m.errors[2]
+}
+
 func TestEsService_PrintInfo(t *testing.T) {
 	t.Run("returns error when ES API Info call fails", func(t *testing.T) {
 		mockEsApi := MockEsApi{
@@ -43,8 +103,8 @@ func TestEsService_PrintInfo(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
 			errors:      []error{errors.New("failed")},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		infoErr := esSvc.PrintInfo()
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		infoErr := esSvc.PrintInfo(context.Background())
 		if infoErr != ErrEsCouldNotFulfillRequest {
 			t.Errorf("Received %s, expected %s", infoErr, ErrEsCouldNotFulfillRequest)
 		}
@@ -55,8 +115,8 @@ func TestEsService_PrintInfo(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("{]"))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		infoErr := esSvc.PrintInfo()
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		infoErr := esSvc.PrintInfo(context.Background())
 		if infoErr != ErrCouldNotParseResponseJson_ {
 			t.Errorf("Received %s, expected %s", infoErr, ErrCouldNotParseResponseJson_)
 		}
@@ -67,49 +127,233 @@ func TestEsService_PrintInfo(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"version": {"number": "123"}}`))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		infoErr := esSvc.PrintInfo()
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		infoErr := esSvc.PrintInfo(context.Background())
 		if infoErr != nil {
 			t.Errorf("Received %s, expected nil", infoErr)
 		}
 	})
 }
 
-func TestEsService_RefreshIndices(t *testing.T) {
+func TestEsService_ClusterHealth(t *testing.T) {
+	t.Run("returns error when ES API ClusterHealth call fails", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{0},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
+			errors:      []error{errors.New("failed")},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, healthErr := esSvc.ClusterHealth(context.Background())
+		if healthErr != ErrEsCouldNotGetClusterHealth {
+			t.Errorf("Received %s, expected %s", healthErr, ErrEsCouldNotGetClusterHealth)
+		}
+	})
+	t.Run("returns error when cluster health is red", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{200},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"status": "red"}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		colour, healthErr := esSvc.ClusterHealth(context.Background())
+		if healthErr != ErrEsClusterHealthRed {
+			t.Errorf("Received %s, expected %s", healthErr, ErrEsClusterHealthRed)
+		}
+		if colour != "red" {
+			t.Errorf("Received %s, expected %s", colour, "red")
+		}
+	})
+	t.Run("returns colour when successful", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{200},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"status": "yellow"}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		colour, healthErr := esSvc.ClusterHealth(context.Background())
+		if healthErr != nil {
+			t.Errorf("Received %s, expected nil", healthErr)
+		}
+		if colour != "yellow" {
+			t.Errorf("Received %s, expected %s", colour, "yellow")
+		}
+	})
+}
+
+func TestEsService_DeleteIndices(t *testing.T) {
 	t.Run("returns error when ES API IndicesDelete call fails", func(t *testing.T) {
 		mockEsApi := MockEsApi{
-			statusCodes: []int{0, 0},
-			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("")), io.NopCloser(strings.NewReader(""))},
-			errors:      []error{errors.New("failed"), nil},
+			statusCodes: []int{0},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
+			errors:      []error{errors.New("failed")},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		refreshErr := esSvc.RefreshIndices([]string{"some-index"})
-		if refreshErr != ErrEsCouldNotDeleteIndices {
-			t.Errorf("Received %s, expected %s", refreshErr, ErrEsCouldNotDeleteIndices)
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		deleteErr := esSvc.DeleteIndices(context.Background(), []string{"some-index"})
+		if deleteErr != ErrEsCouldNotDeleteIndices {
+			t.Errorf("Received %s, expected %s", deleteErr, ErrEsCouldNotDeleteIndices)
+		}
+	})
+	t.Run("returns nil when indices are deleted or missing", func(t *testing.T) {
+		for _, statusCode := range []int{http.StatusOK, http.StatusNotFound} {
+			mockEsApi := MockEsApi{
+				statusCodes: []int{statusCode},
+				bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
+				errors:      []error{nil},
+			}
+			esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+			deleteErr := esSvc.DeleteIndices(context.Background(), []string{"some-index"})
+			if deleteErr != nil {
+				t.Errorf("Received %s, expected nil", deleteErr)
+			}
 		}
 	})
+}
+
+func TestEsService_CreateIndex(t *testing.T) {
 	t.Run("returns error when ES API IndicesCreate call fails", func(t *testing.T) {
 		mockEsApi := MockEsApi{
 			statusCodes: []int{0, 0},
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("")), io.NopCloser(strings.NewReader(""))},
 			errors:      []error{nil, errors.New("failed")},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		refreshErr := esSvc.RefreshIndices([]string{"some-index"})
-		if refreshErr != ErrEsCouldNotCreateIndex {
-			t.Errorf("Received %s, expected %s", refreshErr, ErrEsCouldNotCreateIndex)
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		createErr := esSvc.CreateIndex(context.Background(), "some-index", nil)
+		if createErr != ErrEsCouldNotCreateIndex {
+			t.Errorf("Received %s, expected %s", createErr, ErrEsCouldNotCreateIndex)
+		}
+	})
+	t.Run("returns error when index already exists", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{0, http.StatusBadRequest},
+			bodies: []io.ReadCloser{
+				io.NopCloser(strings.NewReader("")),
+				io.NopCloser(strings.NewReader(`{"error": {"type": "resource_already_exists_exception"}}`)),
+			},
+			errors: []error{nil, nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		createErr := esSvc.CreateIndex(context.Background(), "some-index", json.RawMessage(`{}`))
+		if createErr != ErrEsCouldNotCreateIndex {
+			t.Errorf("Received %s, expected %s", createErr, ErrEsCouldNotCreateIndex)
 		}
 	})
 	t.Run("returns nil when successful", func(t *testing.T) {
 		mockEsApi := MockEsApi{
-			statusCodes: []int{0, 0},
+			statusCodes: []int{0, http.StatusOK},
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("")), io.NopCloser(strings.NewReader(""))},
 			errors:      []error{nil, nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		refreshErr := esSvc.RefreshIndices([]string{"some-index"})
-		if refreshErr != nil {
-			t.Errorf("Received %s, expected nil", refreshErr)
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		createErr := esSvc.CreateIndex(context.Background(), "some-index", json.RawMessage(`{}`))
+		if createErr != nil {
+			t.Errorf("Received %s, expected nil", createErr)
+		}
+	})
+}
+
+func TestEsService_ResolveIndex(t *testing.T) {
+	t.Run("returns indices behind alias", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK, 0},
+			bodies: []io.ReadCloser{
+				io.NopCloser(strings.NewReader(`{"urlstore_v3": {"aliases": {"urlstore": {}}}, "urlstore_v2": {"aliases": {"urlstore": {}}}}`)),
+				io.NopCloser(strings.NewReader("")),
+			},
+			errors: []error{nil, nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		indices, isAlias, err := esSvc.ResolveIndex(context.Background(), "urlstore")
+		if err != nil || !isAlias || strings.Join(indices, ",") != "urlstore_v2,urlstore_v3" {
+			t.Errorf("Received %v and %t, expected %v and %t", indices, isAlias, []string{"urlstore_v2", "urlstore_v3"}, true)
+		}
+	})
+	t.Run("returns index created before aliases", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound, http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{}`)), io.NopCloser(strings.NewReader(""))},
+			errors:      []error{nil, nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		indices, isAlias, err := esSvc.ResolveIndex(context.Background(), "urlstore")
+		if err != nil || isAlias || len(indices) != 1 || indices[0] != "urlstore" {
+			t.Errorf("Received %v and %t, expected %v and %t", indices, isAlias, []string{"urlstore"}, false)
+		}
+	})
+	t.Run("returns no indices when nothing exists", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound, http.StatusNotFound},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{}`)), io.NopCloser(strings.NewReader(""))},
+			errors:      []error{nil, nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		indices, _, err := esSvc.ResolveIndex(context.Background(), "urlstore")
+		if err != nil || len(indices) != 0 {
+			t.Errorf("Received %v and %s, expected no indices", indices, err)
+		}
+	})
+	t.Run("returns error when ES API IndicesGetAlias call fails", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{0, 0},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("")), io.NopCloser(strings.NewReader(""))},
+			errors:      []error{errors.New("failed"), nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, _, err := esSvc.ResolveIndex(context.Background(), "urlstore")
+		if err != ErrEsCouldNotResolveIndex {
+			t.Errorf("Received %s, expected %s", err, ErrEsCouldNotResolveIndex)
+		}
+	})
+}
+
+func TestEsService_UpdateAliases(t *testing.T) {
+	t.Run("returns error when actions are rejected", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "index_not_found_exception"}}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		aliasErr := esSvc.UpdateAliases(context.Background(), []AliasAction{AddAlias("urlstore_v2", "urlstore")})
+		if aliasErr != ErrEsCouldNotUpdateAliases {
+			t.Errorf("Received %s, expected %s", aliasErr, ErrEsCouldNotUpdateAliases)
+		}
+	})
+	t.Run("encodes actions", func(t *testing.T) {
+		encodedJson, _ := json.Marshal([]AliasAction{RemoveIndex("urlstore"), AddAlias("urlstore_v2", "urlstore")})
+		expected := `[{"remove_index":{"index":"urlstore"}},{"add":{"index":"urlstore_v2","alias":"urlstore"}}]`
+		if string(encodedJson) != expected {
+			t.Errorf("Received %s, expected %s", encodedJson, expected)
+		}
+	})
+}
+
+func TestEsService_Reindex(t *testing.T) {
+	t.Run("returns error when some documents fail", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies: []io.ReadCloser{io.NopCloser(strings.NewReader(
+				`{"total": 2, "created": 1, "failures": [{"cause": {"type": "mapper_parsing_exception"}}]}`,
+			))},
+			errors: []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, reindexErr := esSvc.Reindex(context.Background(), "urlstore", "urlstore_v2")
+		if reindexErr != ErrEsCouldNotReindex {
+			t.Errorf("Received %s, expected %s", reindexErr, ErrEsCouldNotReindex)
+		}
+	})
+	t.Run("returns count of written documents, skipping newer ones", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies: []io.ReadCloser{io.NopCloser(strings.NewReader(
+				`{"total": 5, "created": 2, "updated": 1, "version_conflicts": 2, "failures": []}`,
+			))},
+			errors: []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		copied, reindexErr := esSvc.Reindex(context.Background(), "urlstore", "urlstore_v2")
+		if reindexErr != nil || copied != 3 {
+			t.Errorf("Received %d and %s, expected %d and nil", copied, reindexErr, 3)
 		}
 	})
 }
@@ -121,8 +365,8 @@ func TestEsService_IndexDocument(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
 			errors:      []error{errors.New("failed")},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		_, indexErr := esSvc.IndexDocument("some-index", Document{Id: "123", Content: json.RawMessage("{}")})
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, indexErr := esSvc.IndexDocument(context.Background(), "some-index", Document{Id: "123", Content: json.RawMessage("{}")})
 		if indexErr != ErrEsCouldNotFulfillRequest {
 			t.Errorf("Received %s, expected %s", indexErr, ErrEsCouldNotFulfillRequest)
 		}
@@ -133,12 +377,40 @@ func TestEsService_IndexDocument(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("{]"))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		_, indexErr := esSvc.IndexDocument("some-index", Document{Id: "123", Content: json.RawMessage("{}")})
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, indexErr := esSvc.IndexDocument(context.Background(), "some-index", Document{Id: "123", Content: json.RawMessage("{}")})
 		if indexErr != ErrCouldNotParseResponseJson_ {
 			t.Errorf("Received %s, expected %s", indexErr, ErrCouldNotParseResponseJson_)
 		}
 	})
+	t.Run("returns error when document changed since it was retrieved", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusConflict},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"status": 409}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		seqNo, primaryTerm := 4, 1
+		_, indexErr := esSvc.IndexDocument(context.Background(), "some-index", Document{Id: "123", Content: json.RawMessage("{}"), SeqNo: &seqNo, PrimaryTerm: &primaryTerm})
+		if indexErr != ErrEsDocumentVersionConflict {
+			t.Errorf("Received %s, expected %s", indexErr, ErrEsDocumentVersionConflict)
+		}
+	})
+	t.Run("returns error when response is not 2xx", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusBadRequest},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "mapper_parsing_exception"}, "status": 400}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		id, indexErr := esSvc.IndexDocument(context.Background(), "some-index", Document{Id: "123", Content: json.RawMessage("{}")})
+		if indexErr != ErrEsCouldNotIndexDocument {
+			t.Errorf("Received %s, expected %s", indexErr, ErrEsCouldNotIndexDocument)
+		}
+		if id != "" {
+			t.Errorf("Received %s, expected empty id", id)
+		}
+	})
 	t.Run("returns id when successful", func(t *testing.T) {
 		resJson := `{"result": "created", "_id": "123", "_version": 1}`
 		mockEsApi := MockEsApi{
@@ -146,8 +418,8 @@ func TestEsService_IndexDocument(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(resJson))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		id, indexErr := esSvc.IndexDocument("some-index", Document{Id: "123", Content: json.RawMessage("{}")})
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		id, indexErr := esSvc.IndexDocument(context.Background(), "some-index", Document{Id: "123", Content: json.RawMessage("{}")})
 		if indexErr != nil {
 			t.Errorf("Received %s, expected %s", indexErr, ErrCouldNotParseResponseJson_)
 		}
@@ -164,8 +436,8 @@ func TestEsService_GetDocumentById(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
 			errors:      []error{errors.New("failed")},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		_, getErr := esSvc.GetDocumentById("some-index", "123")
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, getErr := esSvc.GetDocumentById(context.Background(), "some-index", "123")
 		if getErr != ErrEsCouldNotFulfillRequest {
 			t.Errorf("Received %s, expected %s", getErr, ErrEsCouldNotFulfillRequest)
 		}
@@ -176,8 +448,8 @@ func TestEsService_GetDocumentById(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("{]"))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		_, getErr := esSvc.GetDocumentById("some-index", "123")
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, getErr := esSvc.GetDocumentById(context.Background(), "some-index", "123")
 		if getErr != ErrCouldNotParseResponseJson_ {
 			t.Errorf("Received %s, expected %s", getErr, ErrCouldNotParseResponseJson_)
 		}
@@ -189,12 +461,24 @@ func TestEsService_GetDocumentById(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(resJson))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		_, getErr := esSvc.GetDocumentById("some-index", "123")
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, getErr := esSvc.GetDocumentById(context.Background(), "some-index", "123")
 		if getErr != ErrEsDoesNotContainDocument {
 			t.Errorf("Received %s, expected %s", getErr, ErrEsDoesNotContainDocument)
 		}
 	})
+	t.Run("returns error when response is not 2xx or 404", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusServiceUnavailable},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "no_shard_available_action_exception"}, "status": 503}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, getErr := esSvc.GetDocumentById(context.Background(), "some-index", "123")
+		if getErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", getErr, ErrEsCouldNotFulfillRequest)
+		}
+	})
 	t.Run("returns document when document is found", func(t *testing.T) {
 		resJson := `{"found": true, "_id": "123", "_version": 1, "_source": "{}"}`
 		mockEsApi := MockEsApi{
@@ -202,8 +486,8 @@ func TestEsService_GetDocumentById(t *testing.T) {
 			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(resJson))},
 			errors:      []error{nil},
 		}
-		esSvc, _ := NewEsService([]string{}, mockEsApi)
-		doc, getErr := esSvc.GetDocumentById("some-index", "123")
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		doc, getErr := esSvc.GetDocumentById(context.Background(), "some-index", "123")
 		if getErr != nil {
 			t.Errorf("Received %s, expected nil", getErr)
 		}
@@ -212,3 +496,425 @@ func TestEsService_GetDocumentById(t *testing.T) {
 		}
 	})
 }
+
+func TestEsService_DeleteDocument(t *testing.T) {
+	t.Run("returns error when document is not found", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"result": "not_found"}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		if deleteErr := esSvc.DeleteDocument(context.Background(), "some-index", "123"); deleteErr != ErrEsDoesNotContainDocument {
+			t.Errorf("Received %s, expected %s", deleteErr, ErrEsDoesNotContainDocument)
+		}
+	})
+	t.Run("returns error when delete is rejected", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusForbidden},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader("{}"))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		if deleteErr := esSvc.DeleteDocument(context.Background(), "some-index", "123"); deleteErr != ErrEsCouldNotDeleteDocument {
+			t.Errorf("Received %s, expected %s", deleteErr, ErrEsCouldNotDeleteDocument)
+		}
+	})
+	t.Run("returns nil when document is deleted", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"result": "deleted"}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		if deleteErr := esSvc.DeleteDocument(context.Background(), "some-index", "123"); deleteErr != nil {
+			t.Errorf("Received %s, expected nil", deleteErr)
+		}
+	})
+}
+
+func TestEsService_BulkIndexDocuments(t *testing.T) {
+	documents := []Document{{Id: "", Content: json.RawMessage("{}")}, {Id: "123", Content: json.RawMessage("{}")}}
+	t.Run("returns error when ES API Bulk call fails", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{0},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
+			errors:      []error{errors.New("failed")},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		bulkErr := esSvc.BulkIndexDocuments(context.Background(), "some-index", documents)
+		if bulkErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", bulkErr, ErrEsCouldNotFulfillRequest)
+		}
+	})
+	t.Run("returns error when some documents are not indexed", func(t *testing.T) {
+		resJson := `{"errors": true, "items": [{"index": {"status": 201}}, {"index": {"status": 400}}]}`
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(resJson))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		bulkErr := esSvc.BulkIndexDocuments(context.Background(), "some-index", documents)
+		if bulkErr != ErrEsCouldNotIndexAllDocuments {
+			t.Errorf("Received %s, expected %s", bulkErr, ErrEsCouldNotIndexAllDocuments)
+		}
+	})
+	t.Run("returns error when response is not 2xx", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusTooManyRequests},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "es_rejected_execution_exception"}, "status": 429}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		bulkErr := esSvc.BulkIndexDocuments(context.Background(), "some-index", documents)
+		if bulkErr != ErrEsCouldNotIndexAllDocuments {
+			t.Errorf("Received %s, expected %s", bulkErr, ErrEsCouldNotIndexAllDocuments)
+		}
+	})
+	t.Run("returns nil when successful", func(t *testing.T) {
+		resJson := `{"errors": false, "items": [{"index": {"status": 201}}, {"index": {"status": 201}}]}`
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(resJson))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		bulkErr := esSvc.BulkIndexDocuments(context.Background(), "some-index", documents)
+		if bulkErr != nil {
+			t.Errorf("Received %s, expected nil", bulkErr)
+		}
+	})
+}
+
+func TestEsService_UpdateDocumentWithScript(t *testing.T) {
+	t.Run("returns error when ES API Update call fails", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{0},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
+			errors:      []error{errors.New("failed")},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, updateErr := esSvc.UpdateDocumentWithScript(context.Background(), "some-index", "123", "ctx.op = 'noop'", nil)
+		if updateErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", updateErr, ErrEsCouldNotFulfillRequest)
+		}
+	})
+	t.Run("returns error when document is not found", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"status": 404}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, updateErr := esSvc.UpdateDocumentWithScript(context.Background(), "some-index", "123", "ctx.op = 'noop'", nil)
+		if updateErr != ErrEsDoesNotContainDocument {
+			t.Errorf("Received %s, expected %s", updateErr, ErrEsDoesNotContainDocument)
+		}
+	})
+	t.Run("returns error when response is not 2xx", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusConflict},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "version_conflict_engine_exception"}, "status": 409}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, updateErr := esSvc.UpdateDocumentWithScript(context.Background(), "some-index", "123", "ctx.op = 'noop'", nil)
+		if updateErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", updateErr, ErrEsCouldNotFulfillRequest)
+		}
+	})
+	t.Run("returns result when successful", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"result": "noop", "_id": "123"}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		result, updateErr := esSvc.UpdateDocumentWithScript(context.Background(), "some-index", "123", "ctx.op = 'noop'", nil)
+		if updateErr != nil {
+			t.Errorf("Received %s, expected nil", updateErr)
+		}
+		if result != "noop" {
+			t.Errorf("Received %s, expected %s", result, "noop")
+		}
+	})
+}
+
+func TestEsService_Search(t *testing.T) {
+	t.Run("returns error when ES API Search call fails", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{0},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(""))},
+			errors:      []error{errors.New("failed")},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, searchErr := esSvc.Search(context.Background(), "some-index", json.RawMessage(`{}`))
+		if searchErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", searchErr, ErrEsCouldNotFulfillRequest)
+		}
+	})
+	t.Run("returns error when query is rejected", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusBadRequest},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "parsing_exception"}}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, searchErr := esSvc.Search(context.Background(), "some-index", json.RawMessage(`{}`))
+		if searchErr != ErrEsCouldNotSearch {
+			t.Errorf("Received %s, expected %s", searchErr, ErrEsCouldNotSearch)
+		}
+	})
+	t.Run("returns documents and sort values of the last hit", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies: []io.ReadCloser{io.NopCloser(strings.NewReader(`{"hits": {"total": {"value": 3}, "hits": [
+				{"_id": "1", "_source": {"short_url": "http://shrt.url/a"}, "sort": [1633046400000, "http://shrt.url/a"]},
+				{"_id": "2", "_source": {"short_url": "http://shrt.url/b"}, "sort": [-9223372036854775808, "http://shrt.url/b"]}
+			]}}`))},
+			errors: []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		result, searchErr := esSvc.Search(context.Background(), "some-index", json.RawMessage(`{}`))
+		if searchErr != nil {
+			t.Fatal(searchErr)
+		}
+		if result.Total != 3 || len(result.Documents) != 2 || result.Documents[1].Id != "2" {
+			t.Errorf("Received %d documents of %d, expected %d of %d", len(result.Documents), result.Total, 2, 3)
+		}
+		expected := `[-9223372036854775808, "http://shrt.url/b"]`
+		if string(result.LastSort) != expected {
+			t.Errorf("Received %s, expected %s", result.LastSort, expected)
+		}
+	})
+}
+
+func TestEsService_CountDocuments(t *testing.T) {
+	t.Run("returns error when index is missing", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		_, countErr := esSvc.CountDocuments(context.Background(), "some-index")
+		if countErr != ErrEsCouldNotCountDocuments {
+			t.Errorf("Received %s, expected %s", countErr, ErrEsCouldNotCountDocuments)
+		}
+	})
+	t.Run("returns count when successful", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"count": 42}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		count, countErr := esSvc.CountDocuments(context.Background(), "some-index")
+		if countErr != nil || count != 42 {
+			t.Errorf("Received %d and %s, expected %d and nil", count, countErr, 42)
+		}
+	})
+}
+
+func TestEsService_CreateSnapshot(t *testing.T) {
+	t.Run("returns error when snapshot is partial", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"snapshot": {"state": "PARTIAL", "shards": {"failed": 1}}}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		snapshotErr := esSvc.CreateSnapshot(context.Background(), "backups", "nightly", []string{"urlstore_v2"})
+		if snapshotErr != ErrEsCouldNotCreateSnapshot {
+			t.Errorf("Received %s, expected %s", snapshotErr, ErrEsCouldNotCreateSnapshot)
+		}
+	})
+	t.Run("returns error when repository is missing", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusNotFound},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"error": {"type": "repository_missing_exception"}}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		snapshotErr := esSvc.CreateSnapshot(context.Background(), "backups", "nightly", []string{"urlstore_v2"})
+		if snapshotErr != ErrEsCouldNotCreateSnapshot {
+			t.Errorf("Received %s, expected %s", snapshotErr, ErrEsCouldNotCreateSnapshot)
+		}
+	})
+	t.Run("returns nil when successful", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{"snapshot": {"state": "SUCCESS", "shards": {"failed": 0}}}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		snapshotErr := esSvc.CreateSnapshot(context.Background(), "backups", "nightly", []string{"urlstore_v2"})
+		if snapshotErr != nil {
+			t.Errorf("Received %s, expected nil", snapshotErr)
+		}
+	})
+}
+
+func TestEsService_ScrollDocuments(t *testing.T) {
+	t.Run("returns error when search is rejected", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusBadRequest},
+			bodies:      []io.ReadCloser{io.NopCloser(strings.NewReader(`{}`))},
+			errors:      []error{nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		scrollErr := esSvc.ScrollDocuments(context.Background(), "some-index", json.RawMessage(`{}`), func(_ []Document) error { return nil })
+		if scrollErr != ErrEsCouldNotScroll {
+			t.Errorf("Received %s, expected %s", scrollErr, ErrEsCouldNotScroll)
+		}
+	})
+	t.Run("hands over pages until one is empty", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+			bodies: []io.ReadCloser{
+				io.NopCloser(strings.NewReader(`{"_scroll_id": "a", "hits": {"hits": [{"_id": "1", "_source": {}}, {"_id": "2", "_source": {}}]}}`)),
+				io.NopCloser(strings.NewReader(`{"_scroll_id": "a", "hits": {"hits": []}}`)),
+				io.NopCloser(strings.NewReader(`{}`)),
+			},
+			errors: []error{nil, nil, nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		var ids []string
+		scrollErr := esSvc.ScrollDocuments(context.Background(), "some-index", json.RawMessage(`{}`), func(documents []Document) error {
+			for _, document := range documents {
+				ids = append(ids, document.Id)
+			}
+			return nil
+		})
+		if scrollErr != nil || strings.Join(ids, ",") != "1,2" {
+			t.Errorf("Received %v and %s, expected %v and nil", ids, scrollErr, []string{"1", "2"})
+		}
+	})
+	t.Run("returns error from page handler", func(t *testing.T) {
+		mockEsApi := MockEsApi{
+			statusCodes: []int{http.StatusOK, 0, http.StatusOK},
+			bodies: []io.ReadCloser{
+				io.NopCloser(strings.NewReader(`{"_scroll_id": "a", "hits": {"hits": [{"_id": "1", "_source": {}}]}}`)),
+				nil,
+				io.NopCloser(strings.NewReader(`{}`)),
+			},
+			errors: []error{nil, nil, nil},
+		}
+		esSvc, _ := NewEsService([]string{}, mockEsApi, EsServiceOptions{})
+		handleErr := errors.New("failed")
+		scrollErr := esSvc.ScrollDocuments(context.Background(), "some-index", json.RawMessage(`{}`), func(_ []Document) error { return handleErr })
+		if scrollErr != handleErr {
+			t.Errorf("Received %s, expected %s", scrollErr, handleErr)
+		}
+	})
+}
+
+// Stands in for Elasticsearch, answering each request with the next status
+// in turn, repeating the last, or dropping the connection for a status of 0.
+// The client's product check is answered apart.
+func newEsServer(t *testing.T, delay time.Duration, statusCodes ...int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/" {
+			w.Write([]byte(`{"version": {"number": "7.17.0", "build_flavor": "default"}, "tagline": "You Know, for Search"}`))
+			return
+		}
+		n := int(requests.Add(1)) - 1
+		time.Sleep(delay)
+		statusCode := statusCodes[min(n, len(statusCodes)-1)]
+		if statusCode == 0 {
+			connection, _, _ := w.(http.Hijacker).Hijack()
+			connection.Close()
+			return
+		}
+		w.WriteHeader(statusCode)
+		w.Write([]byte(`{"result": "created", "_id": "123", "_version": 1}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestEsService_Resilience(t *testing.T) {
+	document := Document{Id: "123", Content: json.RawMessage("{}")}
+
+	t.Run("retries requests rejected with 429 or 503", func(t *testing.T) {
+		server, requests := newEsServer(t, 0, http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusCreated)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: time.Second, MaxRetries: 2})
+		id, indexErr := esSvc.IndexDocument(context.Background(), "some-index", document)
+		if indexErr != nil {
+			t.Errorf("Received %s, expected nil", indexErr)
+		}
+		if id != "123" {
+			t.Errorf("Received %s, expected %s", id, "123")
+		}
+		if requests.Load() != 3 {
+			t.Errorf("Received %d, expected %d", requests.Load(), 3)
+		}
+	})
+	t.Run("does not retry other failures", func(t *testing.T) {
+		server, requests := newEsServer(t, 0, http.StatusBadGateway, http.StatusCreated)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: time.Second, MaxRetries: 2})
+		_, indexErr := esSvc.IndexDocument(context.Background(), "some-index", document)
+		if indexErr != ErrEsCouldNotIndexDocument {
+			t.Errorf("Received %s, expected %s", indexErr, ErrEsCouldNotIndexDocument)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("Received %d, expected %d", requests.Load(), 1)
+		}
+	})
+	t.Run("retries reads that lost their connection", func(t *testing.T) {
+		server, requests := newEsServer(t, 0, 0, http.StatusOK)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: time.Second, MaxRetries: 2})
+		_, _ = esSvc.GetDocumentById(context.Background(), "some-index", "123")
+		if requests.Load() != 2 {
+			t.Errorf("Received %d, expected %d", requests.Load(), 2)
+		}
+	})
+	t.Run("does not retry writes that lost their connection", func(t *testing.T) {
+		server, requests := newEsServer(t, 0, 0, http.StatusOK)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: time.Second, MaxRetries: 2})
+		_, updateErr := esSvc.UpdateDocumentWithScript(context.Background(), "some-index", "123", "ctx._source.clicks += 1", nil)
+		if updateErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", updateErr, ErrEsCouldNotFulfillRequest)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("Received %d, expected %d", requests.Load(), 1)
+		}
+	})
+	t.Run("returns error when retries are used up", func(t *testing.T) {
+		server, requests := newEsServer(t, 0, http.StatusTooManyRequests)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: time.Second, MaxRetries: 1})
+		_, indexErr := esSvc.IndexDocument(context.Background(), "some-index", document)
+		if indexErr != ErrEsCouldNotIndexDocument {
+			t.Errorf("Received %s, expected %s", indexErr, ErrEsCouldNotIndexDocument)
+		}
+		if requests.Load() != 2 {
+			t.Errorf("Received %d, expected %d", requests.Load(), 2)
+		}
+	})
+	t.Run("returns error when operation times out", func(t *testing.T) {
+		server, _ := newEsServer(t, 200*time.Millisecond, http.StatusCreated)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: 50 * time.Millisecond})
+		startTime := time.Now()
+		_, indexErr := esSvc.IndexDocument(context.Background(), "some-index", document)
+		if indexErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", indexErr, ErrEsCouldNotFulfillRequest)
+		}
+		if elapsed := time.Since(startTime); elapsed >= 200*time.Millisecond {
+			t.Errorf("Received %s, expected less than %s", elapsed, 200*time.Millisecond)
+		}
+	})
+	t.Run("returns error when caller cancels", func(t *testing.T) {
+		server, _ := newEsServer(t, 200*time.Millisecond, http.StatusCreated)
+		esSvc, _ := NewEsService([]string{server.URL}, NewEsApi(), EsServiceOptions{Timeout: time.Second})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, indexErr := esSvc.IndexDocument(ctx, "some-index", document)
+		if indexErr != ErrEsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", indexErr, ErrEsCouldNotFulfillRequest)
+		}
+	})
+}
@@ -0,0 +1,442 @@
+package main
+
+// Export and import of links, for backups, migrations and seeding
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LinkFormatJsonl = "jsonl"
+	LinkFormatCsv   = "csv"
+
+	ImportConflictSkip      = "skip"
+	ImportConflictOverwrite = "overwrite"
+	ImportConflictFail      = "fail"
+
+	linkTransferBatchSize = 500
+)
+
+var (
+	knownLinkFormats     = []string{LinkFormatJsonl, LinkFormatCsv}
+	knownImportConflicts = []string{ImportConflictSkip, ImportConflictOverwrite, ImportConflictFail}
+)
+
+var (
+	ErrCouldNotExportShortUrls      = errors.New("could not export short urls")
+	ErrCouldNotImportShortUrls      = errors.New("could not import short urls")
+	ErrCouldNotReserveSlugForImport = errors.New("could not reserve slug for imported short url")
+	ErrImportedShortUrlsExist       = errors.New("imported short urls already exist")
+)
+
+// CSV columns, in order. Attributes that do not fit in a cell are encoded
+// as JSON, so CSV round-trips the same links JSON Lines does.
+var linkCsvColumns = []string{
+	"short_url", "original_url", "title", "tags", "workspace", "created_by", "created_at",
+	"click_count", "max_clicks", "password_hash", "utm", "params", "rules", "variants",
+}
+
+// Link formats
+
+func linkFormatContentType(format string) string {
+	if format == LinkFormatCsv {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+type linkEncoder interface {
+	Encode(content urlDocumentContent) error
+	Flush() error
+}
+
+type jsonlLinkEncoder struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+type csvLinkEncoder struct {
+	writer *csv.Writer
+}
+
+// The CSV header is written straight away, so an export without links still
+// names its columns
+func newLinkEncoder(format string, output io.Writer) linkEncoder {
+	if format == LinkFormatCsv {
+		writer := csv.NewWriter(output)
+		_ = writer.Write(linkCsvColumns)
+		return &csvLinkEncoder{writer: writer}
+	}
+	writer := bufio.NewWriter(output)
+	return &jsonlLinkEncoder{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+func (e *jsonlLinkEncoder) Encode(content urlDocumentContent) error {
+	return e.encoder.Encode(content)
+}
+
+func (e *jsonlLinkEncoder) Flush() error {
+	return e.writer.Flush()
+}
+
+// Empty and zero values are left as empty cells
+func encodeJsonCell(value interface{}, isSet bool) string {
+	if !isSet {
+		return ""
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+func encodeIntCell(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+func (e *csvLinkEncoder) Encode(content urlDocumentContent) error {
+	createdAt := ""
+	if content.CreatedAt != nil {
+		createdAt = content.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return e.writer.Write([]string{
+		content.ShortUrl,
+		content.OriginalUrl,
+		content.Title,
+		strings.Join(content.Tags, " "),
+		content.Workspace,
+		content.CreatedBy,
+		createdAt,
+		encodeIntCell(content.ClickCount),
+		encodeIntCell(content.MaxClicks),
+		content.PasswordHash,
+		encodeJsonCell(content.Utm, content.Utm != nil),
+		encodeJsonCell(content.Params, len(content.Params) > 0),
+		encodeJsonCell(content.Rules, len(content.Rules) > 0),
+		encodeJsonCell(content.Variants, len(content.Variants) > 0),
+	})
+}
+
+func (e *csvLinkEncoder) Flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// Decodes every link in the input, recording lines that cannot be parsed.
+// CSV input needs a header naming at least short_url and original_url;
+// columns other than linkCsvColumns are ignored.
+func decodeLinks(format string, input io.Reader, validation *Validation) []urlDocumentContent {
+	if format == LinkFormatCsv {
+		return decodeCsvLinks(input, validation)
+	}
+	return decodeJsonlLinks(input, validation)
+}
+
+func decodeJsonlLinks(input io.Reader, validation *Validation) []urlDocumentContent {
+	var links []urlDocumentContent
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var content urlDocumentContent
+		if parseErr := json.Unmarshal(scanner.Bytes(), &content); parseErr != nil {
+			validation.Append(fmt.Sprintf("Line %d could not be parsed: %s", line, parseErr))
+			continue
+		}
+		links = append(links, content)
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		validation.Append(fmt.Sprintf("Line %d could not be read: %s", line+1, scanErr))
+	}
+	return links
+}
+
+func decodeCsvLinks(input io.Reader, validation *Validation) []urlDocumentContent {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+	header, headerErr := reader.Read()
+	if headerErr != nil {
+		validation.Append(fmt.Sprintf("Header could not be read: %s", headerErr))
+		return nil
+	}
+	columns := map[string]int{}
+	for i, column := range header {
+		columns[strings.TrimSpace(strings.ToLower(column))] = i
+	}
+	for _, required := range []string{"short_url", "original_url"} {
+		if _, ok := columns[required]; !ok {
+			validation.Append(fmt.Sprintf("Header is missing column %s", required))
+		}
+	}
+	if validation.Fails() {
+		return nil
+	}
+
+	var links []urlDocumentContent
+	for line := 2; ; line++ {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			validation.Append(fmt.Sprintf("Line %d could not be parsed: %s", line, readErr))
+			continue
+		}
+		content, parseErr := parseCsvLink(record, columns)
+		if parseErr != "" {
+			validation.Append(fmt.Sprintf("Line %d could not be parsed: %s", line, parseErr))
+			continue
+		}
+		links = append(links, content)
+	}
+	return links
+}
+
+// Returns a description of the first cell that could not be parsed, if any
+func parseCsvLink(record []string, columns map[string]int) (urlDocumentContent, string) {
+	cell := func(column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	content := urlDocumentContent{
+		ShortUrl:    cell("short_url"),
+		OriginalUrl: cell("original_url"),
+	}
+	content.Title = cell("title")
+	content.Tags = strings.Fields(cell("tags"))
+	content.Workspace = cell("workspace")
+	content.CreatedBy = cell("created_by")
+	content.PasswordHash = cell("password_hash")
+
+	if value := cell("created_at"); value != "" {
+		createdAt, parseErr := time.Parse(time.RFC3339Nano, value)
+		if parseErr != nil {
+			return content, fmt.Sprintf("created_at is not an RFC 3339 time: %s", value)
+		}
+		content.CreatedAt = &createdAt
+	}
+	for column, target := range map[string]*int{
+		"click_count": &content.ClickCount,
+		"max_clicks":  &content.MaxClicks,
+	} {
+		if value := cell(column); value != "" {
+			number, parseErr := strconv.Atoi(value)
+			if parseErr != nil {
+				return content, fmt.Sprintf("%s is not an integer: %s", column, value)
+			}
+			*target = number
+		}
+	}
+	for column, target := range map[string]interface{}{
+		"utm":      &content.Utm,
+		"params":   &content.Params,
+		"rules":    &content.Rules,
+		"variants": &content.Variants,
+	} {
+		if value := cell(column); value != "" {
+			if parseErr := json.Unmarshal([]byte(value), target); parseErr != nil {
+				return content, fmt.Sprintf("%s is not valid JSON: %s", column, parseErr)
+			}
+		}
+	}
+	return content, ""
+}
+
+// Original URLs are only required to be absolute, unlike when shortening,
+// as links imported from elsewhere were not held to this service's rules
+func validateImportedLinks(validation *Validation, links []urlDocumentContent) {
+	seen := map[string]bool{}
+	for i, link := range links {
+		var linkValidation Validation
+		validateShortUrl(&linkValidation, link.ShortUrl)
+		originalUrl, parseErr := url.Parse(link.OriginalUrl)
+		if parseErr != nil || (originalUrl.Scheme != "http" && originalUrl.Scheme != "https") ||
+			originalUrl.Host == "" {
+			linkValidation.Append(fmt.Sprintf("Provided original URL is invalid: %s", link.OriginalUrl))
+		}
+		if seen[link.ShortUrl] {
+			linkValidation.Append(fmt.Sprintf("Provided short URL is repeated: %s", link.ShortUrl))
+		}
+		seen[link.ShortUrl] = true
+		if link.Workspace != "" {
+			validateWorkspace(&linkValidation, link.Workspace)
+		}
+		validateTitleAndTags(&linkValidation, link.Title, link.Tags)
+		validateUrlAttributes(&linkValidation, link.Utm, link.Params)
+		validateRedirectRules(&linkValidation, link.Rules)
+		validateDestinationVariants(&linkValidation, link.Variants)
+		validateMaxClicks(&linkValidation, link.MaxClicks)
+		for _, message := range linkValidation.Errors {
+			validation.Append(fmt.Sprintf("Link %d: %s", i+1, message))
+		}
+	}
+}
+
+// Export
+
+// Hands over every link, or every link in the workspace if one is given, in
+// no particular order. Returns how many links were handed over.
+func (s urlShortenService) ExportShortUrls(ctx context.Context, workspace string, handleLink func(urlDocumentContent) error) (int, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.ExportShortUrls")
+	defer span.End()
+
+	exported := 0
+	scanErr := s.Links.Scan(ctx, workspace, func(links []urlDocumentContent) error {
+		for _, link := range links {
+			if handleErr := handleLink(link); handleErr != nil {
+				return handleErr
+			}
+			exported++
+		}
+		return nil
+	})
+	if scanErr != nil {
+		slog.Error("Error exporting short URLs", "after", exported, "error", scanErr)
+		return exported, ErrCouldNotExportShortUrls
+	}
+
+	slog.Info("Exported short URLs", "count", exported)
+	return exported, nil
+}
+
+// Import
+
+type urlImportOptions struct {
+	Conflict string // What to do with links that already exist
+	DryRun   bool   // Report what would be imported without changing anything
+}
+
+type urlImportResult struct {
+	Total       int
+	Created     int
+	Overwritten int
+	Skipped     int
+	Existing    []string // Short URLs that already exist
+}
+
+// Reserves the slugs of new links in keygensvc, then stores the links in
+// batches. Slugs keygensvc already holds are taken as reserved, as when
+// restoring a backup. With the fail policy nothing is imported if any link
+// exists; otherwise batches stored before an error stay stored, and
+// importing again with the skip policy carries on where it stopped.
+func (s urlShortenService) ImportShortUrls(
+	ctx context.Context, links []urlDocumentContent, options urlImportOptions,
+) (urlImportResult, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.ImportShortUrls")
+	defer span.End()
+
+	result := urlImportResult{Total: len(links)}
+
+	// Find links that already exist
+	existing := map[string]bool{}
+	for start := 0; start < len(links); start += linkTransferBatchSize {
+		var shortUrls []string
+		for _, link := range links[start:minInt(start+linkTransferBatchSize, len(links))] {
+			shortUrls = append(shortUrls, link.ShortUrl)
+		}
+		existingShortUrls, existingErr := s.Links.Existing(ctx, shortUrls)
+		if existingErr != nil {
+			slog.ErrorContext(ctx, "Error finding existing short URLs to import", "error", existingErr)
+			return result, ErrCouldNotImportShortUrls
+		}
+		for _, shortUrl := range existingShortUrls {
+			existing[shortUrl] = true
+		}
+	}
+
+	// Apply conflict policy
+	var imported []urlDocumentContent
+	for _, link := range links {
+		if existing[link.ShortUrl] {
+			result.Existing = append(result.Existing, link.ShortUrl)
+			if options.Conflict == ImportConflictSkip {
+				result.Skipped++
+				continue
+			}
+			result.Overwritten++
+		} else {
+			result.Created++
+		}
+		imported = append(imported, link)
+	}
+	if options.Conflict == ImportConflictFail && len(result.Existing) > 0 {
+		slog.InfoContext(ctx, "Not importing short URLs, some already exist", "count", len(links), "existing", len(result.Existing))
+		return result, ErrImportedShortUrlsExist
+	}
+	if options.DryRun {
+		slog.InfoContext(
+			ctx, "Dry run would import short URLs",
+			"count", len(links), "created", result.Created, "overwritten", result.Overwritten, "skipped", result.Skipped,
+		)
+		return result, nil
+	}
+
+	// Reserve slugs and store links, a batch at a time
+	importedAt := time.Now().UTC()
+	for start := 0; start < len(imported); start += linkTransferBatchSize {
+		var batch []urlDocumentContent
+		for _, link := range imported[start:minInt(start+linkTransferBatchSize, len(imported))] {
+			if !existing[link.ShortUrl] {
+				if reserveErr := s.reserveImportedSlug(ctx, link); reserveErr != nil {
+					return result, reserveErr
+				}
+			}
+			if link.CreatedAt == nil {
+				link.CreatedAt = &importedAt
+			}
+			batch = append(batch, link)
+		}
+		if putErr := s.Links.Put(ctx, batch...); putErr != nil {
+			slog.ErrorContext(ctx, "Error storing imported short URLs", "from", start, "error", putErr)
+			return result, ErrCouldNotImportShortUrls
+		}
+	}
+
+	slog.InfoContext(
+		ctx, "Imported short URLs",
+		"count", len(links), "created", result.Created, "overwritten", result.Overwritten, "skipped", result.Skipped,
+	)
+	return result, nil
+}
+
+func (s urlShortenService) reserveImportedSlug(ctx context.Context, link urlDocumentContent) error {
+	shortHost := shortHostForShortUrl(link.ShortUrl)
+	slug := strings.TrimPrefix(link.ShortUrl, shortHost+"/")
+	sourceWorkspace := link.Workspace
+	if shortHost == s.SharedShortHost {
+		sourceWorkspace = ""
+	}
+	_, createErr := s.KgsService.CreateNewKey(ctx, shortHost, sourceWorkspace, slug)
+	if createErr != nil && createErr != ErrKgsKeyAlreadyExists {
+		slog.ErrorContext(ctx, "Error reserving slug for imported short URL", "short_url", link.ShortUrl, "error", createErr)
+		return ErrCouldNotReserveSlugForImport
+	}
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reports the given short URLs as existing and records indexed documents
+type MockImportEsService struct {
+	MockEsService
+	existing []string
+	indexed  *[]Document
+}
+
+func (m MockImportEsService) Search(_ context.Context, _ string, _ json.RawMessage) (SearchResult, error) {
+	var documents []Document
+	for _, shortUrl := range m.existing {
+		documents = append(documents, Document{Id: documentIdForShortUrl(shortUrl)})
+	}
+	return SearchResult{Total: len(documents), Documents: documents}, m.error
+}
+
+func (m MockImportEsService) IndexDocument(_ context.Context, _ string, document Document) (string, error) {
+	*m.indexed = append(*m.indexed, document)
+	return document.Id, m.error
+}
+
+func (m MockImportEsService) BulkIndexDocuments(_ context.Context, _ string, documents []Document) error {
+	*m.indexed = append(*m.indexed, documents...)
+	return m.error
+}
+
+func TestLinkEncoders(t *testing.T) {
+	createdAt := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	link := urlDocumentContent{
+		OriginalUrl: "http://example.com/launch?a=1&b=2",
+		ShortUrl:    "http://shrt.url/launch",
+		ClickCount:  3,
+		CreatedAt:   &createdAt,
+		urlAttributes: urlAttributes{
+			Title:     "Launch, day one",
+			Tags:      []string{"launch", "q4"},
+			Utm:       &utmParameters{Source: "newsletter"},
+			Params:    map[string]string{"ref": "{slug}"},
+			Workspace: "team-a",
+			MaxClicks: 10,
+		},
+	}
+
+	for _, format := range knownLinkFormats {
+		t.Run("round-trips links as "+format, func(t *testing.T) {
+			var output bytes.Buffer
+			encoder := newLinkEncoder(format, &output)
+			if encodeErr := encoder.Encode(link); encodeErr != nil {
+				t.Fatal(encodeErr)
+			}
+			if flushErr := encoder.Flush(); flushErr != nil {
+				t.Fatal(flushErr)
+			}
+
+			var validation Validation
+			links := decodeLinks(format, &output, &validation)
+			if validation.Fails() {
+				t.Fatalf("Received %v, expected no validation errors", validation.Errors)
+			}
+			if len(links) != 1 || !reflect.DeepEqual(links[0], link) {
+				t.Errorf("Received %+v, expected %+v", links, link)
+			}
+		})
+	}
+	t.Run("decodes CSV with other columns in any order", func(t *testing.T) {
+		input := "Long URL,Clicks,Short_URL,original_url\nignored,5,http://shrt.url/abc,http://example.com\n"
+		var validation Validation
+		links := decodeLinks(LinkFormatCsv, strings.NewReader(input), &validation)
+		if validation.Fails() || len(links) != 1 || links[0].ShortUrl != "http://shrt.url/abc" || links[0].ClickCount != 0 {
+			t.Errorf("Received %+v and %v, expected one link without clicks", links, validation.Errors)
+		}
+	})
+	t.Run("records lines that cannot be parsed", func(t *testing.T) {
+		var validation Validation
+		decodeLinks(LinkFormatJsonl, strings.NewReader("{\"short_url\": \"http://shrt.url/abc\"}\n\nnot json\n"), &validation)
+		if len(validation.Errors) != 1 || !strings.HasPrefix(string(validation.Errors[0]), "Line 3") {
+			t.Errorf("Received %v, expected an error for line 3", validation.Errors)
+		}
+
+		validation = Validation{}
+		decodeLinks(LinkFormatCsv, strings.NewReader("short_url\nhttp://shrt.url/abc\n"), &validation)
+		if len(validation.Errors) != 1 {
+			t.Errorf("Received %v, expected an error for the missing column", validation.Errors)
+		}
+
+		validation = Validation{}
+		decodeLinks(LinkFormatCsv, strings.NewReader("short_url,original_url,max_clicks\nhttp://shrt.url/abc,http://example.com,ten\n"), &validation)
+		if len(validation.Errors) != 1 || !strings.HasPrefix(string(validation.Errors[0]), "Line 2") {
+			t.Errorf("Received %v, expected an error for line 2", validation.Errors)
+		}
+	})
+}
+
+func TestValidateImportedLinks(t *testing.T) {
+	t.Run("returns errors for invalid and repeated links", func(t *testing.T) {
+		var validation Validation
+		validateImportedLinks(&validation, []urlDocumentContent{
+			{ShortUrl: "http://shrt.url/abc", OriginalUrl: "https://example.com/?q=a b&c=%20"},
+			{ShortUrl: "http://shrt.url/abc", OriginalUrl: "ftp://example.com"},
+			{ShortUrl: "shrt.url/def", OriginalUrl: "http://example.com"},
+		})
+		expected := []ValidationError{
+			"Link 2: Provided original URL is invalid: ftp://example.com",
+			"Link 2: Provided short URL is repeated: http://shrt.url/abc",
+			"Link 3: Provided short URL is invalid: shrt.url/def",
+		}
+		if !reflect.DeepEqual(validation.Errors, expected) {
+			t.Errorf("Received %v, expected %v", validation.Errors, expected)
+		}
+	})
+}
+
+func TestUrlShortenService_ExportShortUrls(t *testing.T) {
+	t.Run("returns error when scroll fails", func(t *testing.T) {
+		urlSvc := urlShortenService{Links: esLinkStore{EsIndex: "urlstore", EsService: MockEsService{"", Document{}, errors.New("failed")}}}
+		_, exportErr := urlSvc.ExportShortUrls(context.Background(), "", func(_ urlDocumentContent) error { return nil })
+		if exportErr != ErrCouldNotExportShortUrls {
+			t.Errorf("Received %s, expected %s", exportErr, ErrCouldNotExportShortUrls)
+		}
+	})
+	t.Run("hands over every link", func(t *testing.T) {
+		content := json.RawMessage(`{"original_url": "http://example.com", "short_url": "http://shrt.url/abc"}`)
+		urlSvc := urlShortenService{Links: esLinkStore{EsIndex: "urlstore", EsService: MockEsService{"", Document{Id: "abc", Content: content}, nil}}}
+		var links []urlDocumentContent
+		exported, exportErr := urlSvc.ExportShortUrls(context.Background(), "", func(link urlDocumentContent) error {
+			links = append(links, link)
+			return nil
+		})
+		if exportErr != nil || exported != 1 || links[0].ShortUrl != "http://shrt.url/abc" {
+			t.Errorf("Received %d links and %s, expected %d and nil", exported, exportErr, 1)
+		}
+	})
+}
+
+func TestUrlShortenService_ImportShortUrls(t *testing.T) {
+	links := []urlDocumentContent{
+		{ShortUrl: "http://shrt.url/abc", OriginalUrl: "http://example.com/a"},
+		{ShortUrl: "http://shrt.url/def", OriginalUrl: "http://example.com/d"},
+	}
+	newUrlSvc := func(indexed *[]Document, kgsErr error) urlShortenService {
+		return urlShortenService{
+			Links: esLinkStore{
+				EsIndex: "urlstore", EsService: MockImportEsService{existing: []string{"http://shrt.url/abc"}, indexed: indexed},
+			},
+			KgsService: MockKgsService{"", kgsErr},
+		}
+	}
+
+	t.Run("imports nothing when links exist and policy is fail", func(t *testing.T) {
+		var indexed []Document
+		result, importErr := newUrlSvc(&indexed, nil).ImportShortUrls(context.Background(), links, urlImportOptions{Conflict: ImportConflictFail})
+		if importErr != ErrImportedShortUrlsExist {
+			t.Errorf("Received %s, expected %s", importErr, ErrImportedShortUrlsExist)
+		}
+		if len(indexed) != 0 || !reflect.DeepEqual(result.Existing, []string{"http://shrt.url/abc"}) {
+			t.Errorf("Received %d indexed and %v existing, expected none and %v", len(indexed), result.Existing, []string{"http://shrt.url/abc"})
+		}
+	})
+	t.Run("skips existing links", func(t *testing.T) {
+		var indexed []Document
+		result, importErr := newUrlSvc(&indexed, nil).ImportShortUrls(context.Background(), links, urlImportOptions{Conflict: ImportConflictSkip})
+		if importErr != nil || result.Created != 1 || result.Skipped != 1 {
+			t.Errorf("Received %+v and %s, expected 1 created and 1 skipped", result, importErr)
+		}
+		if len(indexed) != 1 || indexed[0].Id != documentIdForShortUrl("http://shrt.url/def") {
+			t.Errorf("Received %v, expected only the new link to be indexed", indexed)
+		}
+	})
+	t.Run("overwrites existing links", func(t *testing.T) {
+		var indexed []Document
+		result, importErr := newUrlSvc(&indexed, nil).ImportShortUrls(context.Background(), links, urlImportOptions{Conflict: ImportConflictOverwrite})
+		if importErr != nil || result.Created != 1 || result.Overwritten != 1 || len(indexed) != 2 {
+			t.Errorf("Received %+v and %s, expected 1 created and 1 overwritten", result, importErr)
+		}
+	})
+	t.Run("changes nothing on a dry run", func(t *testing.T) {
+		var indexed []Document
+		result, importErr := newUrlSvc(&indexed, errors.New("failed")).ImportShortUrls(
+			context.Background(), links, urlImportOptions{Conflict: ImportConflictOverwrite, DryRun: true},
+		)
+		if importErr != nil || result.Created != 1 || result.Overwritten != 1 || len(indexed) != 0 {
+			t.Errorf("Received %+v and %s, expected counts without indexing", result, importErr)
+		}
+	})
+	t.Run("takes slugs keygensvc already holds as reserved", func(t *testing.T) {
+		var indexed []Document
+		_, importErr := newUrlSvc(&indexed, ErrKgsKeyAlreadyExists).ImportShortUrls(context.Background(), links, urlImportOptions{Conflict: ImportConflictSkip})
+		if importErr != nil || len(indexed) != 1 {
+			t.Errorf("Received %s, expected nil", importErr)
+		}
+	})
+	t.Run("returns error when slug cannot be reserved", func(t *testing.T) {
+		var indexed []Document
+		_, importErr := newUrlSvc(&indexed, errors.New("failed")).ImportShortUrls(context.Background(), links, urlImportOptions{Conflict: ImportConflictSkip})
+		if importErr != ErrCouldNotReserveSlugForImport || len(indexed) != 0 {
+			t.Errorf("Received %s, expected %s", importErr, ErrCouldNotReserveSlugForImport)
+		}
+	})
+}
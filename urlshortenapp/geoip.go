@@ -0,0 +1,56 @@
+package main
+
+// Generic module for country lookups against a local GeoIP database
+
+import (
+	"errors"
+	"github.com/oschwald/maxminddb-golang"
+	"log/slog"
+	"net"
+)
+
+type GeoIpService interface {
+	CountryForIp(ip net.IP) (string, error)
+}
+
+type geoIpService struct {
+	Reader *maxminddb.Reader
+}
+
+var (
+	ErrGeoIpCouldNotOpenDatabase = errors.New("geoip could not open database")
+	ErrGeoIpCouldNotLookupIp     = errors.New("geoip could not look up ip")
+	ErrGeoIpNotConfigured        = errors.New("geoip database not configured")
+)
+
+// NewGeoIpService opens the mmdb file at databasePath. An empty path yields a
+// service that resolves no countries, so country rules never match.
+func NewGeoIpService(databasePath string) (GeoIpService, error) {
+	if databasePath == "" {
+		return &geoIpService{}, nil
+	}
+	reader, openErr := maxminddb.Open(databasePath)
+	if openErr != nil {
+		slog.Error("Error opening GeoIP database", "database_path", databasePath, "error", openErr)
+		return nil, ErrGeoIpCouldNotOpenDatabase
+	}
+	return &geoIpService{Reader: reader}, nil
+}
+
+type geoIpCountryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func (s *geoIpService) CountryForIp(ip net.IP) (string, error) {
+	if s.Reader == nil {
+		return "", ErrGeoIpNotConfigured
+	}
+	var record geoIpCountryRecord
+	if lookupErr := s.Reader.Lookup(ip, &record); lookupErr != nil {
+		slog.Error("Error looking up country", "ip", ip, "error", lookupErr)
+		return "", ErrGeoIpCouldNotLookupIp
+	}
+	return record.Country.IsoCode, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewGeoIpService(t *testing.T) {
+	t.Run("returns error when database cannot be opened", func(t *testing.T) {
+		_, err := NewGeoIpService("/does/not/exist.mmdb")
+		if err != ErrGeoIpCouldNotOpenDatabase {
+			t.Errorf("Received %s, expected %s", err, ErrGeoIpCouldNotOpenDatabase)
+		}
+	})
+	t.Run("returns unconfigured service when path is empty", func(t *testing.T) {
+		geoIpSvc, err := NewGeoIpService("")
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+		_, lookupErr := geoIpSvc.CountryForIp(net.ParseIP("8.8.8.8"))
+		if lookupErr != ErrGeoIpNotConfigured {
+			t.Errorf("Received %s, expected %s", lookupErr, ErrGeoIpNotConfigured)
+		}
+	})
+}
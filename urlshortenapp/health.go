@@ -0,0 +1,181 @@
+package main
+
+// Liveness and readiness. Liveness only says the process serves requests.
+// Readiness checks each dependency, caching the results so that probes from
+// every replica do not hammer them.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HealthStatusOk      = "ok"
+	HealthStatusFailing = "failing"
+	// Shutting down, so that load balancers stop sending requests
+	HealthStatusDraining = "draining"
+
+	ReadinessCacheTtl     = 5 * time.Second
+	ReadinessCheckTimeout = 2 * time.Second
+)
+
+// Returns a detail worth reporting, such as a cluster health colour, or an
+// error when the dependency cannot be used
+type HealthCheckFunc func(ctx context.Context) (string, error)
+
+type dependencyHealthJson struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type readinessJson struct {
+	Status       string                          `json:"status"`
+	CheckedAt    time.Time                       `json:"checked_at"`
+	Dependencies map[string]dependencyHealthJson `json:"dependencies"`
+}
+
+type HealthChecker struct {
+	checks   map[string]HealthCheckFunc
+	cacheTtl time.Duration
+	timeout  time.Duration
+
+	// Held while checking, so that concurrent probes wait for one check
+	// rather than each running their own
+	mutex     sync.Mutex
+	readiness readinessJson
+	draining  bool
+	now       func() time.Time
+}
+
+func NewHealthChecker(cacheTtl time.Duration, timeout time.Duration) *HealthChecker {
+	return &HealthChecker{
+		checks:   map[string]HealthCheckFunc{},
+		cacheTtl: cacheTtl,
+		timeout:  timeout,
+		now:      time.Now,
+	}
+}
+
+func (c *HealthChecker) AddCheck(name string, check HealthCheckFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checks[name] = check
+	c.readiness = readinessJson{}
+}
+
+// Fails readiness from now on, without checking dependencies
+func (c *HealthChecker) Drain() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.draining = true
+}
+
+// Runs every check at once, each under the timeout, unless the last results
+// are still fresh
+func (c *HealthChecker) Readiness(ctx context.Context) readinessJson {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.draining {
+		return readinessJson{Status: HealthStatusDraining, CheckedAt: c.now()}
+	}
+	if !c.readiness.CheckedAt.IsZero() && c.now().Sub(c.readiness.CheckedAt) < c.cacheTtl {
+		return c.readiness
+	}
+
+	readiness := readinessJson{
+		Status:       HealthStatusOk,
+		CheckedAt:    c.now(),
+		Dependencies: map[string]dependencyHealthJson{},
+	}
+	var resultMutex sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func(name string, check HealthCheckFunc) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			startTime := time.Now()
+			detail, checkErr := check(checkCtx)
+			dependency := dependencyHealthJson{
+				Status:    HealthStatusOk,
+				LatencyMs: float64(time.Since(startTime).Microseconds()) / 1000,
+				Detail:    detail,
+			}
+			if checkErr != nil {
+				dependency.Status = HealthStatusFailing
+				dependency.Error = checkErr.Error()
+			}
+
+			resultMutex.Lock()
+			defer resultMutex.Unlock()
+			readiness.Dependencies[name] = dependency
+			if checkErr != nil {
+				readiness.Status = HealthStatusFailing
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	c.readiness = readiness
+	return readiness
+}
+
+func HandleLivenessRequest(w http.ResponseWriter, _ *http.Request) {
+	responseJson, _ := json.Marshal(map[string]string{"status": HealthStatusOk})
+	handleOk(w, responseJson)
+}
+
+// Serves 503 unless every dependency is ready, with the results either way.
+// Checks outlive a probe that gives up, so that their results are cached.
+func HandleReadinessRequest(w http.ResponseWriter, r *http.Request) {
+	readiness := App.Health.Readiness(context.WithoutCancel(r.Context()))
+	responseJson, _ := json.Marshal(readiness)
+	if readiness.Status != HealthStatusOk {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(responseJson)
+		return
+	}
+	handleOk(w, responseJson)
+}
+
+var (
+	ErrEsIndexMissing = errors.New("elasticsearch index does not exist")
+)
+
+// Fails on a red cluster, or when the index links are stored in is missing
+func elasticsearchHealthCheck(esSvc EsService, linksIndex string) HealthCheckFunc {
+	return func(ctx context.Context) (string, error) {
+		colour, healthErr := esSvc.ClusterHealth(ctx)
+		if healthErr != nil || linksIndex == "" {
+			return colour, healthErr
+		}
+		indices, _, resolveErr := esSvc.ResolveIndex(ctx, linksIndex)
+		if resolveErr != nil {
+			return colour, resolveErr
+		}
+		if len(indices) == 0 {
+			return colour, ErrEsIndexMissing
+		}
+		return colour, nil
+	}
+}
+
+func keygensvcHealthCheck(kgsSvc KgsService) HealthCheckFunc {
+	return func(ctx context.Context) (string, error) {
+		return "", kgsSvc.Ping(ctx)
+	}
+}
+
+func linkStoreHealthCheck(links LinkStore) HealthCheckFunc {
+	return func(ctx context.Context) (string, error) {
+		return "", links.Ping(ctx)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestHealthChecker(checks map[string]HealthCheckFunc) *HealthChecker {
+	checker := NewHealthChecker(time.Minute, time.Second)
+	for name, check := range checks {
+		checker.AddCheck(name, check)
+	}
+	return checker
+}
+
+func TestHealthChecker_Readiness(t *testing.T) {
+	t.Run("reports each dependency, failing when any fails", func(t *testing.T) {
+		checker := newTestHealthChecker(map[string]HealthCheckFunc{
+			"elasticsearch": func(_ context.Context) (string, error) { return "yellow", nil },
+			"keygensvc":     func(_ context.Context) (string, error) { return "", errors.New("unreachable") },
+		})
+		readiness := checker.Readiness(context.Background())
+		if readiness.Status != HealthStatusFailing {
+			t.Errorf("Received %s, expected %s", readiness.Status, HealthStatusFailing)
+		}
+		es := readiness.Dependencies["elasticsearch"]
+		if es.Status != HealthStatusOk || es.Detail != "yellow" {
+			t.Errorf("Received %v, expected an ok yellow cluster", es)
+		}
+		kgs := readiness.Dependencies["keygensvc"]
+		if kgs.Status != HealthStatusFailing || kgs.Error != "unreachable" {
+			t.Errorf("Received %v, expected a failing keygensvc", kgs)
+		}
+	})
+	t.Run("caches results until they are stale", func(t *testing.T) {
+		calls := 0
+		checker := newTestHealthChecker(map[string]HealthCheckFunc{
+			"keygensvc": func(_ context.Context) (string, error) { calls++; return "", nil },
+		})
+		now := time.Now()
+		checker.now = func() time.Time { return now }
+		checker.Readiness(context.Background())
+		checker.Readiness(context.Background())
+		if calls != 1 {
+			t.Errorf("Received %d, expected %d", calls, 1)
+		}
+		now = now.Add(2 * time.Minute)
+		checker.Readiness(context.Background())
+		if calls != 2 {
+			t.Errorf("Received %d, expected %d", calls, 2)
+		}
+	})
+	t.Run("reports draining without checking once drained", func(t *testing.T) {
+		calls := 0
+		checker := newTestHealthChecker(map[string]HealthCheckFunc{
+			"keygensvc": func(_ context.Context) (string, error) { calls++; return "", nil },
+		})
+		checker.Drain()
+		readiness := checker.Readiness(context.Background())
+		if readiness.Status != HealthStatusDraining {
+			t.Errorf("Received %s, expected %s", readiness.Status, HealthStatusDraining)
+		}
+		if calls != 0 {
+			t.Errorf("Received %d, expected %d", calls, 0)
+		}
+	})
+	t.Run("fails checks that outlast the timeout", func(t *testing.T) {
+		checker := NewHealthChecker(time.Minute, 10*time.Millisecond)
+		checker.AddCheck("keygensvc", func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+		readiness := checker.Readiness(context.Background())
+		if readiness.Status != HealthStatusFailing {
+			t.Errorf("Received %s, expected %s", readiness.Status, HealthStatusFailing)
+		}
+	})
+}
+
+func TestHandleReadinessRequest(t *testing.T) {
+	originalHealth := App.Health
+	defer func() { App.Health = originalHealth }()
+
+	t.Run("returns 503 Service Unavailable with dependencies when not ready", func(t *testing.T) {
+		App.Health = newTestHealthChecker(map[string]HealthCheckFunc{
+			"keygensvc": func(_ context.Context) (string, error) { return "", errors.New("unreachable") },
+		})
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if res.Code != http.StatusServiceUnavailable {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusServiceUnavailable)
+		}
+		var readiness readinessJson
+		_ = json.Unmarshal(res.Body.Bytes(), &readiness)
+		if readiness.Dependencies["keygensvc"].Status != HealthStatusFailing {
+			t.Errorf("Received %s, expected %s", res.Body.String(), "a failing keygensvc")
+		}
+	})
+	t.Run("returns 200 OK when ready", func(t *testing.T) {
+		App.Health = newTestHealthChecker(map[string]HealthCheckFunc{
+			"keygensvc": func(_ context.Context) (string, error) { return "", nil },
+		})
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestHandleLivenessRequest(t *testing.T) {
+	t.Run("returns 200 OK without checking dependencies", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/livez", nil))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+	})
+}
+
+func TestElasticsearchHealthCheck(t *testing.T) {
+	t.Run("returns error when the links index is missing", func(t *testing.T) {
+		check := elasticsearchHealthCheck(MockIndexEsService{}, "urlstore")
+		colour, err := check(context.Background())
+		if err != ErrEsIndexMissing {
+			t.Errorf("Received %s, expected %s", err, ErrEsIndexMissing)
+		}
+		if colour != "green" {
+			t.Errorf("Received %s, expected %s", colour, "green")
+		}
+	})
+	t.Run("returns nil when the links index exists", func(t *testing.T) {
+		check := elasticsearchHealthCheck(MockIndexEsService{indices: []string{"urlstore_v2"}}, "urlstore")
+		if _, err := check(context.Background()); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+	t.Run("does not check an index when links are stored elsewhere", func(t *testing.T) {
+		check := elasticsearchHealthCheck(MockIndexEsService{}, "")
+		if _, err := check(context.Background()); err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"image/color"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Utils
@@ -19,6 +24,15 @@ func parseRawJsonFromHttpBody(body io.ReadCloser) json.RawMessage {
 	return json.RawMessage(buff.String())
 }
 
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 type ValidationError string
 
 type Validation struct {
@@ -41,31 +55,83 @@ var (
 	ResApplicationHealthy		= "Application healthy"
 	ResMethodNotAllowed 		= "Method not allowed: see Allow header for allowed methods."
 	ResCouldNotParseRequestJson = "Could not parse request JSON"
+	ResPasswordRequired			= "Password required for this short URL"
+	ResPasswordIncorrect		= "Incorrect password for this short URL"
+	ResTooManyPasswordAttempts	= "Too many incorrect passwords for this short URL"
+	ResClickLimitReached		= "This short URL has reached its click limit"
+	ResApiKeyRequired			= "API key required, send it as a Bearer token"
+	ResApiKeyInvalid			= "API key is invalid or revoked"
+	ResCouldNotVerifyApiKey		= "Could not verify API key"
+	ResRateLimited				= "Rate limit exceeded, slow down"
 )
 
 func handleCreated(w http.ResponseWriter, responseJson json.RawMessage) {
-	log.Print("Returning 'Created' to caller")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_, _ = w.Write(responseJson)
 }
 
 func handleFound(w http.ResponseWriter, redirectUrl string) {
-	log.Print("Returning 'Found' to caller")
 	w.Header().Set("Content-Type", "")
 	w.Header().Set("Location", redirectUrl)
 	w.WriteHeader(http.StatusFound)
 }
 
+func handleOk(w http.ResponseWriter, responseJson json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(responseJson)
+}
+
 func handleBadRequest(w http.ResponseWriter, responseJson json.RawMessage) {
-	log.Print("Returning 'Bad Request' to caller")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusBadRequest)
 	_, _ = w.Write(responseJson)
 }
 
+func handleNotFound(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	_, _ = fmt.Fprintf(w, "Not found: %s.", message)
+}
+
+func handleConflict(w http.ResponseWriter, responseJson json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	_, _ = w.Write(responseJson)
+}
+
+func handleUnauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusUnauthorized)
+	_, _ = fmt.Fprintf(w, "Unauthorized: %s.", message)
+}
+
+func handleForbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = fmt.Fprintf(w, "Forbidden: %s.", message)
+}
+
+func handleTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = fmt.Fprintf(w, "Too many requests: %s.", message)
+}
+
+func handleGone(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusGone)
+	_, _ = fmt.Fprintf(w, "Gone: %s.", message)
+}
+
 func handleMethodNotAllowed(w http.ResponseWriter, allowedMethods []string) {
-	log.Print("Returning 'Method Not Allowed' to caller")
 	w.Header().Set("Allow", strings.Join(allowedMethods, ","))
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -74,7 +140,6 @@ func handleMethodNotAllowed(w http.ResponseWriter, allowedMethods []string) {
 }
 
 func handleUnprocessableEntity(w http.ResponseWriter, message string) {
-	log.Print("Returning 'Unprocessable Entity' to caller")
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusUnprocessableEntity)
@@ -82,7 +147,6 @@ func handleUnprocessableEntity(w http.ResponseWriter, message string) {
 }
 
 func handleInternalServerError(w http.ResponseWriter, message string) {
-	log.Print("Returning 'Internal Server Error' to caller")
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusInternalServerError)
@@ -90,7 +154,6 @@ func handleInternalServerError(w http.ResponseWriter, message string) {
 }
 
 func handleServiceUnavailable(w http.ResponseWriter, message string) {
-	log.Print("Returning 'Service Unavailable' to caller")
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusServiceUnavailable)
@@ -109,12 +172,10 @@ func isMethodAllowed(method string, allowedMethods []string) bool {
 }
 
 func HandleIndexRequest(w http.ResponseWriter, _ *http.Request) {
-	log.Print("/ hit")
 	fmt.Fprint(w, ResDefaultMessage)
 }
 
 func HandleHealthcheckRequest(w http.ResponseWriter, _ *http.Request) {
-	log.Print("/healthcheck hit")
 	if !App.VerifyHealth() {
 		handleServiceUnavailable(w, ResApplicationUnhealthy)
 		return
@@ -122,15 +183,181 @@ func HandleHealthcheckRequest(w http.ResponseWriter, _ *http.Request) {
 	_, _ = w.Write([]byte(ResApplicationHealthy))
 }
 
+func validateRedirectRules(validation *Validation, rules []redirectRule) {
+	if len(rules) > 32 {
+		validation.Append("Provided too many redirect rules, maximum is 32")
+	}
+
+	ruleUrlTemplate, _ := regexp.Compile("^(http|https)://[a-zA-Z0-9\\.\\/\\?\\=\\_\\-]+$")
+	languageTemplate, _ := regexp.Compile("^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})?$")
+	countryTemplate, _ := regexp.Compile("^[A-Z]{2}$")
+	for i, rule := range rules {
+		if !ruleUrlTemplate.MatchString(rule.Url) {
+			validation.Append(
+				fmt.Sprintf("Provided URL for rule %d is invalid: %s", i, rule.Url),
+			)
+		}
+		for _, platform := range rule.Platforms {
+			if !containsString(knownPlatforms, platform) {
+				validation.Append(
+					fmt.Sprintf(
+						"Provided platform for rule %d is invalid: %s, must be one of %s",
+						i, platform, strings.Join(knownPlatforms, ", "),
+					),
+				)
+			}
+		}
+		for _, language := range rule.Languages {
+			if !languageTemplate.MatchString(language) {
+				validation.Append(
+					fmt.Sprintf("Provided language for rule %d is invalid: %s", i, language),
+				)
+			}
+		}
+		for _, country := range rule.Countries {
+			if !countryTemplate.MatchString(country) {
+				validation.Append(
+					fmt.Sprintf("Provided country for rule %d is invalid: %s", i, country),
+				)
+			}
+		}
+		if rule.StartsAt != nil && rule.EndsAt != nil && !rule.StartsAt.Before(*rule.EndsAt) {
+			validation.Append(
+				fmt.Sprintf("Provided time window for rule %d ends before it starts", i),
+			)
+		}
+		if rule.Percentage < 0 || rule.Percentage > 100 {
+			validation.Append(
+				fmt.Sprintf("Provided percentage for rule %d must be between 0 and 100", i),
+			)
+		}
+	}
+}
+
+func validateDestinationVariants(validation *Validation, variants []destinationVariant) {
+	if len(variants) > 16 {
+		validation.Append("Provided too many variants, maximum is 16")
+	}
+
+	variantUrlTemplate, _ := regexp.Compile("^(http|https)://[a-zA-Z0-9\\.\\/\\?\\=\\_\\-]+$")
+	variantNameTemplate, _ := regexp.Compile("^[a-zA-Z0-9\\-_]{1,32}$")
+	var names []string
+	totalWeight := 0
+	for i, variant := range variants {
+		if !variantNameTemplate.MatchString(variant.Name) {
+			validation.Append(
+				fmt.Sprintf("Provided name for variant %d is invalid: %s", i, variant.Name),
+			)
+		} else if containsString(names, variant.Name) {
+			validation.Append(
+				fmt.Sprintf("Provided variant name is not unique: %s", variant.Name),
+			)
+		}
+		names = append(names, variant.Name)
+		if !variantUrlTemplate.MatchString(variant.Url) {
+			validation.Append(
+				fmt.Sprintf("Provided URL for variant %s is invalid: %s", variant.Name, variant.Url),
+			)
+		}
+		if variant.Weight < 0 || variant.Weight > 10000 {
+			validation.Append(
+				fmt.Sprintf("Provided weight for variant %s must be between 0 and 10000", variant.Name),
+			)
+		}
+		totalWeight += variant.Weight
+	}
+	if len(variants) > 0 && totalWeight <= 0 {
+		validation.Append("Provided variants must have at least one positive weight")
+	}
+}
+
+func validateLinkPassword(validation *Validation, password string) {
+	if password != "" &&
+				(len(password) < MinLinkPasswordLength || len(password) > MaxLinkPasswordLength) {
+		validation.Append(
+			fmt.Sprintf(
+				"Provided password has incorrect length, minimum is %d and maximum is %d",
+				MinLinkPasswordLength,
+				MaxLinkPasswordLength,
+			),
+		)
+	}
+}
+
+func validateMaxClicks(validation *Validation, maxClicks int) {
+	if maxClicks < 0 || maxClicks > 1000000000 {
+		validation.Append("Provided maximum clicks must be between 0 and 1000000000")
+	}
+}
+
+func validateTitleAndTags(validation *Validation, title string, tags []string) {
+	if len(title) > 256 {
+		validation.Append("Provided title is too long, maximum is 256")
+	}
+	if len(tags) > 16 {
+		validation.Append("Provided tags are too many, maximum is 16")
+	}
+	tagTemplate, _ := regexp.Compile("^[a-zA-Z0-9\\.\\_\\-]{1,64}$")
+	for _, tag := range tags {
+		if !tagTemplate.MatchString(tag) {
+			validation.Append(fmt.Sprintf("Provided tag is invalid: %s", tag))
+		}
+	}
+}
+
+func validateUrlAttributes(
+	validation *Validation, utm *utmParameters, params map[string]string,
+) {
+	// Validate UTM fields
+	if utm != nil {
+		for _, param := range utm.queryParams() {
+			if len(param[1]) > 256 {
+				validation.Append(
+					fmt.Sprintf("Provided %s is too long, maximum is 256", param[0]),
+				)
+			}
+		}
+	}
+
+	// Validate parameter templates
+	paramKeyTemplate, _ := regexp.Compile("^[a-zA-Z0-9\\.\\_\\-]{1,64}$")
+	placeholderTemplate, _ := regexp.Compile("\\{[a-z_]+\\}")
+	for key, value := range params {
+		if !paramKeyTemplate.MatchString(key) {
+			validation.Append(
+				fmt.Sprintf("Provided parameter name is invalid: %s", key),
+			)
+		}
+		for _, placeholder := range placeholderTemplate.FindAllString(value, -1) {
+			if !containsString(paramTemplatePlaceholders, placeholder) {
+				validation.Append(
+					fmt.Sprintf(
+						"Provided parameter %s uses unknown placeholder %s", key, placeholder,
+					),
+				)
+			}
+		}
+	}
+}
+
 type urlShortenRequestJson struct {
-	OriginalUrl  string `json:"original_url"`
-	ShortUrlHost string `json:"short_url_host"`
-	CustomSlug   string `json:"custom_slug"`
-	SlugLength   int    `json:"slug_length"`
+	OriginalUrl  string            `json:"original_url"`
+	ShortUrlHost string            `json:"short_url_host"`
+	CustomSlug   string            `json:"custom_slug"`
+	SlugLength   int               `json:"slug_length"`
+	Title        string            `json:"title"`
+	Tags         []string          `json:"tags"`
+	Utm          *utmParameters    `json:"utm"`
+	Params       map[string]string    `json:"params"`
+	Rules        []redirectRule       `json:"rules"`
+	Variants     []destinationVariant `json:"variants"`
+	Password     string               `json:"password"`
+	MaxClicks    int                  `json:"max_clicks"`
 }
 
 func (r urlShortenRequestJson) Validate() Validation {
 	var validation Validation
+	config := App.Config()
 
 	// Validate original URL
 	originalUrlTemplate, _ := regexp.Compile("^(http|https)://[a-zA-Z0-9\\.\\/\\?\\=\\_\\-]+$")
@@ -152,13 +379,13 @@ func (r urlShortenRequestJson) Validate() Validation {
 
 	// Validate custom slug
 	if r.CustomSlug != "" {
-		if len(r.CustomSlug) < App.EnvVars.MinShortUrlPathLength ||
-					len(r.CustomSlug) > App.EnvVars.MaxShortUrlPathLength {
+		if len(r.CustomSlug) < config.MinShortUrlPathLength ||
+					len(r.CustomSlug) > config.MaxShortUrlPathLength {
 			validation.Append(
 				fmt.Sprintf(
 					"Provided slug has incorrect length, minimum is %d and maximum is %d",
-					App.EnvVars.MinShortUrlPathLength,
-					App.EnvVars.MaxShortUrlPathLength,
+					config.MinShortUrlPathLength,
+					config.MaxShortUrlPathLength,
 				),
 			)
 		}
@@ -166,28 +393,39 @@ func (r urlShortenRequestJson) Validate() Validation {
 
 	// Validate slug length
 	if r.SlugLength > 0 {
-		if r.SlugLength < App.EnvVars.MinShortUrlPathLength ||
-					r.SlugLength > App.EnvVars.MaxShortUrlPathLength {
+		if r.SlugLength < config.MinShortUrlPathLength ||
+					r.SlugLength > config.MaxShortUrlPathLength {
 			validation.Append(
 				fmt.Sprintf(
 					"Requested slug length is too short, minimum is %d",
-					App.EnvVars.MinShortUrlPathLength,
+					config.MinShortUrlPathLength,
 				),
 			)
 		}
 	}
 
+	// Validate title, tags, UTM fields, parameter templates, redirect rules
+	// and variants
+	validateTitleAndTags(&validation, r.Title, r.Tags)
+	validateUrlAttributes(&validation, r.Utm, r.Params)
+	validateRedirectRules(&validation, r.Rules)
+	validateDestinationVariants(&validation, r.Variants)
+
+	// Validate password and click limit
+	validateLinkPassword(&validation, r.Password)
+	validateMaxClicks(&validation, r.MaxClicks)
+
 	return validation
 }
 
 type urlShortenResponseJson struct {
 	OriginalUrl 	 string   		   `json:"original_url"`
 	ShortUrl         string      	   `json:"short_url"`
+	QrUrl            string            `json:"qr_url"`
 	ValidationErrors []ValidationError `json:"validation_errors"`
 }
 
 func HandleUrlShortenRequest(w http.ResponseWriter, r *http.Request) {
-	log.Print("/url/shorten hit")
 
 	// Check method for validity
 	allowedMethods := []string{http.MethodPost}
@@ -195,24 +433,21 @@ func HandleUrlShortenRequest(w http.ResponseWriter, r *http.Request) {
 		handleMethodNotAllowed(w, allowedMethods)
 		return
 	}
-	log.Printf("%s /url/shorten allowed", r.Method)
 
 	// Parse request
 	rawJson := parseRawJsonFromHttpBody(r.Body)
 	var requestJson urlShortenRequestJson
 	jsonUnmarshalErr := json.Unmarshal(rawJson, &requestJson)
 	if jsonUnmarshalErr != nil {
-		log.Printf(
-			"Error parsing the Index document response body: %s", jsonUnmarshalErr,
-		)
+		slog.WarnContext(r.Context(), "Error parsing the URL shorten request JSON", "error", jsonUnmarshalErr)
 		handleUnprocessableEntity(w, ResCouldNotParseRequestJson)
 		return
 	}
-	log.Print("Request JSON parsed")
+	slog.DebugContext(r.Context(), "Request JSON parsed")
 
 	// Validate request
 	validation := requestJson.Validate()
-	log.Print("Request JSON validated")
+	slog.DebugContext(r.Context(), "Request JSON validated")
 
 	// Construct response JSON
 	responseJson := urlShortenResponseJson{
@@ -223,7 +458,7 @@ func HandleUrlShortenRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Short-circuit if we have validation errors
 	if validation.Fails() {
-		log.Print("Validation failed...")
+		slog.DebugContext(r.Context(), "Validation failed", "errors", validation.Errors)
 
 		// Encode response JSON
 		encodedJson, _ := json.Marshal(responseJson)
@@ -240,50 +475,347 @@ func HandleUrlShortenRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Provide defaults if we validate request
 	if shortUrlHost == "" {
-		shortUrlHost = App.EnvVars.InternalShortHost
+		shortUrlHost = App.Config().InternalShortHost
 	}
 	if slugLength <= 0 {
-		slugLength = App.EnvVars.MinShortUrlPathLength
+		slugLength = App.Config().MinShortUrlPathLength
+	}
+	if !isShortHostAllowed(w, r, shortUrlHost) {
+		return
 	}
 
 	// Construct and assign short URL
-	log.Print("Constructing and assigning short URL...")
+	slog.DebugContext(r.Context(), "Constructing and assigning short URL...")
+	attributes := urlAttributes{
+		Title:  requestJson.Title,
+		Tags:   requestJson.Tags,
+		Utm:    requestJson.Utm,
+		Params: requestJson.Params,
+		Rules:    requestJson.Rules,
+		Variants: requestJson.Variants,
+
+		MaxClicks: requestJson.MaxClicks,
+	}
+	if key, ok := apiKeyFromRequest(r); ok {
+		attributes.Workspace = key.Workspace
+		attributes.CreatedBy = key.Id
+	}
+	if requestJson.Password != "" {
+		passwordHash, hashErr := hashLinkPassword(requestJson.Password)
+		if hashErr != nil {
+			handleInternalServerError(
+				w,
+				fmt.Sprintf("Could not shorten URL %s", originalUrl),
+			)
+			return
+		}
+		attributes.PasswordHash = passwordHash
+	}
 	shortUrl, shortenErr := App.UsService.ConstructShortUrlAndAssignToOriginalUrl(
-		originalUrl, shortUrlHost, customSlug, slugLength,
+		r.Context(), originalUrl, shortUrlHost, customSlug, slugLength, attributes,
 	)
+	if shortenErr == ErrKgsUnavailable {
+		slog.WarnContext(r.Context(), "Keygensvc is unavailable, failing fast", "original_url", originalUrl)
+		handleServiceUnavailable(
+			w,
+			fmt.Sprintf("Could not shorten URL %s, try again later", originalUrl),
+		)
+		return
+	}
 	if shortenErr != nil {
-		log.Printf("Unable to construct short URL for %s: %s", originalUrl, shortenErr)
+		slog.ErrorContext(r.Context(), "Unable to construct short URL", "original_url", originalUrl, "error", shortenErr)
 		handleInternalServerError(
 			w,
 			fmt.Sprintf("Could not shorten URL %s", originalUrl),
 		)
 		return
 	}
-	log.Print("Constructed and assigned short URL")
+	slog.DebugContext(r.Context(), "Constructed and assigned short URL")
 
 	// Encode response JSON
 	responseJson.ShortUrl = shortUrl
+	responseJson.QrUrl = qrUrlForShortUrl(shortUrl)
 	encodedJson, _ := json.Marshal(responseJson)
-	log.Print("Response encoded")
+	slog.DebugContext(r.Context(), "Response encoded")
 
 	// Send response
 	handleCreated(w, encodedJson)
 }
 
-type urlRedirectExternalRequestJson struct {
-	ShortUrl string `json:"short_url"`
-}
-
-func (r urlRedirectExternalRequestJson) Validate() Validation {
-	var validation Validation
+func validateShortUrl(validation *Validation, shortUrl string) {
 	shortUrlTemplate, _ := regexp.Compile(
 		"^(http|https)://[a-zA-Z0-9\\.]+/[a-zA-Z0-9\\-_]+$",
 	)
-	if !shortUrlTemplate.MatchString(r.ShortUrl) {
+	if !shortUrlTemplate.MatchString(shortUrl) {
 		validation.Append(
-			fmt.Sprintf("Provided short URL is invalid: %s", r.ShortUrl),
+			fmt.Sprintf("Provided short URL is invalid: %s", shortUrl),
+		)
+	}
+}
+
+type urlUpdateRequestJson struct {
+	ShortUrl string            `json:"short_url"`
+	Title    *string           `json:"title"`
+	Tags     []string          `json:"tags"`
+	Utm      *utmParameters    `json:"utm"`
+	Params   map[string]string    `json:"params"`
+	Rules    []redirectRule       `json:"rules"`
+	Variants []destinationVariant `json:"variants"`
+	Password  *string              `json:"password"`
+	MaxClicks *int                 `json:"max_clicks"`
+}
+
+func (r urlUpdateRequestJson) Validate() Validation {
+	var validation Validation
+	validateShortUrl(&validation, r.ShortUrl)
+	title := ""
+	if r.Title != nil {
+		title = *r.Title
+	}
+	validateTitleAndTags(&validation, title, r.Tags)
+	validateUrlAttributes(&validation, r.Utm, r.Params)
+	validateRedirectRules(&validation, r.Rules)
+	validateDestinationVariants(&validation, r.Variants)
+	if r.Password != nil {
+		validateLinkPassword(&validation, *r.Password)
+	}
+	if r.MaxClicks != nil {
+		validateMaxClicks(&validation, *r.MaxClicks)
+	}
+	return validation
+}
+
+type urlUpdateResponseJson struct {
+	ShortUrl         string            `json:"short_url"`
+	ValidationErrors []ValidationError `json:"validation_errors"`
+}
+
+func HandleUrlUpdateRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodPost}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Parse request
+	rawJson := parseRawJsonFromHttpBody(r.Body)
+	var requestJson urlUpdateRequestJson
+	jsonErr := json.Unmarshal(rawJson, &requestJson)
+	if jsonErr != nil {
+		slog.WarnContext(r.Context(), "Error parsing the URL update request JSON", "error", jsonErr)
+		handleUnprocessableEntity(w, ResCouldNotParseRequestJson)
+		return
+	}
+
+	// Validate request
+	validation := requestJson.Validate()
+
+	// Construct response JSON
+	responseJson := urlUpdateResponseJson{
+		ShortUrl:         requestJson.ShortUrl,
+		ValidationErrors: validation.Errors,
+	}
+
+	// Short-circuit if we have validation errors
+	if validation.Fails() {
+		encodedJson, _ := json.Marshal(responseJson)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+	if !isShortHostAllowed(w, r, shortHostForShortUrl(requestJson.ShortUrl)) {
+		return
+	}
+
+	// Construct update, hashing any new password and clearing an empty one
+	update := urlUpdate{
+		Title:    requestJson.Title,
+		Tags:     requestJson.Tags,
+		Utm:      requestJson.Utm,
+		Params:   requestJson.Params,
+		Rules:    requestJson.Rules,
+		Variants: requestJson.Variants,
+
+		MaxClicks: requestJson.MaxClicks,
+	}
+	if requestJson.Password != nil {
+		passwordHash := ""
+		if *requestJson.Password != "" {
+			var hashErr error
+			passwordHash, hashErr = hashLinkPassword(*requestJson.Password)
+			if hashErr != nil {
+				handleInternalServerError(
+					w,
+					fmt.Sprintf("Could not update short URL %s", requestJson.ShortUrl),
+				)
+				return
+			}
+		}
+		update.PasswordHash = &passwordHash
+	}
+
+	// Update short URL
+	updateErr := App.UsService.UpdateShortUrl(
+		r.Context(), requestJson.ShortUrl, workspaceFromRequest(r), update,
+	)
+	if updateErr == ErrCouldNotFindDocumentForShortUrl || updateErr == ErrShortUrlInOtherWorkspace {
+		handleNotFound(w, fmt.Sprintf("No short URL %s", requestJson.ShortUrl))
+		return
+	}
+	if updateErr != nil {
+		slog.ErrorContext(r.Context(), "Error updating short URL", "short_url", requestJson.ShortUrl, "error", updateErr)
+		handleInternalServerError(
+			w,
+			fmt.Sprintf("Could not update short URL %s", requestJson.ShortUrl),
+		)
+		return
+	}
+	slog.InfoContext(r.Context(), "Updated short URL", "short_url", requestJson.ShortUrl)
+
+	// Send response
+	encodedJson, _ := json.Marshal(responseJson)
+	handleOk(w, encodedJson)
+}
+
+// Checks the password for a protected link, responding to the caller when it
+// is missing or incorrect. Interactive callers are served the password form.
+func verifyLinkPassword(
+	w http.ResponseWriter, r *http.Request, shortUrl string, content urlDocumentContent, password string, interactive bool,
+) bool {
+	form := linkPasswordForm{Action: "/url/unlock", ShortUrl: shortUrl}
+
+	// Ask for password when none was given
+	if password == "" {
+		if interactive {
+			handlePasswordForm(w, http.StatusOK, form)
+		} else {
+			handleUnauthorized(w, ResPasswordRequired)
+		}
+		return false
+	}
+
+	// Refuse attempts while too many have recently failed
+	if retryAfter, blocked := App.PasswordAttempts.Blocked(shortUrl); blocked {
+		slog.WarnContext(r.Context(), "Password attempts blocked for short URL", "short_url", shortUrl)
+		handleTooManyRequests(w, retryAfter, ResTooManyPasswordAttempts)
+		return false
+	}
+
+	// Verify password
+	if !content.VerifyPassword(password) {
+		slog.InfoContext(r.Context(), "Incorrect password for short URL", "short_url", shortUrl)
+		App.PasswordAttempts.RecordFailure(shortUrl)
+		if interactive {
+			form.Failed = true
+			handlePasswordForm(w, http.StatusUnauthorized, form)
+		} else {
+			handleUnauthorized(w, ResPasswordIncorrect)
+		}
+		return false
+	}
+
+	return true
+}
+
+func handleRedirect(
+	w http.ResponseWriter, r *http.Request, shortUrl string, password string, interactive bool,
+) {
+	// Get document for short URL, hiding other workspaces' links from callers
+	// confined to a workspace
+	content, getErr := App.UsService.GetUrlDocumentForShortUrl(r.Context(), shortUrl)
+	if getErr == nil && !content.BelongsToWorkspace(workspaceFromRequest(r)) {
+		getErr = ErrShortUrlInOtherWorkspace
+	}
+	if getErr == ErrCouldNotFindDocumentForShortUrl || getErr == ErrShortUrlInOtherWorkspace {
+		handleNotFound(w, fmt.Sprintf("No short URL %s", shortUrl))
+		return
+	}
+	if getErr != nil {
+		slog.ErrorContext(r.Context(), "Error getting original URL for short URL", "short_url", shortUrl, "error", getErr)
+		handleInternalServerError(
+			w,
+			fmt.Sprintf("Could not forward short URL %s", shortUrl),
+		)
+		return
+	}
+
+	serveRedirect(w, r, shortUrl, content, password, interactive)
+}
+
+func serveRedirect(
+	w http.ResponseWriter, r *http.Request, shortUrl string, content urlDocumentContent, password string, interactive bool,
+) {
+	// Require password for protected links
+	if content.IsPasswordProtected() &&
+				!verifyLinkPassword(w, r, shortUrl, content, password, interactive) {
+		return
+	}
+
+	// Count click against the limit for click-limited links
+	if content.IsClickLimited() {
+		consumeErr := ErrShortUrlClickLimitReached
+		if !content.IsClickLimitReached() {
+			consumeErr = App.UsService.ConsumeClickForShortUrl(r.Context(), shortUrl)
+		}
+		if consumeErr == ErrShortUrlClickLimitReached {
+			handleGone(w, ResClickLimitReached)
+			return
+		}
+		if consumeErr != nil {
+			slog.ErrorContext(r.Context(), "Error counting click for short URL", "short_url", shortUrl, "error", consumeErr)
+			handleInternalServerError(
+				w,
+				fmt.Sprintf("Could not forward short URL %s", shortUrl),
+			)
+			return
+		}
+	}
+
+	// Evaluate redirect rules and split variants for client
+	client := newRedirectClient(r, App.GeoIp, App.TrustedProxies)
+	if cookie, cookieErr := r.Cookie(variantCookieName(shortUrl)); cookieErr == nil {
+		client.StickyVariant = cookie.Value
+	}
+	destination, destinationErr := content.DestinationForClient(client)
+	if destinationErr != nil {
+		slog.ErrorContext(r.Context(), "Error constructing destination URL for short URL", "short_url", shortUrl)
+		handleInternalServerError(
+			w,
+			fmt.Sprintf("Could not forward short URL %s", shortUrl),
 		)
+		return
+	}
+
+	// Keep client on the same variant for later visits
+	if destination.Variant != "" {
+		http.SetCookie(w, newVariantCookie(shortUrl, destination.Variant))
 	}
+
+	// Record which destination was served
+	App.Analytics.RecordClick(clickEvent{
+		ShortUrl:       shortUrl,
+		DestinationUrl: destination.Url,
+		Variant:        destination.Variant,
+		Platform:       client.Platform,
+		Country:        client.Country(),
+		Referrer:       r.Referer(),
+		Timestamp:      client.Time,
+	})
+
+	// Redirect to destination URL
+	slog.DebugContext(r.Context(), "Forwarding short URL", "short_url", shortUrl, "destination", destination.Url)
+	handleFound(w, destination.Url)
+}
+
+type urlRedirectExternalRequestJson struct {
+	ShortUrl string `json:"short_url"`
+	Password string `json:"password"`
+}
+
+func (r urlRedirectExternalRequestJson) Validate() Validation {
+	var validation Validation
+	validateShortUrl(&validation, r.ShortUrl)
 	return validation
 }
 
@@ -292,7 +824,6 @@ type urlRedirectExternalResponseJson struct {
 }
 
 func HandleExternalUrlRedirect(w http.ResponseWriter, r *http.Request) {
-	log.Print("/url/redirect hit")
 
 	// Check method for validity
 	allowedMethods := []string{http.MethodPost}
@@ -306,9 +837,7 @@ func HandleExternalUrlRedirect(w http.ResponseWriter, r *http.Request) {
 	var requestJson urlRedirectExternalRequestJson
 	jsonErr := json.Unmarshal(rawJson, &requestJson)
 	if jsonErr != nil {
-		log.Printf(
-			"Error parsing the URL redirect request JSON: %s", jsonErr,
-		)
+		slog.WarnContext(r.Context(), "Error parsing the URL redirect request JSON", "error", jsonErr)
 		handleUnprocessableEntity(w, ResCouldNotParseRequestJson)
 		return
 	}
@@ -330,41 +859,56 @@ func HandleExternalUrlRedirect(w http.ResponseWriter, r *http.Request) {
 		handleBadRequest(w, encodedJson)
 		return
 	}
-
-	// Get original URL
-	originalUrl, getErr := App.UsService.GetOriginalUrlForShortUrl(
-		requestJson.ShortUrl,
-	)
-	if getErr != nil {
-		log.Printf("Error getting original URL for short URL %s", requestJson.ShortUrl)
-		handleInternalServerError(
-			w,
-			fmt.Sprintf("Could not forward short URL %s", requestJson.ShortUrl),
-		)
+	if !isShortHostAllowed(w, r, shortHostForShortUrl(requestJson.ShortUrl)) {
 		return
 	}
 
-	// Redirect to original URL
-	log.Printf("Forwarding %s to %s", requestJson.ShortUrl, originalUrl)
-	handleFound(w, originalUrl)
+	// Redirect to destination URL
+	password := requestJson.Password
+	if password == "" {
+		password = r.Header.Get(LinkPasswordHeader)
+	}
+	handleRedirect(w, r, requestJson.ShortUrl, password, false)
 }
 
-func HandleInternalUrlRedirect(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s hit", r.URL.Path)
+func HandleUrlUnlockRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Check method for validity
-	allowedMethods := []string{http.MethodGet}
+	allowedMethods := []string{http.MethodPost}
 	if !isMethodAllowed(r.Method, allowedMethods) {
 		handleMethodNotAllowed(w, allowedMethods)
 		return
 	}
 
-	shortUrl := fmt.Sprintf("%s%s", App.EnvVars.InternalShortHost, r.URL.Path)
+	// Only unlock internal links that are password-protected, as the form is
+	// only ever served for those. Anything else would let anyone resolve links
+	// without the API key and host check of the external redirect route.
+	shortUrl := r.PostFormValue("short_url")
+	notFound := fmt.Sprintf("No password-protected short URL %s", shortUrl)
+	if shortHostForShortUrl(shortUrl) != App.Config().InternalShortHost {
+		handleNotFound(w, notFound)
+		return
+	}
 
-	// Get original URL
-	originalUrl, err := App.UsService.GetOriginalUrlForShortUrl(shortUrl)
-	if err != nil {
-		log.Printf("Error getting original URL for short URL %s", shortUrl)
+	// Validate submitted form. The internal host may have a port, which short
+	// URLs given to the API may not, so only the path is checked.
+	slugTemplate, _ := regexp.Compile("^/[a-zA-Z0-9\\-_]+$")
+	if !slugTemplate.MatchString(strings.TrimPrefix(shortUrl, App.Config().InternalShortHost)) {
+		var validation Validation
+		validation.Append(fmt.Sprintf("Provided short URL is invalid: %s", shortUrl))
+		encodedJson, _ := json.Marshal(
+			urlRedirectExternalResponseJson{ValidationErrors: validation.Errors},
+		)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+	content, getErr := App.UsService.GetUrlDocumentForShortUrl(r.Context(), shortUrl)
+	if getErr == ErrCouldNotFindDocumentForShortUrl || (getErr == nil && !content.IsPasswordProtected()) {
+		handleNotFound(w, notFound)
+		return
+	}
+	if getErr != nil {
+		slog.ErrorContext(r.Context(), "Error getting original URL for short URL", "short_url", shortUrl, "error", getErr)
 		handleInternalServerError(
 			w,
 			fmt.Sprintf("Could not forward short URL %s", shortUrl),
@@ -372,7 +916,694 @@ func HandleInternalUrlRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Redirect to original URL
-	log.Printf("Forwarding %s to %s", shortUrl, originalUrl)
-	handleFound(w, originalUrl)
+	// Redirect to destination URL once password is verified
+	serveRedirect(w, r, shortUrl, content, r.PostFormValue(LinkPasswordFormField), true)
+}
+
+func HandleInternalUrlRedirect(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodGet}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	shortUrl := fmt.Sprintf("%s%s", App.Config().InternalShortHost, r.URL.Path)
+
+	// Redirect to destination URL
+	handleRedirect(w, r, shortUrl, r.Header.Get(LinkPasswordHeader), true)
+}
+
+// Parses QR code options from query parameters, falling back to defaults
+func parseQrOptions(query url.Values, validation *Validation) qrOptions {
+	options := qrOptions{
+		Format:     QrFormatPng,
+		Size:       DefaultQrSize,
+		Level:      "M",
+		Margin:     DefaultQrMargin,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+
+	if format := query.Get("format"); format != "" {
+		if format != QrFormatPng && format != QrFormatSvg {
+			validation.Append(fmt.Sprintf("Provided format is invalid: %s, must be png or svg", format))
+		}
+		options.Format = format
+	}
+	if size := query.Get("size"); size != "" {
+		parsedSize, parseErr := strconv.Atoi(size)
+		if parseErr != nil || parsedSize < MinQrSize || parsedSize > MaxQrSize {
+			validation.Append(
+				fmt.Sprintf("Provided size is invalid, minimum is %d and maximum is %d", MinQrSize, MaxQrSize),
+			)
+		}
+		options.Size = parsedSize
+	}
+	if margin := query.Get("margin"); margin != "" {
+		parsedMargin, parseErr := strconv.Atoi(margin)
+		if parseErr != nil || parsedMargin < 0 || parsedMargin > MaxQrMargin {
+			validation.Append(
+				fmt.Sprintf("Provided margin is invalid, minimum is 0 and maximum is %d", MaxQrMargin),
+			)
+		}
+		options.Margin = parsedMargin
+	}
+	for _, param := range []struct {
+		name   string
+		target *color.RGBA
+	}{{"fg", &options.Foreground}, {"bg", &options.Background}} {
+		if value := query.Get(param.name); value != "" {
+			parsedColor, ok := parseHexColor(value)
+			if !ok {
+				validation.Append(fmt.Sprintf("Provided %s color is invalid: %s", param.name, value))
+			}
+			*param.target = parsedColor
+		}
+	}
+
+	// Logos cover modules, so default to the highest error correction
+	if logo, _ := strconv.ParseBool(query.Get("logo")); logo {
+		if App.QrLogo == nil {
+			validation.Append("Provided logo option is unavailable, no logo is configured")
+		}
+		options.Logo = App.QrLogo
+		options.Level = "H"
+	}
+	if level := query.Get("level"); level != "" {
+		if _, ok := qrRecoveryLevels[level]; !ok {
+			validation.Append(fmt.Sprintf("Provided error correction level is invalid: %s, must be L, M, Q or H", level))
+		}
+		options.Level = level
+	}
+
+	return options
+}
+
+func HandleQrCodeRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodGet}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Validate request, the slug is already checked by the route
+	var validation Validation
+	shortHost := r.URL.Query().Get("host")
+	if shortHost == "" {
+		shortHost = App.Config().InternalShortHost
+	} else if parsedHost, parseErr := url.Parse(shortHost); parseErr != nil ||
+		(parsedHost.Scheme != "http" && parsedHost.Scheme != "https") ||
+		parsedHost.Host == "" || (parsedHost.Path != "" && parsedHost.Path != "/") {
+		validation.Append(fmt.Sprintf("Provided short host is invalid: %s", shortHost))
+	}
+	options := parseQrOptions(r.URL.Query(), &validation)
+	if validation.Fails() {
+		encodedJson, _ := json.Marshal(
+			urlRedirectExternalResponseJson{ValidationErrors: validation.Errors},
+		)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+
+	// Only render codes for short URLs that exist
+	slug := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/url/"), "/qr")
+	shortUrl := fmt.Sprintf("%s/%s", strings.TrimSuffix(shortHost, "/"), slug)
+	if _, getErr := App.UsService.GetUrlDocumentForShortUrl(r.Context(), shortUrl); getErr != nil {
+		handleNotFound(w, fmt.Sprintf("No short URL %s", shortUrl))
+		return
+	}
+
+	// Render QR code
+	var image []byte
+	var renderErr error
+	contentType := "image/png"
+	if options.Format == QrFormatSvg {
+		image, renderErr = renderQrSvg(shortUrl, options)
+		contentType = "image/svg+xml"
+	} else {
+		image, renderErr = renderQrPng(shortUrl, options)
+	}
+	if renderErr != nil {
+		handleInternalServerError(
+			w,
+			fmt.Sprintf("Could not render QR code for short URL %s", shortUrl),
+		)
+		return
+	}
+
+	// Send response
+	slog.DebugContext(r.Context(), "Returning QR code", "format", options.Format, "short_url", shortUrl)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, _ = w.Write(image)
+}
+
+// Parses search options from query parameters, falling back to defaults
+func parseUrlSearchQuery(query url.Values, validation *Validation) urlSearchQuery {
+	searchQuery := urlSearchQuery{
+		Text:  strings.TrimSpace(query.Get("q")),
+		Tag:   query.Get("tag"),
+		Sort:  query.Get("sort"),
+		Size:  DefaultUrlSearchSize,
+		After: query.Get("after"),
+	}
+
+	if len(searchQuery.Text) > 256 {
+		validation.Append("Provided search text is too long, maximum is 256")
+	}
+	if host := query.Get("host"); host != "" {
+		shortHostTemplate, _ := regexp.Compile("^(http|https)://[a-zA-Z0-9\\.\\-:]+$")
+		if !shortHostTemplate.MatchString(host) {
+			validation.Append(fmt.Sprintf("Provided short host is invalid: %s", host))
+		}
+		searchQuery.ShortHosts = []string{host}
+	}
+	if workspace := query.Get("workspace"); workspace != "" {
+		validateWorkspace(validation, workspace)
+		searchQuery.Workspace = workspace
+	}
+	if createdAfter := query.Get("created_after"); createdAfter != "" {
+		parsedTime, parseErr := time.Parse(time.RFC3339, createdAfter)
+		if parseErr != nil {
+			parsedTime, parseErr = time.Parse("2006-01-02", createdAfter)
+		}
+		if parseErr != nil {
+			validation.Append(
+				fmt.Sprintf("Provided created_after is invalid: %s, must be a date or RFC 3339 time", createdAfter),
+			)
+		}
+		searchQuery.CreatedAfter = &parsedTime
+	}
+	if searchQuery.Sort != "" && !containsString(knownUrlSearchSorts, searchQuery.Sort) {
+		validation.Append(
+			fmt.Sprintf(
+				"Provided sort is invalid: %s, must be one of %s",
+				searchQuery.Sort, strings.Join(knownUrlSearchSorts, ", "),
+			),
+		)
+	}
+	if size := query.Get("size"); size != "" {
+		parsedSize, parseErr := strconv.Atoi(size)
+		if parseErr != nil || parsedSize < 1 || parsedSize > MaxUrlSearchSize {
+			validation.Append(
+				fmt.Sprintf("Provided size is invalid, minimum is 1 and maximum is %d", MaxUrlSearchSize),
+			)
+		}
+		searchQuery.Size = parsedSize
+	}
+	if searchQuery.After != "" {
+		if _, cursorErr := decodeSearchCursor(searchQuery.After); cursorErr != nil {
+			validation.Append("Provided after cursor is invalid")
+		}
+	}
+
+	return searchQuery
+}
+
+type urlSearchResultJson struct {
+	ShortUrl    string     `json:"short_url"`
+	OriginalUrl string     `json:"original_url"`
+	Title       string     `json:"title,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Workspace   string     `json:"workspace,omitempty"`
+	ClickCount  int        `json:"click_count"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+type urlSearchResponseJson struct {
+	Total            int                   `json:"total"`
+	Results          []urlSearchResultJson `json:"results"`
+	Next             string                `json:"next,omitempty"`
+	ValidationErrors []ValidationError     `json:"validation_errors"`
+}
+
+func HandleUrlSearchRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodGet}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Validate request
+	var validation Validation
+	searchQuery := parseUrlSearchQuery(r.URL.Query(), &validation)
+	responseJson := urlSearchResponseJson{
+		Results:          []urlSearchResultJson{},
+		ValidationErrors: validation.Errors,
+	}
+	if validation.Fails() {
+		encodedJson, _ := json.Marshal(responseJson)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+
+	// Confine the search to the caller's workspace and short hosts
+	if workspace := workspaceFromRequest(r); workspace != "" {
+		if searchQuery.Workspace != "" && searchQuery.Workspace != workspace {
+			handleForbidden(w, fmt.Sprintf("API key is not allowed for workspace %s", searchQuery.Workspace))
+			return
+		}
+		searchQuery.Workspace = workspace
+	}
+	if len(searchQuery.ShortHosts) > 0 {
+		if !isShortHostAllowed(w, r, searchQuery.ShortHosts[0]) {
+			return
+		}
+	} else if key, ok := apiKeyFromRequest(r); ok {
+		searchQuery.ShortHosts = key.Hosts
+	}
+
+	// Search short URLs
+	searchResult, searchErr := App.UsService.SearchShortUrls(r.Context(), searchQuery)
+	if searchErr != nil {
+		slog.ErrorContext(r.Context(), "Error searching short URLs", "error", searchErr)
+		handleInternalServerError(w, "Could not search short URLs")
+		return
+	}
+	slog.DebugContext(r.Context(), "Found short URLs", "total", searchResult.Total)
+
+	// Encode response JSON
+	responseJson.Total = searchResult.Total
+	responseJson.Next = searchResult.Next
+	for _, content := range searchResult.Results {
+		responseJson.Results = append(responseJson.Results, urlSearchResultJson{
+			ShortUrl:    content.ShortUrl,
+			OriginalUrl: content.OriginalUrl,
+			Title:       content.Title,
+			Tags:        content.Tags,
+			Workspace:   content.Workspace,
+			ClickCount:  content.ClickCount,
+			CreatedAt:   content.CreatedAt,
+		})
+	}
+	encodedJson, _ := json.Marshal(responseJson)
+
+	// Send response
+	handleOk(w, encodedJson)
+}
+
+func validateWorkspace(validation *Validation, workspace string) {
+	workspaceTemplate, _ := regexp.Compile("^[a-z0-9\\-_]{1,64}$")
+	if !workspaceTemplate.MatchString(workspace) {
+		validation.Append(fmt.Sprintf("Provided workspace is invalid: %s", workspace))
+	}
+}
+
+type apiKeyMintRequestJson struct {
+	Name      string   `json:"name"`
+	Workspace string   `json:"workspace"`
+	Scopes    []string `json:"scopes"`
+	Hosts     []string `json:"hosts"`
+}
+
+func (r apiKeyMintRequestJson) Validate() Validation {
+	var validation Validation
+	if len(r.Name) < 1 || len(r.Name) > 64 {
+		validation.Append("Provided name is invalid, must be between 1 and 64 characters")
+	}
+	if r.Workspace != "" {
+		validateWorkspace(&validation, r.Workspace)
+	}
+	if len(r.Scopes) == 0 {
+		validation.Append("Provided scopes are empty, at least one is required")
+	}
+	for _, scope := range r.Scopes {
+		if !containsString(knownApiKeyScopes, scope) {
+			validation.Append(
+				fmt.Sprintf(
+					"Provided scope is invalid: %s, must be one of %s",
+					scope, strings.Join(knownApiKeyScopes, ", "),
+				),
+			)
+		}
+	}
+	for _, host := range r.Hosts {
+		parsedHost, parseErr := url.Parse(host)
+		if parseErr != nil || (parsedHost.Scheme != "http" && parsedHost.Scheme != "https") ||
+			parsedHost.Host == "" || parsedHost.Path != "" {
+			validation.Append(fmt.Sprintf("Provided short host is invalid: %s", host))
+		}
+	}
+	return validation
+}
+
+type apiKeyMintResponseJson struct {
+	Id               string            `json:"id"`
+	Key              string            `json:"key"`
+	Name             string            `json:"name"`
+	Workspace        string            `json:"workspace"`
+	Scopes           []string          `json:"scopes"`
+	Hosts            []string          `json:"hosts"`
+	ValidationErrors []ValidationError `json:"validation_errors"`
+}
+
+func HandleApiKeyMintRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodPost}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Parse request
+	rawJson := parseRawJsonFromHttpBody(r.Body)
+	var requestJson apiKeyMintRequestJson
+	jsonErr := json.Unmarshal(rawJson, &requestJson)
+	if jsonErr != nil {
+		slog.WarnContext(r.Context(), "Error parsing the API key mint request JSON", "error", jsonErr)
+		handleUnprocessableEntity(w, ResCouldNotParseRequestJson)
+		return
+	}
+
+	// Validate request
+	validation := requestJson.Validate()
+
+	// Construct response JSON
+	responseJson := apiKeyMintResponseJson{
+		Name:             requestJson.Name,
+		Workspace:        requestJson.Workspace,
+		Scopes:           requestJson.Scopes,
+		Hosts:            requestJson.Hosts,
+		ValidationErrors: validation.Errors,
+	}
+
+	// Short-circuit if we have validation errors
+	if validation.Fails() {
+		encodedJson, _ := json.Marshal(responseJson)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+
+	// Confine the key to the caller's workspace
+	if workspace := workspaceFromRequest(r); workspace != "" {
+		if requestJson.Workspace != "" && requestJson.Workspace != workspace {
+			handleForbidden(w, fmt.Sprintf("API key is not allowed for workspace %s", requestJson.Workspace))
+			return
+		}
+		requestJson.Workspace = workspace
+		responseJson.Workspace = workspace
+	}
+
+	// Mint key
+	rawKey, id, mintErr := App.ApiKeys.MintApiKey(
+		r.Context(), requestJson.Name, requestJson.Workspace, requestJson.Scopes, requestJson.Hosts,
+	)
+	if mintErr != nil {
+		handleInternalServerError(
+			w,
+			fmt.Sprintf("Could not mint API key %s", requestJson.Name),
+		)
+		return
+	}
+
+	// Send response, the only time the raw key is revealed
+	responseJson.Id = id
+	responseJson.Key = rawKey
+	encodedJson, _ := json.Marshal(responseJson)
+	handleCreated(w, encodedJson)
+}
+
+type apiKeyRevokeRequestJson struct {
+	Id string `json:"id"`
+}
+
+func (r apiKeyRevokeRequestJson) Validate() Validation {
+	var validation Validation
+	idTemplate, _ := regexp.Compile("^[a-f0-9]{64}$")
+	if !idTemplate.MatchString(r.Id) {
+		validation.Append(fmt.Sprintf("Provided API key id is invalid: %s", r.Id))
+	}
+	return validation
+}
+
+type apiKeyRevokeResponseJson struct {
+	Id               string            `json:"id"`
+	ValidationErrors []ValidationError `json:"validation_errors"`
+}
+
+func HandleApiKeyRevokeRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodPost}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Parse request
+	rawJson := parseRawJsonFromHttpBody(r.Body)
+	var requestJson apiKeyRevokeRequestJson
+	jsonErr := json.Unmarshal(rawJson, &requestJson)
+	if jsonErr != nil {
+		slog.WarnContext(r.Context(), "Error parsing the API key revoke request JSON", "error", jsonErr)
+		handleUnprocessableEntity(w, ResCouldNotParseRequestJson)
+		return
+	}
+
+	// Validate request
+	validation := requestJson.Validate()
+	responseJson := apiKeyRevokeResponseJson{
+		Id:               requestJson.Id,
+		ValidationErrors: validation.Errors,
+	}
+	if validation.Fails() {
+		encodedJson, _ := json.Marshal(responseJson)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+
+	// Revoke key, only in the caller's workspace if it has one
+	revokeErr := App.ApiKeys.RevokeApiKey(r.Context(), requestJson.Id, workspaceFromRequest(r))
+	if revokeErr == ErrApiKeyNotFound {
+		handleNotFound(w, fmt.Sprintf("No API key %s", requestJson.Id))
+		return
+	}
+	if revokeErr != nil {
+		handleInternalServerError(
+			w,
+			fmt.Sprintf("Could not revoke API key %s", requestJson.Id),
+		)
+		return
+	}
+
+	// Send response
+	encodedJson, _ := json.Marshal(responseJson)
+	handleOk(w, encodedJson)
+}
+
+func HandleExportRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodGet}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Validate request
+	var validation Validation
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = LinkFormatJsonl
+	}
+	if !containsString(knownLinkFormats, format) {
+		validation.Append(
+			fmt.Sprintf(
+				"Provided format is invalid: %s, must be one of %s",
+				format, strings.Join(knownLinkFormats, ", "),
+			),
+		)
+	}
+	workspace := r.URL.Query().Get("workspace")
+	if workspace != "" {
+		validateWorkspace(&validation, workspace)
+	}
+	if validation.Fails() {
+		encodedJson, _ := json.Marshal(map[string][]ValidationError{"validation_errors": validation.Errors})
+		handleBadRequest(w, encodedJson)
+		return
+	}
+
+	// Confine the export to the caller's workspace
+	if keyWorkspace := workspaceFromRequest(r); keyWorkspace != "" {
+		if workspace != "" && workspace != keyWorkspace {
+			handleForbidden(w, fmt.Sprintf("API key is not allowed for workspace %s", workspace))
+			return
+		}
+		workspace = keyWorkspace
+	}
+
+	// Stream links as they are scrolled through, for as long as it takes
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", linkFormatContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"links.%s\"", format))
+	encoder := newLinkEncoder(format, w)
+	exported, exportErr := App.UsService.ExportShortUrls(r.Context(), workspace, encoder.Encode)
+	if exportErr != nil && exported == 0 {
+		w.Header().Del("Content-Disposition")
+		handleInternalServerError(w, "Could not export short URLs")
+		return
+	}
+	if flushErr := encoder.Flush(); exportErr == nil {
+		exportErr = flushErr
+	}
+	if exportErr != nil {
+		// Links were already sent, so break off the response rather than let
+		// it pass for a complete export
+		slog.ErrorContext(r.Context(), "Error exporting short URLs", "after", exported, "error", exportErr)
+		panic(http.ErrAbortHandler)
+	}
+	slog.InfoContext(r.Context(), "Exported short URLs", "count", exported)
+}
+
+// Imports are read whole, so that they can be checked before anything is stored
+const MaxImportBytes = 64 << 20
+
+type urlImportResponseJson struct {
+	Total            int               `json:"total"`
+	Created          int               `json:"created"`
+	Overwritten      int               `json:"overwritten"`
+	Skipped          int               `json:"skipped"`
+	Existing         []string          `json:"existing"`
+	DryRun           bool              `json:"dry_run"`
+	ValidationErrors []ValidationError `json:"validation_errors"`
+}
+
+func newUrlImportResponseJson(result urlImportResult, options urlImportOptions) urlImportResponseJson {
+	existing := result.Existing
+	if existing == nil {
+		existing = []string{}
+	}
+	return urlImportResponseJson{
+		Total:       result.Total,
+		Created:     result.Created,
+		Overwritten: result.Overwritten,
+		Skipped:     result.Skipped,
+		Existing:    existing,
+		DryRun:      options.DryRun,
+	}
+}
+
+func HandleImportRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodPost}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Validate options
+	var validation Validation
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = LinkFormatJsonl
+	}
+	if !containsString(knownLinkFormats, format) {
+		validation.Append(
+			fmt.Sprintf(
+				"Provided format is invalid: %s, must be one of %s",
+				format, strings.Join(knownLinkFormats, ", "),
+			),
+		)
+	}
+	options := urlImportOptions{Conflict: query.Get("conflict"), DryRun: query.Get("dry_run") == "true"}
+	if options.Conflict == "" {
+		options.Conflict = ImportConflictFail
+	}
+	if !containsString(knownImportConflicts, options.Conflict) {
+		validation.Append(
+			fmt.Sprintf(
+				"Provided conflict policy is invalid: %s, must be one of %s",
+				options.Conflict, strings.Join(knownImportConflicts, ", "),
+			),
+		)
+	}
+	if dryRun := query.Get("dry_run"); dryRun != "" && dryRun != "true" && dryRun != "false" {
+		validation.Append(fmt.Sprintf("Provided dry_run is invalid: %s, must be true or false", dryRun))
+	}
+
+	// Parse and validate links
+	var links []urlDocumentContent
+	if !validation.Fails() {
+		links = decodeLinks(format, http.MaxBytesReader(w, r.Body, MaxImportBytes), &validation)
+		validateImportedLinks(&validation, links)
+	}
+	responseJson := newUrlImportResponseJson(urlImportResult{Total: len(links)}, options)
+	responseJson.ValidationErrors = validation.Errors
+	if validation.Fails() {
+		slog.DebugContext(r.Context(), "Validation failed", "errors", validation.Errors)
+		encodedJson, _ := json.Marshal(responseJson)
+		handleBadRequest(w, encodedJson)
+		return
+	}
+	slog.DebugContext(r.Context(), "Parsed links to import", "count", len(links))
+
+	// Confine the import to the caller's workspace and short hosts
+	if key, ok := apiKeyFromRequest(r); ok {
+		for i := range links {
+			if key.Workspace != "" && links[i].Workspace != "" && links[i].Workspace != key.Workspace {
+				handleForbidden(w, fmt.Sprintf("API key is not allowed for workspace %s", links[i].Workspace))
+				return
+			}
+			if key.Workspace != "" {
+				links[i].Workspace = key.Workspace
+			}
+			if !isShortHostAllowed(w, r, shortHostForShortUrl(links[i].ShortUrl)) {
+				return
+			}
+		}
+	}
+
+	// Import links
+	result, importErr := App.UsService.ImportShortUrls(r.Context(), links, options)
+	responseJson = newUrlImportResponseJson(result, options)
+	encodedJson, _ := json.Marshal(responseJson)
+	if importErr == ErrImportedShortUrlsExist {
+		handleConflict(w, encodedJson)
+		return
+	}
+	if importErr != nil {
+		slog.ErrorContext(r.Context(), "Error importing short URLs", "error", importErr)
+		handleInternalServerError(w, "Could not import short URLs")
+		return
+	}
+
+	// Send response
+	if options.DryRun {
+		handleOk(w, encodedJson)
+		return
+	}
+	handleCreated(w, encodedJson)
+}
+
+type linkCacheStatsResponseJson struct {
+	Enabled bool `json:"enabled"`
+	linkCacheStats
+}
+
+func HandleLinkCacheStatsRequest(w http.ResponseWriter, r *http.Request) {
+
+	// Check method for validity
+	allowedMethods := []string{http.MethodGet}
+	if !isMethodAllowed(r.Method, allowedMethods) {
+		handleMethodNotAllowed(w, allowedMethods)
+		return
+	}
+
+	// Send response
+	responseJson := linkCacheStatsResponseJson{Enabled: App.LinkCache != nil}
+	if App.LinkCache != nil {
+		responseJson.linkCacheStats = App.LinkCache.Stats()
+	}
+	encodedJson, _ := json.Marshal(responseJson)
+	handleOk(w, encodedJson)
 }
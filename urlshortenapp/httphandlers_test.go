@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockUsService struct {
@@ -14,36 +16,331 @@ type MockUsService struct {
 	error error
 	shortUrl string
 	originalUrl string
+	attributes urlAttributes
 }
 
-func (m MockUsService) TestElasticsearchConnection() bool {
+func (m MockUsService) TestLinkStoreConnection() bool {
 	return m.esIsLive
 }
 
-func (m MockUsService) RefreshElasticsearchIndex() error {
+func (m MockUsService) InitLinkStore() error {
 	return m.error
 }
 
-func (m MockUsService) ConstructShortUrlAndAssignToOriginalUrl(_ string, _ string, _ string, _ int) (string, error) {
+func (m MockUsService) EnsureElasticsearchIndex() error {
+	return m.error
+}
+
+func (m MockUsService) MigrateElasticsearchIndex() error {
+	return m.error
+}
+
+func (m MockUsService) GetElasticsearchIndexStatus() (esIndexStatus, error) {
+	return esIndexStatus{}, m.error
+}
+
+func (m MockUsService) SnapshotElasticsearchIndex(_ string, _ string) error {
+	return m.error
+}
+
+func (m MockUsService) DeleteElasticsearchIndex(_ bool) error {
+	return m.error
+}
+
+func (m MockUsService) ConstructShortUrlAndAssignToOriginalUrl(_ context.Context, _ string, _ string, _ string, _ int, _ urlAttributes) (string, error) {
 	return m.shortUrl, m.error
 }
 
-func (_ MockUsService) constructShortUrl(_ string, _ string, _ int) (string, error) {
+func (_ MockUsService) constructShortUrl(_ context.Context, _ string, _ string, _ string, _ int) (string, error) {
 	return "", nil
 }
 
-func (_ MockUsService) assignShortUrlToOriginalUrl(_ string, _ string) error {
+func (_ MockUsService) assignShortUrlToOriginalUrl(_ context.Context, _ string, _ string, _ urlAttributes) error {
 	return nil
 }
 
-func (m MockUsService) GetOriginalUrlForShortUrl(_ string) (string, error) {
+func (m MockUsService) GetOriginalUrlForShortUrl(_ context.Context, _ string) (string, error) {
 	return m.originalUrl, m.error
 }
 
+func (m MockUsService) GetUrlDocumentForShortUrl(_ context.Context, _ string) (urlDocumentContent, error) {
+	return urlDocumentContent{OriginalUrl: m.originalUrl, urlAttributes: m.attributes}, m.error
+}
+
+func (m MockUsService) ConsumeClickForShortUrl(_ context.Context, _ string) error {
+	return m.error
+}
+
+func (m MockUsService) UpdateShortUrl(_ context.Context, _ string, _ string, _ urlUpdate) error {
+	return m.error
+}
+
+func (m MockUsService) SearchShortUrls(_ context.Context, _ urlSearchQuery) (urlSearchResult, error) {
+	if m.shortUrl == "" {
+		return urlSearchResult{Results: []urlDocumentContent{}}, m.error
+	}
+	return urlSearchResult{
+		Total:   1,
+		Results: []urlDocumentContent{{OriginalUrl: m.originalUrl, ShortUrl: m.shortUrl, urlAttributes: m.attributes}},
+		Next:    "WzFd",
+	}, m.error
+}
+
+func (m MockUsService) ExportShortUrls(_ context.Context, _ string, handleLink func(urlDocumentContent) error) (int, error) {
+	if m.shortUrl == "" {
+		return 0, m.error
+	}
+	content := urlDocumentContent{OriginalUrl: m.originalUrl, ShortUrl: m.shortUrl, urlAttributes: m.attributes}
+	if handleErr := handleLink(content); handleErr != nil {
+		return 0, handleErr
+	}
+	return 1, m.error
+}
+
+func (m MockUsService) ImportShortUrls(_ context.Context, links []urlDocumentContent, _ urlImportOptions) (urlImportResult, error) {
+	return urlImportResult{Total: len(links), Created: len(links)}, m.error
+}
+
+// Reports no clicks on the document, but reaches the limit when counting
+type MockClickLimitReachedUsService struct {
+	MockUsService
+}
+
+func (_ MockClickLimitReachedUsService) ConsumeClickForShortUrl(_ context.Context, _ string) error {
+	return ErrShortUrlClickLimitReached
+}
+
+// Authenticates MockApiKey with every scope and rejects other keys
+type MockApiKeyService struct {
+	key apiKey
+}
+
+const MockApiKey = "usk_mock"
+
+func (_ MockApiKeyService) MintApiKey(_ context.Context, _ string, _ string, _ []string, _ []string) (string, string, error) {
+	return MockApiKey, apiKeyIdForRawKey(MockApiKey), nil
+}
+
+func (m MockApiKeyService) AuthenticateApiKey(_ context.Context, rawKey string) (apiKey, error) {
+	if rawKey != MockApiKey {
+		return apiKey{}, ErrApiKeyNotFound
+	}
+	return m.key, nil
+}
+
+func (_ MockApiKeyService) RevokeApiKey(_ context.Context, id string, _ string) error {
+	if id != apiKeyIdForRawKey(MockApiKey) {
+		return ErrApiKeyNotFound
+	}
+	return nil
+}
+
 var OriginalUsService UrlShortenService
 
-func init() {
-	OriginalUsService = App.UsService
+func TestHandleRedirectWithVariants(t *testing.T) {
+	t.Run("sets sticky variant cookie and records served variant", func(t *testing.T) {
+		App.UsService = MockUsService{
+			esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url",
+			attributes: urlAttributes{Variants: []destinationVariant{{Name: "b", Url: "http://variant.url", Weight: 1}}},
+		}
+		originalAnalytics := App.Analytics
+		mockAnalytics := &MockAnalyticsService{}
+		App.Analytics = mockAnalytics
+		req, err := http.NewRequest("GET", "/some-method", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusFound)
+		}
+		if res.Header().Get("Location") != "http://variant.url" {
+			t.Errorf("Received %s, expected %s", res.Header().Get("Location"), "http://variant.url")
+		}
+		if cookies := res.Result().Cookies(); len(cookies) != 1 || cookies[0].Value != "b" {
+			t.Errorf("Received %v, expected variant cookie for %s", cookies, "b")
+		}
+		if len(mockAnalytics.events) != 1 || mockAnalytics.events[0].Variant != "b" {
+			t.Errorf("Received %v, expected one click event for variant %s", mockAnalytics.events, "b")
+		}
+		App.Analytics = originalAnalytics
+		App.UsService = OriginalUsService
+	})
+}
+
+func TestHandleRedirectWithPassword(t *testing.T) {
+	passwordHash, _ := hashLinkPassword("correct horse")
+	protected := MockUsService{
+		esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url",
+		attributes: urlAttributes{PasswordHash: passwordHash},
+	}
+	newUnlockRequest := func(form string) *http.Request {
+		req := httptest.NewRequest("POST", "/url/unlock", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	defer func(original *RateLimiter) { App.RateLimiter = original }(App.RateLimiter)
+	App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), map[string]RouteRateLimits{})
+	t.Run("returns password form when no password is given", func(t *testing.T) {
+		App.UsService = protected
+		req, err := http.NewRequest("GET", "/some-method", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		if !strings.Contains(res.Body.String(), `action="/url/unlock"`) {
+			t.Errorf("Received %s, expected password form", res.Body.String())
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 401 Unauthorized when API client gives incorrect password", func(t *testing.T) {
+		App.UsService = protected
+		req, err := http.NewRequest(
+			"POST",
+			"/url/redirect",
+			strings.NewReader(`{"short_url": "http://short.url/locked1"}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		req.Header.Set(LinkPasswordHeader, "battery staple")
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusUnauthorized {
+			t.Errorf("Received %d, expected %d", status, http.StatusUnauthorized)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 429 Too Many Requests after repeated failures", func(t *testing.T) {
+		App.UsService = protected
+		var res *httptest.ResponseRecorder
+		for i := 0; i <= App.PasswordAttempts.MaxFailures; i++ {
+			req, err := http.NewRequest(
+				"POST",
+				"/url/unlock",
+				strings.NewReader("short_url=http://localhost:8080/locked2&password=battery+staple"),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			res = httptest.NewRecorder()
+			App.Routes.ServeHTTP(res, req)
+		}
+		if status := res.Code; status != http.StatusTooManyRequests {
+			t.Errorf("Received %d, expected %d", status, http.StatusTooManyRequests)
+		}
+		if res.Header().Get("Retry-After") == "" {
+			t.Error("Received nothing, expected Retry-After header")
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 302 Found when form password is correct", func(t *testing.T) {
+		App.UsService = protected
+		req, err := http.NewRequest(
+			"POST",
+			"/url/unlock",
+			strings.NewReader("short_url=http://localhost:8080/locked3&password=correct+horse"),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusFound)
+		}
+		if res.Header().Get("Location") != "http://original.url" {
+			t.Errorf("Received %s, expected %s", res.Header().Get("Location"), "http://original.url")
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 404 Not Found when unlocking a link that is not protected", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url"}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, newUnlockRequest("short_url=http://localhost:8080/open1"))
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		if location := res.Header().Get("Location"); location != "" {
+			t.Errorf("Received %s, expected no redirect", location)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 404 Not Found when unlocking a link on another host", func(t *testing.T) {
+		App.UsService = protected
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, newUnlockRequest("short_url=http://short.url/locked4&password=correct+horse"))
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 429 Too Many Requests when one IP makes too many attempts", func(t *testing.T) {
+		App.UsService = protected
+		store := NewMemoryRateLimitStore()
+		now := time.Now()
+		store.(*memoryRateLimitStore).now = func() time.Time { return now }
+		App.RateLimiter = NewRateLimiter(store, DefaultRateLimits)
+		var res *httptest.ResponseRecorder
+		for i := 0; i <= DefaultRateLimits["unlock"].PerIp.Burst; i++ {
+			req := newUnlockRequest(fmt.Sprintf("short_url=http://localhost:8080/locked%d&password=battery+staple", 10+i))
+			req.RemoteAddr = "192.0.2.1:1234"
+			res = httptest.NewRecorder()
+			App.Routes.ServeHTTP(res, req)
+		}
+		if status := res.Code; status != http.StatusTooManyRequests {
+			t.Errorf("Received %d, expected %d", status, http.StatusTooManyRequests)
+		}
+		if res.Header().Get(RateLimitLimitHeader) == "" {
+			t.Errorf("Received %v, expected rate limit headers", res.Header())
+		}
+		App.UsService = OriginalUsService
+	})
+}
+
+func TestHandleRedirectWithClickLimit(t *testing.T) {
+	t.Run("returns 410 Gone when click limit is reached", func(t *testing.T) {
+		App.UsService = MockClickLimitReachedUsService{
+			MockUsService{
+				esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url",
+				attributes: urlAttributes{MaxClicks: 1},
+			},
+		}
+		req, err := http.NewRequest("GET", "/some-method", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusGone {
+			t.Errorf("Received %d, expected %d", status, http.StatusGone)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 302 Found while under click limit", func(t *testing.T) {
+		App.UsService = MockUsService{
+			esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url",
+			attributes: urlAttributes{MaxClicks: 1},
+		}
+		req, err := http.NewRequest("GET", "/some-method", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusFound)
+		}
+		App.UsService = OriginalUsService
+	})
 }
 
 func TestHandleIndexRequest(t *testing.T) {
@@ -107,6 +404,7 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusMethodNotAllowed {
@@ -123,6 +421,7 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusUnprocessableEntity {
@@ -151,6 +450,7 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusBadRequest {
@@ -179,6 +479,7 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusInternalServerError {
@@ -189,6 +490,35 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 		}
 		App.UsService = OriginalUsService
 	})
+	t.Run("returns 503 Service Unavailable when keygensvc fails fast", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrKgsUnavailable, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/shorten",
+			strings.NewReader(
+				`
+				{
+					"original_url": "http://successful.url/over/here?params=true",
+					"short_url_host": "",
+					"custom_slug": "",
+					"slug_length": 8
+				}`,
+			),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusServiceUnavailable {
+			t.Errorf("Received %d, expected %d", status, http.StatusServiceUnavailable)
+		}
+		if res.Body.String() != "Service unavailable: Could not shorten URL http://successful.url/over/here?params=true, try again later." {
+			t.Errorf("Received %s, expected %s", res.Body.String(), "Service unavailable: Could not shorten URL http://successful.url/over/here?params=true, try again later.")
+		}
+		App.UsService = OriginalUsService
+	})
 	t.Run("returns 201 Created when successful", func(t *testing.T) {
 		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "http://shrt.url/12345678", originalUrl: ""}
 		req, err := http.NewRequest(
@@ -207,6 +537,7 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusCreated {
@@ -219,6 +550,77 @@ func TestHandleUrlShortenRequest(t *testing.T) {
 	})
 }
 
+func TestHandleUrlUpdateRequest(t *testing.T) {
+	t.Run("returns 405 Method Not Allowed when disallowed method is detected", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest("GET", "/url/update", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusMethodNotAllowed {
+			t.Errorf("Received %d, expected %d", status, http.StatusMethodNotAllowed)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 400 Bad Request when validation errors occur", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/update",
+			strings.NewReader(`{"short_url": "http://short.url/someslug", "params": {"ref": "{unknown}"}}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 404 Not Found when short url does not exist", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrCouldNotFindDocumentForShortUrl, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/update",
+			strings.NewReader(`{"short_url": "http://short.url/someslug", "utm": {"source": "newsletter"}}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 200 OK when successful", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/update",
+			strings.NewReader(`{"short_url": "http://short.url/someslug", "utm": {"source": "newsletter"}}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		App.UsService = OriginalUsService
+	})
+}
+
 func TestHandleExternalUrlRedirect(t *testing.T) {
 	t.Run("returns 405 Method Not Allowed when disallowed method is detected", func(t *testing.T) {
 		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
@@ -226,6 +628,7 @@ func TestHandleExternalUrlRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusMethodNotAllowed {
@@ -242,6 +645,7 @@ func TestHandleExternalUrlRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusUnprocessableEntity {
@@ -262,6 +666,7 @@ func TestHandleExternalUrlRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusBadRequest {
@@ -282,6 +687,7 @@ func TestHandleExternalUrlRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusInternalServerError {
@@ -303,6 +709,7 @@ func TestHandleExternalUrlRedirect(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
 		res := httptest.NewRecorder()
 		App.Routes.ServeHTTP(res, req)
 		if status := res.Code; status != http.StatusFound {
@@ -343,12 +750,25 @@ func TestHandleInternalUrlRedirect(t *testing.T) {
 		if status := res.Code; status != http.StatusInternalServerError {
 			t.Errorf("Received %d, expected %d", status, http.StatusInternalServerError)
 		}
-		expected := fmt.Sprintf("Internal server error: Could not forward short URL %s/some-method.", App.EnvVars.InternalShortHost)
+		expected := fmt.Sprintf("Internal server error: Could not forward short URL %s/some-method.", App.Config().InternalShortHost)
 		if res.Body.String() != expected {
 			t.Errorf("Received %s, expected %s", res.Body.String(), expected)
 		}
 		App.UsService = OriginalUsService
 	})
+	t.Run("returns 404 Not Found when short url does not exist", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrCouldNotFindDocumentForShortUrl, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest("GET", "/some-method", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		App.UsService = OriginalUsService
+	})
 	t.Run("returns 302 Found when successful", func(t *testing.T) {
 		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url"}
 		req, err := http.NewRequest("GET", "/some-method", nil)
@@ -366,3 +786,512 @@ func TestHandleInternalUrlRedirect(t *testing.T) {
 		App.UsService = OriginalUsService
 	})
 }
+
+func TestHandleQrCodeRequest(t *testing.T) {
+	t.Run("returns 405 Method Not Allowed when disallowed method is detected", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest("POST", "/url/someslug/qr", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusMethodNotAllowed {
+			t.Errorf("Received %d, expected %d", status, http.StatusMethodNotAllowed)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 400 Bad Request when validation errors occur", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest("GET", "/url/someslug/qr?format=gif&size=10&fg=nothex", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 404 Not Found when short url does not exist", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrCouldNotFindDocumentForShortUrl, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest("GET", "/url/someslug/qr", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 200 OK with png when successful", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url"}
+		req, err := http.NewRequest("GET", "/url/someslug/qr", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != "image/png" {
+			t.Errorf("Received %s, expected %s", contentType, "image/png")
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 200 OK with svg when requested", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url"}
+		req, err := http.NewRequest("GET", "/url/someslug/qr?format=svg&level=Q&fg=333&bg=ffffff", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != "image/svg+xml" {
+			t.Errorf("Received %s, expected %s", contentType, "image/svg+xml")
+		}
+		App.UsService = OriginalUsService
+	})
+}
+
+func TestHandleApiKeyMintRequest(t *testing.T) {
+	t.Run("returns 400 Bad Request when validation errors occur", func(t *testing.T) {
+		req, err := http.NewRequest(
+			"POST",
+			"/admin/apikeys",
+			strings.NewReader(`{"name": "ci", "scopes": ["everything"], "hosts": ["shrt.url"]}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+	})
+	t.Run("returns 201 Created with the raw key when successful", func(t *testing.T) {
+		req, err := http.NewRequest(
+			"POST",
+			"/admin/apikeys",
+			strings.NewReader(`{"name": "ci", "scopes": ["shorten"], "hosts": ["http://shrt.url"]}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusCreated {
+			t.Errorf("Received %d, expected %d", status, http.StatusCreated)
+		}
+		if !strings.Contains(res.Body.String(), MockApiKey) {
+			t.Errorf("Received %s, expected key %s", res.Body.String(), MockApiKey)
+		}
+	})
+	t.Run("returns 403 Forbidden when minting for another workspace", func(t *testing.T) {
+		originalApiKeys := App.ApiKeys
+		defer func() { App.ApiKeys = originalApiKeys }()
+		App.ApiKeys = MockApiKeyService{key: apiKey{Name: "team-b", Workspace: "team-b", Scopes: []string{ApiKeyScopeAdmin}}}
+		req, _ := http.NewRequest(
+			"POST",
+			"/admin/apikeys",
+			strings.NewReader(`{"name": "ci", "workspace": "team-a", "scopes": ["shorten"]}`),
+		)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+	})
+	t.Run("mints keys in the caller's workspace when none is given", func(t *testing.T) {
+		originalApiKeys := App.ApiKeys
+		defer func() { App.ApiKeys = originalApiKeys }()
+		App.ApiKeys = MockApiKeyService{key: apiKey{Name: "team-b", Workspace: "team-b", Scopes: []string{ApiKeyScopeAdmin}}}
+		req, _ := http.NewRequest("POST", "/admin/apikeys", strings.NewReader(`{"name": "ci", "scopes": ["shorten"]}`))
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if !strings.Contains(res.Body.String(), `"workspace":"team-b"`) {
+			t.Errorf("Received %s, expected key in workspace %s", res.Body.String(), "team-b")
+		}
+	})
+}
+
+func TestHandleApiKeyRevokeRequest(t *testing.T) {
+	t.Run("returns 404 Not Found when key does not exist", func(t *testing.T) {
+		req, err := http.NewRequest(
+			"POST",
+			"/admin/apikeys/revoke",
+			strings.NewReader(fmt.Sprintf(`{"id": "%s"}`, strings.Repeat("a", 64))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+	})
+	t.Run("returns 200 OK when successful", func(t *testing.T) {
+		req, err := http.NewRequest(
+			"POST",
+			"/admin/apikeys/revoke",
+			strings.NewReader(fmt.Sprintf(`{"id": "%s"}`, apiKeyIdForRawKey(MockApiKey))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+	})
+}
+
+func TestWorkspaceIsolation(t *testing.T) {
+	originalApiKeys := App.ApiKeys
+	defer func() { App.ApiKeys = originalApiKeys }()
+	App.ApiKeys = MockApiKeyService{
+		key: apiKey{Name: "team-b", Workspace: "team-b", Scopes: []string{ApiKeyScopeManage, ApiKeyScopeStats}},
+	}
+
+	t.Run("returns 404 Not Found when updating another workspace's link", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrShortUrlInOtherWorkspace, shortUrl: "", originalUrl: ""}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/update",
+			strings.NewReader(`{"short_url": "http://short.url/someslug", "max_clicks": 5}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("does not resolve another workspace's link", func(t *testing.T) {
+		App.UsService = MockUsService{
+			esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url",
+			attributes: urlAttributes{Workspace: "team-a"},
+		}
+		req, err := http.NewRequest(
+			"POST",
+			"/url/redirect",
+			strings.NewReader(`{"short_url": "http://short.url/someslug"}`),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusNotFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusNotFound)
+		}
+		if location := res.Header().Get("Location"); location != "" {
+			t.Errorf("Received %s, expected no redirect", location)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("still redirects public requests for any workspace's link", func(t *testing.T) {
+		App.UsService = MockUsService{
+			esIsLive: true, error: nil, shortUrl: "", originalUrl: "http://original.url",
+			attributes: urlAttributes{Workspace: "team-a"},
+		}
+		req, err := http.NewRequest("GET", "/someslug", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusFound {
+			t.Errorf("Received %d, expected %d", status, http.StatusFound)
+		}
+		App.UsService = OriginalUsService
+	})
+}
+
+// Records the search query it receives
+type MockSearchUsService struct {
+	MockUsService
+	query *urlSearchQuery
+}
+
+func (m MockSearchUsService) SearchShortUrls(_ context.Context, query urlSearchQuery) (urlSearchResult, error) {
+	*m.query = query
+	return m.MockUsService.SearchShortUrls(context.Background(), query)
+}
+
+func TestHandleUrlSearchRequest(t *testing.T) {
+	t.Run("returns 200 OK with results and next cursor", func(t *testing.T) {
+		App.UsService = MockUsService{
+			esIsLive: true, error: nil, shortUrl: "http://shrt.url/abc123", originalUrl: "http://example.com",
+			attributes: urlAttributes{Title: "Example", Tags: []string{"launch"}},
+		}
+		req, err := http.NewRequest("GET", "/url?q=example.com&tag=launch&created_after=2021-10-01", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		expected := `{"total":1,"results":[{"short_url":"http://shrt.url/abc123","original_url":"http://example.com","title":"Example","tags":["launch"],"click_count":0}],"next":"WzFd","validation_errors":null}`
+		if body := res.Body.String(); body != expected {
+			t.Errorf("Received %s, expected %s", body, expected)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 400 Bad Request when parameters are invalid", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true}
+		req, err := http.NewRequest("GET", "/url?sort=random&size=1000&created_after=yesterday&after=!", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+		if count := strings.Count(res.Body.String(), "Provided"); count != 4 {
+			t.Errorf("Received %d validation errors, expected %d", count, 4)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 500 Internal Server Error when search fails", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrCouldNotSearchShortUrls}
+		req, err := http.NewRequest("GET", "/url?q=example", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusInternalServerError {
+			t.Errorf("Received %d, expected %d", status, http.StatusInternalServerError)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("confines search to the caller's workspace and hosts", func(t *testing.T) {
+		originalApiKeys := App.ApiKeys
+		App.ApiKeys = MockApiKeyService{key: apiKey{
+			Name: "team-b", Workspace: "team-b", Scopes: []string{ApiKeyScopeStats}, Hosts: []string{"http://b.url"},
+		}}
+		var query urlSearchQuery
+		App.UsService = MockSearchUsService{MockUsService{esIsLive: true}, &query}
+
+		req, _ := http.NewRequest("GET", "/url", nil)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if query.Workspace != "team-b" || len(query.ShortHosts) != 1 || query.ShortHosts[0] != "http://b.url" {
+			t.Errorf("Received %s and %v, expected %s and %v", query.Workspace, query.ShortHosts, "team-b", []string{"http://b.url"})
+		}
+
+		req, _ = http.NewRequest("GET", "/url?workspace=team-a", nil)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res = httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+
+		req, _ = http.NewRequest("GET", "/url?host=http://a.url", nil)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res = httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusForbidden {
+			t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+		}
+
+		App.ApiKeys = originalApiKeys
+		App.UsService = OriginalUsService
+	})
+}
+
+func TestHandleExportRequest(t *testing.T) {
+	t.Run("returns 200 OK with links as CSV", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, shortUrl: "http://shrt.url/abc123", originalUrl: "http://example.com"}
+		req, err := http.NewRequest("GET", "/admin/export?format=csv", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "http://shrt.url/abc123,http://example.com,") {
+			t.Errorf("Received %s, expected header and one link", res.Body.String())
+		}
+		if contentType := res.Header().Get("Content-Type"); contentType != "text/csv; charset=utf-8" {
+			t.Errorf("Received %s, expected %s", contentType, "text/csv; charset=utf-8")
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 400 Bad Request when format is unknown", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true}
+		req, _ := http.NewRequest("GET", "/admin/export?format=xml", nil)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 500 Internal Server Error when nothing could be exported", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrCouldNotExportShortUrls}
+		req, _ := http.NewRequest("GET", "/admin/export", nil)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusInternalServerError {
+			t.Errorf("Received %d, expected %d", status, http.StatusInternalServerError)
+		}
+		App.UsService = OriginalUsService
+	})
+}
+
+// Records the links and options it was asked to import
+type MockImportUsService struct {
+	MockUsService
+	links   *[]urlDocumentContent
+	options *urlImportOptions
+}
+
+func (m MockImportUsService) ImportShortUrls(ctx context.Context, links []urlDocumentContent, options urlImportOptions) (urlImportResult, error) {
+	*m.links = links
+	*m.options = options
+	return m.MockUsService.ImportShortUrls(ctx, links, options)
+}
+
+func TestHandleImportRequest(t *testing.T) {
+	body := "{\"short_url\": \"http://b.url/abc123\", \"original_url\": \"http://example.com\"}\n"
+
+	t.Run("returns 201 Created with import counts", func(t *testing.T) {
+		var links []urlDocumentContent
+		var options urlImportOptions
+		App.UsService = MockImportUsService{MockUsService{esIsLive: true}, &links, &options}
+		req, err := http.NewRequest("POST", "/admin/import?conflict=skip", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusCreated {
+			t.Errorf("Received %d, expected %d", status, http.StatusCreated)
+		}
+		expected := `{"total":1,"created":1,"overwritten":0,"skipped":0,"existing":[],"dry_run":false,"validation_errors":null}`
+		if res.Body.String() != expected {
+			t.Errorf("Received %s, expected %s", res.Body.String(), expected)
+		}
+		if options.Conflict != ImportConflictSkip || len(links) != 1 {
+			t.Errorf("Received %+v and %d links, expected %s and 1 link", options, len(links), ImportConflictSkip)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 400 Bad Request when links are invalid", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true}
+		req, _ := http.NewRequest(
+			"POST", "/admin/import?format=csv&conflict=merge",
+			strings.NewReader("short_url,original_url\nhttp://b.url/abc123,http://example.com\n"),
+		)
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+
+		req, _ = http.NewRequest("POST", "/admin/import", strings.NewReader(body+"{\"short_url\": \"nope\"}\n"))
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res = httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusBadRequest {
+			t.Errorf("Received %d, expected %d", status, http.StatusBadRequest)
+		}
+		if !strings.Contains(res.Body.String(), "Link 2: Provided short URL is invalid") {
+			t.Errorf("Received %s, expected error for link 2", res.Body.String())
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 409 Conflict when links exist and policy is fail", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true, error: ErrImportedShortUrlsExist}
+		req, _ := http.NewRequest("POST", "/admin/import", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusConflict {
+			t.Errorf("Received %d, expected %d", status, http.StatusConflict)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("returns 200 OK on a dry run", func(t *testing.T) {
+		App.UsService = MockUsService{esIsLive: true}
+		req, _ := http.NewRequest("POST", "/admin/import?dry_run=true", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if status := res.Code; status != http.StatusOK {
+			t.Errorf("Received %d, expected %d", status, http.StatusOK)
+		}
+		App.UsService = OriginalUsService
+	})
+	t.Run("confines import to the caller's workspace and hosts", func(t *testing.T) {
+		originalApiKeys := App.ApiKeys
+		App.ApiKeys = MockApiKeyService{key: apiKey{
+			Name: "team-b", Workspace: "team-b", Scopes: []string{ApiKeyScopeAdmin}, Hosts: []string{"http://b.url"},
+		}}
+		var links []urlDocumentContent
+		var options urlImportOptions
+		App.UsService = MockImportUsService{MockUsService{esIsLive: true}, &links, &options}
+
+		req, _ := http.NewRequest("POST", "/admin/import", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+MockApiKey)
+		res := httptest.NewRecorder()
+		App.Routes.ServeHTTP(res, req)
+		if len(links) != 1 || links[0].Workspace != "team-b" {
+			t.Errorf("Received %+v, expected link in workspace %s", links, "team-b")
+		}
+
+		for _, forbidden := range []string{
+			"{\"short_url\": \"http://b.url/abc123\", \"original_url\": \"http://example.com\", \"workspace\": \"team-a\"}\n",
+			"{\"short_url\": \"http://a.url/abc123\", \"original_url\": \"http://example.com\"}\n",
+		} {
+			req, _ = http.NewRequest("POST", "/admin/import", strings.NewReader(forbidden))
+			req.Header.Set("Authorization", "Bearer "+MockApiKey)
+			res = httptest.NewRecorder()
+			App.Routes.ServeHTTP(res, req)
+			if status := res.Code; status != http.StatusForbidden {
+				t.Errorf("Received %d, expected %d", status, http.StatusForbidden)
+			}
+		}
+		App.ApiKeys = originalApiKeys
+		App.UsService = OriginalUsService
+	})
+}
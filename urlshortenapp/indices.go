@@ -0,0 +1,369 @@
+package main
+
+// Versioned Elasticsearch indices for links, read and written through an
+// alias so that mappings can change without downtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// Bump when urlIndexBody changes, then run index migrate. Version 1 is the
+// index created with dynamic mappings, before aliases were used.
+const UrlIndexVersion = 2
+
+var (
+	ErrCouldNotEnsureElasticsearchIndex    = errors.New("could not ensure elasticsearch index")
+	ErrCouldNotMigrateElasticsearchIndex   = errors.New("could not migrate elasticsearch index")
+	ErrCouldNotGetElasticsearchIndexStatus = errors.New("could not get elasticsearch index status")
+	ErrCouldNotSnapshotElasticsearchIndex  = errors.New("could not snapshot elasticsearch index")
+	ErrCouldNotDeleteElasticsearchIndex    = errors.New("could not delete elasticsearch index")
+	ErrElasticsearchIndexDoesNotExist      = errors.New("elasticsearch index does not exist")
+	ErrElasticsearchIndexNotEmpty          = errors.New("elasticsearch index is not empty")
+)
+
+type esIndexSettings struct {
+	Shards   int
+	Replicas int
+}
+
+func versionedIndexName(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d", alias, version)
+}
+
+// Original URLs are split on anything but letters and digits, so that a
+// search for a domain such as example.com matches links pointing at it.
+// Fields only read back with the link, such as parameters, are not indexed.
+func urlIndexBody(settings esIndexSettings) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{
+	"settings": {
+		"number_of_shards": %d,
+		"number_of_replicas": %d,
+		"analysis": {
+			"tokenizer": {
+				"url_parts": {"type": "pattern", "pattern": "[^\\p{L}\\p{N}]+"}
+			},
+			"analyzer": {
+				"url": {"type": "custom", "tokenizer": "url_parts", "filter": ["lowercase"]}
+			}
+		}
+	},
+	"mappings": {
+		"dynamic": false,
+		"properties": {
+			"original_url": {
+				"type": "text",
+				"analyzer": "url",
+				"fields": {"keyword": {"type": "keyword", "ignore_above": 2048}}
+			},
+			"short_url": {"type": "keyword"},
+			"title": {"type": "text"},
+			"tags": {"type": "text", "fields": {"keyword": {"type": "keyword"}}},
+			"workspace": {"type": "keyword"},
+			"created_by": {"type": "keyword"},
+			"created_at": {"type": "date"},
+			"click_count": {"type": "integer"},
+			"max_clicks": {"type": "integer"},
+			"password_hash": {"type": "keyword", "index": false},
+			"utm": {
+				"properties": {
+					"source": {"type": "keyword"},
+					"medium": {"type": "keyword"},
+					"campaign": {"type": "keyword"},
+					"term": {"type": "keyword"},
+					"content": {"type": "keyword"}
+				}
+			},
+			"params": {"type": "object", "enabled": false},
+			"rules": {
+				"type": "nested",
+				"properties": {
+					"url": {"type": "keyword", "index": false},
+					"platforms": {"type": "keyword"},
+					"languages": {"type": "keyword"},
+					"countries": {"type": "keyword"},
+					"starts_at": {"type": "date"},
+					"ends_at": {"type": "date"},
+					"percentage": {"type": "integer"}
+				}
+			},
+			"variants": {
+				"type": "nested",
+				"properties": {
+					"name": {"type": "keyword"},
+					"url": {"type": "keyword", "index": false},
+					"weight": {"type": "integer"}
+				}
+			}
+		}
+	}
+}`, settings.Shards, settings.Replicas))
+}
+
+// Creates the current index and its alias when neither exists, such as on
+// first start. Older indices are left for index migrate.
+func (s esLinkStore) EnsureElasticsearchIndex() error {
+	indices, isAlias, resolveErr := s.EsService.ResolveIndex(context.Background(), s.EsIndex)
+	if resolveErr != nil {
+		slog.Error("Error resolving Elasticsearch index", "es_index", s.EsIndex, "error", resolveErr)
+		return ErrCouldNotEnsureElasticsearchIndex
+	}
+
+	currentIndex := versionedIndexName(s.EsIndex, UrlIndexVersion)
+	switch {
+	case len(indices) == 0:
+		if createErr := s.createAliasedIndex(currentIndex); createErr != nil {
+			return ErrCouldNotEnsureElasticsearchIndex
+		}
+		slog.Info("Created Elasticsearch index behind alias", "index", currentIndex, "es_index", s.EsIndex)
+	case !isAlias || !containsString(indices, currentIndex):
+		slog.Warn(
+			"Elasticsearch index is not at the current version, run index migrate",
+			"es_index", s.EsIndex, "indices", indices, "current_index", currentIndex,
+		)
+	}
+	return nil
+}
+
+func (s esLinkStore) createAliasedIndex(index string) error {
+	if createErr := s.EsService.CreateIndex(context.Background(), index, urlIndexBody(s.IndexSettings)); createErr != nil {
+		slog.Error("Error creating Elasticsearch index", "index", index, "error", createErr)
+		return createErr
+	}
+	if aliasErr := s.EsService.UpdateAliases(context.Background(), []AliasAction{AddAlias(index, s.EsIndex)}); aliasErr != nil {
+		slog.Error("Error adding alias", "es_index", s.EsIndex, "to", index, "error", aliasErr)
+		return aliasErr
+	}
+	return nil
+}
+
+// Copies links into a new index with the current mappings and switches the
+// alias to it. Links written to the old index while copying are picked up by
+// a second pass, newer versions winning.
+//
+// An index from before aliases shares the alias's name, so it has to be
+// removed in the same step the alias is added. Its second pass runs just
+// before the switch, leaving a moment where writes can be lost; migrate it
+// while traffic is quiet. Older aliased indices are kept for rolling back.
+func (s esLinkStore) MigrateElasticsearchIndex() error {
+	indices, isAlias, resolveErr := s.EsService.ResolveIndex(context.Background(), s.EsIndex)
+	if resolveErr != nil {
+		slog.Error("Error resolving Elasticsearch index", "es_index", s.EsIndex, "error", resolveErr)
+		return ErrCouldNotMigrateElasticsearchIndex
+	}
+
+	// Create the index, or stop if the alias already points at it
+	currentIndex := versionedIndexName(s.EsIndex, UrlIndexVersion)
+	if len(indices) == 0 {
+		if createErr := s.createAliasedIndex(currentIndex); createErr != nil {
+			return ErrCouldNotMigrateElasticsearchIndex
+		}
+		slog.Info("Nothing to migrate, created Elasticsearch index", "index", currentIndex)
+		return nil
+	}
+	if isAlias && len(indices) == 1 && indices[0] == currentIndex {
+		slog.Info("Elasticsearch index is already at the current version", "es_index", s.EsIndex, "current_index", currentIndex)
+		return nil
+	}
+	if createErr := s.EsService.CreateIndex(context.Background(), currentIndex, urlIndexBody(s.IndexSettings)); createErr != nil {
+		return ErrCouldNotMigrateElasticsearchIndex
+	}
+
+	// Copy links, catching up on changes before the switch when the old
+	// index is about to be removed
+	passes := 1
+	if !isAlias {
+		passes = 2
+	}
+	if copyErr := s.reindexAll(indices, currentIndex, passes); copyErr != nil {
+		return ErrCouldNotMigrateElasticsearchIndex
+	}
+
+	// Switch alias
+	var actions []AliasAction
+	for _, index := range indices {
+		if isAlias {
+			actions = append(actions, RemoveAlias(index, s.EsIndex))
+		} else {
+			actions = append(actions, RemoveIndex(index))
+		}
+	}
+	actions = append(actions, AddAlias(currentIndex, s.EsIndex))
+	if aliasErr := s.EsService.UpdateAliases(context.Background(), actions); aliasErr != nil {
+		slog.Error("Error switching alias", "es_index", s.EsIndex, "to", currentIndex, "error", aliasErr)
+		return ErrCouldNotMigrateElasticsearchIndex
+	}
+	slog.Info("Switched alias", "es_index", s.EsIndex, "from", indices, "to", currentIndex)
+
+	// Copy links written to the old index before the switch
+	if isAlias {
+		if copyErr := s.reindexAll(indices, currentIndex, 1); copyErr != nil {
+			return ErrCouldNotMigrateElasticsearchIndex
+		}
+		slog.Info("Old indices can be deleted once the current index is verified", "indices", indices, "current_index", currentIndex)
+	}
+
+	return nil
+}
+
+func (s esLinkStore) reindexAll(sourceIndices []string, destIndex string, passes int) error {
+	for pass := 1; pass <= passes; pass++ {
+		for _, sourceIndex := range sourceIndices {
+			copied, reindexErr := s.EsService.Reindex(context.Background(), sourceIndex, destIndex)
+			if reindexErr != nil {
+				slog.Error("Error reindexing", "source_index", sourceIndex, "dest_index", destIndex, "error", reindexErr)
+				return reindexErr
+			}
+			slog.Info("Copied links", "count", copied, "source_index", sourceIndex, "dest_index", destIndex)
+		}
+	}
+	return nil
+}
+
+type esIndexStatus struct {
+	Alias        string
+	IsAlias      bool
+	CurrentIndex string
+	Indices      map[string]int // Document count per index behind the alias
+}
+
+// Up to date when the alias points at the current index alone
+func (s esIndexStatus) IsCurrent() bool {
+	_, ok := s.Indices[s.CurrentIndex]
+	return s.IsAlias && ok && len(s.Indices) == 1
+}
+
+func (s esLinkStore) GetElasticsearchIndexStatus() (esIndexStatus, error) {
+	status := esIndexStatus{
+		Alias:        s.EsIndex,
+		CurrentIndex: versionedIndexName(s.EsIndex, UrlIndexVersion),
+		Indices:      map[string]int{},
+	}
+
+	indices, isAlias, resolveErr := s.EsService.ResolveIndex(context.Background(), s.EsIndex)
+	if resolveErr != nil {
+		slog.Error("Error resolving Elasticsearch index", "es_index", s.EsIndex, "error", resolveErr)
+		return esIndexStatus{}, ErrCouldNotGetElasticsearchIndexStatus
+	}
+	status.IsAlias = isAlias
+	for _, index := range indices {
+		count, countErr := s.EsService.CountDocuments(context.Background(), index)
+		if countErr != nil {
+			slog.Error("Error counting links", "index", index, "error", countErr)
+			return esIndexStatus{}, ErrCouldNotGetElasticsearchIndexStatus
+		}
+		status.Indices[index] = count
+	}
+
+	return status, nil
+}
+
+func (s esLinkStore) SnapshotElasticsearchIndex(repository string, snapshot string) error {
+	indices, _, resolveErr := s.EsService.ResolveIndex(context.Background(), s.EsIndex)
+	if resolveErr != nil {
+		slog.Error("Error resolving Elasticsearch index", "es_index", s.EsIndex, "error", resolveErr)
+		return ErrCouldNotSnapshotElasticsearchIndex
+	}
+	if len(indices) == 0 {
+		slog.Info("Elasticsearch index does not exist", "es_index", s.EsIndex)
+		return ErrElasticsearchIndexDoesNotExist
+	}
+	if snapshotErr := s.EsService.CreateSnapshot(context.Background(), repository, snapshot, indices); snapshotErr != nil {
+		return ErrCouldNotSnapshotElasticsearchIndex
+	}
+	slog.Info("Snapshotted Elasticsearch indices", "indices", indices, "snapshot", snapshot, "repository", repository)
+	return nil
+}
+
+// Deletes every index behind the alias, which removes the alias with them.
+// Indices holding links are only deleted when forced.
+func (s esLinkStore) DeleteElasticsearchIndex(force bool) error {
+	status, statusErr := s.GetElasticsearchIndexStatus()
+	if statusErr != nil {
+		return ErrCouldNotDeleteElasticsearchIndex
+	}
+	if len(status.Indices) == 0 {
+		slog.Info("Elasticsearch index does not exist, nothing to delete", "es_index", s.EsIndex)
+		return nil
+	}
+
+	var indices []string
+	total := 0
+	for index, count := range status.Indices {
+		indices = append(indices, index)
+		total += count
+	}
+	sort.Strings(indices)
+	if total > 0 && !force {
+		slog.Warn("Elasticsearch index holds links, not deleting without force", "es_index", s.EsIndex, "count", total)
+		return ErrElasticsearchIndexNotEmpty
+	}
+
+	if deleteErr := s.EsService.DeleteIndices(context.Background(), indices); deleteErr != nil {
+		slog.Error("Error deleting Elasticsearch indices", "error", deleteErr)
+		return ErrCouldNotDeleteElasticsearchIndex
+	}
+	slog.Info("Deleted Elasticsearch indices", "indices", indices, "count", total)
+	return nil
+}
+
+// Index administration only applies when links are stored in Elasticsearch
+
+func (s urlShortenService) elasticsearchLinks() (*esLinkStore, error) {
+	links := s.Links
+	for {
+		if esLinks, ok := links.(*esLinkStore); ok {
+			return esLinks, nil
+		}
+		wrapper, ok := links.(linkStoreWrapper)
+		if !ok {
+			slog.Info("Links are not stored in Elasticsearch, there is no index to manage")
+			return nil, ErrLinkStoreNotElasticsearch
+		}
+		links = wrapper.Unwrap()
+	}
+}
+
+func (s urlShortenService) EnsureElasticsearchIndex() error {
+	esLinks, storeErr := s.elasticsearchLinks()
+	if storeErr != nil {
+		return storeErr
+	}
+	return esLinks.EnsureElasticsearchIndex()
+}
+
+func (s urlShortenService) MigrateElasticsearchIndex() error {
+	esLinks, storeErr := s.elasticsearchLinks()
+	if storeErr != nil {
+		return storeErr
+	}
+	return esLinks.MigrateElasticsearchIndex()
+}
+
+func (s urlShortenService) GetElasticsearchIndexStatus() (esIndexStatus, error) {
+	esLinks, storeErr := s.elasticsearchLinks()
+	if storeErr != nil {
+		return esIndexStatus{}, storeErr
+	}
+	return esLinks.GetElasticsearchIndexStatus()
+}
+
+func (s urlShortenService) SnapshotElasticsearchIndex(repository string, snapshot string) error {
+	esLinks, storeErr := s.elasticsearchLinks()
+	if storeErr != nil {
+		return storeErr
+	}
+	return esLinks.SnapshotElasticsearchIndex(repository, snapshot)
+}
+
+func (s urlShortenService) DeleteElasticsearchIndex(force bool) error {
+	esLinks, storeErr := s.elasticsearchLinks()
+	if storeErr != nil {
+		return storeErr
+	}
+	return esLinks.DeleteElasticsearchIndex(force)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Resolves the alias to the given indices and records what is done to them
+type MockIndexEsService struct {
+	MockEsService
+	indices []string
+	isAlias bool
+	counts  map[string]int
+	calls   *[]string
+}
+
+func (m MockIndexEsService) ResolveIndex(_ context.Context, _ string) ([]string, bool, error) {
+	return m.indices, m.isAlias, m.error
+}
+
+func (m MockIndexEsService) DeleteIndices(_ context.Context, indices []string) error {
+	*m.calls = append(*m.calls, fmt.Sprintf("delete %v", indices))
+	return m.error
+}
+
+func (m MockIndexEsService) CreateIndex(_ context.Context, index string, _ json.RawMessage) error {
+	*m.calls = append(*m.calls, "create "+index)
+	return m.error
+}
+
+func (m MockIndexEsService) UpdateAliases(_ context.Context, actions []AliasAction) error {
+	encodedJson, _ := json.Marshal(actions)
+	*m.calls = append(*m.calls, "aliases "+string(encodedJson))
+	return m.error
+}
+
+func (m MockIndexEsService) Reindex(_ context.Context, sourceIndex string, destIndex string) (int, error) {
+	*m.calls = append(*m.calls, fmt.Sprintf("reindex %s %s", sourceIndex, destIndex))
+	return 1, m.error
+}
+
+func (m MockIndexEsService) CountDocuments(_ context.Context, index string) (int, error) {
+	return m.counts[index], m.error
+}
+
+func (m MockIndexEsService) CreateSnapshot(_ context.Context, repository string, snapshot string, indices []string) error {
+	*m.calls = append(*m.calls, fmt.Sprintf("snapshot %s %s %v", repository, snapshot, indices))
+	return m.error
+}
+
+func assertIndexCalls(t *testing.T, calls []string, expected []string) {
+	t.Helper()
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("Received %v, expected %v", calls, expected)
+	}
+}
+
+func TestUrlIndexBody(t *testing.T) {
+	t.Run("returns valid JSON with settings", func(t *testing.T) {
+		var body struct {
+			Settings struct {
+				Shards   int `json:"number_of_shards"`
+				Replicas int `json:"number_of_replicas"`
+			} `json:"settings"`
+		}
+		if err := json.Unmarshal(urlIndexBody(esIndexSettings{Shards: 3, Replicas: 2}), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Settings.Shards != 3 || body.Settings.Replicas != 2 {
+			t.Errorf("Received %d and %d, expected %d and %d", body.Settings.Shards, body.Settings.Replicas, 3, 2)
+		}
+	})
+}
+
+func TestEsLinkStore_EnsureElasticsearchIndex(t *testing.T) {
+	t.Run("creates index and alias when nothing exists", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{EsIndex: "urlstore", EsService: MockIndexEsService{calls: &calls}}
+		if err := links.EnsureElasticsearchIndex(); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, []string{
+			"create urlstore_v2",
+			`aliases [{"add":{"index":"urlstore_v2","alias":"urlstore"}}]`,
+		})
+	})
+	t.Run("leaves existing indices alone", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore"}, calls: &calls},
+		}
+		if err := links.EnsureElasticsearchIndex(); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, nil)
+	})
+	t.Run("returns error when alias cannot be resolved", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{MockEsService: MockEsService{error: errors.New("failed")}, calls: &calls},
+		}
+		if err := links.EnsureElasticsearchIndex(); err != ErrCouldNotEnsureElasticsearchIndex {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotEnsureElasticsearchIndex)
+		}
+	})
+}
+
+func TestEsLinkStore_MigrateElasticsearchIndex(t *testing.T) {
+	t.Run("copies aliased index, switches alias and catches up", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore_v1"}, isAlias: true, calls: &calls},
+		}
+		if err := links.MigrateElasticsearchIndex(); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, []string{
+			"create urlstore_v2",
+			"reindex urlstore_v1 urlstore_v2",
+			`aliases [{"remove":{"index":"urlstore_v1","alias":"urlstore"}},{"add":{"index":"urlstore_v2","alias":"urlstore"}}]`,
+			"reindex urlstore_v1 urlstore_v2",
+		})
+	})
+	t.Run("replaces index created before aliases in the same step as adding alias", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore"}, calls: &calls},
+		}
+		if err := links.MigrateElasticsearchIndex(); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, []string{
+			"create urlstore_v2",
+			"reindex urlstore urlstore_v2",
+			"reindex urlstore urlstore_v2",
+			`aliases [{"remove_index":{"index":"urlstore"}},{"add":{"index":"urlstore_v2","alias":"urlstore"}}]`,
+		})
+	})
+	t.Run("does nothing when alias is already current", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore_v2"}, isAlias: true, calls: &calls},
+		}
+		if err := links.MigrateElasticsearchIndex(); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, nil)
+	})
+	t.Run("returns error and keeps alias when copy fails", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore",
+			EsService: MockIndexEsService{
+				MockEsService: MockEsService{error: ErrEsCouldNotReindex}, indices: []string{"urlstore_v1"}, isAlias: true, calls: &calls,
+			},
+		}
+		if err := links.MigrateElasticsearchIndex(); err != ErrCouldNotMigrateElasticsearchIndex {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotMigrateElasticsearchIndex)
+		}
+	})
+}
+
+func TestEsLinkStore_GetElasticsearchIndexStatus(t *testing.T) {
+	t.Run("returns link counts and whether alias is current", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore",
+			EsService: MockIndexEsService{
+				indices: []string{"urlstore_v2"}, isAlias: true, counts: map[string]int{"urlstore_v2": 42}, calls: &calls,
+			},
+		}
+		status, err := links.GetElasticsearchIndexStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !status.IsCurrent() || status.Indices["urlstore_v2"] != 42 {
+			t.Errorf("Received %v, expected current index with %d links", status, 42)
+		}
+	})
+	t.Run("reports index created before aliases as out of date", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore"}, calls: &calls},
+		}
+		status, _ := links.GetElasticsearchIndexStatus()
+		if status.IsCurrent() {
+			t.Errorf("Received %t, expected %t", true, false)
+		}
+	})
+}
+
+func TestEsLinkStore_SnapshotElasticsearchIndex(t *testing.T) {
+	t.Run("snapshots indices behind alias", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore_v2"}, isAlias: true, calls: &calls},
+		}
+		if err := links.SnapshotElasticsearchIndex("backups", "nightly"); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, []string{"snapshot backups nightly [urlstore_v2]"})
+	})
+	t.Run("returns error when index does not exist", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{EsIndex: "urlstore", EsService: MockIndexEsService{calls: &calls}}
+		if err := links.SnapshotElasticsearchIndex("backups", "nightly"); err != ErrElasticsearchIndexDoesNotExist {
+			t.Errorf("Received %s, expected %s", err, ErrElasticsearchIndexDoesNotExist)
+		}
+	})
+}
+
+func TestEsLinkStore_DeleteElasticsearchIndex(t *testing.T) {
+	t.Run("refuses to delete indices holding links without force", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore",
+			EsService: MockIndexEsService{
+				indices: []string{"urlstore_v1", "urlstore_v2"}, isAlias: true,
+				counts: map[string]int{"urlstore_v2": 1}, calls: &calls,
+			},
+		}
+		if err := links.DeleteElasticsearchIndex(false); err != ErrElasticsearchIndexNotEmpty {
+			t.Errorf("Received %s, expected %s", err, ErrElasticsearchIndexNotEmpty)
+		}
+		assertIndexCalls(t, calls, nil)
+
+		if err := links.DeleteElasticsearchIndex(true); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, []string{"delete [urlstore_v1 urlstore_v2]"})
+	})
+	t.Run("deletes empty indices without force", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{
+			EsIndex: "urlstore", EsService: MockIndexEsService{indices: []string{"urlstore_v2"}, isAlias: true, calls: &calls},
+		}
+		if err := links.DeleteElasticsearchIndex(false); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, []string{"delete [urlstore_v2]"})
+	})
+	t.Run("does nothing when index does not exist", func(t *testing.T) {
+		var calls []string
+		links := esLinkStore{EsIndex: "urlstore", EsService: MockIndexEsService{calls: &calls}}
+		if err := links.DeleteElasticsearchIndex(true); err != nil {
+			t.Fatal(err)
+		}
+		assertIndexCalls(t, calls, nil)
+	})
+}
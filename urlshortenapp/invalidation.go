@@ -0,0 +1,200 @@
+package main
+
+// Invalidation of cached links across instances of the app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	InvalidationBusMemory   = "memory"
+	InvalidationBusPostgres = "postgres"
+
+	postgresInvalidationChannel = "link_invalidations"
+	// Postgres rejects notification payloads of 8000 bytes or more
+	maxPostgresInvalidationPayload = 7000
+)
+
+var knownInvalidationBuses = []string{InvalidationBusMemory, InvalidationBusPostgres}
+
+var (
+	ErrUnknownInvalidationBus           = errors.New("unknown invalidation bus")
+	ErrCouldNotConnectToInvalidationBus = errors.New("could not connect to invalidation bus")
+	ErrCouldNotPublishInvalidation      = errors.New("could not publish invalidation")
+)
+
+// Carries the short URLs of changed links to every subscribed instance,
+// including the publishing one. Subscribers are handed nil when
+// invalidations may have been missed, such as after reconnecting, and should
+// then drop everything.
+type InvalidationBus interface {
+	Publish(shortUrls ...string) error
+	Subscribe(handle func(shortUrls []string))
+	// Stops delivering and releases connections
+	Close() error
+}
+
+// Delivers to subscribers in the same process, such as caches in tests
+type memoryInvalidationBus struct {
+	mutex       sync.Mutex
+	subscribers []func(shortUrls []string)
+}
+
+func NewMemoryInvalidationBus() InvalidationBus {
+	return &memoryInvalidationBus{}
+}
+
+func (b *memoryInvalidationBus) Publish(shortUrls ...string) error {
+	b.mutex.Lock()
+	subscribers := append([]func([]string){}, b.subscribers...)
+	b.mutex.Unlock()
+	for _, handle := range subscribers {
+		handle(shortUrls)
+	}
+	return nil
+}
+
+func (b *memoryInvalidationBus) Subscribe(handle func(shortUrls []string)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = append(b.subscribers, handle)
+}
+
+func (b *memoryInvalidationBus) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.subscribers = nil
+	return nil
+}
+
+// Delivers through Postgres LISTEN/NOTIFY, which needs no tables and
+// reaches every instance connected to the same database
+type postgresInvalidationBus struct {
+	Pool      *pgxpool.Pool
+	RetryWait time.Duration
+	// Cancelled on close, to end the listeners
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners sync.WaitGroup
+}
+
+// Connects lazily, as for the Postgres link store
+func NewPostgresInvalidationBus(connStr string) (InvalidationBus, error) {
+	config, parseErr := pgxpool.ParseConfig(connStr)
+	if parseErr != nil {
+		slog.Error("Error parsing Postgres connection string", "error", parseErr)
+		return nil, ErrCouldNotConnectToInvalidationBus
+	}
+	config.LazyConnect = true
+	pool, connectErr := pgxpool.ConnectConfig(context.Background(), config)
+	if connectErr != nil {
+		slog.Error("Error connecting to Postgres", "error", connectErr)
+		return nil, ErrCouldNotConnectToInvalidationBus
+	}
+	return newPostgresInvalidationBus(pool, 5*time.Second), nil
+}
+
+func newPostgresInvalidationBus(pool *pgxpool.Pool, retryWait time.Duration) *postgresInvalidationBus {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &postgresInvalidationBus{Pool: pool, RetryWait: retryWait, ctx: ctx, cancel: cancel}
+}
+
+// Splits short URLs into JSON arrays that fit in a notification payload
+func encodeInvalidationPayloads(shortUrls []string, maxPayload int) []string {
+	var payloads []string
+	var batch []string
+	batchSize := 2
+	for _, shortUrl := range shortUrls {
+		encodedShortUrl, _ := json.Marshal(shortUrl)
+		if len(batch) > 0 && batchSize+len(encodedShortUrl)+1 > maxPayload {
+			encodedBatch, _ := json.Marshal(batch)
+			payloads = append(payloads, string(encodedBatch))
+			batch, batchSize = nil, 2
+		}
+		batch = append(batch, shortUrl)
+		batchSize += len(encodedShortUrl) + 1
+	}
+	if len(batch) > 0 {
+		encodedBatch, _ := json.Marshal(batch)
+		payloads = append(payloads, string(encodedBatch))
+	}
+	return payloads
+}
+
+func (b *postgresInvalidationBus) Publish(shortUrls ...string) error {
+	for _, payload := range encodeInvalidationPayloads(shortUrls, maxPostgresInvalidationPayload) {
+		_, execErr := b.Pool.Exec(
+			context.Background(), "SELECT pg_notify($1, $2)", postgresInvalidationChannel, payload,
+		)
+		if execErr != nil {
+			slog.Error("Error publishing invalidation of short URLs", "count", len(shortUrls), "error", execErr)
+			return ErrCouldNotPublishInvalidation
+		}
+	}
+	return nil
+}
+
+// Listens in the background on a connection of its own, reconnecting when it
+// is lost
+func (b *postgresInvalidationBus) Subscribe(handle func(shortUrls []string)) {
+	b.listeners.Add(1)
+	go func() {
+		defer b.listeners.Done()
+		for {
+			listenErr := b.listen(b.ctx, handle)
+			if b.ctx.Err() != nil {
+				return
+			}
+			slog.Error("Error listening for invalidations, retrying", "retry_wait", b.RetryWait, "error", listenErr)
+			select {
+			case <-b.ctx.Done():
+				return
+			case <-time.After(b.RetryWait):
+			}
+		}
+	}()
+}
+
+// Ends the listeners first, as closing the pool waits for every connection
+// to be released
+func (b *postgresInvalidationBus) Close() error {
+	b.cancel()
+	b.listeners.Wait()
+	b.Pool.Close()
+	return nil
+}
+
+func (b *postgresInvalidationBus) listen(ctx context.Context, handle func(shortUrls []string)) error {
+	conn, acquireErr := b.Pool.Acquire(ctx)
+	if acquireErr != nil {
+		return acquireErr
+	}
+	defer conn.Release()
+	if _, listenErr := conn.Exec(ctx, "LISTEN "+postgresInvalidationChannel); listenErr != nil {
+		return listenErr
+	}
+	slog.Info("Listening for invalidations", "channel", postgresInvalidationChannel)
+
+	// Invalidations published while not listening were missed
+	handle(nil)
+
+	for {
+		notification, waitErr := conn.Conn().WaitForNotification(ctx)
+		if waitErr != nil {
+			return waitErr
+		}
+		var shortUrls []string
+		if parseErr := json.Unmarshal([]byte(notification.Payload), &shortUrls); parseErr != nil {
+			slog.Error("Error parsing invalidation payload", "error", parseErr)
+			handle(nil)
+			continue
+		}
+		handle(shortUrls)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryInvalidationBus(t *testing.T) {
+	t.Run("delivers to every subscriber", func(t *testing.T) {
+		bus := NewMemoryInvalidationBus()
+		var received [][]string
+		for i := 0; i < 2; i++ {
+			bus.Subscribe(func(shortUrls []string) { received = append(received, shortUrls) })
+		}
+		_ = bus.Publish("http://shrt.url/abc")
+		expected := [][]string{{"http://shrt.url/abc"}, {"http://shrt.url/abc"}}
+		if !reflect.DeepEqual(received, expected) {
+			t.Errorf("Received %v, expected %v", received, expected)
+		}
+	})
+}
+
+func TestCachedLinkStore_InvalidationBus(t *testing.T) {
+	t.Run("drops links written by other instances", func(t *testing.T) {
+		bus := NewMemoryInvalidationBus()
+		store := newMockCountingLinkStore()
+		writer := NewCachedLinkStore(store, 10, time.Minute, time.Minute, bus)
+		reader := NewCachedLinkStore(store, 10, time.Minute, time.Minute, bus)
+		_, _ = reader.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = reader.Get(context.Background(), "http://shrt.url/def")
+		_ = writer.Update(context.Background(), "http://shrt.url/abc", func(_ *urlDocumentContent) error { return nil })
+		if reader.Stats().Size != 1 || reader.Stats().Invalidations != 1 {
+			t.Errorf("Received %+v, expected 1 cached link and 1 invalidation", reader.Stats())
+		}
+	})
+	t.Run("drops every link when invalidations may have been missed", func(t *testing.T) {
+		bus := NewMemoryInvalidationBus()
+		cache := NewCachedLinkStore(newMockCountingLinkStore(), 10, time.Minute, time.Minute, bus)
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = cache.Get(context.Background(), "http://shrt.url/xyz")
+		bus.(*memoryInvalidationBus).subscribers[0](nil)
+		if cache.Stats().Size != 0 || cache.Stats().Invalidations != 2 {
+			t.Errorf("Received %+v, expected no cached links and 2 invalidations", cache.Stats())
+		}
+	})
+	t.Run("stops listening and closes the store when closed", func(t *testing.T) {
+		bus := NewMemoryInvalidationBus()
+		store := newMockCountingLinkStore()
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, bus)
+		_ = cache.Close()
+		if len(bus.(*memoryInvalidationBus).subscribers) != 0 {
+			t.Errorf("Received %d, expected %d", len(bus.(*memoryInvalidationBus).subscribers), 0)
+		}
+		if !store.closed {
+			t.Errorf("Received %t, expected %t", store.closed, true)
+		}
+	})
+}
+
+func TestEncodeInvalidationPayloads(t *testing.T) {
+	t.Run("splits short URLs across payloads of the maximum size", func(t *testing.T) {
+		shortUrls := []string{"http://shrt.url/abc", "http://shrt.url/def", "http://shrt.url/ghi"}
+		payloads := encodeInvalidationPayloads(shortUrls, 50)
+		expected := []string{`["http://shrt.url/abc","http://shrt.url/def"]`, `["http://shrt.url/ghi"]`}
+		if !reflect.DeepEqual(payloads, expected) {
+			t.Errorf("Received %v, expected %v", payloads, expected)
+		}
+		for _, payload := range payloads {
+			if len(payload) > 50 {
+				t.Errorf("Received %d bytes, expected at most %d", len(payload), 50)
+			}
+		}
+	})
+	t.Run("keeps short URLs longer than the maximum whole", func(t *testing.T) {
+		shortUrl := "http://shrt.url/" + strings.Repeat("a", 60)
+		payloads := encodeInvalidationPayloads([]string{shortUrl}, 50)
+		if len(payloads) != 1 || !strings.Contains(payloads[0], shortUrl) {
+			t.Errorf("Received %v, expected one payload with %s", payloads, shortUrl)
+		}
+	})
+}
+
+var fakePostgresNotifyQuery = regexp.MustCompile(`^SELECT pg_notify\('([^']*)', '((?:[^']|'')*)'\)$`)
+
+// Stands in for Postgres LISTEN/NOTIFY over the simple query protocol,
+// delivering notifications to every connection listening
+type fakePostgres struct {
+	listener  net.Listener
+	mutex     sync.Mutex
+	listening map[*fakePostgresConn]string
+}
+
+type fakePostgresConn struct {
+	mutex   sync.Mutex
+	backend *pgproto3.Backend
+}
+
+func (c *fakePostgresConn) send(messages ...pgproto3.BackendMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, message := range messages {
+		_ = c.backend.Send(message)
+	}
+}
+
+func newFakePostgres(t *testing.T) *fakePostgres {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	postgres := &fakePostgres{listener: listener, listening: map[*fakePostgresConn]string{}}
+	go func() {
+		for {
+			netConn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go postgres.serve(netConn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return postgres
+}
+
+func (p *fakePostgres) connect() *pgxpool.Pool {
+	config, _ := pgxpool.ParseConfig("postgres://test@" + p.listener.Addr().String() + "/test?sslmode=disable&prefer_simple_protocol=true")
+	config.LazyConnect = true
+	pool, _ := pgxpool.ConnectConfig(context.Background(), config)
+	return pool
+}
+
+func (p *fakePostgres) listeners() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.listening)
+}
+
+func (p *fakePostgres) serve(netConn net.Conn) {
+	defer netConn.Close()
+	conn := &fakePostgresConn{backend: pgproto3.NewBackend(pgproto3.NewChunkReader(netConn), netConn)}
+	defer func() {
+		p.mutex.Lock()
+		delete(p.listening, conn)
+		p.mutex.Unlock()
+	}()
+	if startup, startupErr := conn.backend.ReceiveStartupMessage(); startupErr != nil {
+		return
+	} else if _, ok := startup.(*pgproto3.StartupMessage); !ok {
+		return
+	}
+	conn.send(
+		&pgproto3.AuthenticationOk{},
+		&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"},
+		&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"},
+		&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1},
+		&pgproto3.ReadyForQuery{TxStatus: 'I'},
+	)
+	for {
+		message, receiveErr := conn.backend.Receive()
+		if receiveErr != nil {
+			return
+		}
+		query, ok := message.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+		if channel := strings.TrimPrefix(query.String, "LISTEN "); channel != query.String {
+			p.mutex.Lock()
+			p.listening[conn] = channel
+			p.mutex.Unlock()
+			conn.send(&pgproto3.CommandComplete{CommandTag: []byte("LISTEN")}, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			continue
+		}
+		if match := fakePostgresNotifyQuery.FindStringSubmatch(query.String); match != nil {
+			payload := strings.ReplaceAll(match[2], "''", "'")
+			p.mutex.Lock()
+			for listening, channel := range p.listening {
+				if channel == match[1] {
+					listening.send(&pgproto3.NotificationResponse{PID: 1, Channel: channel, Payload: payload})
+				}
+			}
+			p.mutex.Unlock()
+			conn.send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			continue
+		}
+		conn.send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "42601", Message: "unexpected query"}, &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	}
+}
+
+// Waits for a condition the bus reaches in the background
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPostgresInvalidationBus(t *testing.T) {
+	t.Run("drops links written by instances on other connections", func(t *testing.T) {
+		postgres := newFakePostgres(t)
+		writerBus := newPostgresInvalidationBus(postgres.connect(), time.Second)
+		readerBus := newPostgresInvalidationBus(postgres.connect(), time.Second)
+		store := newMockCountingLinkStore()
+		writer := NewCachedLinkStore(store, 10, time.Minute, time.Minute, writerBus)
+		reader := NewCachedLinkStore(store, 10, time.Minute, time.Minute, readerBus)
+		defer writer.Close()
+		defer reader.Close()
+		if !eventually(func() bool { return postgres.listeners() == 2 }) {
+			t.Fatalf("Received %d, expected %d listeners", postgres.listeners(), 2)
+		}
+
+		_, _ = reader.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = reader.Get(context.Background(), "http://shrt.url/def")
+		_ = writer.Update(context.Background(), "http://shrt.url/abc", func(_ *urlDocumentContent) error { return nil })
+		if !eventually(func() bool { return reader.Stats().Size == 1 && reader.Stats().Invalidations == 1 }) {
+			t.Errorf("Received %+v, expected 1 cached link and 1 invalidation", reader.Stats())
+		}
+	})
+	t.Run("returns from close while listening", func(t *testing.T) {
+		postgres := newFakePostgres(t)
+		bus := newPostgresInvalidationBus(postgres.connect(), time.Second)
+		bus.Subscribe(func(_ []string) {})
+		if !eventually(func() bool { return postgres.listeners() == 1 }) {
+			t.Fatalf("Received %d, expected %d listeners", postgres.listeners(), 1)
+		}
+
+		closed := make(chan error)
+		go func() { closed <- bus.Close() }()
+		select {
+		case closeErr := <-closed:
+			if closeErr != nil {
+				t.Errorf("Received %s, expected nil", closeErr)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Received no return from close, expected nil")
+		}
+	})
+}
@@ -4,36 +4,306 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type KgsClient interface {
-	PostJson(endpoint string, rawJson json.RawMessage) (*http.Response, error)
+	PostJson(ctx context.Context, endpoint string, rawJson json.RawMessage) (*http.Response, error)
+	Get(ctx context.Context, endpoint string) (*http.Response, error)
+}
+
+const (
+	KgsRetryBaseDelay = 100 * time.Millisecond
+	KgsRetryMaxDelay  = 2 * time.Second
+)
+
+var (
+	ErrKgsUnavailable = errors.New("keygensvc unavailable, circuit open")
+)
+
+type KgsClientOptions struct {
+	// Per attempt, cut short by any earlier deadline of the caller
+	Timeout    time.Duration
+	MaxRetries int
+	// Failures in a row that open the circuit, or zero to never open it
+	BreakerFailures int
+	BreakerCooldown time.Duration
 }
 
 type kgsClient struct {
-	kgsUrl string
+	kgsUrl       string
+	apiKey       string
+	sharedSecret string
+	options      KgsClientOptions
+	httpClient   *http.Client
+	breaker      *circuitBreaker
 }
 
-func NewKgsClient(kgsUrl string) KgsClient {
-	return &kgsClient{kgsUrl: kgsUrl}
+// Requests are signed and responses verified when a shared secret is set
+func NewKgsClient(kgsUrl string, apiKey string, sharedSecret string, options KgsClientOptions) KgsClient {
+	return &kgsClient{
+		kgsUrl:       kgsUrl,
+		apiKey:       apiKey,
+		sharedSecret: sharedSecret,
+		options:      options,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: options.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   32,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   options.Timeout,
+				ResponseHeaderTimeout: options.Timeout,
+			},
+		},
+		breaker: newCircuitBreaker(options.BreakerFailures, options.BreakerCooldown, observeKgsCircuitState),
+	}
 }
 
-func (c kgsClient) PostJson(endpoint string, rawJson json.RawMessage) (*http.Response, error) {
-	// Make request
-	return http.Post(
+// Traced, passing the trace on to keygensvc
+func (c kgsClient) PostJson(ctx context.Context, endpoint string, rawJson json.RawMessage) (*http.Response, error) {
+	ctx, span := startClientSpan(
+		ctx, "POST "+endpoint, semconv.HTTPRequestMethodKey.String(http.MethodPost), semconv.URLPath(endpoint),
+	)
+	httpResponse, httpErr := c.withRetries(ctx, http.MethodPost, endpoint, func(ctx context.Context) (*http.Response, error) {
+		return c.postJson(ctx, endpoint, rawJson)
+	})
+	statusCode := 0
+	if httpResponse != nil {
+		statusCode = httpResponse.StatusCode
+	}
+	endClientSpan(span, statusCode, httpErr)
+	return httpResponse, httpErr
+}
+
+// Unsigned, as only public endpoints are read
+func (c kgsClient) Get(ctx context.Context, endpoint string) (*http.Response, error) {
+	ctx, span := startClientSpan(
+		ctx, "GET "+endpoint, semconv.HTTPRequestMethodKey.String(http.MethodGet), semconv.URLPath(endpoint),
+	)
+	httpResponse, httpErr := c.withRetries(ctx, http.MethodGet, endpoint, func(ctx context.Context) (*http.Response, error) {
+		return c.get(ctx, endpoint)
+	})
+	statusCode := 0
+	if httpResponse != nil {
+		statusCode = httpResponse.StatusCode
+	}
+	endClientSpan(span, statusCode, httpErr)
+	return httpResponse, httpErr
+}
+
+// Makes each attempt under its own timeout, unless the circuit is open.
+// Attempts build their request afresh, so that each is signed with a new
+// nonce.
+func (c kgsClient) withRetries(
+	ctx context.Context, method string, endpoint string, attempt func(ctx context.Context) (*http.Response, error),
+) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		if !c.breaker.Allow() {
+			return nil, ErrKgsUnavailable
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, c.options.Timeout)
+		httpResponse, httpErr := attempt(attemptCtx)
+		cancel()
+
+		// Failures after the caller gave up say nothing about keygensvc
+		failed := isKgsFailure(httpResponse, httpErr)
+		if ctx.Err() != nil {
+			c.breaker.Abandon()
+			return httpResponse, httpErr
+		}
+		c.breaker.Record(!failed)
+		if !failed || retry >= c.options.MaxRetries || !isKgsRetryable(method, httpResponse, httpErr) {
+			return httpResponse, httpErr
+		}
+
+		// Back off before the next attempt, unless the caller gives up first
+		wait := jitteredBackoff(retry, KgsRetryBaseDelay, KgsRetryMaxDelay)
+		slog.WarnContext(
+			ctx, "Retrying keygensvc request",
+			"endpoint", endpoint, "retry", retry+1, "wait", wait, "error", httpErr, "status", statusCodeOf(httpResponse),
+		)
+		kgsRetriesTotal.WithLabelValues(endpoint).Inc()
+		select {
+		case <-ctx.Done():
+			return httpResponse, httpErr
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Whether keygensvc looks down, rather than refusing this one request
+func isKgsFailure(httpResponse *http.Response, httpErr error) bool {
+	if httpErr != nil {
+		return !errors.Is(httpErr, ErrKgsResponseSignatureIncorrect)
+	}
+	return httpResponse.StatusCode >= http.StatusInternalServerError
+}
+
+// Whether a failed request can be sent again without doing anything twice.
+// Reads always can. Writes only can when they never reached keygensvc, or it
+// refused them unprocessed, as a key may have been reserved otherwise.
+func isKgsRetryable(method string, httpResponse *http.Response, httpErr error) bool {
+	if errors.Is(httpErr, ErrKgsResponseSignatureIncorrect) {
+		return false
+	}
+	if method == http.MethodGet {
+		return true
+	}
+	if httpErr != nil {
+		var opErr *net.OpError
+		return errors.As(httpErr, &opErr) && opErr.Op == "dial"
+	}
+	return httpResponse.StatusCode == http.StatusServiceUnavailable
+}
+
+// Full jitter, so that clients backing off together do not retry together
+func jitteredBackoff(retry int, baseDelay time.Duration, maxDelay time.Duration) time.Duration {
+	ceiling := maxDelay
+	if retry < 30 && baseDelay<<retry < maxDelay {
+		ceiling = baseDelay << retry
+	}
+	return time.Duration(mathrand.Int63n(int64(ceiling) + 1))
+}
+
+func statusCodeOf(httpResponse *http.Response) int {
+	if httpResponse == nil {
+		return 0
+	}
+	return httpResponse.StatusCode
+}
+
+// Reads the body before the attempt's timeout cancels it
+func (c kgsClient) do(request *http.Request) (*http.Response, []byte, error) {
+	httpResponse, httpErr := c.httpClient.Do(request)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+	defer httpResponse.Body.Close()
+	body, readErr := io.ReadAll(httpResponse.Body)
+	if readErr != nil {
+		return nil, nil, readErr
+	}
+	httpResponse.Body = io.NopCloser(bytes.NewReader(body))
+	return httpResponse, body, nil
+}
+
+func (c kgsClient) get(ctx context.Context, endpoint string) (*http.Response, error) {
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, c.kgsUrl + endpoint, nil)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	if requestId := requestIdFromContext(ctx); requestId != "" {
+		request.Header.Set(RequestIdHeader, requestId)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	httpResponse, _, httpErr := c.do(request)
+	return httpResponse, httpErr
+}
+
+func (c kgsClient) postJson(ctx context.Context, endpoint string, rawJson json.RawMessage) (*http.Response, error) {
+	// Construct request
+	request, requestErr := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
 		c.kgsUrl + endpoint,
-		"application/json",
 		bytes.NewBuffer(rawJson),
 	)
+	if requestErr != nil {
+		return nil, requestErr
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if requestId := requestIdFromContext(ctx); requestId != "" {
+		request.Header.Set(RequestIdHeader, requestId)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+	if c.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer " + c.apiKey)
+	}
+	if c.sharedSecret == "" {
+		httpResponse, _, httpErr := c.do(request)
+		return httpResponse, httpErr
+	}
+
+	// Sign request
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceBuff := make([]byte, 16)
+	_, _ = rand.Read(nonceBuff)
+	nonce := hex.EncodeToString(nonceBuff)
+	request.Header.Set(KgsSignatureTimestampHeader, timestamp)
+	request.Header.Set(KgsSignatureNonceHeader, nonce)
+	request.Header.Set(
+		KgsSignatureHeader,
+		signKgsRequest(c.sharedSecret, http.MethodPost, request.URL.Path, timestamp, nonce, rawJson),
+	)
+
+	// Make request
+	httpResponse, body, httpErr := c.do(request)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	// Verify response came from keygensvc and answers this request
+	expected := signKgsResponse(c.sharedSecret, httpResponse.StatusCode, nonce, body)
+	if !hmac.Equal([]byte(httpResponse.Header.Get(KgsSignatureHeader)), []byte(expected)) {
+		slog.WarnContext(ctx, "Response signature from keygensvc is incorrect", "status", httpResponse.StatusCode)
+		return nil, ErrKgsResponseSignatureIncorrect
+	}
+
+	return httpResponse, nil
+}
+
+// Signing shared with keygensvc. Requests are signed over their method, path,
+// timestamp, nonce and body; responses over their status, the request nonce
+// and body, so a response cannot be replayed against another request.
+
+const (
+	KgsSignatureHeader          = "X-Signature"
+	KgsSignatureTimestampHeader = "X-Signature-Timestamp"
+	KgsSignatureNonceHeader     = "X-Signature-Nonce"
+)
+
+func signKgsMessage(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func kgsBodyDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return hex.EncodeToString(digest[:])
+}
+
+func signKgsRequest(secret, method, path, timestamp, nonce string, body []byte) string {
+	return signKgsMessage(secret, "request", method, path, timestamp, nonce, kgsBodyDigest(body))
+}
+
+func signKgsResponse(secret string, statusCode int, nonce string, body []byte) string {
+	return signKgsMessage(secret, "response", strconv.Itoa(statusCode), nonce, kgsBodyDigest(body))
 }
 
 type KgsService interface {
-	GenerateKey(sourceName string, keyLength int) (string, error)
-	CreateNewKey(sourceName string, key string) (string, error)
+	GenerateKey(ctx context.Context, sourceName string, workspace string, keyLength int) (string, error)
+	CreateNewKey(ctx context.Context, sourceName string, workspace string, key string) (string, error)
+	Ping(ctx context.Context) error
 }
 
 type kgsService struct {
@@ -47,13 +317,16 @@ func NewKgsService(kgsClient KgsClient) (KgsService, error) {
 }
 
 var (
-	ErrKgsCouldNotProcessRequest = errors.New("keygensvc could not process request")
-	ErrKgsCouldNotFulfillRequest = errors.New("keygensvc could not fulfill request")
-	ErrCouldNotParseResponseJson = errors.New("could not parse response json")
+	ErrKgsCouldNotProcessRequest     = errors.New("keygensvc could not process request")
+	ErrKgsCouldNotFulfillRequest     = errors.New("keygensvc could not fulfill request")
+	ErrCouldNotParseResponseJson     = errors.New("could not parse response json")
+	ErrKgsResponseSignatureIncorrect = errors.New("keygensvc response signature incorrect")
+	ErrKgsKeyAlreadyExists           = errors.New("keygensvc key already exists")
 )
 
 type generateKeyRequestJson struct {
 	SourceName string `json:"source_name"`
+	Workspace  string `json:"workspace,omitempty"`
 	KeyLength  int    `json:"key_length"`
 }
 
@@ -61,23 +334,28 @@ type generateKeyResponseJson struct {
 	Key string `json:"key"`
 }
 
-func (s kgsService) GenerateKey(sourceName string, keyLength int) (string, error) {
+func (s kgsService) GenerateKey(ctx context.Context, sourceName string, workspace string, keyLength int) (string, error) {
 	// Construct payload
 	requestJson, _ := json.Marshal(
-		generateKeyRequestJson{SourceName: sourceName, KeyLength: keyLength},
+		generateKeyRequestJson{SourceName: sourceName, Workspace: workspace, KeyLength: keyLength},
 	)
 
 	// Make generate key request
-	httpResponse, httpErr := s.Client.PostJson("/key/generate", requestJson)
+	startTime := time.Now()
+	httpResponse, httpErr := s.Client.PostJson(ctx, "/key/generate", requestJson)
+	observeKgsRequest("/key/generate", startTime, httpResponse, httpErr)
+	if httpErr == ErrKgsUnavailable {
+		return "", ErrKgsUnavailable
+	}
 	if httpErr != nil {
-		log.Printf("Error posting /key/generate: %s", httpErr)
+		slog.ErrorContext(ctx, "Error posting /key/generate", "error", httpErr)
 		return "", ErrKgsCouldNotProcessRequest
 	}
 	defer httpResponse.Body.Close()
 
 	// Check status code
 	if httpResponse.StatusCode != http.StatusCreated {
-		log.Printf("[%d] Key was not generated", httpResponse.StatusCode)
+		slog.ErrorContext(ctx, "Key was not generated", "status", httpResponse.StatusCode)
 		return "", ErrKgsCouldNotFulfillRequest
 	}
 
@@ -86,41 +364,76 @@ func (s kgsService) GenerateKey(sourceName string, keyLength int) (string, error
 	var responseJson generateKeyResponseJson
 	parseErr := json.Unmarshal(rawJson, &responseJson)
 	if parseErr != nil {
-		log.Printf("Error parsing the response body for key generation: %s", parseErr)
+		slog.ErrorContext(ctx, "Error parsing the response body for key generation", "error", parseErr)
 		return "", ErrCouldNotParseResponseJson
 	}
 
 	// Return generated key
-	log.Printf("[%d] Key generated: %s", httpResponse.StatusCode, responseJson.Key)
+	slog.DebugContext(ctx, "Key generated", "status", httpResponse.StatusCode, "key", responseJson.Key)
 	return responseJson.Key, nil
 }
 
 type newKeyRequestJson struct {
 	SourceName string `json:"source_name"`
+	Workspace  string `json:"workspace,omitempty"`
 	Key	   string `json:"key"`
 }
 
-func (s kgsService) CreateNewKey(sourceName string, key string) (string, error) {
+func (s kgsService) CreateNewKey(ctx context.Context, sourceName string, workspace string, key string) (string, error) {
 	// Construct payload
 	requestJson, _ := json.Marshal(
-		newKeyRequestJson{SourceName: sourceName, Key: key},
+		newKeyRequestJson{SourceName: sourceName, Workspace: workspace, Key: key},
 	)
 
 	// Make new key request
-	httpResponse, httpErr := s.Client.PostJson("/key/new", requestJson)
+	startTime := time.Now()
+	httpResponse, httpErr := s.Client.PostJson(ctx, "/key/new", requestJson)
+	observeKgsRequest("/key/new", startTime, httpResponse, httpErr)
+	if httpErr == ErrKgsUnavailable {
+		return "", ErrKgsUnavailable
+	}
 	if httpErr != nil {
-		log.Printf("Error posting /key/generate: %s", httpErr)
+		slog.ErrorContext(ctx, "Error posting /key/new", "error", httpErr)
 		return "", ErrKgsCouldNotProcessRequest
 	}
 	defer httpResponse.Body.Close()
 
 	// Check status code
+	if httpResponse.StatusCode == http.StatusConflict {
+		slog.WarnContext(ctx, "Key already exists", "status", httpResponse.StatusCode, "key", key)
+		keyCollisionsTotal.Inc()
+		return "", ErrKgsKeyAlreadyExists
+	}
 	if httpResponse.StatusCode != http.StatusCreated {
-		log.Printf("[%d] Key was not created", httpResponse.StatusCode)
+		slog.ErrorContext(ctx, "Key was not created", "status", httpResponse.StatusCode)
 		return "", ErrKgsCouldNotFulfillRequest
 	}
 
 	// Return new key
-	log.Printf("[%d] Key created: %s", httpResponse.StatusCode, key)
+	slog.DebugContext(ctx, "Key created", "status", httpResponse.StatusCode, "key", key)
 	return key, nil
 }
+
+// Checks keygensvc is serving, not whether its database is
+func (s kgsService) Ping(ctx context.Context) error {
+	// Make liveness request
+	startTime := time.Now()
+	httpResponse, httpErr := s.Client.Get(ctx, "/livez")
+	observeKgsRequest("/livez", startTime, httpResponse, httpErr)
+	if httpErr == ErrKgsUnavailable {
+		return ErrKgsUnavailable
+	}
+	if httpErr != nil {
+		slog.ErrorContext(ctx, "Error getting /livez", "error", httpErr)
+		return ErrKgsCouldNotProcessRequest
+	}
+	defer httpResponse.Body.Close()
+
+	// Check status code
+	if httpResponse.StatusCode != http.StatusOK {
+		slog.ErrorContext(ctx, "Keygensvc is not live", "status", httpResponse.StatusCode)
+		return ErrKgsCouldNotFulfillRequest
+	}
+
+	return nil
+}
@@ -1,32 +1,76 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+var testKgsClientOptions = KgsClientOptions{Timeout: time.Second, MaxRetries: 2}
+
 type MockKgsClient struct {
 	response *http.Response
 	error error
 }
 
-func (m MockKgsClient) PostJson(_ string, _ json.RawMessage) (*http.Response, error) {
+func (m MockKgsClient) PostJson(_ context.Context, _ string, _ json.RawMessage) (*http.Response, error) {
 	return m.response, m.error
 }
 
+func (m MockKgsClient) Get(_ context.Context, _ string) (*http.Response, error) {
+	return m.response, m.error
+}
+
+func TestKgsService_Ping(t *testing.T) {
+	t.Run("returns error when keygensvc is unreachable", func(t *testing.T) {
+		kgsSvc, _ := NewKgsService(MockKgsClient{response: nil, error: errors.New("failed")})
+		pingErr := kgsSvc.Ping(context.Background())
+		if pingErr != ErrKgsCouldNotProcessRequest {
+			t.Errorf("Received %s, expected %s", pingErr, ErrKgsCouldNotProcessRequest)
+		}
+	})
+	t.Run("returns error when status code is not 200 OK", func(t *testing.T) {
+		kgsSvc, _ := NewKgsService(MockKgsClient{
+			response: &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader(""))},
+		})
+		pingErr := kgsSvc.Ping(context.Background())
+		if pingErr != ErrKgsCouldNotFulfillRequest {
+			t.Errorf("Received %s, expected %s", pingErr, ErrKgsCouldNotFulfillRequest)
+		}
+	})
+	t.Run("returns nil when keygensvc is live", func(t *testing.T) {
+		kgsSvc, _ := NewKgsService(MockKgsClient{
+			response: &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"status": "ok"}`))},
+		})
+		if pingErr := kgsSvc.Ping(context.Background()); pingErr != nil {
+			t.Errorf("Received %s, expected nil", pingErr)
+		}
+	})
+}
+
 func TestKgsService_GenerateKey(t *testing.T) {
 	t.Run("returns error when KGS API Generate Key call fails", func(t *testing.T) {
 		mockKgsClient := MockKgsClient{response: nil, error: errors.New("failed")}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		_, genErr := kgsSvc.GenerateKey("some-source", 12)
+		_, genErr := kgsSvc.GenerateKey(context.Background(), "some-source", "", 12)
 		if genErr != ErrKgsCouldNotProcessRequest {
 			t.Errorf("Received %s, expected %s", genErr, ErrKgsCouldNotProcessRequest)
 		}
 	})
+	t.Run("returns ErrKgsUnavailable when the circuit is open", func(t *testing.T) {
+		kgsSvc, _ := NewKgsService(MockKgsClient{response: nil, error: ErrKgsUnavailable})
+		_, genErr := kgsSvc.GenerateKey(context.Background(), "some-source", "", 12)
+		if genErr != ErrKgsUnavailable {
+			t.Errorf("Received %s, expected %s", genErr, ErrKgsUnavailable)
+		}
+	})
 	t.Run("returns error when status code is not 201 Created", func(t *testing.T) {
 		mockKgsClient := MockKgsClient{
 			response: &http.Response{
@@ -35,7 +79,7 @@ func TestKgsService_GenerateKey(t *testing.T) {
 			}, error: nil,
 		}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		_, genErr := kgsSvc.GenerateKey("some-source", 12)
+		_, genErr := kgsSvc.GenerateKey(context.Background(), "some-source", "", 12)
 		if genErr != ErrKgsCouldNotFulfillRequest {
 			t.Errorf("Received %s, expected %s", genErr, ErrKgsCouldNotFulfillRequest)
 		}
@@ -49,7 +93,7 @@ func TestKgsService_GenerateKey(t *testing.T) {
 			error: nil,
 		}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		_, genErr := kgsSvc.GenerateKey("some-source", 12)
+		_, genErr := kgsSvc.GenerateKey(context.Background(), "some-source", "", 12)
 		if genErr != ErrCouldNotParseResponseJson {
 			t.Errorf("Received %s, expected %s", genErr, ErrCouldNotParseResponseJson)
 		}
@@ -63,7 +107,7 @@ func TestKgsService_GenerateKey(t *testing.T) {
 			error: nil,
 		}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		key, genErr := kgsSvc.GenerateKey("some-source", 12)
+		key, genErr := kgsSvc.GenerateKey(context.Background(), "some-source", "", 12)
 		if genErr != nil {
 			t.Errorf("Received %s, expected nil", genErr)
 		}
@@ -77,7 +121,7 @@ func TestKgsService_CreateNewKey(t *testing.T) {
 	t.Run("returns error when KGS API Create New Key call fails", func(t *testing.T) {
 		mockKgsClient := MockKgsClient{response: nil, error: errors.New("failed")}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		_, genErr := kgsSvc.CreateNewKey("some-source", "12345")
+		_, genErr := kgsSvc.CreateNewKey(context.Background(), "some-source", "", "12345")
 		if genErr != ErrKgsCouldNotProcessRequest {
 			t.Errorf("Received %s, expected %s", genErr, ErrKgsCouldNotProcessRequest)
 		}
@@ -90,11 +134,24 @@ func TestKgsService_CreateNewKey(t *testing.T) {
 			}, error: nil,
 		}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		_, genErr := kgsSvc.CreateNewKey("some-source", "12345")
+		_, genErr := kgsSvc.CreateNewKey(context.Background(), "some-source", "", "12345")
 		if genErr != ErrKgsCouldNotFulfillRequest {
 			t.Errorf("Received %s, expected %s", genErr, ErrKgsCouldNotFulfillRequest)
 		}
 	})
+	t.Run("returns error when key already exists", func(t *testing.T) {
+		mockKgsClient := MockKgsClient{
+			response: &http.Response{
+				StatusCode: http.StatusConflict,
+				Body: io.NopCloser(strings.NewReader("")),
+			}, error: nil,
+		}
+		kgsSvc, _ := NewKgsService(mockKgsClient)
+		_, genErr := kgsSvc.CreateNewKey(context.Background(), "some-source", "", "12345")
+		if genErr != ErrKgsKeyAlreadyExists {
+			t.Errorf("Received %s, expected %s", genErr, ErrKgsKeyAlreadyExists)
+		}
+	})
 	t.Run("returns key when successful", func(t *testing.T) {
 		mockKgsClient := MockKgsClient{
 			response: &http.Response{
@@ -104,7 +161,7 @@ func TestKgsService_CreateNewKey(t *testing.T) {
 			error: nil,
 		}
 		kgsSvc, _ := NewKgsService(mockKgsClient)
-		key, genErr := kgsSvc.CreateNewKey("some-source", "12345")
+		key, genErr := kgsSvc.CreateNewKey(context.Background(), "some-source", "", "12345")
 		if genErr != nil {
 			t.Errorf("Received %s, expected nil", genErr)
 		}
@@ -112,4 +169,215 @@ func TestKgsService_CreateNewKey(t *testing.T) {
 			t.Errorf("Received %s, expected %s", key, "12345")
 		}
 	})
-}
\ No newline at end of file
+}
+func TestKgsClient_PostJson(t *testing.T) {
+	t.Run("sends api key as bearer token when set", func(t *testing.T) {
+		var authorization string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		response, err := NewKgsClient(server.URL, "kgk_secret", "", testKgsClientOptions).PostJson(context.Background(), "/key/new", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if authorization != "Bearer kgk_secret" {
+			t.Errorf("Received %s, expected %s", authorization, "Bearer kgk_secret")
+		}
+	})
+	t.Run("passes on the request id of the context", func(t *testing.T) {
+		var requestId string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId = r.Header.Get(RequestIdHeader)
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		ctx := contextWithRequestId(context.Background(), "some-request-id")
+		response, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).PostJson(ctx, "/key/new", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if requestId != "some-request-id" {
+			t.Errorf("Received %s, expected %s", requestId, "some-request-id")
+		}
+	})
+}
+
+func TestKgsClient_PostJson_Signed(t *testing.T) {
+	t.Run("signs request and accepts correctly signed response", func(t *testing.T) {
+		var signatureCorrect bool
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := parseRawJsonFromHttpBody(r.Body)
+			nonce := r.Header.Get(KgsSignatureNonceHeader)
+			expected := signKgsRequest(
+				"secret", r.Method, r.URL.Path, r.Header.Get(KgsSignatureTimestampHeader), nonce, body,
+			)
+			signatureCorrect = r.Header.Get(KgsSignatureHeader) == expected
+			w.Header().Set(KgsSignatureHeader, signKgsResponse("secret", http.StatusCreated, nonce, []byte(`{"key": "12345"}`)))
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"key": "12345"}`))
+		}))
+		defer server.Close()
+
+		response, err := NewKgsClient(server.URL, "", "secret", testKgsClientOptions).PostJson(context.Background(), "/key/generate", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		if !signatureCorrect {
+			t.Errorf("Received incorrect request signature, expected it to verify")
+		}
+		if body := string(parseRawJsonFromHttpBody(response.Body)); body != `{"key": "12345"}` {
+			t.Errorf("Received %s, expected %s", body, `{"key": "12345"}`)
+		}
+	})
+	t.Run("returns error when response is signed with another secret", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			nonce := r.Header.Get(KgsSignatureNonceHeader)
+			w.Header().Set(KgsSignatureHeader, signKgsResponse("other", http.StatusCreated, nonce, nil))
+			w.WriteHeader(http.StatusCreated)
+		}))
+		defer server.Close()
+
+		_, err := NewKgsClient(server.URL, "", "secret", testKgsClientOptions).PostJson(context.Background(), "/key/generate", json.RawMessage(`{}`))
+		if err != ErrKgsResponseSignatureIncorrect {
+			t.Errorf("Received %s, expected %s", err, ErrKgsResponseSignatureIncorrect)
+		}
+	})
+}
+
+func TestKgsClient_Retries(t *testing.T) {
+	newServer := func(calls *int32, statusCodes ...int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			call := int(atomic.AddInt32(calls, 1)) - 1
+			if call >= len(statusCodes) {
+				call = len(statusCodes) - 1
+			}
+			w.WriteHeader(statusCodes[call])
+		}))
+	}
+
+	t.Run("retries reads that fail, then returns the response", func(t *testing.T) {
+		var calls int32
+		server := newServer(&calls, http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+		defer server.Close()
+
+		response, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).Get(context.Background(), "/livez")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Received %d, expected %d", response.StatusCode, http.StatusOK)
+		}
+		if calls != 3 {
+			t.Errorf("Received %d, expected %d", calls, 3)
+		}
+	})
+	t.Run("returns the last failure once retries run out", func(t *testing.T) {
+		var calls int32
+		server := newServer(&calls, http.StatusInternalServerError)
+		defer server.Close()
+
+		response, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).Get(context.Background(), "/livez")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Received %d, expected %d", response.StatusCode, http.StatusInternalServerError)
+		}
+		if calls != 3 {
+			t.Errorf("Received %d, expected %d", calls, 3)
+		}
+	})
+	t.Run("does not retry writes keygensvc may have processed", func(t *testing.T) {
+		var calls int32
+		server := newServer(&calls, http.StatusInternalServerError, http.StatusCreated)
+		defer server.Close()
+
+		response, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).PostJson(context.Background(), "/key/generate", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Received %d, expected %d", response.StatusCode, http.StatusInternalServerError)
+		}
+		if calls != 1 {
+			t.Errorf("Received %d, expected %d", calls, 1)
+		}
+	})
+	t.Run("retries writes keygensvc refused unprocessed", func(t *testing.T) {
+		var calls int32
+		server := newServer(&calls, http.StatusServiceUnavailable, http.StatusCreated)
+		defer server.Close()
+
+		response, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).PostJson(context.Background(), "/key/generate", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != http.StatusCreated {
+			t.Errorf("Received %d, expected %d", response.StatusCode, http.StatusCreated)
+		}
+		if calls != 2 {
+			t.Errorf("Received %d, expected %d", calls, 2)
+		}
+	})
+	t.Run("returns ErrKgsUnavailable without sending once the circuit opens", func(t *testing.T) {
+		var calls int32
+		server := newServer(&calls, http.StatusInternalServerError)
+		defer server.Close()
+		client := NewKgsClient(server.URL, "", "", KgsClientOptions{
+			Timeout: time.Second, BreakerFailures: 2, BreakerCooldown: time.Minute,
+		})
+
+		for i := 0; i < 2; i++ {
+			if _, err := client.Get(context.Background(), "/livez"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := client.Get(context.Background(), "/livez")
+		if err != ErrKgsUnavailable {
+			t.Errorf("Received %v, expected %s", err, ErrKgsUnavailable)
+		}
+		if calls != 2 {
+			t.Errorf("Received %d, expected %d", calls, 2)
+		}
+	})
+	t.Run("gives up once the deadline of the caller passes", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		}))
+		defer server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		startTime := time.Now()
+		_, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).Get(ctx, "/livez")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Received %v, expected %s", err, context.DeadlineExceeded)
+		}
+		if took := time.Since(startTime); took > 500*time.Millisecond {
+			t.Errorf("Received %s, expected under %s", took, 500*time.Millisecond)
+		}
+	})
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	t.Run("returns waits up to the base doubled per retry, capped", func(t *testing.T) {
+		for retry, ceiling := range []time.Duration{100, 200, 400, 500, 500} {
+			for i := 0; i < 20; i++ {
+				wait := jitteredBackoff(retry, 100, 500)
+				if wait < 0 || wait > ceiling {
+					t.Errorf("Received %s, expected at most %s", wait, ceiling)
+				}
+			}
+		}
+	})
+}
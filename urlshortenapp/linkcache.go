@@ -0,0 +1,245 @@
+package main
+
+// Read-through cache of links in front of the link store, so that hot links
+// are redirected without a round trip to the store
+
+import (
+	"container/list"
+	"context"
+	"golang.org/x/sync/singleflight"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How long a read of the store shared by concurrent misses may take. It is
+// not bound to any one caller, so needs a limit of its own.
+const LinkCacheReadTimeout = 10 * time.Second
+
+// Counts since the cache was created
+type linkCacheStats struct {
+	Size          int    `json:"size"`
+	Capacity      int    `json:"capacity"`
+	Hits          uint64 `json:"hits"`
+	NegativeHits  uint64 `json:"negative_hits"` // Hits on links cached as missing
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+}
+
+type linkCacheEntry struct {
+	shortUrl  string
+	link      urlDocumentContent
+	found     bool
+	expiresAt time.Time
+}
+
+// Gets are served from the cache until their entry expires or the link is
+// written through this cache. Missing links are cached for NegativeTtl, so
+// that requests for unknown slugs do not all reach the store. Concurrent
+// misses for one link share a single read of the store.
+//
+// Writes are published on the invalidation bus, when there is one, so that
+// other instances drop the links too. Without one, links written by other
+// instances are only seen once the entry expires.
+// Clicks are counted in the store without invalidating, as the store enforces
+// click limits itself, so cached click counts lag behind.
+type cachedLinkStore struct {
+	LinkStore
+	Capacity    int
+	Ttl         time.Duration
+	NegativeTtl time.Duration
+	Bus         InvalidationBus
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+	flights singleflight.Group
+	stats   linkCacheStats
+	// Bumped on every invalidation, so that reads started before one are
+	// not cached
+	generation uint64
+	now        func() time.Time
+}
+
+func NewCachedLinkStore(
+	links LinkStore, capacity int, ttl time.Duration, negativeTtl time.Duration, bus InvalidationBus,
+) *cachedLinkStore {
+	cache := &cachedLinkStore{
+		LinkStore:   links,
+		Capacity:    capacity,
+		Ttl:         ttl,
+		NegativeTtl: negativeTtl,
+		Bus:         bus,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+		now:         time.Now,
+	}
+	if bus != nil {
+		bus.Subscribe(func(shortUrls []string) {
+			if shortUrls == nil {
+				cache.InvalidateAll()
+				return
+			}
+			cache.Invalidate(shortUrls...)
+		})
+	}
+	return cache
+}
+
+func (c *cachedLinkStore) Unwrap() LinkStore {
+	return c.LinkStore
+}
+
+func (c *cachedLinkStore) Get(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	// Serve from cache
+	c.mutex.Lock()
+	if element, ok := c.entries[shortUrl]; ok {
+		entry := element.Value.(*linkCacheEntry)
+		if c.now().Before(entry.expiresAt) {
+			c.order.MoveToFront(element)
+			if !entry.found {
+				c.stats.NegativeHits++
+				c.mutex.Unlock()
+				return urlDocumentContent{}, ErrLinkNotFound
+			}
+			c.stats.Hits++
+			c.mutex.Unlock()
+			return entry.link, nil
+		}
+		c.remove(element)
+	}
+	c.stats.Misses++
+	generation := c.generation
+	c.mutex.Unlock()
+
+	// Read from store, once for all concurrent misses. The read is not
+	// cancelled with the caller that started it, which would fail every other
+	// caller waiting on it, and each caller waits only as long as it can.
+	flight := c.flights.DoChan(shortUrl, func() (interface{}, error) {
+		readCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), LinkCacheReadTimeout)
+		defer cancel()
+		link, getErr := c.LinkStore.Get(readCtx, shortUrl)
+		if getErr == nil || getErr == ErrLinkNotFound {
+			c.store(shortUrl, link, getErr == nil, generation)
+		}
+		return link, getErr
+	})
+	select {
+	case result := <-flight:
+		if result.Err != nil {
+			return urlDocumentContent{}, result.Err
+		}
+		return result.Val.(urlDocumentContent), nil
+	case <-ctx.Done():
+		return urlDocumentContent{}, ctx.Err()
+	}
+}
+
+func (c *cachedLinkStore) store(shortUrl string, link urlDocumentContent, found bool, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+
+	ttl := c.Ttl
+	if !found {
+		ttl = c.NegativeTtl
+	}
+	entry := &linkCacheEntry{shortUrl: shortUrl, link: link, found: found, expiresAt: c.now().Add(ttl)}
+	if element, ok := c.entries[shortUrl]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[shortUrl] = c.order.PushFront(entry)
+
+	// Evict least recently used
+	for c.order.Len() > c.Capacity {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *cachedLinkStore) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*linkCacheEntry).shortUrl)
+}
+
+// Invalidate drops the cached links, including links cached as missing
+func (c *cachedLinkStore) Invalidate(shortUrls ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	for _, shortUrl := range shortUrls {
+		if element, ok := c.entries[shortUrl]; ok {
+			c.remove(element)
+			c.stats.Invalidations++
+		}
+	}
+}
+
+func (c *cachedLinkStore) InvalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	c.stats.Invalidations += uint64(c.order.Len())
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// Drops the links here, then on other instances. Failing to reach them is
+// not an error for the write, as their entries expire in time.
+func (c *cachedLinkStore) invalidateEverywhere(shortUrls ...string) {
+	c.Invalidate(shortUrls...)
+	if c.Bus == nil || len(shortUrls) == 0 {
+		return
+	}
+	if publishErr := c.Bus.Publish(shortUrls...); publishErr != nil {
+		slog.Warn("Other instances may serve stale links until they expire", "count", len(shortUrls), "error", publishErr)
+	}
+}
+
+// Stops listening for invalidations before closing the store beneath
+func (c *cachedLinkStore) Close() error {
+	if c.Bus != nil {
+		if closeErr := c.Bus.Close(); closeErr != nil {
+			slog.Error("Error closing invalidation bus", "error", closeErr)
+		}
+	}
+	return c.LinkStore.Close()
+}
+
+func (c *cachedLinkStore) Stats() linkCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.Capacity
+	return stats
+}
+
+// Writes go to the store, then drop what the cache holds for the links
+
+func (c *cachedLinkStore) Put(ctx context.Context, links ...urlDocumentContent) error {
+	putErr := c.LinkStore.Put(ctx, links...)
+	var shortUrls []string
+	for _, link := range links {
+		shortUrls = append(shortUrls, link.ShortUrl)
+	}
+	c.invalidateEverywhere(shortUrls...)
+	return putErr
+}
+
+func (c *cachedLinkStore) Delete(ctx context.Context, shortUrl string) error {
+	deleteErr := c.LinkStore.Delete(ctx, shortUrl)
+	c.invalidateEverywhere(shortUrl)
+	return deleteErr
+}
+
+func (c *cachedLinkStore) Update(ctx context.Context, shortUrl string, update func(*urlDocumentContent) error) error {
+	updateErr := c.LinkStore.Update(ctx, shortUrl, update)
+	c.invalidateEverywhere(shortUrl)
+	return updateErr
+}
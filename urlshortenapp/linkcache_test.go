@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Serves the given links, counting reads and holding them until released
+type MockCountingLinkStore struct {
+	LinkStore
+	links   map[string]urlDocumentContent
+	error   error
+	release chan struct{}
+	mutex   sync.Mutex
+	gets    int
+	closed  bool
+}
+
+func (m *MockCountingLinkStore) Get(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	m.mutex.Lock()
+	m.gets++
+	m.mutex.Unlock()
+	if m.release != nil {
+		select {
+		case <-m.release:
+		case <-ctx.Done():
+			return urlDocumentContent{}, ctx.Err()
+		}
+	}
+	if m.error != nil {
+		return urlDocumentContent{}, m.error
+	}
+	link, ok := m.links[shortUrl]
+	if !ok {
+		return urlDocumentContent{}, ErrLinkNotFound
+	}
+	return link, nil
+}
+
+func (m *MockCountingLinkStore) Update(_ context.Context, _ string, _ func(*urlDocumentContent) error) error {
+	return nil
+}
+
+func (m *MockCountingLinkStore) Close() error {
+	m.closed = true
+	return nil
+}
+
+func (m *MockCountingLinkStore) Gets() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.gets
+}
+
+func newMockCountingLinkStore() *MockCountingLinkStore {
+	return &MockCountingLinkStore{links: map[string]urlDocumentContent{
+		"http://shrt.url/abc": {ShortUrl: "http://shrt.url/abc", OriginalUrl: "http://example.com/a"},
+		"http://shrt.url/def": {ShortUrl: "http://shrt.url/def", OriginalUrl: "http://example.com/d"},
+	}}
+}
+
+func TestCachedLinkStore_Get(t *testing.T) {
+	t.Run("serves repeated reads from the cache", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, nil)
+		for i := 0; i < 3; i++ {
+			link, getErr := cache.Get(context.Background(), "http://shrt.url/abc")
+			if getErr != nil || link.OriginalUrl != "http://example.com/a" {
+				t.Errorf("Received %s and %s, expected %s", link.OriginalUrl, getErr, "http://example.com/a")
+			}
+		}
+		stats := cache.Stats()
+		if store.Gets() != 1 || stats.Hits != 2 || stats.Misses != 1 {
+			t.Errorf("Received %d reads and %+v, expected 1 read, 2 hits and 1 miss", store.Gets(), stats)
+		}
+	})
+	t.Run("caches missing links but not errors", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, nil)
+		for i := 0; i < 2; i++ {
+			if _, getErr := cache.Get(context.Background(), "http://shrt.url/xyz"); getErr != ErrLinkNotFound {
+				t.Errorf("Received %s, expected %s", getErr, ErrLinkNotFound)
+			}
+		}
+		if store.Gets() != 1 || cache.Stats().NegativeHits != 1 {
+			t.Errorf("Received %d reads and %+v, expected 1 read and 1 negative hit", store.Gets(), cache.Stats())
+		}
+
+		store.error = errors.New("failed")
+		for i := 0; i < 2; i++ {
+			if _, getErr := cache.Get(context.Background(), "http://shrt.url/abc"); getErr != store.error {
+				t.Errorf("Received %s, expected %s", getErr, store.error)
+			}
+		}
+		if store.Gets() != 3 {
+			t.Errorf("Received %d reads, expected %d", store.Gets(), 3)
+		}
+	})
+	t.Run("reads again once entries expire", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Second, nil)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = cache.Get(context.Background(), "http://shrt.url/xyz")
+		now = now.Add(2 * time.Second)
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = cache.Get(context.Background(), "http://shrt.url/xyz")
+		if store.Gets() != 3 {
+			t.Errorf("Received %d reads, expected only the missing link to be read again", store.Gets())
+		}
+	})
+	t.Run("evicts the least recently used link", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		cache := NewCachedLinkStore(store, 1, time.Minute, time.Minute, nil)
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = cache.Get(context.Background(), "http://shrt.url/def")
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		stats := cache.Stats()
+		if store.Gets() != 3 || stats.Evictions != 2 || stats.Size != 1 {
+			t.Errorf("Received %d reads and %+v, expected 3 reads and 2 evictions", store.Gets(), stats)
+		}
+	})
+	t.Run("collapses concurrent reads of one link", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		store.release = make(chan struct{})
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, nil)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+			}()
+		}
+		for cache.Stats().Misses < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(store.release)
+		wg.Wait()
+		if store.Gets() != 1 {
+			t.Errorf("Received %d reads, expected %d", store.Gets(), 1)
+		}
+	})
+	t.Run("serves callers waiting on a read whose first caller gave up", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		store.release = make(chan struct{})
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		firstErr := make(chan error)
+		go func() {
+			_, getErr := cache.Get(ctx, "http://shrt.url/abc")
+			firstErr <- getErr
+		}()
+		for store.Gets() < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		type getResult struct {
+			link urlDocumentContent
+			err  error
+		}
+		second := make(chan getResult)
+		go func() {
+			link, getErr := cache.Get(context.Background(), "http://shrt.url/abc")
+			second <- getResult{link, getErr}
+		}()
+		for cache.Stats().Misses < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		cancel()
+		if getErr := <-firstErr; getErr != context.Canceled {
+			t.Errorf("Received %s, expected %s", getErr, context.Canceled)
+		}
+		close(store.release)
+		result := <-second
+		if result.err != nil || result.link.OriginalUrl != "http://example.com/a" {
+			t.Errorf("Received %s and %s, expected %s", result.link.OriginalUrl, result.err, "http://example.com/a")
+		}
+		if store.Gets() != 1 {
+			t.Errorf("Received %d reads, expected %d", store.Gets(), 1)
+		}
+	})
+}
+
+func TestCachedLinkStore_Invalidate(t *testing.T) {
+	t.Run("drops links when they are written", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, nil)
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		_ = cache.Update(context.Background(), "http://shrt.url/abc", func(_ *urlDocumentContent) error { return nil })
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		if store.Gets() != 2 || cache.Stats().Invalidations != 1 {
+			t.Errorf("Received %d reads and %+v, expected 2 reads and 1 invalidation", store.Gets(), cache.Stats())
+		}
+	})
+	t.Run("does not cache reads started before an invalidation", func(t *testing.T) {
+		store := newMockCountingLinkStore()
+		store.release = make(chan struct{})
+		cache := NewCachedLinkStore(store, 10, time.Minute, time.Minute, nil)
+		done := make(chan struct{})
+		go func() {
+			_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+			close(done)
+		}()
+		for store.Gets() < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		cache.Invalidate("http://shrt.url/abc")
+		close(store.release)
+		<-done
+		if cache.Stats().Size != 0 {
+			t.Errorf("Received %d cached links, expected none", cache.Stats().Size)
+		}
+	})
+}
+
+func TestHandleLinkCacheStatsRequest(t *testing.T) {
+	originalLinkCache := App.LinkCache
+	defer func() { App.LinkCache = originalLinkCache }()
+
+	t.Run("returns disabled when there is no cache", func(t *testing.T) {
+		App.LinkCache = nil
+		w := httptest.NewRecorder()
+		HandleLinkCacheStatsRequest(w, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":false`) {
+			t.Errorf("Received %d %s, expected %d and disabled", w.Code, w.Body.String(), http.StatusOK)
+		}
+	})
+	t.Run("returns stats of the cache", func(t *testing.T) {
+		App.LinkCache = NewCachedLinkStore(newMockCountingLinkStore(), 10, time.Minute, time.Minute, nil)
+		_, _ = App.LinkCache.Get(context.Background(), "http://shrt.url/abc")
+		w := httptest.NewRecorder()
+		HandleLinkCacheStatsRequest(w, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+		if !strings.Contains(w.Body.String(), `"enabled":true,"size":1,"capacity":10,"hits":0,"negative_hits":0,"misses":1`) {
+			t.Errorf("Received %s, expected stats of the cache", w.Body.String())
+		}
+	})
+}
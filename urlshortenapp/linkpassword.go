@@ -0,0 +1,124 @@
+package main
+
+// Password gate for protected short links
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LinkPasswordHeader    = "X-Link-Password"
+	LinkPasswordFormField = "password"
+	MinLinkPasswordLength = 8
+	MaxLinkPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+var (
+	ErrCouldNotHashLinkPassword = errors.New("could not hash link password")
+)
+
+func hashLinkPassword(password string) (string, error) {
+	hash, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if hashErr != nil {
+		slog.Error("Error hashing link password", "error", hashErr)
+		return "", ErrCouldNotHashLinkPassword
+	}
+	return string(hash), nil
+}
+
+func (c urlDocumentContent) IsPasswordProtected() bool {
+	return c.PasswordHash != ""
+}
+
+func (c urlDocumentContent) VerifyPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.PasswordHash), []byte(password)) == nil
+}
+
+// Limits failed password attempts per link within a fixed window
+type passwordAttemptLimiter struct {
+	MaxFailures int
+	Window      time.Duration
+	mutex       sync.Mutex
+	windows     map[string]*failureWindow
+}
+
+type failureWindow struct {
+	failures int
+	resetAt  time.Time
+}
+
+func newPasswordAttemptLimiter(maxFailures int, window time.Duration) *passwordAttemptLimiter {
+	return &passwordAttemptLimiter{
+		MaxFailures: maxFailures,
+		Window:      window,
+		windows:     map[string]*failureWindow{},
+	}
+}
+
+// Returns how long the caller must wait before trying again, if blocked
+func (l *passwordAttemptLimiter) Blocked(key string) (time.Duration, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	window, ok := l.windows[key]
+	if !ok {
+		return 0, false
+	}
+	now := time.Now()
+	if !now.Before(window.resetAt) {
+		delete(l.windows, key)
+		return 0, false
+	}
+	if window.failures < l.MaxFailures {
+		return 0, false
+	}
+	return window.resetAt.Sub(now), true
+}
+
+func (l *passwordAttemptLimiter) RecordFailure(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	window, ok := l.windows[key]
+	if !ok || !now.Before(window.resetAt) {
+		window = &failureWindow{resetAt: now.Add(l.Window)}
+		l.windows[key] = window
+	}
+	window.failures++
+}
+
+var linkPasswordFormTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password required</title></head>
+<body>
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="short_url" value="{{.ShortUrl}}">
+<p>{{.ShortUrl}} is password protected.</p>
+{{if .Failed}}<p>Incorrect password, try again.</p>{{end}}
+<input type="password" name="password" autofocus required>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+type linkPasswordForm struct {
+	Action   string
+	ShortUrl string
+	Failed   bool
+}
+
+func handlePasswordForm(w http.ResponseWriter, statusCode int, form linkPasswordForm) {
+	slog.Debug("Returning password form", "status", statusCode)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	_ = linkPasswordFormTemplate.Execute(w, form)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUrlDocumentContent_VerifyPassword(t *testing.T) {
+	passwordHash, err := hashLinkPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := urlDocumentContent{urlAttributes: urlAttributes{PasswordHash: passwordHash}}
+	t.Run("returns false for incorrect password", func(t *testing.T) {
+		if content.VerifyPassword("battery staple") {
+			t.Errorf("Received %t, expected %t", true, false)
+		}
+	})
+	t.Run("returns true for correct password", func(t *testing.T) {
+		if !content.VerifyPassword("correct horse") {
+			t.Errorf("Received %t, expected %t", false, true)
+		}
+	})
+}
+
+func TestPasswordAttemptLimiter(t *testing.T) {
+	t.Run("blocks a key after too many failures", func(t *testing.T) {
+		limiter := newPasswordAttemptLimiter(2, time.Minute)
+		limiter.RecordFailure("http://shrt.url/abc123")
+		if _, blocked := limiter.Blocked("http://shrt.url/abc123"); blocked {
+			t.Errorf("Received %t, expected %t", blocked, false)
+		}
+		limiter.RecordFailure("http://shrt.url/abc123")
+		retryAfter, blocked := limiter.Blocked("http://shrt.url/abc123")
+		if !blocked || retryAfter <= 0 {
+			t.Errorf("Received %t after %s, expected %t", blocked, retryAfter, true)
+		}
+		if _, blocked := limiter.Blocked("http://shrt.url/other1"); blocked {
+			t.Errorf("Received %t for other key, expected %t", blocked, false)
+		}
+	})
+	t.Run("unblocks a key once the window passes", func(t *testing.T) {
+		limiter := newPasswordAttemptLimiter(1, time.Millisecond)
+		limiter.RecordFailure("http://shrt.url/abc123")
+		time.Sleep(2 * time.Millisecond)
+		if _, blocked := limiter.Blocked("http://shrt.url/abc123"); blocked {
+			t.Errorf("Received %t, expected %t", blocked, false)
+		}
+	})
+}
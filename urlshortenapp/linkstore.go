@@ -0,0 +1,223 @@
+package main
+
+// Storage of links, behind an interface so that small deployments can run
+// without Elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	LinkStoreElasticsearch = "elasticsearch"
+	LinkStorePostgres      = "postgres"
+	LinkStoreBolt          = "bolt"
+)
+
+var knownLinkStores = []string{LinkStoreElasticsearch, LinkStorePostgres, LinkStoreBolt}
+
+var (
+	ErrLinkNotFound               = errors.New("link not found")
+	ErrUnknownLinkStore           = errors.New("unknown link store")
+	ErrLinkStoreNotElasticsearch  = errors.New("link store is not elasticsearch")
+	ErrCouldNotInitLinkStore      = errors.New("could not init link store")
+	ErrCouldNotConnectToLinkStore = errors.New("could not connect to link store")
+)
+
+// Links are keyed by their short URL. Stores other than Elasticsearch match
+// search text as substrings, and sort by relevance as newest first.
+type LinkStore interface {
+	Init(ctx context.Context) error
+	Ping(ctx context.Context) error
+	Get(ctx context.Context, shortUrl string) (urlDocumentContent, error)
+	// Creates links or replaces them whole
+	Put(ctx context.Context, links ...urlDocumentContent) error
+	Delete(ctx context.Context, shortUrl string) error
+	// Reads, changes and writes back a link without losing concurrent writes
+	Update(ctx context.Context, shortUrl string, update func(*urlDocumentContent) error) error
+	// Counts a click unless the link's limit is reached, atomically
+	ConsumeClick(ctx context.Context, shortUrl string) error
+	Search(ctx context.Context, query urlSearchQuery) (urlSearchResult, error)
+	// Hands over every link, or every link in the workspace, in pages
+	Scan(ctx context.Context, workspace string, handlePage func([]urlDocumentContent) error) error
+	// Returns which of the short URLs are stored
+	Existing(ctx context.Context, shortUrls []string) ([]string, error)
+	// Releases connections or files, once nothing uses the store
+	Close() error
+}
+
+// Implemented by stores that add behaviour to another, such as caching or
+// tracing, so that the store underneath can be reached
+type linkStoreWrapper interface {
+	Unwrap() LinkStore
+}
+
+// Traces the store, then caches links in front of it unless the cache is
+// disabled, returning the cache too when there is one
+func wrapLinkStore(links LinkStore, config Config, bus InvalidationBus) (LinkStore, *cachedLinkStore) {
+	links = NewTracedLinkStore(links, config.LinkStore)
+	if config.LinkCacheSize <= 0 {
+		return links, nil
+	}
+	cache := NewCachedLinkStore(
+		links,
+		config.LinkCacheSize,
+		time.Duration(config.LinkCacheTtl)*time.Second,
+		time.Duration(config.LinkCacheNegativeTtl)*time.Second,
+		bus,
+	)
+	return cache, cache
+}
+
+// Search helpers for stores without a query language of their own
+
+func urlSearchSort(query urlSearchQuery) string {
+	if query.Sort != "" {
+		return query.Sort
+	}
+	if query.Text != "" {
+		return UrlSearchSortRelevance
+	}
+	return UrlSearchSortNewest
+}
+
+func urlSearchSize(query urlSearchQuery) int {
+	if query.Size <= 0 {
+		return DefaultUrlSearchSize
+	}
+	return query.Size
+}
+
+// Split like the url analyzer of the Elasticsearch index
+func urlSearchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func linkMatchesSearchQuery(link urlDocumentContent, query urlSearchQuery) bool {
+	if query.Workspace != "" && link.Workspace != query.Workspace {
+		return false
+	}
+	if query.Tag != "" && !containsString(link.Tags, query.Tag) {
+		return false
+	}
+	if query.CreatedAfter != nil && (link.CreatedAt == nil || !link.CreatedAt.After(*query.CreatedAfter)) {
+		return false
+	}
+	if len(query.ShortHosts) > 0 {
+		matchesHost := false
+		for _, shortHost := range query.ShortHosts {
+			if strings.HasPrefix(link.ShortUrl, strings.TrimSuffix(shortHost, "/")+"/") {
+				matchesHost = true
+				break
+			}
+		}
+		if !matchesHost {
+			return false
+		}
+	}
+	searchable := strings.ToLower(strings.Join(
+		append([]string{link.OriginalUrl, link.Title}, link.Tags...), " ",
+	))
+	for _, word := range urlSearchWords(query.Text) {
+		if !strings.Contains(searchable, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// Links without a creation time sort as the oldest, as in Elasticsearch
+func linkSearchSortKey(link urlDocumentContent, sort string) int64 {
+	switch sort {
+	case UrlSearchSortMostClicks, UrlSearchSortFewestClicks:
+		return int64(link.ClickCount)
+	default:
+		if link.CreatedAt == nil {
+			return math.MinInt64
+		}
+		return link.CreatedAt.UnixNano()
+	}
+}
+
+type linkSearchCursor struct {
+	Key      int64
+	ShortUrl string
+}
+
+func parseLinkSearchCursor(cursor string) (linkSearchCursor, error) {
+	sortValues, decodeErr := decodeSearchCursor(cursor)
+	if decodeErr != nil {
+		return linkSearchCursor{}, decodeErr
+	}
+	var values []json.RawMessage
+	var parsed linkSearchCursor
+	if json.Unmarshal(sortValues, &values) != nil || len(values) != 2 ||
+		json.Unmarshal(values[0], &parsed.Key) != nil || json.Unmarshal(values[1], &parsed.ShortUrl) != nil {
+		return linkSearchCursor{}, ErrCouldNotParseSearchCursor
+	}
+	return parsed, nil
+}
+
+// Filters, sorts and pages through links held in memory, ties broken on the
+// short URL as in Elasticsearch
+func searchLinks(links []urlDocumentContent, query urlSearchQuery) (urlSearchResult, error) {
+	var after *linkSearchCursor
+	if query.After != "" {
+		cursor, cursorErr := parseLinkSearchCursor(query.After)
+		if cursorErr != nil {
+			return urlSearchResult{}, cursorErr
+		}
+		after = &cursor
+	}
+
+	// Filter and sort
+	sortBy := urlSearchSort(query)
+	ascending := sortBy == UrlSearchSortOldest || sortBy == UrlSearchSortFewestClicks
+	var matches []urlDocumentContent
+	for _, link := range links {
+		if linkMatchesSearchQuery(link, query) {
+			matches = append(matches, link)
+		}
+	}
+	precedes := func(a linkSearchCursor, b linkSearchCursor) bool {
+		if a.Key != b.Key {
+			return (a.Key < b.Key) == ascending
+		}
+		return a.ShortUrl < b.ShortUrl
+	}
+	cursorFor := func(link urlDocumentContent) linkSearchCursor {
+		return linkSearchCursor{Key: linkSearchSortKey(link, sortBy), ShortUrl: link.ShortUrl}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return precedes(cursorFor(matches[i]), cursorFor(matches[j]))
+	})
+
+	// Page after the cursor, leaving out password hashes
+	result := urlSearchResult{Total: len(matches), Results: []urlDocumentContent{}}
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return precedes(*after, cursorFor(matches[i]))
+		})
+	}
+	size := urlSearchSize(query)
+	for _, link := range matches[start:minInt(start+size, len(matches))] {
+		link.PasswordHash = ""
+		result.Results = append(result.Results, link)
+	}
+	if len(result.Results) == size {
+		last := cursorFor(result.Results[size-1])
+		sortValues, _ := json.Marshal([]interface{}{last.Key, last.ShortUrl})
+		result.Next = encodeSearchCursor(sortValues)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+// Links stored in an embedded bbolt database file, for small deployments
+// and tests that should not need a database server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"log/slog"
+	"time"
+)
+
+var boltLinksBucket = []byte("links")
+
+type boltLinkStore struct {
+	Db *bbolt.DB
+}
+
+// Only one process can hold the file open, so every instance of the app
+// needs its own. The bucket is created on opening, so that subcommands can
+// run against a new file.
+func NewBoltLinkStore(path string) (LinkStore, error) {
+	db, openErr := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if openErr != nil {
+		slog.Error("Error opening bbolt database", "path", path, "error", openErr)
+		return nil, ErrCouldNotConnectToLinkStore
+	}
+	store := &boltLinkStore{Db: db}
+	if initErr := store.Init(context.Background()); initErr != nil {
+		slog.Error("Error creating bucket in bbolt database", "path", path, "error", initErr)
+		_ = db.Close()
+		return nil, ErrCouldNotInitLinkStore
+	}
+	return store, nil
+}
+
+func (s boltLinkStore) Init(ctx context.Context) error {
+	return s.Db.Update(func(tx *bbolt.Tx) error {
+		_, createErr := tx.CreateBucketIfNotExists(boltLinksBucket)
+		return createErr
+	})
+}
+
+// The file is opened up front, so there is nothing to wait for
+func (s boltLinkStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Waits for open transactions, then releases the file for other processes
+func (s boltLinkStore) Close() error {
+	return s.Db.Close()
+}
+
+func getBoltLink(bucket *bbolt.Bucket, shortUrl string) (urlDocumentContent, error) {
+	value := bucket.Get([]byte(shortUrl))
+	if value == nil {
+		return urlDocumentContent{}, ErrLinkNotFound
+	}
+	return parseBoltLink(value)
+}
+
+func parseBoltLink(value []byte) (urlDocumentContent, error) {
+	var content urlDocumentContent
+	if parseErr := json.Unmarshal(value, &content); parseErr != nil {
+		slog.Error("Error parsing link document", "error", parseErr)
+		return urlDocumentContent{}, ErrCouldNotParseDocumentJson
+	}
+	return content, nil
+}
+
+func putBoltLink(bucket *bbolt.Bucket, link urlDocumentContent) error {
+	value, _ := json.Marshal(link)
+	return bucket.Put([]byte(link.ShortUrl), value)
+}
+
+func (s boltLinkStore) Get(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	var content urlDocumentContent
+	viewErr := s.Db.View(func(tx *bbolt.Tx) error {
+		var getErr error
+		content, getErr = getBoltLink(tx.Bucket(boltLinksBucket), shortUrl)
+		return getErr
+	})
+	return content, viewErr
+}
+
+func (s boltLinkStore) Put(ctx context.Context, links ...urlDocumentContent) error {
+	return s.Db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltLinksBucket)
+		for _, link := range links {
+			if putErr := putBoltLink(bucket, link); putErr != nil {
+				return putErr
+			}
+		}
+		return nil
+	})
+}
+
+func (s boltLinkStore) Delete(ctx context.Context, shortUrl string) error {
+	return s.Db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltLinksBucket)
+		if bucket.Get([]byte(shortUrl)) == nil {
+			return ErrLinkNotFound
+		}
+		return bucket.Delete([]byte(shortUrl))
+	})
+}
+
+// bbolt runs one writer at a time, so nothing can change the link between
+// reading and writing it
+func (s boltLinkStore) Update(ctx context.Context, shortUrl string, update func(*urlDocumentContent) error) error {
+	return s.Db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltLinksBucket)
+		content, getErr := getBoltLink(bucket, shortUrl)
+		if getErr != nil {
+			return getErr
+		}
+		if updateErr := update(&content); updateErr != nil {
+			return updateErr
+		}
+		return putBoltLink(bucket, content)
+	})
+}
+
+func (s boltLinkStore) ConsumeClick(ctx context.Context, shortUrl string) error {
+	return s.Update(ctx, shortUrl, func(content *urlDocumentContent) error {
+		if content.IsClickLimitReached() {
+			return ErrShortUrlClickLimitReached
+		}
+		content.ClickCount++
+		return nil
+	})
+}
+
+// Reads every link, which is fine at the sizes this store is meant for
+func (s boltLinkStore) Search(ctx context.Context, query urlSearchQuery) (urlSearchResult, error) {
+	var links []urlDocumentContent
+	viewErr := s.Db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltLinksBucket).ForEach(func(_ []byte, value []byte) error {
+			content, parseErr := parseBoltLink(value)
+			if parseErr != nil {
+				return parseErr
+			}
+			links = append(links, content)
+			return nil
+		})
+	})
+	if viewErr != nil {
+		return urlSearchResult{}, viewErr
+	}
+	return searchLinks(links, query)
+}
+
+// Each page is read in its own transaction, so that handling a page does not
+// hold up writers
+func (s boltLinkStore) Scan(ctx context.Context, workspace string, handlePage func([]urlDocumentContent) error) error {
+	var after []byte
+	for {
+		var links []urlDocumentContent
+		var lastKey []byte
+		viewErr := s.Db.View(func(tx *bbolt.Tx) error {
+			cursor := tx.Bucket(boltLinksBucket).Cursor()
+			key, value := cursor.First()
+			if after != nil {
+				key, value = cursor.Seek(after)
+				if key != nil && bytes.Equal(key, after) {
+					key, value = cursor.Next()
+				}
+			}
+			for scanned := 0; key != nil && scanned < linkTransferBatchSize; key, value = cursor.Next() {
+				scanned++
+				lastKey = append([]byte{}, key...)
+				content, parseErr := parseBoltLink(value)
+				if parseErr != nil {
+					return parseErr
+				}
+				if workspace == "" || content.Workspace == workspace {
+					links = append(links, content)
+				}
+			}
+			return nil
+		})
+		if viewErr != nil {
+			return viewErr
+		}
+
+		if len(links) > 0 {
+			if handleErr := handlePage(links); handleErr != nil {
+				return handleErr
+			}
+		}
+		if lastKey == nil {
+			return nil
+		}
+		after = lastKey
+	}
+}
+
+func (s boltLinkStore) Existing(ctx context.Context, shortUrls []string) ([]string, error) {
+	var existing []string
+	viewErr := s.Db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltLinksBucket)
+		for _, shortUrl := range shortUrls {
+			if bucket.Get([]byte(shortUrl)) != nil {
+				existing = append(existing, shortUrl)
+			}
+		}
+		return nil
+	})
+	return existing, viewErr
+}
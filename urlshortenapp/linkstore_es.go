@@ -0,0 +1,237 @@
+package main
+
+// Links stored in Elasticsearch, as documents keyed by a hash of the short URL
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+)
+
+// EsIndex is the alias that versioned indices are read and written through
+type esLinkStore struct {
+	EsIndex       string
+	EsService     EsService
+	IndexSettings esIndexSettings
+}
+
+func NewEsLinkStore(esIndex string, esService EsService, indexSettings esIndexSettings) LinkStore {
+	return &esLinkStore{
+		EsIndex:       esIndex,
+		EsService:     esService,
+		IndexSettings: indexSettings,
+	}
+}
+
+func documentIdForShortUrl(shortUrl string) string {
+	shortUrlHash := md5.Sum([]byte(shortUrl))
+	return hex.EncodeToString(shortUrlHash[:])
+}
+
+func parseLinkDocument(document Document) (urlDocumentContent, error) {
+	var content urlDocumentContent
+	if parseErr := json.Unmarshal(document.Content, &content); parseErr != nil {
+		slog.Error("Error parsing document content", "id", document.Id, "error", parseErr)
+		return urlDocumentContent{}, ErrCouldNotParseDocumentJson
+	}
+	return content, nil
+}
+
+func (s esLinkStore) Init(ctx context.Context) error {
+	return s.EnsureElasticsearchIndex()
+}
+
+func (s esLinkStore) Ping(ctx context.Context) error {
+	return s.EsService.PrintInfo(ctx)
+}
+
+// The Elasticsearch client holds no connections worth closing
+func (s esLinkStore) Close() error {
+	return nil
+}
+
+func (s esLinkStore) Get(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	_, content, getErr := s.getDocument(ctx, shortUrl)
+	return content, getErr
+}
+
+func (s esLinkStore) getDocument(ctx context.Context, shortUrl string) (Document, urlDocumentContent, error) {
+	document, getErr := s.EsService.GetDocumentById(ctx, s.EsIndex, documentIdForShortUrl(shortUrl))
+	if getErr == ErrEsDoesNotContainDocument {
+		return Document{}, urlDocumentContent{}, ErrLinkNotFound
+	}
+	if getErr != nil {
+		return Document{}, urlDocumentContent{}, getErr
+	}
+	content, parseErr := parseLinkDocument(document)
+	if parseErr != nil {
+		return Document{}, urlDocumentContent{}, parseErr
+	}
+	return document, content, nil
+}
+
+func (s esLinkStore) Put(ctx context.Context, links ...urlDocumentContent) error {
+	var documents []Document
+	for _, link := range links {
+		content, _ := json.Marshal(link)
+		documents = append(documents, Document{Id: documentIdForShortUrl(link.ShortUrl), Content: content})
+	}
+	if len(documents) == 1 {
+		id, indexErr := s.EsService.IndexDocument(ctx, s.EsIndex, documents[0])
+		if indexErr != nil {
+			return indexErr
+		}
+		slog.Debug("Indexed document", "id", id)
+		return nil
+	}
+	return s.EsService.BulkIndexDocuments(ctx, s.EsIndex, documents)
+}
+
+func (s esLinkStore) Delete(ctx context.Context, shortUrl string) error {
+	deleteErr := s.EsService.DeleteDocument(ctx, s.EsIndex, documentIdForShortUrl(shortUrl))
+	if deleteErr == ErrEsDoesNotContainDocument {
+		return ErrLinkNotFound
+	}
+	return deleteErr
+}
+
+// Retries when the document changes between reading and writing it, such as
+// when a click is counted at the same time
+func (s esLinkStore) Update(ctx context.Context, shortUrl string, update func(*urlDocumentContent) error) error {
+	for attempt := 1; ; attempt++ {
+		document, content, getErr := s.getDocument(ctx, shortUrl)
+		if getErr != nil {
+			return getErr
+		}
+		if updateErr := update(&content); updateErr != nil {
+			return updateErr
+		}
+
+		// Store updated document over the retrieved one
+		document.Content, _ = json.Marshal(content)
+		_, indexErr := s.EsService.IndexDocument(ctx, s.EsIndex, document)
+		if indexErr == ErrEsDocumentVersionConflict && attempt < 3 {
+			slog.Debug("Document for short URL changed, retrying update", "short_url", shortUrl)
+			continue
+		}
+		if indexErr != nil {
+			return indexErr
+		}
+		slog.Debug("Updated document", "id", document.Id)
+		return nil
+	}
+}
+
+// Counts the click unless the limit is already reached, atomically in
+// Elasticsearch so concurrent redirects cannot exceed the limit
+const consumeClickScript = `
+def count = ctx._source.click_count == null ? 0 : ctx._source.click_count;
+if (ctx._source.max_clicks != null && ctx._source.max_clicks > 0 && count >= ctx._source.max_clicks) {
+	ctx.op = 'noop';
+} else {
+	ctx._source.click_count = count + 1;
+}`
+
+func (s esLinkStore) ConsumeClick(ctx context.Context, shortUrl string) error {
+	result, updateErr := s.EsService.UpdateDocumentWithScript(
+		ctx, s.EsIndex, documentIdForShortUrl(shortUrl), consumeClickScript, nil,
+	)
+	if updateErr == ErrEsDoesNotContainDocument {
+		return ErrLinkNotFound
+	}
+	if updateErr != nil {
+		return updateErr
+	}
+	if result == "noop" {
+		return ErrShortUrlClickLimitReached
+	}
+	return nil
+}
+
+func (s esLinkStore) Search(ctx context.Context, query urlSearchQuery) (urlSearchResult, error) {
+	// Construct search request
+	searchJson, buildErr := buildUrlSearchQuery(query)
+	if buildErr != nil {
+		return urlSearchResult{}, buildErr
+	}
+
+	// Search Elasticsearch
+	searchResult, searchErr := s.EsService.Search(ctx, s.EsIndex, searchJson)
+	if searchErr != nil {
+		return urlSearchResult{}, searchErr
+	}
+
+	// Parse matching documents
+	result := urlSearchResult{Total: searchResult.Total, Results: []urlDocumentContent{}}
+	for _, document := range searchResult.Documents {
+		content, parseErr := parseLinkDocument(document)
+		if parseErr != nil {
+			return urlSearchResult{}, parseErr
+		}
+		result.Results = append(result.Results, content)
+	}
+
+	// Continue after the last result, unless the page was not full
+	if len(searchResult.Documents) == urlSearchSize(query) && searchResult.LastSort != nil {
+		result.Next = encodeSearchCursor(searchResult.LastSort)
+	}
+
+	return result, nil
+}
+
+func (s esLinkStore) Scan(ctx context.Context, workspace string, handlePage func([]urlDocumentContent) error) error {
+	// Construct scroll request
+	var query interface{} = map[string]interface{}{"match_all": map[string]interface{}{}}
+	if workspace != "" {
+		query = map[string]interface{}{"term": map[string]string{"workspace": workspace}}
+	}
+	scrollJson, _ := json.Marshal(map[string]interface{}{
+		"size":  linkTransferBatchSize,
+		"sort":  []string{"_doc"},
+		"query": query,
+	})
+
+	// Scroll through links
+	return s.EsService.ScrollDocuments(ctx, s.EsIndex, scrollJson, func(documents []Document) error {
+		var links []urlDocumentContent
+		for _, document := range documents {
+			content, parseErr := parseLinkDocument(document)
+			if parseErr != nil {
+				return parseErr
+			}
+			links = append(links, content)
+		}
+		return handlePage(links)
+	})
+}
+
+func (s esLinkStore) Existing(ctx context.Context, shortUrls []string) ([]string, error) {
+	if len(shortUrls) == 0 {
+		return nil, nil
+	}
+	shortUrlsById := map[string]string{}
+	var ids []string
+	for _, shortUrl := range shortUrls {
+		id := documentIdForShortUrl(shortUrl)
+		shortUrlsById[id] = shortUrl
+		ids = append(ids, id)
+	}
+	searchJson, _ := json.Marshal(map[string]interface{}{
+		"size":    len(ids),
+		"_source": false,
+		"query":   map[string]interface{}{"ids": map[string]interface{}{"values": ids}},
+	})
+	searchResult, searchErr := s.EsService.Search(ctx, s.EsIndex, searchJson)
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	var existing []string
+	for _, document := range searchResult.Documents {
+		if shortUrl, ok := shortUrlsById[document.Id]; ok {
+			existing = append(existing, shortUrl)
+		}
+	}
+	return existing, nil
+}
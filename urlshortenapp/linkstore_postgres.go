@@ -0,0 +1,404 @@
+package main
+
+// Links stored in Postgres, as JSON documents alongside the columns they are
+// filtered and sorted on
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log/slog"
+	"strings"
+)
+
+var postgresLinkSchema = []string{
+	`CREATE TABLE IF NOT EXISTS links (
+		short_url   text PRIMARY KEY,
+		workspace   text NOT NULL DEFAULT '',
+		created_at  timestamptz,
+		click_count integer NOT NULL DEFAULT 0,
+		document    jsonb NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS links_workspace_created_at ON links (workspace, created_at)`,
+	`CREATE INDEX IF NOT EXISTS links_tags ON links USING gin ((document->'tags'))`,
+}
+
+const upsertLinkSql = `
+INSERT INTO links (short_url, workspace, created_at, click_count, document)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (short_url) DO UPDATE SET
+	workspace = excluded.workspace,
+	created_at = excluded.created_at,
+	click_count = excluded.click_count,
+	document = excluded.document`
+
+// Counts the click unless the limit is already reached, in one statement so
+// concurrent redirects cannot exceed the limit
+const consumeClickSql = `
+UPDATE links SET
+	click_count = click_count + 1,
+	document = jsonb_set(document, '{click_count}', to_jsonb(click_count + 1))
+WHERE short_url = $1
+	AND NOT (COALESCE((document->>'max_clicks')::integer, 0) > 0
+		AND click_count >= (document->>'max_clicks')::integer)`
+
+type postgresLinkStore struct {
+	Pool *pgxpool.Pool
+}
+
+// Connects lazily, so that the app can start before Postgres is ready and
+// wait for it in the healthcheck
+func NewPostgresLinkStore(connStr string) (LinkStore, error) {
+	config, parseErr := pgxpool.ParseConfig(connStr)
+	if parseErr != nil {
+		slog.Error("Error parsing Postgres connection string", "error", parseErr)
+		return nil, ErrCouldNotConnectToLinkStore
+	}
+	config.LazyConnect = true
+	pool, connectErr := pgxpool.ConnectConfig(context.Background(), config)
+	if connectErr != nil {
+		slog.Error("Error connecting to Postgres", "error", connectErr)
+		return nil, ErrCouldNotConnectToLinkStore
+	}
+	return &postgresLinkStore{Pool: pool}, nil
+}
+
+func (s postgresLinkStore) Init(ctx context.Context) error {
+	for _, statement := range postgresLinkSchema {
+		if _, execErr := s.Pool.Exec(ctx, statement); execErr != nil {
+			return execErr
+		}
+	}
+	return nil
+}
+
+func (s postgresLinkStore) Ping(ctx context.Context) error {
+	return s.Pool.Ping(ctx)
+}
+
+// Waits for acquired connections to be released
+func (s postgresLinkStore) Close() error {
+	s.Pool.Close()
+	return nil
+}
+
+func parsePostgresLink(document []byte) (urlDocumentContent, error) {
+	var content urlDocumentContent
+	if parseErr := json.Unmarshal(document, &content); parseErr != nil {
+		slog.Error("Error parsing link document", "error", parseErr)
+		return urlDocumentContent{}, ErrCouldNotParseDocumentJson
+	}
+	return content, nil
+}
+
+func upsertLinkArgs(link urlDocumentContent) []interface{} {
+	document, _ := json.Marshal(link)
+	return []interface{}{link.ShortUrl, link.Workspace, link.CreatedAt, link.ClickCount, string(document)}
+}
+
+func (s postgresLinkStore) Get(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	var document []byte
+	queryErr := s.Pool.QueryRow(
+		ctx, `SELECT document FROM links WHERE short_url = $1`, shortUrl,
+	).Scan(&document)
+	if queryErr == pgx.ErrNoRows {
+		return urlDocumentContent{}, ErrLinkNotFound
+	}
+	if queryErr != nil {
+		return urlDocumentContent{}, queryErr
+	}
+	return parsePostgresLink(document)
+}
+
+func (s postgresLinkStore) Put(ctx context.Context, links ...urlDocumentContent) error {
+	if len(links) == 1 {
+		_, execErr := s.Pool.Exec(ctx, upsertLinkSql, upsertLinkArgs(links[0])...)
+		return execErr
+	}
+
+	// Store every link or none
+	tx, beginErr := s.Pool.Begin(ctx)
+	if beginErr != nil {
+		return beginErr
+	}
+	defer tx.Rollback(ctx)
+	batch := &pgx.Batch{}
+	for _, link := range links {
+		batch.Queue(upsertLinkSql, upsertLinkArgs(link)...)
+	}
+	if batchErr := tx.SendBatch(ctx, batch).Close(); batchErr != nil {
+		return batchErr
+	}
+	return tx.Commit(ctx)
+}
+
+func (s postgresLinkStore) Delete(ctx context.Context, shortUrl string) error {
+	tag, execErr := s.Pool.Exec(ctx, `DELETE FROM links WHERE short_url = $1`, shortUrl)
+	if execErr != nil {
+		return execErr
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+// Locks the row while the link is changed
+func (s postgresLinkStore) Update(ctx context.Context, shortUrl string, update func(*urlDocumentContent) error) error {
+	tx, beginErr := s.Pool.Begin(ctx)
+	if beginErr != nil {
+		return beginErr
+	}
+	defer tx.Rollback(ctx)
+
+	var document []byte
+	queryErr := tx.QueryRow(
+		ctx, `SELECT document FROM links WHERE short_url = $1 FOR UPDATE`, shortUrl,
+	).Scan(&document)
+	if queryErr == pgx.ErrNoRows {
+		return ErrLinkNotFound
+	}
+	if queryErr != nil {
+		return queryErr
+	}
+	content, parseErr := parsePostgresLink(document)
+	if parseErr != nil {
+		return parseErr
+	}
+	if updateErr := update(&content); updateErr != nil {
+		return updateErr
+	}
+
+	if _, execErr := tx.Exec(ctx, upsertLinkSql, upsertLinkArgs(content)...); execErr != nil {
+		return execErr
+	}
+	return tx.Commit(ctx)
+}
+
+func (s postgresLinkStore) ConsumeClick(ctx context.Context, shortUrl string) error {
+	tag, execErr := s.Pool.Exec(ctx, consumeClickSql, shortUrl)
+	if execErr != nil {
+		return execErr
+	}
+	if tag.RowsAffected() == 1 {
+		return nil
+	}
+
+	// Nothing was counted, either because the link does not exist or its
+	// limit is reached
+	var exists bool
+	queryErr := s.Pool.QueryRow(
+		ctx, `SELECT EXISTS (SELECT 1 FROM links WHERE short_url = $1)`, shortUrl,
+	).Scan(&exists)
+	if queryErr != nil {
+		return queryErr
+	}
+	if !exists {
+		return ErrLinkNotFound
+	}
+	return ErrShortUrlClickLimitReached
+}
+
+var postgresLikeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type postgresSearchQuery struct {
+	Sql      string
+	Args     []interface{}
+	CountSql string
+	// Arguments of the count are the leading arguments of the search
+	CountArgs int
+}
+
+// Search text is matched word by word against the same fields as in
+// Elasticsearch. Links are paged by their sort key and short URL, which the
+// cursor holds as text.
+func buildPostgresSearchQuery(query urlSearchQuery) (postgresSearchQuery, error) {
+	var where []string
+	var args []interface{}
+	addArg := func(arg interface{}) string {
+		args = append(args, arg)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// Filter
+	for _, word := range urlSearchWords(query.Text) {
+		where = append(where, fmt.Sprintf(
+			`lower(concat_ws(' ', document->>'original_url', document->>'title', document->>'tags')) LIKE %s`,
+			addArg("%"+word+"%"),
+		))
+	}
+	if len(query.ShortHosts) > 0 {
+		var hosts []string
+		for _, shortHost := range query.ShortHosts {
+			hosts = append(hosts, "short_url LIKE "+addArg(
+				postgresLikeEscaper.Replace(strings.TrimSuffix(shortHost, "/"))+"/%",
+			))
+		}
+		where = append(where, "("+strings.Join(hosts, " OR ")+")")
+	}
+	if query.Workspace != "" {
+		where = append(where, "workspace = "+addArg(query.Workspace))
+	}
+	if query.Tag != "" {
+		where = append(where, fmt.Sprintf(`document->'tags' @> jsonb_build_array(%s::text)`, addArg(query.Tag)))
+	}
+	if query.CreatedAfter != nil {
+		where = append(where, "created_at > "+addArg(query.CreatedAfter.UTC()))
+	}
+	countSql := "SELECT count(*) FROM links"
+	if len(where) > 0 {
+		countSql += " WHERE " + strings.Join(where, " AND ")
+	}
+	countArgs := len(args)
+
+	// Sort, links without a creation time sorting as the oldest
+	sortKey, sortType := "COALESCE(created_at, '-infinity')", "timestamptz"
+	sortBy := urlSearchSort(query)
+	if sortBy == UrlSearchSortMostClicks || sortBy == UrlSearchSortFewestClicks {
+		sortKey, sortType = "click_count", "integer"
+	}
+	order, after := "DESC", "<"
+	if sortBy == UrlSearchSortOldest || sortBy == UrlSearchSortFewestClicks {
+		order, after = "ASC", ">"
+	}
+
+	// Continue after the cursor
+	if query.After != "" {
+		sortValues, cursorErr := decodeSearchCursor(query.After)
+		if cursorErr != nil {
+			return postgresSearchQuery{}, cursorErr
+		}
+		var cursor []string
+		if json.Unmarshal(sortValues, &cursor) != nil || len(cursor) != 2 {
+			return postgresSearchQuery{}, ErrCouldNotParseSearchCursor
+		}
+		key, shortUrl := addArg(cursor[0]), addArg(cursor[1])
+		where = append(where, fmt.Sprintf(
+			"(%[1]s %[2]s %[3]s::%[4]s OR (%[1]s = %[3]s::%[4]s AND short_url > %[5]s))",
+			sortKey, after, key, sortType, shortUrl,
+		))
+	}
+
+	searchSql := fmt.Sprintf(
+		"SELECT %s::text, document - 'password_hash' FROM links", sortKey,
+	)
+	if len(where) > 0 {
+		searchSql += " WHERE " + strings.Join(where, " AND ")
+	}
+	searchSql += fmt.Sprintf(
+		" ORDER BY %s %s, short_url ASC LIMIT %s", sortKey, order, addArg(urlSearchSize(query)),
+	)
+
+	return postgresSearchQuery{Sql: searchSql, Args: args, CountSql: countSql, CountArgs: countArgs}, nil
+}
+
+func (s postgresLinkStore) Search(ctx context.Context, query urlSearchQuery) (urlSearchResult, error) {
+	searchQuery, buildErr := buildPostgresSearchQuery(query)
+	if buildErr != nil {
+		return urlSearchResult{}, buildErr
+	}
+
+	// Count every match
+	result := urlSearchResult{Results: []urlDocumentContent{}}
+	countErr := s.Pool.QueryRow(
+		ctx, searchQuery.CountSql, searchQuery.Args[:searchQuery.CountArgs]...,
+	).Scan(&result.Total)
+	if countErr != nil {
+		return urlSearchResult{}, countErr
+	}
+
+	// Fetch the page
+	rows, queryErr := s.Pool.Query(ctx, searchQuery.Sql, searchQuery.Args...)
+	if queryErr != nil {
+		return urlSearchResult{}, queryErr
+	}
+	defer rows.Close()
+	var lastKey string
+	for rows.Next() {
+		var document []byte
+		if scanErr := rows.Scan(&lastKey, &document); scanErr != nil {
+			return urlSearchResult{}, scanErr
+		}
+		content, parseErr := parsePostgresLink(document)
+		if parseErr != nil {
+			return urlSearchResult{}, parseErr
+		}
+		result.Results = append(result.Results, content)
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return urlSearchResult{}, rowsErr
+	}
+
+	// Continue after the last result, unless the page was not full
+	if len(result.Results) == urlSearchSize(query) {
+		sortValues, _ := json.Marshal([]string{lastKey, result.Results[len(result.Results)-1].ShortUrl})
+		result.Next = encodeSearchCursor(sortValues)
+	}
+
+	return result, nil
+}
+
+func (s postgresLinkStore) Scan(ctx context.Context, workspace string, handlePage func([]urlDocumentContent) error) error {
+	after := ""
+	for {
+		rows, queryErr := s.Pool.Query(
+			ctx,
+			`SELECT document FROM links WHERE ($1 = '' OR workspace = $1) AND short_url > $2
+			ORDER BY short_url LIMIT $3`,
+			workspace, after, linkTransferBatchSize,
+		)
+		if queryErr != nil {
+			return queryErr
+		}
+		var links []urlDocumentContent
+		for rows.Next() {
+			var document []byte
+			if scanErr := rows.Scan(&document); scanErr != nil {
+				rows.Close()
+				return scanErr
+			}
+			content, parseErr := parsePostgresLink(document)
+			if parseErr != nil {
+				rows.Close()
+				return parseErr
+			}
+			links = append(links, content)
+		}
+		rows.Close()
+		if rowsErr := rows.Err(); rowsErr != nil {
+			return rowsErr
+		}
+
+		if len(links) == 0 {
+			return nil
+		}
+		if handleErr := handlePage(links); handleErr != nil {
+			return handleErr
+		}
+		if len(links) < linkTransferBatchSize {
+			return nil
+		}
+		after = links[len(links)-1].ShortUrl
+	}
+}
+
+func (s postgresLinkStore) Existing(ctx context.Context, shortUrls []string) ([]string, error) {
+	rows, queryErr := s.Pool.Query(
+		ctx, `SELECT short_url FROM links WHERE short_url = ANY($1)`, shortUrls,
+	)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	var existing []string
+	for rows.Next() {
+		var shortUrl string
+		if scanErr := rows.Scan(&shortUrl); scanErr != nil {
+			return nil, scanErr
+		}
+		existing = append(existing, shortUrl)
+	}
+	return existing, rows.Err()
+}
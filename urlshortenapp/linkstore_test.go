@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBoltLinkStore(t *testing.T) LinkStore {
+	t.Helper()
+	links, openErr := NewBoltLinkStore(filepath.Join(t.TempDir(), "links.db"))
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	t.Cleanup(func() { _ = links.(*boltLinkStore).Db.Close() })
+	return links
+}
+
+func testSearchLinks() []urlDocumentContent {
+	earlier := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Hour)
+	return []urlDocumentContent{
+		{
+			ShortUrl: "http://shrt.url/abc", OriginalUrl: "http://example.com/launch", CreatedAt: &earlier, ClickCount: 5,
+			urlAttributes: urlAttributes{Title: "Launch", Tags: []string{"spring"}, Workspace: "team-a", PasswordHash: "hash"},
+		},
+		{
+			ShortUrl: "http://shrt.url/def", OriginalUrl: "http://example.com/pricing", CreatedAt: &later, ClickCount: 1,
+			urlAttributes: urlAttributes{Workspace: "team-a"},
+		},
+		{ShortUrl: "http://other.url/ghi", OriginalUrl: "http://example.org/launch", ClickCount: 3},
+	}
+}
+
+func searchResultShortUrls(result urlSearchResult) []string {
+	shortUrls := []string{}
+	for _, link := range result.Results {
+		shortUrls = append(shortUrls, link.ShortUrl)
+	}
+	return shortUrls
+}
+
+func TestSearchLinks(t *testing.T) {
+	links := testSearchLinks()
+	t.Run("filters on every given field", func(t *testing.T) {
+		result, _ := searchLinks(links, urlSearchQuery{
+			Text: "example.com launch", ShortHosts: []string{"http://shrt.url"}, Workspace: "team-a", Tag: "spring",
+		})
+		if !reflect.DeepEqual(searchResultShortUrls(result), []string{"http://shrt.url/abc"}) || result.Total != 1 {
+			t.Errorf("Received %v, expected %v", searchResultShortUrls(result), []string{"http://shrt.url/abc"})
+		}
+		if result.Results[0].PasswordHash != "" {
+			t.Errorf("Received %s, expected password hash to be left out", result.Results[0].PasswordHash)
+		}
+	})
+	t.Run("sorts links without a creation time as the oldest", func(t *testing.T) {
+		result, _ := searchLinks(links, urlSearchQuery{})
+		expected := []string{"http://shrt.url/def", "http://shrt.url/abc", "http://other.url/ghi"}
+		if !reflect.DeepEqual(searchResultShortUrls(result), expected) {
+			t.Errorf("Received %v, expected %v", searchResultShortUrls(result), expected)
+		}
+	})
+	t.Run("pages through links with the cursor", func(t *testing.T) {
+		var shortUrls []string
+		query := urlSearchQuery{Sort: UrlSearchSortFewestClicks, Size: 2}
+		for page := 0; page < 3; page++ {
+			result, searchErr := searchLinks(links, query)
+			if searchErr != nil {
+				t.Fatal(searchErr)
+			}
+			shortUrls = append(shortUrls, searchResultShortUrls(result)...)
+			if result.Next == "" {
+				break
+			}
+			query.After = result.Next
+		}
+		expected := []string{"http://shrt.url/def", "http://other.url/ghi", "http://shrt.url/abc"}
+		if !reflect.DeepEqual(shortUrls, expected) {
+			t.Errorf("Received %v, expected %v", shortUrls, expected)
+		}
+	})
+	t.Run("returns error when cursor cannot be parsed", func(t *testing.T) {
+		_, searchErr := searchLinks(links, urlSearchQuery{After: encodeSearchCursor(json.RawMessage(`["a"]`))})
+		if searchErr != ErrCouldNotParseSearchCursor {
+			t.Errorf("Received %s, expected %s", searchErr, ErrCouldNotParseSearchCursor)
+		}
+	})
+}
+
+func TestBoltLinkStore(t *testing.T) {
+	t.Run("returns error when link is not found", func(t *testing.T) {
+		links := newTestBoltLinkStore(t)
+		if _, getErr := links.Get(context.Background(), "http://shrt.url/abc"); getErr != ErrLinkNotFound {
+			t.Errorf("Received %s, expected %s", getErr, ErrLinkNotFound)
+		}
+		if deleteErr := links.Delete(context.Background(), "http://shrt.url/abc"); deleteErr != ErrLinkNotFound {
+			t.Errorf("Received %s, expected %s", deleteErr, ErrLinkNotFound)
+		}
+	})
+	t.Run("stores, updates and deletes links", func(t *testing.T) {
+		links := newTestBoltLinkStore(t)
+		if putErr := links.Put(context.Background(), testSearchLinks()...); putErr != nil {
+			t.Fatal(putErr)
+		}
+		updateErr := links.Update(context.Background(), "http://shrt.url/def", func(content *urlDocumentContent) error {
+			content.Title = "Pricing"
+			return nil
+		})
+		if updateErr != nil {
+			t.Fatal(updateErr)
+		}
+		link, _ := links.Get(context.Background(), "http://shrt.url/def")
+		if link.Title != "Pricing" || link.Workspace != "team-a" {
+			t.Errorf("Received %+v, expected title %s in workspace %s", link, "Pricing", "team-a")
+		}
+		if deleteErr := links.Delete(context.Background(), "http://shrt.url/def"); deleteErr != nil {
+			t.Fatal(deleteErr)
+		}
+		existing, _ := links.Existing(context.Background(), []string{"http://shrt.url/abc", "http://shrt.url/def"})
+		if !reflect.DeepEqual(existing, []string{"http://shrt.url/abc"}) {
+			t.Errorf("Received %v, expected %v", existing, []string{"http://shrt.url/abc"})
+		}
+	})
+	t.Run("stops counting clicks at the limit", func(t *testing.T) {
+		links := newTestBoltLinkStore(t)
+		_ = links.Put(context.Background(), urlDocumentContent{ShortUrl: "http://shrt.url/abc", urlAttributes: urlAttributes{MaxClicks: 1}})
+		if consumeErr := links.ConsumeClick(context.Background(), "http://shrt.url/abc"); consumeErr != nil {
+			t.Errorf("Received %s, expected nil", consumeErr)
+		}
+		if consumeErr := links.ConsumeClick(context.Background(), "http://shrt.url/abc"); consumeErr != ErrShortUrlClickLimitReached {
+			t.Errorf("Received %s, expected %s", consumeErr, ErrShortUrlClickLimitReached)
+		}
+		if consumeErr := links.ConsumeClick(context.Background(), "http://shrt.url/def"); consumeErr != ErrLinkNotFound {
+			t.Errorf("Received %s, expected %s", consumeErr, ErrLinkNotFound)
+		}
+	})
+	t.Run("scans links in the workspace", func(t *testing.T) {
+		links := newTestBoltLinkStore(t)
+		_ = links.Put(context.Background(), testSearchLinks()...)
+		var shortUrls []string
+		scanErr := links.Scan(context.Background(), "team-a", func(page []urlDocumentContent) error {
+			for _, link := range page {
+				shortUrls = append(shortUrls, link.ShortUrl)
+			}
+			return nil
+		})
+		if scanErr != nil || !reflect.DeepEqual(shortUrls, []string{"http://shrt.url/abc", "http://shrt.url/def"}) {
+			t.Errorf("Received %v and %s, expected %v", shortUrls, scanErr, []string{"http://shrt.url/abc", "http://shrt.url/def"})
+		}
+	})
+}
+
+func TestBuildPostgresSearchQuery(t *testing.T) {
+	t.Run("binds every filter as an argument", func(t *testing.T) {
+		searchQuery, _ := buildPostgresSearchQuery(urlSearchQuery{
+			Text: "Example.com", ShortHosts: []string{"http://shrt_url/"}, Workspace: "team-a", Tag: "spring",
+		})
+		expected := []interface{}{"%example%", "%com%", `http://shrt\_url/%`, "team-a", "spring", DefaultUrlSearchSize}
+		if !reflect.DeepEqual(searchQuery.Args, expected) {
+			t.Errorf("Received %v, expected %v", searchQuery.Args, expected)
+		}
+		if searchQuery.CountArgs != 5 || strings.Contains(searchQuery.CountSql, "LIMIT") {
+			t.Errorf("Received %s with %d arguments, expected count of 5 filters", searchQuery.CountSql, searchQuery.CountArgs)
+		}
+	})
+	t.Run("continues after the cursor in sort order", func(t *testing.T) {
+		cursor := encodeSearchCursor(json.RawMessage(`["3", "http://shrt.url/abc"]`))
+		searchQuery, _ := buildPostgresSearchQuery(urlSearchQuery{Sort: UrlSearchSortMostClicks, After: cursor})
+		if !strings.Contains(searchQuery.Sql, "(click_count < $1::integer OR (click_count = $1::integer AND short_url > $2))") {
+			t.Errorf("Received %s, expected to continue after the cursor", searchQuery.Sql)
+		}
+		if !strings.HasSuffix(searchQuery.Sql, "ORDER BY click_count DESC, short_url ASC LIMIT $3") {
+			t.Errorf("Received %s, expected to sort by most clicks", searchQuery.Sql)
+		}
+	})
+	t.Run("returns error when cursor cannot be parsed", func(t *testing.T) {
+		_, buildErr := buildPostgresSearchQuery(urlSearchQuery{After: encodeSearchCursor(json.RawMessage(`[1]`))})
+		if buildErr != ErrCouldNotParseSearchCursor {
+			t.Errorf("Received %s, expected %s", buildErr, ErrCouldNotParseSearchCursor)
+		}
+	})
+}
+
+func TestUrlShortenService_EnsureElasticsearchIndex(t *testing.T) {
+	t.Run("returns error when links are not stored in elasticsearch", func(t *testing.T) {
+		config := testConfig()
+		config.LinkStore = LinkStoreBolt
+		links, _ := wrapLinkStore(newTestBoltLinkStore(t), config, nil)
+		urlSvc := urlShortenService{Links: links}
+		if err := urlSvc.EnsureElasticsearchIndex(); err != ErrLinkStoreNotElasticsearch {
+			t.Errorf("Received %s, expected %s", err, ErrLinkStoreNotElasticsearch)
+		}
+	})
+}
+
+func TestUrlShortenService_elasticsearchLinks(t *testing.T) {
+	esLinks := NewEsLinkStore("some-index", nil, esIndexSettings{})
+	for _, cacheSize := range []int{10000, 0} {
+		t.Run(fmt.Sprintf("returns elasticsearch store under the wrappers setup adds with cache size %d", cacheSize), func(t *testing.T) {
+			config := testConfig()
+			config.LinkCacheSize = cacheSize
+			links, _ := wrapLinkStore(esLinks, config, nil)
+			urlSvc := urlShortenService{Links: links}
+			received, err := urlSvc.elasticsearchLinks()
+			if err != nil {
+				t.Fatalf("Received %s, expected nil", err)
+			}
+			if received != esLinks {
+				t.Errorf("Received %v, expected %v", received, esLinks)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// Structured logging, with the ID of the request being served on every line
+// logged with its context
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Passed on to keygensvc, so that a request can be followed across services
+const RequestIdHeader = "X-Request-ID"
+
+// IDs from callers are only accepted when they cannot garble a log line
+var requestIdPattern = regexp.MustCompile(`^[a-zA-Z0-9\-_.:]{1,128}$`)
+
+type requestIdContextKey struct{}
+
+func newRequestId() string {
+	buff := make([]byte, 16)
+	_, _ = rand.Read(buff)
+	return hex.EncodeToString(buff)
+}
+
+func contextWithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdContextKey{}, requestId)
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+// Accepts the caller's request ID or generates one, and returns it in the
+// response
+func withRequestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(RequestIdHeader)
+		if !requestIdPattern.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, requestId)
+		handler.ServeHTTP(w, r.WithContext(contextWithRequestId(r.Context(), requestId)))
+	})
+}
+
+// Adds the request ID, and the trace and span being recorded, from the
+// context of each record
+type requestIdLogHandler struct {
+	slog.Handler
+}
+
+func (h requestIdLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId := requestIdFromContext(ctx); requestId != "" {
+		record.AddAttrs(slog.String("request_id", requestId))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", spanContext.TraceID().String()),
+			slog.String("span_id", spanContext.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIdLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdLogHandler) WithGroup(name string) slog.Handler {
+	return requestIdLogHandler{h.Handler.WithGroup(name)}
+}
+
+// Lines are written as JSON, one per record
+func NewLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(requestIdLogHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// Accepts debug, info, warn or error, defaulting to info
+func parseLogLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+	err := level.UnmarshalText([]byte(strings.ToUpper(name)))
+	return level, err
+}
+
+// Logs at error level and exits, as log.Fatal did
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
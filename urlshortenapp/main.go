@@ -1,64 +1,62 @@
 package main
 
 import (
-    "errors"
+    "context"
     "flag"
     "fmt"
-    "log"
+    "github.com/prometheus/client_golang/prometheus"
+    "go.opentelemetry.io/otel"
+    "go.opentelemetry.io/otel/propagation"
+    sdktrace "go.opentelemetry.io/otel/sdk/trace"
+    "image"
+    "log/slog"
+    "net"
     "net/http"
     "os"
+    "os/signal"
     "regexp"
-    "strconv"
     "strings"
+    "sync/atomic"
+    "syscall"
     "time"
 )
 
 // App
 
 type UrlShortenApp struct {
-    Flags struct {
-        RefreshIndex *bool
-    }
-    EnvVars struct {
-        EsAddresses           string
-        EsIndex               string
-        InitMaxAttempts       int
-        InitWaitInSeconds     int
-        KgsUrl                string
-        InternalShortHost     string
-        MinShortUrlPathLength int
-        MaxShortUrlPathLength int
-    }
+    // Read through Config, as settings can be reloaded while serving
+    ConfigLoader ConfigLoader
+    config       atomic.Pointer[Config]
+    LogLevel     *slog.LevelVar
+
     Routes    *Routes
     UsService UrlShortenService
+    LinkCache *cachedLinkStore
+    Links     LinkStore
+    ApiKeys   ApiKeyService
+    GeoIp     GeoIpService
+    Analytics AnalyticsService
+    Health    *HealthChecker
+    Tracing   *sdktrace.TracerProvider
+
+    PasswordAttempts *passwordAttemptLimiter
+    RateLimiter      *RateLimiter
+    // Whose X-Forwarded-For is believed when finding client addresses
+    TrustedProxies   []*net.IPNet
+    QrLogo           image.Image
 }
 
 var App UrlShortenApp
 
-// Env Handlers
-
-func HandleGetenvString(key string) string {
-    envVar := os.Getenv(key)
-    if envVar == "" {
-        panic(fmt.Sprintf("Environment variable %s is not set", key))
-    }
-    return envVar
-}
-
-func HandleGetenvInt(key string) int {
-    envVar := HandleGetenvString(key)
-    intVar, err := strconv.Atoi(envVar)
-    if err != nil {
-        panic(fmt.Sprintf("Enviroment variable %s is not an integer", key))
-    }
-    return intVar
+func (a *UrlShortenApp) Config() *Config {
+    return a.config.Load()
 }
 
-
 // Routes
 // https://stackoverflow.com/questions/6564558/wildcards-in-the-pattern-for-http-handlefunc
 
 type RouteHandler struct {
+    Name    string
     Pattern *regexp.Regexp
     Func    http.Handler
 }
@@ -67,25 +65,39 @@ type Routes struct {
     Handlers []*RouteHandler
 }
 
+// Routes are rate limited by name, ahead of any other work
 func (routes *Routes) HandleFunc(
-    pattern *regexp.Regexp, handler func(w http.ResponseWriter, r *http.Request),
+    name string, pattern *regexp.Regexp, handler func(w http.ResponseWriter, r *http.Request),
 ) {
     routes.Handlers = append(
-        routes.Handlers, &RouteHandler{Pattern: pattern, Func: http.HandlerFunc(handler)},
+        routes.Handlers,
+        &RouteHandler{Name: name, Pattern: pattern, Func: rateLimited(name, handler)},
     )
 }
 
+// Same as HandleFunc, but only for callers with an API key holding the scope
+func (routes *Routes) HandleScopedFunc(
+    name string, pattern *regexp.Regexp, scope string, handler func(w http.ResponseWriter, r *http.Request),
+) {
+    routes.HandleFunc(name, pattern, requireApiKey(scope, handler))
+}
+
 func (routes *Routes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
     for _, handler := range routes.Handlers {
         if handler.Pattern.MatchString(r.URL.Path) {
-            log.Printf("Matched route %s", r.URL.Path)
-            handler.Func.ServeHTTP(w, r)
+            serveTracedHttpRequest(handler.Name, w, r, handler.Func)
             return
         }
     }
 
-    log.Printf("Did not match any routes for %s", r.URL.Path)
-    http.NotFound(w, r)
+    serveTracedHttpRequest(unmatchedRouteName, w, r, http.HandlerFunc(http.NotFound))
+}
+
+// The span wraps the access log line, so that it carries the trace
+func serveTracedHttpRequest(route string, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+    traceHttpRequest(route, w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        observeHttpRequest(route, w, r, handler)
+    }))
 }
 
 func (routes Routes) Define() *Routes {
@@ -95,119 +107,365 @@ func (routes Routes) Define() *Routes {
 
     // Match index route
     indexRoute, _ := regexp.Compile("^/$")
-    // Match healthcheck route
+    // Match healthcheck routes
     healthcheckRoute, _ := regexp.Compile("^/healthcheck$")
+    livenessRoute, _ := regexp.Compile("^/livez$")
+    readinessRoute, _ := regexp.Compile("^/readyz$")
+    // Match Prometheus metrics route
+    metricsRoute, _ := regexp.Compile("^/metrics$")
     // Match URL-shorten route
     urlShortenRoute, _ := regexp.Compile("^/url/shorten$")
+    // Match URL search route
+    urlSearchRoute, _ := regexp.Compile("^/url$")
+    // Match URL update route
+    urlUpdateRoute, _ := regexp.Compile("^/url/update$")
+    // Match URL unlock route, the target of the link password form
+    urlUnlockRoute, _ := regexp.Compile("^/url/unlock$")
+    // Match URL QR code route
+    urlQrCodeRoute, _ := regexp.Compile("^/url/[a-zA-Z0-9\\-_]+/qr$")
     // Match URL external redirect route
     urlRedirectExternalRoute, _ := regexp.Compile("^/url/redirect$")
+    // Match API key admin routes
+    apiKeyMintRoute, _ := regexp.Compile("^/admin/apikeys$")
+    apiKeyRevokeRoute, _ := regexp.Compile("^/admin/apikeys/revoke$")
+    // Match link export and import admin routes
+    exportRoute, _ := regexp.Compile("^/admin/export$")
+    importRoute, _ := regexp.Compile("^/admin/import$")
+    // Match link cache stats admin route
+    linkCacheRoute, _ := regexp.Compile("^/admin/cache$")
     // Match everything else recognizable as an internal short URL
     urlRedirectInternalRoute, _ := regexp.Compile("^/[a-zA-Z0-9\\-_]+$")
 
-    routes.HandleFunc(indexRoute, HandleIndexRequest)
-    routes.HandleFunc(healthcheckRoute, HandleHealthcheckRequest)
-    routes.HandleFunc(urlShortenRoute, HandleUrlShortenRequest)
-    routes.HandleFunc(urlRedirectExternalRoute, HandleExternalUrlRedirect)
-    routes.HandleFunc(urlRedirectInternalRoute, HandleInternalUrlRedirect)
+    routes.HandleFunc("index", indexRoute, HandleIndexRequest)
+    routes.HandleFunc("healthcheck", healthcheckRoute, HandleHealthcheckRequest)
+    routes.HandleFunc("livez", livenessRoute, HandleLivenessRequest)
+    routes.HandleFunc("readyz", readinessRoute, HandleReadinessRequest)
+    routes.HandleFunc("metrics", metricsRoute, HandleMetricsRequest)
+    routes.HandleScopedFunc("shorten", urlShortenRoute, ApiKeyScopeShorten, HandleUrlShortenRequest)
+    routes.HandleScopedFunc("search", urlSearchRoute, ApiKeyScopeStats, HandleUrlSearchRequest)
+    routes.HandleScopedFunc("update", urlUpdateRoute, ApiKeyScopeManage, HandleUrlUpdateRequest)
+    routes.HandleFunc("unlock", urlUnlockRoute, HandleUrlUnlockRequest)
+    routes.HandleFunc("qr", urlQrCodeRoute, HandleQrCodeRequest)
+    routes.HandleScopedFunc("redirect-external", urlRedirectExternalRoute, ApiKeyScopeStats, HandleExternalUrlRedirect)
+    routes.HandleScopedFunc("apikeys-mint", apiKeyMintRoute, ApiKeyScopeAdmin, HandleApiKeyMintRequest)
+    routes.HandleScopedFunc("apikeys-revoke", apiKeyRevokeRoute, ApiKeyScopeAdmin, HandleApiKeyRevokeRequest)
+    routes.HandleScopedFunc("export", exportRoute, ApiKeyScopeAdmin, HandleExportRequest)
+    routes.HandleScopedFunc("import", importRoute, ApiKeyScopeAdmin, HandleImportRequest)
+    routes.HandleScopedFunc("cache", linkCacheRoute, ApiKeyScopeAdmin, HandleLinkCacheStatsRequest)
+    routes.HandleFunc("redirect", urlRedirectInternalRoute, HandleInternalUrlRedirect)
 
     return &routes
 }
 
-func (a UrlShortenApp) VerifyHealth() bool {
+func (a *UrlShortenApp) VerifyHealth() bool {
     healthy := true
-    log.Print("Running healthcheck...")
-    healthy = healthy && a.UsService.TestElasticsearchConnection()
+    slog.Debug("Running healthcheck...")
+    healthy = healthy && a.UsService.TestLinkStoreConnection()
     return healthy
 }
 
-// Init
+// Runs once requests in flight are done, so that nothing they left behind
+// is lost
+func (a *UrlShortenApp) Shutdown(ctx context.Context) {
+    if flushErr := a.Analytics.Flush(); flushErr != nil {
+        slog.Error("Click events buffered at shutdown were lost", "error", flushErr)
+    }
+    closed := make(chan error, 1)
+    go func() { closed <- a.Links.Close() }()
+    select {
+    case closeErr := <-closed:
+        if closeErr != nil {
+            slog.Error("Error closing link store", "error", closeErr)
+        }
+    case <-ctx.Done():
+        slog.Error("Gave up closing link store", "error", ctx.Err())
+    }
+    if a.Tracing != nil {
+        if tracingErr := a.Tracing.Shutdown(ctx); tracingErr != nil {
+            slog.Error("Error exporting remaining spans", "error", tracingErr)
+        }
+    }
+}
 
-func init() {
-    App.Flags.RefreshIndex = flag.Bool(
-        "refresh-index",
-        false,
-        "Deletes and recreates Elasticsearch index.",
-    )
-    log.Printf("Flags established")
-
-    App.EnvVars.EsAddresses           = HandleGetenvString("ELASTICSEARCH_ADDRESSES")
-    App.EnvVars.EsIndex               = HandleGetenvString("ELASTICSEARCH_INDEX")
-    App.EnvVars.InitMaxAttempts       = HandleGetenvInt("INIT_MAXIMUM_ATTEMPTS")
-    App.EnvVars.InitWaitInSeconds     = HandleGetenvInt("INIT_WAIT_IN_SECONDS")
-    App.EnvVars.KgsUrl                = HandleGetenvString("KEYGENSVC_URL")
-    App.EnvVars.InternalShortHost     = HandleGetenvString("INTERNAL_SHORT_HOST")
-    App.EnvVars.MinShortUrlPathLength = HandleGetenvInt("MINIMUM_SHORT_URL_PATH_LENGTH")
-    App.EnvVars.MaxShortUrlPathLength = HandleGetenvInt("MAXIMUM_SHORT_URL_PATH_LENGTH")
-    log.Print("Environment variables established")
+// Setup
+
+// Instantiates services from config, once it is loaded and valid
+func setup(config Config) {
+    App.config.Store(&config)
+
+    // Log structured lines from the start, leveled so that steps of every
+    // request can be turned on when needed
+    logLevel, _ := parseLogLevel(config.LogLevel)
+    App.LogLevel = new(slog.LevelVar)
+    App.LogLevel.Set(logLevel)
+    slog.SetDefault(NewLogger(os.Stderr, App.LogLevel))
+
+    // Trace requests when an exporter is set. Trace context is passed on to
+    // keygensvc either way.
+    otel.SetTextMapPropagator(propagation.TraceContext{})
+    if config.TracesExporter != TracesExporterNone {
+        destination := config.OtlpTracesEndpoint
+        if config.TracesExporter == TracesExporterFile {
+            destination = config.TracesFilePath
+        }
+        tracing, tracingErr := NewTracerProvider("urlshortenapp", config.TracesExporter, destination)
+        if tracingErr != nil {
+            logFatal("Could not instantiate tracer provider", "traces_exporter", config.TracesExporter, "error", tracingErr)
+        }
+        otel.SetTracerProvider(tracing)
+        App.Tracing = tracing
+    }
+    linksInEs := config.LinkStore == LinkStoreElasticsearch
 
     App.Routes = Routes{}.Define()
-    log.Print("Routes defined")
+    slog.Info("Routes defined")
+
+    // Instantiate Elasticsearch service, which is optional unless links are
+    // stored in it. Without it, API keys other than the admin key cannot be
+    // used and click events are dropped.
+    var esSvc EsService
+    if config.EsAddresses != "" {
+        var esErr error
+        esSvc, esErr = NewEsService(
+            strings.Split(config.EsAddresses, ","), NewEsApi(),
+            EsServiceOptions{
+                Timeout:    time.Duration(config.EsTimeout) * time.Second,
+                MaxRetries: config.EsMaxRetries,
+            },
+        )
+        if esErr != nil {
+            logFatal("Could not instantiate Elasticsearch service", "error", esErr)
+        }
+    }
 
-    // Instantiate Elasticsearch service
-    esSvc, esErr := NewEsService(
-        strings.Split(App.EnvVars.EsAddresses, ","), NewEsApi(),
-    )
-    if esErr != nil {
-        log.Printf("Error instantiating Elasticsearch service: %s", esErr)
-        log.Fatal(errors.New("could not instantiate elasticsearch service"))
+    // Instantiate link store
+    var links LinkStore
+    var linksErr error
+    switch config.LinkStore {
+    case LinkStoreElasticsearch:
+        links = NewEsLinkStore(
+            config.EsIndex,
+            esSvc,
+            esIndexSettings{Shards: config.EsShards, Replicas: config.EsReplicas},
+        )
+    case LinkStorePostgres:
+        links, linksErr = NewPostgresLinkStore(config.PostgresConnStr)
+    case LinkStoreBolt:
+        links, linksErr = NewBoltLinkStore(config.BoltDatabasePath)
+    default:
+        logFatal(
+            "Could not instantiate link store",
+            "error", ErrUnknownLinkStore,
+            "link_store", config.LinkStore,
+            "known_link_stores", knownLinkStores,
+        )
+    }
+    if linksErr != nil {
+        logFatal("Could not instantiate link store", "link_store", config.LinkStore, "error", linksErr)
     }
 
-    // Instantiate keygensvc service
-    kgsSvc, kgsErr := NewKgsService(NewKgsClient(App.EnvVars.KgsUrl))
+    // Trace the store, then cache links in front of it for hot redirects,
+    // unless disabled
+    var bus InvalidationBus
+    if config.LinkCacheSize > 0 {
+        // Drop links written by other instances from the cache, when shared
+        var busErr error
+        switch config.InvalidationBus {
+        case "":
+        case InvalidationBusMemory:
+            bus = NewMemoryInvalidationBus()
+        case InvalidationBusPostgres:
+            bus, busErr = NewPostgresInvalidationBus(config.PostgresConnStr)
+        default:
+            logFatal(
+                "Could not instantiate invalidation bus",
+                "error", ErrUnknownInvalidationBus,
+                "invalidation_bus", config.InvalidationBus,
+                "known_invalidation_buses", knownInvalidationBuses,
+            )
+        }
+        if busErr != nil {
+            logFatal(
+                "Could not instantiate invalidation bus",
+                "invalidation_bus", config.InvalidationBus,
+                "error", busErr,
+            )
+        }
+    }
+    links, App.LinkCache = wrapLinkStore(links, config, bus)
+    if App.LinkCache != nil {
+        registerLinkCacheMetrics(prometheus.DefaultRegisterer, App.LinkCache)
+    }
+
+    // Instantiate keygensvc service, retrying failed requests that are safe
+    // to send again and failing fast while keygensvc is down
+    kgsSvc, kgsErr := NewKgsService(
+        NewKgsClient(
+            config.KgsUrl, config.KgsApiKey, config.SharedSecret,
+            KgsClientOptions{
+                Timeout:         time.Duration(config.KgsTimeout) * time.Second,
+                MaxRetries:      config.KgsMaxRetries,
+                BreakerFailures: config.KgsBreakerFailures,
+                BreakerCooldown: time.Duration(config.KgsBreakerCooldown) * time.Second,
+            },
+        ),
+    )
     if kgsErr != nil {
-        log.Printf("Error instantiating keygensvc service: %s", kgsErr)
-        log.Fatal(errors.New("could not instantiate keygensvc service"))
+        logFatal("Could not instantiate keygensvc service", "error", kgsErr)
+    }
+
+    // Instantiate GeoIP service, used by country redirect rules
+    geoIpSvc, geoIpErr := NewGeoIpService(config.GeoIpDatabasePath)
+    if geoIpErr != nil {
+        logFatal("Could not instantiate GeoIP service", "error", geoIpErr)
+    }
+    App.GeoIp = geoIpSvc
+
+    // Load logo for QR codes
+    qrLogo, qrLogoErr := loadQrLogo(config.QrLogoPath)
+    if qrLogoErr != nil {
+        logFatal("Could not load QR code logo", "error", qrLogoErr)
     }
+    App.QrLogo = qrLogo
 
     // Attach UrlShortenService to app
-    App.UsService = NewUrlShortenService(App.EnvVars.EsIndex, esSvc, kgsSvc)
-    log.Print("Service layer established")
+    App.Links = links
+    App.UsService = NewUrlShortenService(links, kgsSvc, config.InternalShortHost)
+
+    // Attach ApiKeyService to app, storing hashed keys beside links
+    App.ApiKeys = NewApiKeyService(
+        fmt.Sprintf("%s-apikeys", config.EsIndex), esSvc, config.AdminApiKey,
+    )
+
+    // Attach AnalyticsService to app, storing click events beside links
+    App.Analytics = NewAnalyticsService(
+        fmt.Sprintf("%s-clicks", config.EsIndex), esSvc, 500,
+    )
+    App.PasswordAttempts = newPasswordAttemptLimiter(5, 15 * time.Minute)
+
+    // Attach RateLimiter to app, keeping buckets in memory per instance
+    rateLimits, rateLimitsErr := parseRateLimits(config.RateLimits, DefaultRateLimits)
+    if rateLimitsErr != nil {
+        logFatal("Could not parse rate limits", "error", rateLimitsErr)
+    }
+    App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), rateLimits)
+    trustedProxies, trustedProxiesErr := parseTrustedProxies(config.TrustedProxies)
+    if trustedProxiesErr != nil {
+        logFatal("Could not parse trusted proxies", "error", trustedProxiesErr)
+    }
+    App.TrustedProxies = trustedProxies
+
+    // Check every dependency for readiness. Elasticsearch holds the links
+    // index only when links are stored in it.
+    App.Health = NewHealthChecker(ReadinessCacheTtl, ReadinessCheckTimeout)
+    if esSvc != nil {
+        linksIndex := ""
+        if linksInEs {
+            linksIndex = config.EsIndex
+        }
+        App.Health.AddCheck("elasticsearch", elasticsearchHealthCheck(esSvc, linksIndex))
+    }
+    if !linksInEs {
+        App.Health.AddCheck(config.LinkStore, linkStoreHealthCheck(links))
+    }
+    App.Health.AddCheck("keygensvc", keygensvcHealthCheck(kgsSvc))
+    slog.Info("Service layer established")
 }
 
 // Main
 
 func main() {
+    // Parse command-line flags and subcommands before anything else, so a
+    // mistyped command fails fast instead of doing something unintended
+    flag.Usage = func() {
+        fmt.Fprintln(flag.CommandLine.Output(), commandUsage)
+        flag.PrintDefaults()
+    }
+    configLoader := NewConfigLoader(flag.CommandLine, Config{})
+    flag.Parse()
+    runCommand, commandErr := parseCommand(flag.Args(), os.Stdout, os.Stderr)
+    if commandErr != nil {
+        slog.Error("Error parsing command", "error", commandErr)
+        os.Exit(2)
+    }
+
+    // Load config, listing every invalid setting at once, then instantiate
+    // services from it
+    App.ConfigLoader = configLoader()
+    config, configErr := App.ConfigLoader.Load()
+    if configErr != nil {
+        slog.Error("Invalid config", "errors", strings.Split(configErr.Error(), "\n"))
+        os.Exit(2)
+    }
+    setup(config)
+    slog.Info("Config loaded")
+
     // Run healthcheck on startup.
-    // Necessary as Elasticsearch can take half a minute or more to start up,
+    // Necessary as Elasticsearch or Postgres can take half a minute or more to start up,
     // and we want to wait until it's live before we begin serving routes.
-    // It's also required to handle the --refresh-index flag.
+    // It's also required to run subcommands.
     attempts := 0
     startTime := time.Now()
     for {
-        if attempts == App.EnvVars.InitMaxAttempts {
+        if attempts == config.InitMaxAttempts {
             // Hard fail when we can't verify in a reasonable amount of time
-            log.Fatal("Could not verify app health")
+            logFatal("Could not verify app health")
         }
 
-        log.Printf("Verifying app health: attempt %d...", attempts + 1)
+        slog.Info("Verifying app health...", "attempt", attempts + 1)
 
         // Check app health
         if !App.VerifyHealth() {
             // On failure, wait and try again
-            waitInSeconds := time.Duration(App.EnvVars.InitWaitInSeconds) * time.Second
-            log.Printf("Retrying in %s...", waitInSeconds.String())
+            waitInSeconds := time.Duration(config.InitWaitInSeconds) * time.Second
+            slog.Info("Retrying app health verification", "wait", waitInSeconds.String())
             time.Sleep(waitInSeconds)
             attempts++
             continue
         }
 
         totalTime := time.Since(startTime)
-        log.Printf("App health verified, took %s", totalTime.String())
+        slog.Info("App health verified", "took", totalTime.String())
         break
     }
 
-    // Parse and handle command-line flags
-    flag.Parse()
-    log.Print("Flags parsed, handling...")
-    if App.Flags.RefreshIndex != nil && *App.Flags.RefreshIndex {
-        if err := App.UsService.RefreshElasticsearchIndex(); err != nil {
-            log.Printf("Error while refreshing Elasticsearch index: %s", err)
+    // Run subcommand instead of serving, if given
+    if runCommand != nil {
+        if err := runCommand(); err != nil {
+            logFatal("Error running command", "error", err)
         }
         return
     }
 
-    // Instantiate HTTP server
-    http.HandleFunc("/", App.Routes.ServeHTTP)
-    log.Print("Routes established, listening...")
-    log.Fatal(http.ListenAndServe(":80", nil))
+    // Create the index or tables on first start, before anything writes to them
+    if err := App.UsService.InitLinkStore(); err != nil {
+        logFatal("Could not initialise link store", "error", err)
+    }
+
+    // Flush buffered click events periodically
+    go App.Analytics.FlushEvery(10 * time.Second)
+
+    // Instantiate HTTP server, failing readiness then draining requests in
+    // flight on SIGTERM
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+    // Reload settings that can change while serving on SIGHUP
+    reloads := make(chan os.Signal, 1)
+    signal.Notify(reloads, syscall.SIGHUP)
+    go App.ReloadConfigOn(reloads)
+    listener, listenErr := net.Listen("tcp", ":80")
+    if listenErr != nil {
+        logFatal("Could not listen", "error", listenErr)
+    }
+    server := GracefulServer{
+        Server:          NewHttpServer(withRequestId(App.Routes)),
+        ReadinessDelay:  ShutdownReadinessDelay,
+        ShutdownTimeout: ShutdownTimeout,
+        OnSignal:        App.Health.Drain,
+        OnDrained:       App.Shutdown,
+    }
+    slog.Info("Routes established, listening...")
+    if serveErr := server.Serve(listener, signals); serveErr != nil {
+        logFatal("Stopped serving", "error", serveErr)
+    }
 }
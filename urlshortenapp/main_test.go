@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// Instantiates services the way main does, from config rather than env vars.
+// Nothing they connect to is up, so tests swap in mocks.
+func testConfig() Config {
+	return Config{
+		LinkStore:             LinkStoreElasticsearch,
+		LinkCacheSize:         10000,
+		LinkCacheTtl:          60,
+		LinkCacheNegativeTtl:  10,
+		EsAddresses:           "http://localhost:9200",
+		EsIndex:               "urlstore",
+		EsShards:              1,
+		EsReplicas:            1,
+		EsTimeout:             10,
+		EsMaxRetries:          3,
+		InitMaxAttempts:       1,
+		KgsUrl:                "http://localhost:5000",
+		KgsTimeout:            5,
+		KgsMaxRetries:         2,
+		KgsBreakerFailures:    5,
+		KgsBreakerCooldown:    30,
+		InternalShortHost:     "http://localhost:8080",
+		MinShortUrlPathLength: 6,
+		MaxShortUrlPathLength: 12,
+	}
+}
+
+func TestMain(m *testing.M) {
+	setup(testConfig())
+	OriginalUsService = App.UsService
+	App.ApiKeys = MockApiKeyService{key: apiKey{Name: "mock", Scopes: []string{ApiKeyScopeAdmin}}}
+	os.Exit(m.Run())
+}
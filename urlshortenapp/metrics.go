@@ -0,0 +1,140 @@
+package main
+
+// Prometheus metrics, served on /metrics
+
+import (
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortenapp_http_requests_total",
+		Help: "HTTP requests by route name, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "urlshortenapp_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests by route name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	esRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "urlshortenapp_elasticsearch_request_duration_seconds",
+		Help:    "Time taken by Elasticsearch requests by EsApi method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+	esRequestErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortenapp_elasticsearch_request_errors_total",
+		Help: "Elasticsearch requests that failed or returned a server error, by EsApi method.",
+	}, []string{"method"})
+	esRetriesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urlshortenapp_elasticsearch_retries_total",
+		Help: "Elasticsearch requests sent again after being rejected with 429 or 503, or failing to connect.",
+	})
+	kgsRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "urlshortenapp_keygensvc_request_duration_seconds",
+		Help:    "Time taken by keygensvc requests by endpoint and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint", "code"})
+	kgsRetriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "urlshortenapp_keygensvc_retries_total",
+		Help: "Keygensvc requests sent again after failing, by endpoint.",
+	}, []string{"endpoint"})
+	kgsCircuitOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "urlshortenapp_keygensvc_circuit_open",
+		Help: "Whether keygensvc requests fail fast, 1 while the circuit is open or half-open.",
+	})
+	keyCollisionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "urlshortenapp_key_collisions_total",
+		Help: "Custom short URL paths that were already taken.",
+	})
+)
+
+// Serves every registered metric, along with Go runtime and process metrics
+var HandleMetricsRequest = promhttp.Handler().ServeHTTP
+
+// Routes not matched are counted under this name
+const unmatchedRouteName = "none"
+
+// Records the status code written by a handler, which is 200 unless set
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Lets handlers reach the underlying writer, such as to extend deadlines
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Counts, times and logs each request served for a route
+func observeHttpRequest(route string, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	startTime := time.Now()
+	handler.ServeHTTP(recorder, r)
+	duration := time.Since(startTime)
+	httpRequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+	httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(recorder.statusCode)).Inc()
+	slog.InfoContext(
+		r.Context(), "Served request",
+		"route", route, "method", r.Method, "path", r.URL.Path, "status", recorder.statusCode, "duration", duration,
+	)
+}
+
+// Client errors such as missing documents are expected, so only transport
+// failures and server errors count as errors
+func observeEsRequest(method string, startTime time.Time, res *esapi.Response, err error) {
+	esRequestDuration.WithLabelValues(method).Observe(time.Since(startTime).Seconds())
+	if err != nil || res.StatusCode >= http.StatusInternalServerError {
+		esRequestErrorsTotal.WithLabelValues(method).Inc()
+	}
+}
+
+func observeKgsCircuitState(state string) {
+	if state == CircuitClosed {
+		kgsCircuitOpen.Set(0)
+		return
+	}
+	kgsCircuitOpen.Set(1)
+}
+
+func observeKgsRequest(endpoint string, startTime time.Time, res *http.Response, err error) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	kgsRequestDuration.WithLabelValues(endpoint, code).Observe(time.Since(startTime).Seconds())
+}
+
+// Exposes the counts the cache keeps anyway, read on every scrape. The hit
+// rate is hits over hits and misses.
+func registerLinkCacheMetrics(registerer prometheus.Registerer, cache *cachedLinkStore) {
+	counters := map[string]func(linkCacheStats) uint64{
+		"hits":          func(s linkCacheStats) uint64 { return s.Hits },
+		"negative_hits": func(s linkCacheStats) uint64 { return s.NegativeHits },
+		"misses":        func(s linkCacheStats) uint64 { return s.Misses },
+		"evictions":     func(s linkCacheStats) uint64 { return s.Evictions },
+		"invalidations": func(s linkCacheStats) uint64 { return s.Invalidations },
+	}
+	for name, count := range counters {
+		count := count
+		registerer.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "urlshortenapp_link_cache_" + name + "_total",
+			Help: "Link cache " + name + " since the app started.",
+		}, func() float64 { return float64(count(cache.Stats())) }))
+	}
+	registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "urlshortenapp_link_cache_size",
+		Help: "Links held in the link cache.",
+	}, func() float64 { return float64(cache.Stats().Size) }))
+}
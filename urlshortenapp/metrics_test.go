@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/elastic/go-elasticsearch/esapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoutes_ServeHTTP_Metrics(t *testing.T) {
+	routes := Routes{}
+	teapotRoute, _ := regexp.Compile("^/test/teapot$")
+	routes.HandleFunc("test-teapot", teapotRoute, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	t.Run("counts requests by route name, method and status code", func(t *testing.T) {
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/teapot", nil))
+		counted := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("test-teapot", http.MethodGet, "418"))
+		if counted != 1 {
+			t.Errorf("Received %v, expected %v", counted, 1)
+		}
+	})
+	t.Run("counts requests matching no route as not found", func(t *testing.T) {
+		before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(unmatchedRouteName, http.MethodGet, "404"))
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/unknown", nil))
+		after := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(unmatchedRouteName, http.MethodGet, "404"))
+		if after != before+1 {
+			t.Errorf("Received %v, expected %v", after, before+1)
+		}
+	})
+}
+
+func TestObserveEsRequest(t *testing.T) {
+	t.Run("counts failed requests and server errors but not client errors", func(t *testing.T) {
+		before := testutil.ToFloat64(esRequestErrorsTotal.WithLabelValues("TestMethod"))
+		observeEsRequest("TestMethod", time.Now(), &esapi.Response{StatusCode: http.StatusNotFound}, nil)
+		observeEsRequest("TestMethod", time.Now(), &esapi.Response{StatusCode: http.StatusServiceUnavailable}, nil)
+		observeEsRequest("TestMethod", time.Now(), nil, errors.New("failed"))
+		after := testutil.ToFloat64(esRequestErrorsTotal.WithLabelValues("TestMethod"))
+		if after != before+2 {
+			t.Errorf("Received %v, expected %v", after, before+2)
+		}
+	})
+}
+
+func TestRegisterLinkCacheMetrics(t *testing.T) {
+	t.Run("exposes the stats of the cache", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		cache := NewCachedLinkStore(newMockCountingLinkStore(), 10, time.Minute, time.Minute, nil)
+		registerLinkCacheMetrics(registry, cache)
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+		_, _ = cache.Get(context.Background(), "http://shrt.url/abc")
+
+		expected := `
+# HELP urlshortenapp_link_cache_hits_total Link cache hits since the app started.
+# TYPE urlshortenapp_link_cache_hits_total counter
+urlshortenapp_link_cache_hits_total 1
+# HELP urlshortenapp_link_cache_misses_total Link cache misses since the app started.
+# TYPE urlshortenapp_link_cache_misses_total counter
+urlshortenapp_link_cache_misses_total 1
+# HELP urlshortenapp_link_cache_size Links held in the link cache.
+# TYPE urlshortenapp_link_cache_size gauge
+urlshortenapp_link_cache_size 1
+`
+		gatherErr := testutil.GatherAndCompare(
+			registry,
+			strings.NewReader(expected),
+			"urlshortenapp_link_cache_hits_total",
+			"urlshortenapp_link_cache_misses_total",
+			"urlshortenapp_link_cache_size",
+		)
+		if gatherErr != nil {
+			t.Errorf("Received %s, expected stats of the cache", gatherErr)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+// QR code rendering for short URLs, as PNG or SVG
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	QrFormatPng = "png"
+	QrFormatSvg = "svg"
+
+	DefaultQrSize   = 256
+	MinQrSize       = 64
+	MaxQrSize       = 2048
+	DefaultQrMargin = 4
+	MaxQrMargin     = 16
+
+	// Share of the code width covered by a logo. Kept well under the 30%
+	// of modules that high error correction can recover.
+	qrLogoRatio = 0.2
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+var (
+	ErrCouldNotEncodeQrCode = errors.New("could not encode qr code")
+	ErrCouldNotLoadQrLogo   = errors.New("could not load qr logo")
+)
+
+type qrOptions struct {
+	Format     string
+	Size       int
+	Level      string
+	Margin     int
+	Foreground color.RGBA
+	Background color.RGBA
+	Logo       image.Image
+}
+
+// Parses "rgb" or "rrggbb" hex colors, with or without a leading '#'
+func parseHexColor(value string) (color.RGBA, bool) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) == 3 {
+		value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+	}
+	if len(value) != 6 {
+		return color.RGBA{}, false
+	}
+	rgb, parseErr := strconv.ParseUint(value, 16, 32)
+	if parseErr != nil {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xff}, true
+}
+
+func loadQrLogo(path string) (image.Image, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		slog.Error("Error opening QR logo", "path", path, "error", openErr)
+		return nil, ErrCouldNotLoadQrLogo
+	}
+	defer file.Close()
+	logo, _, decodeErr := image.Decode(file)
+	if decodeErr != nil {
+		slog.Error("Error decoding QR logo", "path", path, "error", decodeErr)
+		return nil, ErrCouldNotLoadQrLogo
+	}
+	return logo, nil
+}
+
+// Returns the code's modules with the requested quiet-zone margin around them
+func qrModules(content string, options qrOptions) ([][]bool, error) {
+	code, encodeErr := qrcode.New(content, qrRecoveryLevels[options.Level])
+	if encodeErr != nil {
+		slog.Error("Error encoding QR code", "content", content, "error", encodeErr)
+		return nil, ErrCouldNotEncodeQrCode
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	width := len(bitmap) + 2*options.Margin
+	modules := make([][]bool, width)
+	for y := range modules {
+		modules[y] = make([]bool, width)
+	}
+	for y, row := range bitmap {
+		copy(modules[y+options.Margin][options.Margin:], row)
+	}
+	return modules, nil
+}
+
+// Returns the pixels per module and resulting image width for a code that
+// fits within the requested size
+func qrScale(moduleCount int, size int) (int, int) {
+	moduleSize := size / moduleCount
+	if moduleSize < 1 {
+		moduleSize = 1
+	}
+	return moduleSize, moduleSize * moduleCount
+}
+
+// Scales the logo to cover the centre of the code using nearest-neighbour
+// sampling, over a background-coloured box so it stays legible
+func drawQrLogo(canvas draw.Image, logo image.Image, width int, background color.RGBA) {
+	logoWidth := int(float64(width) * qrLogoRatio)
+	if logoWidth < 1 {
+		return
+	}
+	bounds := logo.Bounds()
+	logoHeight := logoWidth * bounds.Dy() / bounds.Dx()
+	offsetX, offsetY := (width-logoWidth)/2, (width-logoHeight)/2
+
+	padding := logoWidth / 10
+	draw.Draw(
+		canvas,
+		image.Rect(offsetX-padding, offsetY-padding, offsetX+logoWidth+padding, offsetY+logoHeight+padding),
+		image.NewUniform(background),
+		image.Point{},
+		draw.Src,
+	)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, logoWidth, logoHeight))
+	for y := 0; y < logoHeight; y++ {
+		for x := 0; x < logoWidth; x++ {
+			scaled.Set(x, y, logo.At(
+				bounds.Min.X+x*bounds.Dx()/logoWidth,
+				bounds.Min.Y+y*bounds.Dy()/logoHeight,
+			))
+		}
+	}
+	draw.Draw(
+		canvas,
+		image.Rect(offsetX, offsetY, offsetX+logoWidth, offsetY+logoHeight),
+		scaled,
+		image.Point{},
+		draw.Over,
+	)
+}
+
+func renderQrPng(content string, options qrOptions) ([]byte, error) {
+	modules, modulesErr := qrModules(content, options)
+	if modulesErr != nil {
+		return nil, modulesErr
+	}
+	moduleSize, width := qrScale(len(modules), options.Size)
+
+	// Paint modules
+	canvas := image.NewRGBA(image.Rect(0, 0, width, width))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(options.Background), image.Point{}, draw.Src)
+	foreground := image.NewUniform(options.Foreground)
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				draw.Draw(
+					canvas,
+					image.Rect(x*moduleSize, y*moduleSize, (x+1)*moduleSize, (y+1)*moduleSize),
+					foreground,
+					image.Point{},
+					draw.Src,
+				)
+			}
+		}
+	}
+	if options.Logo != nil {
+		drawQrLogo(canvas, options.Logo, width, options.Background)
+	}
+
+	// Encode image
+	var buff bytes.Buffer
+	if encodeErr := png.Encode(&buff, canvas); encodeErr != nil {
+		slog.Error("Error encoding QR code PNG", "error", encodeErr)
+		return nil, ErrCouldNotEncodeQrCode
+	}
+	return buff.Bytes(), nil
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func renderQrSvg(content string, options qrOptions) ([]byte, error) {
+	modules, modulesErr := qrModules(content, options)
+	if modulesErr != nil {
+		return nil, modulesErr
+	}
+	_, width := qrScale(len(modules), options.Size)
+
+	// Draw modules as a single path in module units, scaled by the viewBox
+	var path strings.Builder
+	for y, row := range modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+
+	var buff bytes.Buffer
+	fmt.Fprintf(
+		&buff,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		width, width, len(modules), len(modules),
+	)
+	fmt.Fprintf(&buff, `<rect width="100%%" height="100%%" fill="%s"/>`, svgColor(options.Background))
+	fmt.Fprintf(&buff, `<path fill="%s" d="%s"/>`, svgColor(options.Foreground), path.String())
+
+	// Embed logo as PNG over a background box in the centre
+	if options.Logo != nil {
+		var logoBuff bytes.Buffer
+		if encodeErr := png.Encode(&logoBuff, options.Logo); encodeErr != nil {
+			slog.Error("Error encoding QR logo PNG", "error", encodeErr)
+			return nil, ErrCouldNotEncodeQrCode
+		}
+		moduleCount := float64(len(modules))
+		bounds := options.Logo.Bounds()
+		logoWidth := moduleCount * qrLogoRatio
+		logoHeight := logoWidth * float64(bounds.Dy()) / float64(bounds.Dx())
+		offsetX, offsetY := (moduleCount-logoWidth)/2, (moduleCount-logoHeight)/2
+		padding := logoWidth / 10
+		fmt.Fprintf(
+			&buff,
+			`<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"/>`,
+			offsetX-padding, offsetY-padding, logoWidth+2*padding, logoHeight+2*padding,
+			svgColor(options.Background),
+		)
+		fmt.Fprintf(
+			&buff,
+			`<image x="%.2f" y="%.2f" width="%.2f" height="%.2f" href="data:image/png;base64,%s"/>`,
+			offsetX, offsetY, logoWidth, logoHeight,
+			base64.StdEncoding.EncodeToString(logoBuff.Bytes()),
+		)
+	}
+	buff.WriteString("</svg>")
+
+	return buff.Bytes(), nil
+}
+
+// Address of the QR code endpoint for a short URL, served from the internal
+// host. Short URLs on other hosts pass theirs along.
+func qrUrlForShortUrl(shortUrl string) string {
+	shortHost := shortHostForShortUrl(shortUrl)
+	slug := strings.TrimPrefix(shortUrl, shortHost+"/")
+	qrUrl := fmt.Sprintf("%s/url/%s/qr", App.Config().InternalShortHost, slug)
+	if shortHost != App.Config().InternalShortHost {
+		qrUrl = fmt.Sprintf("%s?host=%s", qrUrl, url.QueryEscape(shortHost))
+	}
+	return qrUrl
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestParseHexColor(t *testing.T) {
+	t.Run("parses six digit colors", func(t *testing.T) {
+		expected := color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xff}
+		if received, ok := parseHexColor("#123456"); !ok || received != expected {
+			t.Errorf("Received %v, expected %v", received, expected)
+		}
+	})
+	t.Run("parses three digit colors", func(t *testing.T) {
+		expected := color.RGBA{R: 0xff, G: 0x00, B: 0xaa, A: 0xff}
+		if received, ok := parseHexColor("f0a"); !ok || received != expected {
+			t.Errorf("Received %v, expected %v", received, expected)
+		}
+	})
+	t.Run("rejects invalid colors", func(t *testing.T) {
+		for _, value := range []string{"", "#12345", "zzzzzz", "#1234567"} {
+			if _, ok := parseHexColor(value); ok {
+				t.Errorf("Received %t for %s, expected %t", ok, value, false)
+			}
+		}
+	})
+}
+
+func TestRenderQrPng(t *testing.T) {
+	options := qrOptions{
+		Format:     QrFormatPng,
+		Size:       DefaultQrSize,
+		Level:      "M",
+		Margin:     DefaultQrMargin,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+	t.Run("returns a square png within the requested size", func(t *testing.T) {
+		encoded, err := renderQrPng("http://shrt.url/abc123", options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bounds := decoded.Bounds()
+		if bounds.Dx() != bounds.Dy() || bounds.Dx() > DefaultQrSize || bounds.Dx() < DefaultQrSize/2 {
+			t.Errorf("Received %dx%d, expected square of at most %d", bounds.Dx(), bounds.Dy(), DefaultQrSize)
+		}
+		if received := color.RGBAModel.Convert(decoded.At(0, 0)); received != options.Background {
+			t.Errorf("Received %v in margin, expected %v", received, options.Background)
+		}
+	})
+	t.Run("draws the logo over the centre", func(t *testing.T) {
+		logo := image.NewRGBA(image.Rect(0, 0, 10, 10))
+		red := color.RGBA{R: 0xff, A: 0xff}
+		for y := 0; y < 10; y++ {
+			for x := 0; x < 10; x++ {
+				logo.Set(x, y, red)
+			}
+		}
+		withLogo := options
+		withLogo.Level = "H"
+		withLogo.Logo = logo
+		encoded, err := renderQrPng("http://shrt.url/abc123", withLogo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := png.Decode(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		centre := decoded.Bounds().Dx() / 2
+		if received := color.RGBAModel.Convert(decoded.At(centre, centre)); received != red {
+			t.Errorf("Received %v at centre, expected %v", received, red)
+		}
+	})
+}
+
+func TestRenderQrSvg(t *testing.T) {
+	t.Run("returns an svg using the requested colors", func(t *testing.T) {
+		encoded, err := renderQrSvg("http://shrt.url/abc123", qrOptions{
+			Format:     QrFormatSvg,
+			Size:       DefaultQrSize,
+			Level:      "L",
+			Margin:     0,
+			Foreground: color.RGBA{R: 0x11, G: 0x22, B: 0x33, A: 0xff},
+			Background: color.RGBA{R: 0xee, G: 0xee, B: 0xee, A: 0xff},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		svg := string(encoded)
+		if !strings.HasPrefix(svg, "<svg") || !strings.HasSuffix(svg, "</svg>") {
+			t.Errorf("Received %s, expected svg document", svg)
+		}
+		if !strings.Contains(svg, `fill="#112233"`) || !strings.Contains(svg, `fill="#eeeeee"`) {
+			t.Errorf("Received %s, expected requested colors", svg)
+		}
+	})
+}
+
+func TestQrUrlForShortUrl(t *testing.T) {
+	originalConfig := App.Config()
+	config := *originalConfig
+	config.InternalShortHost = "http://localhost:8080"
+	App.config.Store(&config)
+	defer App.config.Store(originalConfig)
+
+	t.Run("returns endpoint for internal short urls", func(t *testing.T) {
+		expected := "http://localhost:8080/url/abc123/qr"
+		if received := qrUrlForShortUrl("http://localhost:8080/abc123"); received != expected {
+			t.Errorf("Received %s, expected %s", received, expected)
+		}
+	})
+	t.Run("passes along other short hosts", func(t *testing.T) {
+		expected := "http://localhost:8080/url/abc123/qr?host=http%3A%2F%2Fshrt.url"
+		if received := qrUrlForShortUrl("http://shrt.url/abc123"); received != expected {
+			t.Errorf("Received %s, expected %s", received, expected)
+		}
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+// Token-bucket rate limiting per route, by client IP and by API key
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset"
+
+	RateLimitByIp     = "ip"
+	RateLimitByApiKey = "key"
+)
+
+var (
+	ErrCouldNotParseRateLimits = errors.New("could not parse rate limits")
+)
+
+// Refills at Rate tokens per second, holding at most Burst. A zero rate
+// disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) IsDisabled() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Requests carrying an API key count against both limits, so rotating
+// invalid keys does not get around the IP limit
+type RouteRateLimits struct {
+	PerIp     RateLimit
+	PerApiKey RateLimit
+}
+
+// Applied unless overridden by RATE_LIMITS
+var DefaultRateLimits = map[string]RouteRateLimits{
+	"shorten":           {PerIp: RateLimit{Rate: 5, Burst: 20}, PerApiKey: RateLimit{Rate: 10, Burst: 40}},
+	"redirect":          {PerIp: RateLimit{Rate: 20, Burst: 40}},
+	"search":            {PerIp: RateLimit{Rate: 2, Burst: 10}, PerApiKey: RateLimit{Rate: 2, Burst: 10}},
+	"redirect-external": {PerIp: RateLimit{Rate: 20, Burst: 40}, PerApiKey: RateLimit{Rate: 20, Burst: 40}},
+	// Every request renders an image
+	"qr": {PerIp: RateLimit{Rate: 2, Burst: 10}},
+	// Every attempt costs a bcrypt comparison
+	"unlock": {PerIp: RateLimit{Rate: 0.2, Burst: 10}},
+}
+
+type rateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // Until a token is available, when not allowed
+	ResetAfter time.Duration // Until the bucket is full again
+}
+
+// Holds the buckets. Implementations backed by a shared store, such as
+// Redis, let several instances enforce one limit.
+type RateLimitStore interface {
+	Take(key string, limit RateLimit) (rateLimitDecision, error)
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type memoryRateLimitStore struct {
+	SweepInterval time.Duration
+	mutex         sync.Mutex
+	buckets       map[string]*tokenBucket
+	limits        map[string]RateLimit
+	sweptAt       time.Time
+	now           func() time.Time
+}
+
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{
+		SweepInterval: time.Minute,
+		buckets:       map[string]*tokenBucket{},
+		limits:        map[string]RateLimit{},
+		sweptAt:       time.Now(),
+		now:           time.Now,
+	}
+}
+
+func refillTokens(bucket *tokenBucket, limit RateLimit, now time.Time) float64 {
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	return math.Min(float64(limit.Burst), bucket.tokens+elapsed*limit.Rate)
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit RateLimit) (rateLimitDecision, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = refillTokens(bucket, limit, now)
+	bucket.updatedAt = now
+	s.limits[key] = limit
+
+	decision := rateLimitDecision{Limit: limit.Burst}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsToDuration((1 - bucket.tokens) / limit.Rate)
+	}
+	decision.Remaining = int(math.Floor(bucket.tokens))
+	decision.ResetAfter = secondsToDuration((float64(limit.Burst) - bucket.tokens) / limit.Rate)
+
+	return decision, nil
+}
+
+// Drops buckets that have refilled, as they are the same as new ones
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.sweptAt) < s.SweepInterval {
+		return
+	}
+	s.sweptAt = now
+	for key, bucket := range s.buckets {
+		limit := s.limits[key]
+		if refillTokens(bucket, limit, now) >= float64(limit.Burst) {
+			delete(s.buckets, key)
+			delete(s.limits, key)
+		}
+	}
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+type RateLimiter struct {
+	Store RateLimitStore
+
+	// Replaced when config is reloaded
+	mutex  sync.RWMutex
+	limits map[string]RouteRateLimits
+}
+
+func NewRateLimiter(store RateLimitStore, limits map[string]RouteRateLimits) *RateLimiter {
+	return &RateLimiter{Store: store, limits: limits}
+}
+
+// Buckets already taken from keep their tokens, under the new rate
+func (l *RateLimiter) SetLimits(limits map[string]RouteRateLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limits = limits
+}
+
+// Parses a comma-separated list of route.by=rate/burst entries over the
+// defaults, e.g. "redirect.ip=50/100,shorten.key=0/0". Rates are per second.
+func parseRateLimits(spec string, defaults map[string]RouteRateLimits) (map[string]RouteRateLimits, error) {
+	limits := map[string]RouteRateLimits{}
+	for route, routeLimits := range defaults {
+		limits[route] = routeLimits
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target, value, hasValue := cutString(entry, "=")
+		route, by, hasBy := cutString(target, ".")
+		rateString, burstString, hasBurst := cutString(value, "/")
+		if !hasValue || !hasBy || !hasBurst || route == "" {
+			slog.Error("Error parsing rate limit", "entry", entry)
+			return nil, ErrCouldNotParseRateLimits
+		}
+		rate, rateErr := strconv.ParseFloat(rateString, 64)
+		burst, burstErr := strconv.Atoi(burstString)
+		if rateErr != nil || burstErr != nil || rate < 0 || burst < 0 {
+			slog.Error("Error parsing rate limit", "entry", entry)
+			return nil, ErrCouldNotParseRateLimits
+		}
+
+		routeLimits := limits[route]
+		switch by {
+		case RateLimitByIp:
+			routeLimits.PerIp = RateLimit{Rate: rate, Burst: burst}
+		case RateLimitByApiKey:
+			routeLimits.PerApiKey = RateLimit{Rate: rate, Burst: burst}
+		default:
+			slog.Error("Error parsing rate limit, unknown limit", "entry", entry, "by", by)
+			return nil, ErrCouldNotParseRateLimits
+		}
+		limits[route] = routeLimits
+	}
+
+	return limits, nil
+}
+
+func cutString(s string, separator string) (string, string, bool) {
+	parts := strings.SplitN(s, separator, 2)
+	if len(parts) != 2 {
+		return s, "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Takes a token from each bucket the request counts against, returning the
+// most restrictive decision. Store errors let the request through.
+func (l *RateLimiter) Take(route string, r *http.Request, clientIp net.IP) (rateLimitDecision, bool) {
+	l.mutex.RLock()
+	routeLimits, ok := l.limits[route]
+	l.mutex.RUnlock()
+	if !ok {
+		return rateLimitDecision{}, false
+	}
+
+	var buckets []string
+	var limits []RateLimit
+	if !routeLimits.PerIp.IsDisabled() {
+		buckets = append(buckets, fmt.Sprintf("%s:%s:%s", route, RateLimitByIp, clientIp))
+		limits = append(limits, routeLimits.PerIp)
+	}
+	if rawKey := rawApiKeyFromRequest(r); rawKey != "" && !routeLimits.PerApiKey.IsDisabled() {
+		buckets = append(buckets, fmt.Sprintf("%s:%s:%s", route, RateLimitByApiKey, apiKeyIdForRawKey(rawKey)))
+		limits = append(limits, routeLimits.PerApiKey)
+	}
+
+	var decision rateLimitDecision
+	limited := false
+	for i, bucket := range buckets {
+		bucketDecision, takeErr := l.Store.Take(bucket, limits[i])
+		if takeErr != nil {
+			slog.ErrorContext(r.Context(), "Error taking rate limit token", "bucket", bucket, "error", takeErr)
+			continue
+		}
+		if !limited || isMoreRestrictive(bucketDecision, decision) {
+			decision = bucketDecision
+			limited = true
+		}
+	}
+	return decision, limited
+}
+
+func isMoreRestrictive(a rateLimitDecision, b rateLimitDecision) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	return a.Remaining < b.Remaining
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, decision rateLimitDecision) {
+	w.Header().Set(RateLimitLimitHeader, strconv.Itoa(decision.Limit))
+	w.Header().Set(RateLimitRemainingHeader, strconv.Itoa(decision.Remaining))
+	w.Header().Set(
+		RateLimitResetHeader, strconv.Itoa(int(math.Ceil(decision.ResetAfter.Seconds()))),
+	)
+}
+
+// Rejects requests over the route's limits before any other work is done.
+// Does nothing without a rate limiter or limits for the route.
+func rateLimited(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if App.RateLimiter == nil {
+			handler(w, r)
+			return
+		}
+		clientIp := clientIpFromRequest(r, App.TrustedProxies)
+		decision, limited := App.RateLimiter.Take(route, r, clientIp)
+		if limited {
+			setRateLimitHeaders(w, decision)
+		}
+		if limited && !decision.Allowed {
+			slog.InfoContext(r.Context(), "Rate limited request", "route", route, "client_ip", clientIp)
+			handleTooManyRequests(w, decision.RetryAfter, ResRateLimited)
+			return
+		}
+		handler(w, r)
+	}
+}
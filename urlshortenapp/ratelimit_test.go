@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type MockRateLimitStore struct {
+	error error
+}
+
+func (m MockRateLimitStore) Take(_ string, _ RateLimit) (rateLimitDecision, error) {
+	return rateLimitDecision{}, m.error
+}
+
+func TestMemoryRateLimitStore_Take(t *testing.T) {
+	t.Run("allows requests until the burst is spent", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+		limit := RateLimit{Rate: 1.0 / 3600, Burst: 2}
+		for i := 0; i < 2; i++ {
+			decision, _ := store.Take("some-key", limit)
+			if !decision.Allowed {
+				t.Errorf("Received %t, expected %t", decision.Allowed, true)
+			}
+		}
+		decision, _ := store.Take("some-key", limit)
+		if decision.Allowed {
+			t.Errorf("Received %t, expected %t", decision.Allowed, false)
+		}
+		if decision.Remaining != 0 || decision.Limit != 2 {
+			t.Errorf("Received %d of %d, expected %d of %d", decision.Remaining, decision.Limit, 0, 2)
+		}
+		if decision.RetryAfter < 59*time.Minute {
+			t.Errorf("Received %s, expected about %s", decision.RetryAfter, time.Hour)
+		}
+	})
+	t.Run("keeps separate buckets per key", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+		limit := RateLimit{Rate: 1.0 / 3600, Burst: 1}
+		_, _ = store.Take("some-key", limit)
+		decision, _ := store.Take("other-key", limit)
+		if !decision.Allowed {
+			t.Errorf("Received %t, expected %t", decision.Allowed, true)
+		}
+	})
+	t.Run("refills tokens over time", func(t *testing.T) {
+		store := NewMemoryRateLimitStore()
+		limit := RateLimit{Rate: 1000, Burst: 1}
+		_, _ = store.Take("some-key", limit)
+		time.Sleep(5 * time.Millisecond)
+		decision, _ := store.Take("some-key", limit)
+		if !decision.Allowed {
+			t.Errorf("Received %t, expected %t", decision.Allowed, true)
+		}
+	})
+}
+
+func TestParseRateLimits(t *testing.T) {
+	t.Run("overrides defaults per route and limit", func(t *testing.T) {
+		limits, err := parseRateLimits(" redirect.ip=50/100, qr.key=0.5/2", DefaultRateLimits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limits["redirect"].PerIp != (RateLimit{Rate: 50, Burst: 100}) {
+			t.Errorf("Received %v, expected %v", limits["redirect"].PerIp, RateLimit{Rate: 50, Burst: 100})
+		}
+		if limits["qr"].PerApiKey != (RateLimit{Rate: 0.5, Burst: 2}) {
+			t.Errorf("Received %v, expected %v", limits["qr"].PerApiKey, RateLimit{Rate: 0.5, Burst: 2})
+		}
+		if limits["shorten"] != DefaultRateLimits["shorten"] {
+			t.Errorf("Received %v, expected %v", limits["shorten"], DefaultRateLimits["shorten"])
+		}
+		if DefaultRateLimits["redirect"].PerIp.Rate == 50 {
+			t.Error("Received modified defaults, expected defaults to be copied")
+		}
+	})
+	for _, spec := range []string{"redirect", "redirect.ip=50", "redirect.host=1/1", "redirect.ip=fast/1", ".ip=1/1"} {
+		t.Run("returns error when spec is "+spec, func(t *testing.T) {
+			_, err := parseRateLimits(spec, DefaultRateLimits)
+			if err != ErrCouldNotParseRateLimits {
+				t.Errorf("Received %s, expected %s", err, ErrCouldNotParseRateLimits)
+			}
+		})
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	okHandler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	newRequest := func(remoteAddr string, rawKey string) *http.Request {
+		req := httptest.NewRequest("GET", "/some-slug", nil)
+		req.RemoteAddr = remoteAddr
+		if rawKey != "" {
+			req.Header.Set("Authorization", "Bearer "+rawKey)
+		}
+		return req
+	}
+	defer func(original *RateLimiter) { App.RateLimiter = original }(App.RateLimiter)
+
+	t.Run("returns 429 Too Many Requests with headers when IP is over limit", func(t *testing.T) {
+		App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), map[string]RouteRateLimits{
+			"redirect": {PerIp: RateLimit{Rate: 1.0 / 60, Burst: 1}},
+		})
+		h := rateLimited("redirect", okHandler)
+
+		res := httptest.NewRecorder()
+		h(res, newRequest("203.0.113.7:1234", ""))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+		if res.Header().Get(RateLimitLimitHeader) != "1" || res.Header().Get(RateLimitRemainingHeader) != "0" {
+			t.Errorf(
+				"Received %s and %s, expected %s and %s",
+				res.Header().Get(RateLimitLimitHeader), res.Header().Get(RateLimitRemainingHeader), "1", "0",
+			)
+		}
+
+		res = httptest.NewRecorder()
+		h(res, newRequest("203.0.113.7:5678", ""))
+		if res.Code != http.StatusTooManyRequests {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusTooManyRequests)
+		}
+		if retryAfter := res.Header().Get("Retry-After"); retryAfter != "60" {
+			t.Errorf("Received %s, expected %s", retryAfter, "60")
+		}
+		if reset := res.Header().Get(RateLimitResetHeader); reset != "60" {
+			t.Errorf("Received %s, expected %s", reset, "60")
+		}
+
+		res = httptest.NewRecorder()
+		h(res, newRequest("198.51.100.1:1234", ""))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+	})
+	t.Run("returns 429 Too Many Requests when IP is over limit whatever X-Forwarded-For says", func(t *testing.T) {
+		App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), map[string]RouteRateLimits{
+			"redirect": {PerIp: RateLimit{Rate: 1.0 / 60, Burst: 1}},
+		})
+		h := rateLimited("redirect", okHandler)
+
+		var res *httptest.ResponseRecorder
+		for _, forwardedFor := range []string{"198.51.100.1", "198.51.100.2"} {
+			req := newRequest("203.0.113.7:1234", "")
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+			res = httptest.NewRecorder()
+			h(res, req)
+		}
+		if res.Code != http.StatusTooManyRequests {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusTooManyRequests)
+		}
+	})
+	t.Run("returns 429 Too Many Requests when API key is over limit on any IP", func(t *testing.T) {
+		App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), map[string]RouteRateLimits{
+			"shorten": {PerIp: RateLimit{Rate: 1, Burst: 10}, PerApiKey: RateLimit{Rate: 1.0 / 60, Burst: 1}},
+		})
+		h := rateLimited("shorten", okHandler)
+
+		res := httptest.NewRecorder()
+		h(res, newRequest("203.0.113.7:1234", MockApiKey))
+		res = httptest.NewRecorder()
+		h(res, newRequest("198.51.100.1:1234", MockApiKey))
+		if res.Code != http.StatusTooManyRequests {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusTooManyRequests)
+		}
+
+		res = httptest.NewRecorder()
+		h(res, newRequest("198.51.100.1:1234", ""))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+	})
+	t.Run("does not limit routes without limits", func(t *testing.T) {
+		App.RateLimiter = NewRateLimiter(NewMemoryRateLimitStore(), map[string]RouteRateLimits{})
+		res := httptest.NewRecorder()
+		rateLimited("index", okHandler)(res, newRequest("203.0.113.7:1234", ""))
+		if res.Code != http.StatusOK || res.Header().Get(RateLimitLimitHeader) != "" {
+			t.Errorf("Received %d, expected %d without headers", res.Code, http.StatusOK)
+		}
+	})
+	t.Run("lets requests through when store fails", func(t *testing.T) {
+		App.RateLimiter = NewRateLimiter(MockRateLimitStore{errors.New("failed")}, map[string]RouteRateLimits{
+			"redirect": {PerIp: RateLimit{Rate: 1, Burst: 1}},
+		})
+		res := httptest.NewRecorder()
+		rateLimited("redirect", okHandler)(res, newRequest("203.0.113.7:1234", ""))
+		if res.Code != http.StatusOK {
+			t.Errorf("Received %d, expected %d", res.Code, http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+// Conditional redirect rules evaluated against the requesting client
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCouldNotParseTrustedProxies = errors.New("could not parse trusted proxies")
+)
+
+const (
+	PlatformIos     = "ios"
+	PlatformAndroid = "android"
+	PlatformDesktop = "desktop"
+)
+
+var knownPlatforms = []string{PlatformIos, PlatformAndroid, PlatformDesktop}
+
+// A rule matches when every condition it sets matches; unset conditions are
+// ignored. Rules are evaluated in order and the first match wins, falling
+// back to the link's split variants or original URL when none match.
+type redirectRule struct {
+	Url        string     `json:"url"`
+	Platforms  []string   `json:"platforms,omitempty"`
+	Languages  []string   `json:"languages,omitempty"`
+	Countries  []string   `json:"countries,omitempty"`
+	StartsAt   *time.Time `json:"starts_at,omitempty"`
+	EndsAt     *time.Time `json:"ends_at,omitempty"`
+	Percentage int        `json:"percentage,omitempty"`
+}
+
+// Details of the requesting client that rules are matched against
+type redirectClient struct {
+	Platform      string
+	Languages     []string
+	Ip            net.IP
+	UserAgent     string
+	Time          time.Time
+	GeoIp         GeoIpService
+	StickyVariant string
+	country       *string
+}
+
+func newRedirectClient(r *http.Request, geoIp GeoIpService, trustedProxies []*net.IPNet) *redirectClient {
+	return &redirectClient{
+		Platform:  platformFromUserAgent(r.UserAgent()),
+		Languages: languagesFromAcceptLanguage(r.Header.Get("Accept-Language")),
+		Ip:        clientIpFromRequest(r, trustedProxies),
+		UserAgent: r.UserAgent(),
+		Time:      time.Now(),
+		GeoIp:     geoIp,
+	}
+}
+
+func platformFromUserAgent(userAgent string) string {
+	userAgent = strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(userAgent, "iphone"),
+		strings.Contains(userAgent, "ipad"),
+		strings.Contains(userAgent, "ipod"):
+		return PlatformIos
+	case strings.Contains(userAgent, "android"):
+		return PlatformAndroid
+	default:
+		return PlatformDesktop
+	}
+}
+
+// Returns language tags from an Accept-Language header, most preferred first
+func languagesFromAcceptLanguage(header string) []string {
+	type weightedLanguage struct {
+		tag    string
+		weight float64
+	}
+	var weighted []weightedLanguage
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		weight := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if q, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					weight = q
+				}
+			}
+		}
+		if weight > 0 {
+			weighted = append(weighted, weightedLanguage{tag: tag, weight: weight})
+		}
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].weight > weighted[j].weight
+	})
+
+	languages := make([]string, 0, len(weighted))
+	for _, language := range weighted {
+		languages = append(languages, language.tag)
+	}
+	return languages
+}
+
+// Parses a comma-separated list of CIDRs, or of single addresses
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, ErrCouldNotParseTrustedProxies
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, proxy, parseErr := net.ParseCIDR(entry)
+		if parseErr != nil {
+			return nil, ErrCouldNotParseTrustedProxies
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Uses the peer address, unless it is a trusted proxy. Then X-Forwarded-For
+// is read from the right, as each proxy appends the address it received the
+// request from, and the first hop that is not a trusted proxy is the client.
+// Hops left of it were set by the client and cannot be trusted.
+func clientIpFromRequest(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// Looks up the client's country once, on first use
+func (c *redirectClient) Country() string {
+	if c.country == nil {
+		country := ""
+		if c.GeoIp != nil && c.Ip != nil {
+			country, _ = c.GeoIp.CountryForIp(c.Ip)
+		}
+		country = strings.ToUpper(country)
+		c.country = &country
+	}
+	return *c.country
+}
+
+// Places the client in a stable bucket from 0 to 99 for a given rule, so the
+// same client lands on the same side of a percentage split.
+func (c *redirectClient) bucket(ruleIndex int) int {
+	hash := fnv.New32a()
+	_, _ = fmt.Fprintf(hash, "%d|%s|%s", ruleIndex, c.Ip, c.Platform)
+	return int(hash.Sum32() % 100)
+}
+
+func (rule redirectRule) matchesLanguage(languages []string) bool {
+	for _, language := range languages {
+		for _, ruleLanguage := range rule.Languages {
+			ruleLanguage = strings.ToLower(ruleLanguage)
+			if language == ruleLanguage || strings.HasPrefix(language, ruleLanguage+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule redirectRule) matches(ruleIndex int, client *redirectClient) bool {
+	if len(rule.Platforms) > 0 && !containsString(rule.Platforms, client.Platform) {
+		return false
+	}
+	if len(rule.Languages) > 0 && !rule.matchesLanguage(client.Languages) {
+		return false
+	}
+	if rule.StartsAt != nil && client.Time.Before(*rule.StartsAt) {
+		return false
+	}
+	if rule.EndsAt != nil && !client.Time.Before(*rule.EndsAt) {
+		return false
+	}
+	if rule.Percentage > 0 && client.bucket(ruleIndex) >= rule.Percentage {
+		return false
+	}
+	if len(rule.Countries) > 0 && !containsString(rule.Countries, client.Country()) {
+		return false
+	}
+	return true
+}
+
+// Returns the URL of the first matching rule, if any
+func (c urlDocumentContent) matchRedirectRules(client *redirectClient) (string, bool) {
+	for i, rule := range c.Rules {
+		if rule.matches(i, client) {
+			return rule.Url, true
+		}
+	}
+	return "", false
+}
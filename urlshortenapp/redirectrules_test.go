@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type MockGeoIpService struct {
+	country string
+	error   error
+}
+
+func (m MockGeoIpService) CountryForIp(_ net.IP) (string, error) {
+	return m.country, m.error
+}
+
+func TestNewRedirectClient(t *testing.T) {
+	t.Run("detects platform, languages and client ip from request", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/some-slug", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X)")
+		req.Header.Set("Accept-Language", "de;q=0.5, pt-BR, en;q=0.8")
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		trustedProxies, _ := parseTrustedProxies("10.0.0.0/8")
+		client := newRedirectClient(req, MockGeoIpService{"BR", nil}, trustedProxies)
+		if client.Platform != PlatformIos {
+			t.Errorf("Received %s, expected %s", client.Platform, PlatformIos)
+		}
+		if len(client.Languages) != 3 || client.Languages[0] != "pt-br" || client.Languages[2] != "de" {
+			t.Errorf("Received %v, expected [pt-br en de]", client.Languages)
+		}
+		if client.Ip.String() != "203.0.113.7" {
+			t.Errorf("Received %s, expected %s", client.Ip, "203.0.113.7")
+		}
+		if client.Country() != "BR" {
+			t.Errorf("Received %s, expected %s", client.Country(), "BR")
+		}
+	})
+}
+
+func TestClientIpFromRequest(t *testing.T) {
+	trustedProxies, _ := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	cases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expected     string
+	}{
+		{"peer address without a proxy", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"peer address when an untrusted peer sends X-Forwarded-For", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"last hop added by a trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"right-most untrusted hop behind several proxies", "10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7", "192.0.2.1, 10.0.0.2"}, "203.0.113.7"},
+		{"last trusted hop when a hop cannot be parsed", "10.0.0.1:1234", []string{"not-an-ip, 10.0.0.2"}, "10.0.0.2"},
+		{"trusted peer without X-Forwarded-For", "10.0.0.1:1234", nil, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		t.Run("returns "+c.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/some-slug", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = c.remoteAddr
+			for _, forwardedFor := range c.forwardedFor {
+				req.Header.Add("X-Forwarded-For", forwardedFor)
+			}
+			if ip := clientIpFromRequest(req, trustedProxies); ip.String() != c.expected {
+				t.Errorf("Received %s, expected %s", ip, c.expected)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Run("returns networks for CIDRs and single addresses", func(t *testing.T) {
+		proxies, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1,2001:db8::1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"}
+		if len(proxies) != len(expected) {
+			t.Fatalf("Received %v, expected %v", proxies, expected)
+		}
+		for i, proxy := range proxies {
+			if proxy.String() != expected[i] {
+				t.Errorf("Received %s, expected %s", proxy, expected[i])
+			}
+		}
+	})
+	t.Run("returns error when an entry is not an address", func(t *testing.T) {
+		if _, err := parseTrustedProxies("10.0.0.0/8, proxy.local"); err != ErrCouldNotParseTrustedProxies {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotParseTrustedProxies)
+		}
+	})
+}
+
+func TestUrlDocumentContent_DestinationForClient(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	content := urlDocumentContent{
+		OriginalUrl: "http://fallback.url",
+		urlAttributes: urlAttributes{
+			Rules: []redirectRule{
+				{Url: "http://apps.apple.com/app", Platforms: []string{PlatformIos}},
+				{Url: "http://play.google.com/app", Platforms: []string{PlatformAndroid}},
+				{Url: "http://expired.url", StartsAt: &past, EndsAt: &past},
+				{Url: "http://pt.url", Languages: []string{"pt"}, StartsAt: &past, EndsAt: &future},
+				{Url: "http://de.url", Countries: []string{"DE"}},
+			},
+		},
+	}
+	cases := []struct {
+		name     string
+		client   *redirectClient
+		expected string
+	}{
+		{"matches platform", &redirectClient{Platform: PlatformAndroid, Time: now}, "http://play.google.com/app"},
+		{"matches language prefix within time window", &redirectClient{Platform: PlatformDesktop, Languages: []string{"pt-br"}, Time: now}, "http://pt.url"},
+		{"matches country", &redirectClient{Platform: PlatformDesktop, Ip: net.ParseIP("1.2.3.4"), GeoIp: MockGeoIpService{"DE", nil}, Time: now}, "http://de.url"},
+		{"falls back to original url", &redirectClient{Platform: PlatformDesktop, Time: now}, "http://fallback.url"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			destination, err := content.DestinationForClient(c.client)
+			if err != nil {
+				t.Errorf("Received %s, expected nil", err)
+			}
+			if destination.Url != c.expected {
+				t.Errorf("Received %s, expected %s", destination.Url, c.expected)
+			}
+		})
+	}
+	t.Run("percentage split is stable for the same client", func(t *testing.T) {
+		split := urlDocumentContent{
+			OriginalUrl:   "http://a.url",
+			urlAttributes: urlAttributes{Rules: []redirectRule{{Url: "http://b.url", Percentage: 50}}},
+		}
+		client := &redirectClient{Platform: PlatformDesktop, Ip: net.ParseIP("198.51.100.4"), Time: now}
+		first, _ := split.DestinationForClient(client)
+		for i := 0; i < 10; i++ {
+			if destination, _ := split.DestinationForClient(client); destination.Url != first.Url {
+				t.Errorf("Received %s, expected %s", destination.Url, first.Url)
+			}
+		}
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+// Search and listing of short URLs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	UrlSearchSortNewest       = "-created_at"
+	UrlSearchSortOldest       = "created_at"
+	UrlSearchSortMostClicks   = "-click_count"
+	UrlSearchSortFewestClicks = "click_count"
+	UrlSearchSortRelevance    = "relevance"
+
+	DefaultUrlSearchSize = 20
+	MaxUrlSearchSize     = 100
+)
+
+var knownUrlSearchSorts = []string{
+	UrlSearchSortNewest,
+	UrlSearchSortOldest,
+	UrlSearchSortMostClicks,
+	UrlSearchSortFewestClicks,
+	UrlSearchSortRelevance,
+}
+
+var (
+	ErrCouldNotSearchShortUrls   = errors.New("could not search short urls")
+	ErrCouldNotParseSearchCursor = errors.New("could not parse search cursor")
+)
+
+// Empty fields do not filter. Text is matched against original URLs, titles
+// and tags; every word must match in one of them.
+type urlSearchQuery struct {
+	Text         string
+	ShortHosts   []string // Any of
+	Workspace    string
+	Tag          string
+	CreatedAfter *time.Time
+	Sort         string
+	Size         int
+	After        string // Cursor returned with the previous page
+}
+
+type urlSearchResult struct {
+	Total   int
+	Results []urlDocumentContent
+	Next    string // Cursor for the next page, empty on the last page
+}
+
+func encodeSearchCursor(sortValues json.RawMessage) string {
+	return base64.RawURLEncoding.EncodeToString(sortValues)
+}
+
+func decodeSearchCursor(cursor string) (json.RawMessage, error) {
+	decoded, decodeErr := base64.RawURLEncoding.DecodeString(cursor)
+	var sortValues []interface{}
+	if decodeErr != nil || json.Unmarshal(decoded, &sortValues) != nil {
+		return nil, ErrCouldNotParseSearchCursor
+	}
+	return decoded, nil
+}
+
+// Ties are broken on the short URL, so that every document has a distinct
+// position to continue from
+func urlSearchSortClause(sort string) []map[string]interface{} {
+	var clause []map[string]interface{}
+	switch sort {
+	case UrlSearchSortRelevance:
+		clause = append(clause, map[string]interface{}{"_score": "desc"})
+	case UrlSearchSortOldest, UrlSearchSortFewestClicks:
+		clause = append(clause, map[string]interface{}{
+			sort: map[string]string{"order": "asc", "missing": "_first"},
+		})
+	default:
+		clause = append(clause, map[string]interface{}{
+			strings.TrimPrefix(sort, "-"): map[string]string{"order": "desc", "missing": "_last"},
+		})
+	}
+	return append(clause, map[string]interface{}{"short_url": "asc"})
+}
+
+func buildUrlSearchQuery(query urlSearchQuery) (json.RawMessage, error) {
+	must := []interface{}{}
+	filter := []interface{}{}
+
+	if query.Text != "" {
+		must = append(must, map[string]interface{}{
+			"multi_match": map[string]interface{}{
+				"query":    query.Text,
+				"fields":   []string{"original_url", "title^2", "tags"},
+				"type":     "cross_fields",
+				"operator": "and",
+			},
+		})
+	}
+	if len(query.ShortHosts) > 0 {
+		var hosts []interface{}
+		for _, shortHost := range query.ShortHosts {
+			hosts = append(hosts, map[string]interface{}{
+				"prefix": map[string]string{"short_url": strings.TrimSuffix(shortHost, "/") + "/"},
+			})
+		}
+		filter = append(filter, map[string]interface{}{
+			"bool": map[string]interface{}{"should": hosts, "minimum_should_match": 1},
+		})
+	}
+	if query.Workspace != "" {
+		filter = append(filter, map[string]interface{}{
+			"term": map[string]string{"workspace": query.Workspace},
+		})
+	}
+	if query.Tag != "" {
+		filter = append(filter, map[string]interface{}{
+			"term": map[string]string{"tags.keyword": query.Tag},
+		})
+	}
+	if query.CreatedAfter != nil {
+		filter = append(filter, map[string]interface{}{
+			"range": map[string]interface{}{
+				"created_at": map[string]string{"gt": query.CreatedAfter.UTC().Format(time.RFC3339Nano)},
+			},
+		})
+	}
+
+	requestJson := map[string]interface{}{
+		"size":             urlSearchSize(query),
+		"track_total_hits": true,
+		"sort":             urlSearchSortClause(urlSearchSort(query)),
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"must": must, "filter": filter},
+		},
+		"_source": map[string]interface{}{"excludes": []string{"password_hash"}},
+	}
+	if query.After != "" {
+		searchAfter, cursorErr := decodeSearchCursor(query.After)
+		if cursorErr != nil {
+			return nil, cursorErr
+		}
+		requestJson["search_after"] = searchAfter
+	}
+
+	encodedJson, _ := json.Marshal(requestJson)
+	return encodedJson, nil
+}
+
+func (s urlShortenService) SearchShortUrls(ctx context.Context, query urlSearchQuery) (urlSearchResult, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.SearchShortUrls")
+	defer span.End()
+
+	result, searchErr := s.Links.Search(ctx, query)
+	switch searchErr {
+	case nil:
+		return result, nil
+	case ErrCouldNotParseSearchCursor, ErrCouldNotParseDocumentJson:
+		return urlSearchResult{}, searchErr
+	default:
+		slog.Error("Error searching short URLs", "error", searchErr)
+		return urlSearchResult{}, ErrCouldNotSearchShortUrls
+	}
+}
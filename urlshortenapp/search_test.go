@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildUrlSearchQuery(t *testing.T) {
+	t.Run("filters by host, workspace, tag and creation time", func(t *testing.T) {
+		createdAfter := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+		searchJson, err := buildUrlSearchQuery(urlSearchQuery{
+			ShortHosts:   []string{"http://shrt.url"},
+			Workspace:    "team-a",
+			Tag:          "launch",
+			CreatedAfter: &createdAfter,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{
+			`{"prefix":{"short_url":"http://shrt.url/"}}`,
+			`{"term":{"workspace":"team-a"}}`,
+			`{"term":{"tags.keyword":"launch"}}`,
+			`{"range":{"created_at":{"gt":"2021-10-01T00:00:00Z"}}}`,
+			`"sort":[{"created_at":{"missing":"_last","order":"desc"}},{"short_url":"asc"}]`,
+			`"size":20`,
+		} {
+			if !strings.Contains(string(searchJson), expected) {
+				t.Errorf("Received %s, expected it to contain %s", searchJson, expected)
+			}
+		}
+	})
+	t.Run("sorts text searches by relevance by default", func(t *testing.T) {
+		searchJson, _ := buildUrlSearchQuery(urlSearchQuery{Text: "example.com"})
+		expected := `"sort":[{"_score":"desc"},{"short_url":"asc"}]`
+		if !strings.Contains(string(searchJson), expected) {
+			t.Errorf("Received %s, expected it to contain %s", searchJson, expected)
+		}
+	})
+	t.Run("continues after cursor", func(t *testing.T) {
+		cursor := encodeSearchCursor(json.RawMessage(`[-9223372036854775808,"http://shrt.url/b"]`))
+		searchJson, _ := buildUrlSearchQuery(urlSearchQuery{After: cursor})
+		expected := `"search_after":[-9223372036854775808,"http://shrt.url/b"]`
+		if !strings.Contains(string(searchJson), expected) {
+			t.Errorf("Received %s, expected it to contain %s", searchJson, expected)
+		}
+	})
+	t.Run("returns error when cursor is invalid", func(t *testing.T) {
+		_, err := buildUrlSearchQuery(urlSearchQuery{After: "bm90IGpzb24"})
+		if err != ErrCouldNotParseSearchCursor {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotParseSearchCursor)
+		}
+	})
+}
+
+func TestUrlShortenService_SearchShortUrls(t *testing.T) {
+	t.Run("returns error when search fails", func(t *testing.T) {
+		urlSvc := urlShortenService{Links: esLinkStore{EsService: MockEsService{"", Document{}, errors.New("failed")}}}
+		_, err := urlSvc.SearchShortUrls(context.Background(), urlSearchQuery{Text: "example"})
+		if err != ErrCouldNotSearchShortUrls {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotSearchShortUrls)
+		}
+	})
+	t.Run("returns error when document cannot be parsed", func(t *testing.T) {
+		urlSvc := urlShortenService{Links: esLinkStore{EsService: MockEsService{"", Document{Id: "123", Content: json.RawMessage("{]")}, nil}}}
+		_, err := urlSvc.SearchShortUrls(context.Background(), urlSearchQuery{Text: "example"})
+		if err != ErrCouldNotParseDocumentJson {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotParseDocumentJson)
+		}
+	})
+	t.Run("returns next cursor only when page is full", func(t *testing.T) {
+		content := json.RawMessage(`{"original_url": "http://example.com", "short_url": "http://shrt.url/abc123"}`)
+		urlSvc := urlShortenService{Links: esLinkStore{EsService: MockEsService{"", Document{Id: "123", Content: content}, nil}}}
+		result, err := urlSvc.SearchShortUrls(context.Background(), urlSearchQuery{Size: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Total != 1 || result.Results[0].ShortUrl != "http://shrt.url/abc123" {
+			t.Errorf("Received %v, expected %s", result.Results, "http://shrt.url/abc123")
+		}
+		if result.Next != encodeSearchCursor(json.RawMessage(`[1]`)) {
+			t.Errorf("Received %s, expected %s", result.Next, encodeSearchCursor(json.RawMessage(`[1]`)))
+		}
+		result, _ = urlSvc.SearchShortUrls(context.Background(), urlSearchQuery{Size: 2})
+		if result.Next != "" {
+			t.Errorf("Received %s, expected no cursor", result.Next)
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+// HTTP server with timeouts, stopped gracefully on SIGTERM so that rolling
+// deploys do not cut off requests in flight
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	ServerReadHeaderTimeout = 5 * time.Second
+	// Long enough to read an import body
+	ServerReadTimeout    = 60 * time.Second
+	ServerWriteTimeout   = 60 * time.Second
+	ServerIdleTimeout    = 120 * time.Second
+	ServerMaxHeaderBytes = 64 << 10
+
+	// How long readiness fails before the server stops taking requests, so
+	// that load balancers notice first
+	ShutdownReadinessDelay = 5 * time.Second
+	// How long requests in flight, then cleanup, are each waited for
+	ShutdownTimeout = 30 * time.Second
+)
+
+func NewHttpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: ServerReadHeaderTimeout,
+		ReadTimeout:       ServerReadTimeout,
+		WriteTimeout:      ServerWriteTimeout,
+		IdleTimeout:       ServerIdleTimeout,
+		MaxHeaderBytes:    ServerMaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+type GracefulServer struct {
+	Server          *http.Server
+	ReadinessDelay  time.Duration
+	ShutdownTimeout time.Duration
+	// Run as soon as a signal arrives, such as to fail readiness
+	OnSignal func()
+	// Run once requests in flight are done, or given up on, such as to flush
+	// buffers and close connections
+	OnDrained func(ctx context.Context)
+}
+
+// Serves until a signal arrives, then stops taking requests, waits for those
+// in flight and cleans up. Returns nil once shut down.
+func (s GracefulServer) Serve(listener net.Listener, signals <-chan os.Signal) error {
+	serveErrs := make(chan error, 1)
+	go func() { serveErrs <- s.Server.Serve(listener) }()
+
+	select {
+	case serveErr := <-serveErrs:
+		return serveErr
+	case received := <-signals:
+		slog.Info("Shutting down", "signal", received.String(), "readiness_delay", s.ReadinessDelay)
+	}
+	if s.OnSignal != nil {
+		s.OnSignal()
+	}
+	time.Sleep(s.ReadinessDelay)
+
+	// Stop taking requests and wait for those in flight
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancelDrain()
+	if shutdownErr := s.Server.Shutdown(drainCtx); shutdownErr != nil {
+		slog.Error("Requests in flight were cut off", "error", shutdownErr)
+	}
+	if serveErr := <-serveErrs; !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+
+	// Clean up, under a deadline of its own
+	if s.OnDrained != nil {
+		cleanupCtx, cancelCleanup := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		defer cancelCleanup()
+		s.OnDrained(cleanupCtx)
+	}
+	slog.Info("Shut down")
+	return nil
+}
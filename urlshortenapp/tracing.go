@@ -0,0 +1,204 @@
+package main
+
+// OpenTelemetry tracing of requests, from the router down to Elasticsearch,
+// the link store and keygensvc
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+)
+
+const (
+	TracesExporterNone   = ""
+	TracesExporterOtlp   = "otlp"
+	TracesExporterStdout = "stdout"
+	TracesExporterFile   = "file"
+)
+
+var (
+	ErrUnknownTracesExporter = errors.New("unknown traces exporter")
+)
+
+// Spans are dropped until a tracer provider is set, but trace context is
+// still passed on to keygensvc
+var tracer = otel.Tracer("urlshortenapp")
+
+// The destination is the OTLP/HTTP traces URL, or the path of the file
+func NewTracerProvider(serviceName string, exporter string, destination string) (*sdktrace.TracerProvider, error) {
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case TracesExporterOtlp:
+		otlpExporter, otlpErr := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(destination))
+		if otlpErr != nil {
+			return nil, otlpErr
+		}
+		spanExporter = otlpExporter
+	case TracesExporterStdout:
+		stdoutExporter, stdoutErr := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if stdoutErr != nil {
+			return nil, stdoutErr
+		}
+		spanExporter = stdoutExporter
+	case TracesExporterFile:
+		file, openErr := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if openErr != nil {
+			return nil, openErr
+		}
+		fileExporter, fileErr := stdouttrace.New(stdouttrace.WithWriter(file))
+		if fileErr != nil {
+			return nil, fileErr
+		}
+		spanExporter = fileExporter
+	default:
+		return nil, ErrUnknownTracesExporter
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	), nil
+}
+
+// Traces a request served by a route, continuing the caller's trace
+func traceHttpRequest(route string, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(
+		ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.HTTPRoute(route), semconv.URLPath(r.URL.Path)),
+	)
+	defer span.End()
+
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	handler.ServeHTTP(recorder, r.WithContext(ctx))
+	span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.statusCode))
+	if recorder.statusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(recorder.statusCode))
+	}
+}
+
+// Starts a span for a call to another service
+func startClientSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+// Ends a client span, failing it on errors and server errors
+func endClientSpan(span trace.Span, statusCode int, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+		if statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+	}
+	span.End()
+}
+
+// Traces every call to the link store it wraps, under the link cache
+type tracedLinkStore struct {
+	LinkStore
+	System attribute.KeyValue
+}
+
+func NewTracedLinkStore(links LinkStore, linkStoreName string) LinkStore {
+	system := semconv.DBSystemKey.String(linkStoreName)
+	switch linkStoreName {
+	case LinkStoreElasticsearch:
+		system = semconv.DBSystemElasticsearch
+	case LinkStorePostgres:
+		system = semconv.DBSystemPostgreSQL
+	}
+	return &tracedLinkStore{LinkStore: links, System: system}
+}
+
+func (s *tracedLinkStore) Unwrap() LinkStore {
+	return s.LinkStore
+}
+
+func (s *tracedLinkStore) start(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer.Start(
+		ctx, "LinkStore."+operation,
+		trace.WithAttributes(s.System, semconv.DBOperationName(operation)),
+	)
+}
+
+// Links that are missing or used up are answers, not failures
+func endLinkStoreSpan(span trace.Span, err error) {
+	if err != nil && err != ErrLinkNotFound && err != ErrShortUrlClickLimitReached {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s *tracedLinkStore) Get(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	ctx, span := s.start(ctx, "Get")
+	link, getErr := s.LinkStore.Get(ctx, shortUrl)
+	endLinkStoreSpan(span, getErr)
+	return link, getErr
+}
+
+func (s *tracedLinkStore) Put(ctx context.Context, links ...urlDocumentContent) error {
+	ctx, span := s.start(ctx, "Put")
+	span.SetAttributes(attribute.Int("links", len(links)))
+	putErr := s.LinkStore.Put(ctx, links...)
+	endLinkStoreSpan(span, putErr)
+	return putErr
+}
+
+func (s *tracedLinkStore) Delete(ctx context.Context, shortUrl string) error {
+	ctx, span := s.start(ctx, "Delete")
+	deleteErr := s.LinkStore.Delete(ctx, shortUrl)
+	endLinkStoreSpan(span, deleteErr)
+	return deleteErr
+}
+
+func (s *tracedLinkStore) Update(ctx context.Context, shortUrl string, update func(*urlDocumentContent) error) error {
+	ctx, span := s.start(ctx, "Update")
+	updateErr := s.LinkStore.Update(ctx, shortUrl, update)
+	endLinkStoreSpan(span, updateErr)
+	return updateErr
+}
+
+func (s *tracedLinkStore) ConsumeClick(ctx context.Context, shortUrl string) error {
+	ctx, span := s.start(ctx, "ConsumeClick")
+	consumeErr := s.LinkStore.ConsumeClick(ctx, shortUrl)
+	endLinkStoreSpan(span, consumeErr)
+	return consumeErr
+}
+
+func (s *tracedLinkStore) Search(ctx context.Context, query urlSearchQuery) (urlSearchResult, error) {
+	ctx, span := s.start(ctx, "Search")
+	result, searchErr := s.LinkStore.Search(ctx, query)
+	endLinkStoreSpan(span, searchErr)
+	return result, searchErr
+}
+
+func (s *tracedLinkStore) Scan(ctx context.Context, workspace string, handlePage func([]urlDocumentContent) error) error {
+	ctx, span := s.start(ctx, "Scan")
+	scanErr := s.LinkStore.Scan(ctx, workspace, handlePage)
+	endLinkStoreSpan(span, scanErr)
+	return scanErr
+}
+
+func (s *tracedLinkStore) Existing(ctx context.Context, shortUrls []string) ([]string, error) {
+	ctx, span := s.start(ctx, "Existing")
+	span.SetAttributes(attribute.Int("links", len(shortUrls)))
+	existing, existingErr := s.LinkStore.Existing(ctx, shortUrls)
+	endLinkStoreSpan(span, existingErr)
+	return existing, existingErr
+}
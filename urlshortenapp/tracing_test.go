@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Records the spans ended by the test, in place of the exported ones
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previousTracer := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("urlshortenapp")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { tracer = previousTracer })
+	return recorder
+}
+
+func TestRoutes_ServeHTTP_Tracing(t *testing.T) {
+	routes := Routes{}
+	okRoute, _ := regexp.Compile("^/test/ok$")
+	routes.HandleFunc("test-ok", okRoute, func(w http.ResponseWriter, r *http.Request) {})
+	failingRoute, _ := regexp.Compile("^/test/failing$")
+	routes.HandleFunc("test-failing", failingRoute, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	t.Run("continues the trace of the caller", func(t *testing.T) {
+		recorder := recordSpans(t)
+		request := httptest.NewRequest(http.MethodGet, "/test/ok", nil)
+		request.Header.Set("traceparent", testTraceParent)
+		routes.ServeHTTP(httptest.NewRecorder(), request)
+
+		spans := recorder.Ended()
+		if len(spans) != 1 {
+			t.Fatalf("Received %d spans, expected %d", len(spans), 1)
+		}
+		if spans[0].Name() != "GET test-ok" {
+			t.Errorf("Received %s, expected %s", spans[0].Name(), "GET test-ok")
+		}
+		traceId := spans[0].SpanContext().TraceID().String()
+		if traceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("Received %s, expected %s", traceId, "4bf92f3577b34da6a3ce929d0e0e4736")
+		}
+		parentId := spans[0].Parent().SpanID().String()
+		if parentId != "00f067aa0ba902b7" {
+			t.Errorf("Received %s, expected %s", parentId, "00f067aa0ba902b7")
+		}
+	})
+	t.Run("fails spans of requests ending in server errors", func(t *testing.T) {
+		recorder := recordSpans(t)
+		routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/failing", nil))
+
+		spans := recorder.Ended()
+		if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+			t.Errorf("Received %v, expected a single failed span", spans)
+		}
+	})
+}
+
+func TestKgsClient_PostJson_Tracing(t *testing.T) {
+	t.Run("passes on the trace to keygensvc", func(t *testing.T) {
+		recorder := recordSpans(t)
+		var traceParent string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceParent = r.Header.Get("traceparent")
+		}))
+		defer server.Close()
+
+		ctx, span := tracer.Start(context.Background(), "test")
+		response, err := NewKgsClient(server.URL, "", "", testKgsClientOptions).PostJson(ctx, "/key/new", json.RawMessage(`{}`))
+		span.End()
+		if err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+		response.Body.Close()
+
+		spans := recorder.Ended()
+		if len(spans) != 2 {
+			t.Fatalf("Received %d spans, expected %d", len(spans), 2)
+		}
+		expected := "00-" + span.SpanContext().TraceID().String() + "-" + spans[0].SpanContext().SpanID().String() + "-01"
+		if traceParent != expected {
+			t.Errorf("Received %s, expected %s", traceParent, expected)
+		}
+	})
+}
+
+func TestTracedLinkStore(t *testing.T) {
+	t.Run("does not fail spans of links not found", func(t *testing.T) {
+		recorder := recordSpans(t)
+		links := NewTracedLinkStore(newMockCountingLinkStore(), LinkStoreElasticsearch)
+		_, err := links.Get(context.Background(), "http://shrt.url/xyz")
+		if err != ErrLinkNotFound {
+			t.Errorf("Received %s, expected %s", err, ErrLinkNotFound)
+		}
+
+		spans := recorder.Ended()
+		if len(spans) != 1 || spans[0].Name() != "LinkStore.Get" || spans[0].Status().Code == codes.Error {
+			t.Errorf("Received %v, expected a single unfailed LinkStore.Get span", spans)
+		}
+	})
+	t.Run("fails spans of link store errors", func(t *testing.T) {
+		recorder := recordSpans(t)
+		store := newMockCountingLinkStore()
+		store.error = errors.New("unavailable")
+		links := NewTracedLinkStore(store, LinkStorePostgres)
+		_, _ = links.Get(context.Background(), "http://shrt.url/abc")
+
+		spans := recorder.Ended()
+		if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+			t.Errorf("Received %v, expected a single failed span", spans)
+		}
+	})
+}
+
+func TestNewTracerProvider_Otlp(t *testing.T) {
+	t.Run("exports spans to the OTLP/HTTP traces URL", func(t *testing.T) {
+		var path string
+		var body coltracepb.ExportTraceServiceRequest
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			encoded, _ := io.ReadAll(r.Body)
+			_ = proto.Unmarshal(encoded, &body)
+		}))
+		defer server.Close()
+
+		provider, err := NewTracerProvider("urlshortenapp", TracesExporterOtlp, server.URL+"/v1/traces")
+		if err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+		_, span := provider.Tracer("urlshortenapp").Start(context.Background(), "test")
+		span.End()
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Received %s, expected nil", err)
+		}
+
+		if path != "/v1/traces" {
+			t.Errorf("Received %s, expected %s", path, "/v1/traces")
+		}
+		if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+			t.Fatalf("Received %v, expected spans of a single scope", body.ResourceSpans)
+		}
+		exported := body.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		if hex.EncodeToString(exported.TraceId) != span.SpanContext().TraceID().String() {
+			t.Errorf("Received %x, expected %s", exported.TraceId, span.SpanContext().TraceID())
+		}
+	})
+}
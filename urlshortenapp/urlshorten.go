@@ -1,41 +1,55 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
 )
 
 type UrlShortenService interface {
-	TestElasticsearchConnection() bool
-	RefreshElasticsearchIndex() error
-	ConstructShortUrlAndAssignToOriginalUrl(originalUrl string, shortHost string, customSlug string, slugLength int) (string, error)
-	constructShortUrl(shortHost string, customSlug string, slugLength int) (string, error)
-	assignShortUrlToOriginalUrl(url string, shortUrl string) error
-	GetOriginalUrlForShortUrl(shortUrl string) (string, error)
+	TestLinkStoreConnection() bool
+	InitLinkStore() error
+	EnsureElasticsearchIndex() error
+	MigrateElasticsearchIndex() error
+	GetElasticsearchIndexStatus() (esIndexStatus, error)
+	SnapshotElasticsearchIndex(repository string, snapshot string) error
+	DeleteElasticsearchIndex(force bool) error
+	ConstructShortUrlAndAssignToOriginalUrl(ctx context.Context, originalUrl string, shortHost string, customSlug string, slugLength int, attributes urlAttributes) (string, error)
+	constructShortUrl(ctx context.Context, shortHost string, workspace string, customSlug string, slugLength int) (string, error)
+	assignShortUrlToOriginalUrl(ctx context.Context, url string, shortUrl string, attributes urlAttributes) error
+	GetOriginalUrlForShortUrl(ctx context.Context, shortUrl string) (string, error)
+	GetUrlDocumentForShortUrl(ctx context.Context, shortUrl string) (urlDocumentContent, error)
+	UpdateShortUrl(ctx context.Context, shortUrl string, workspace string, update urlUpdate) error
+	ConsumeClickForShortUrl(ctx context.Context, shortUrl string) error
+	SearchShortUrls(ctx context.Context, query urlSearchQuery) (urlSearchResult, error)
+	ExportShortUrls(ctx context.Context, workspace string, handleLink func(urlDocumentContent) error) (int, error)
+	ImportShortUrls(ctx context.Context, links []urlDocumentContent, options urlImportOptions) (urlImportResult, error)
 }
 
 type urlShortenService struct {
-	EsIndex    string
-	EsService  EsService
+	Links      LinkStore
 	KgsService KgsService
+
+	SharedShortHost string
 }
 
+// Slugs on the shared short host are drawn from a keygensvc source open to
+// every workspace; other short hosts get a source owned by one workspace
 func NewUrlShortenService(
-	esIndex string, esService EsService, kgsService KgsService,
+	links LinkStore, kgsService KgsService, sharedShortHost string,
 ) UrlShortenService {
 	return &urlShortenService{
-		EsIndex: esIndex,
-		EsService: esService,
+		Links: links,
 		KgsService: kgsService,
+		SharedShortHost: sharedShortHost,
 	}
 }
 
 var (
-	ErrCouldNotRefreshElasticsearchIndex   = errors.New("could not refresh elasticsearch Index")
 	ErrCouldNotConstructShortUrl		   = errors.New("could not construct short url")
 	ErrCouldNotAssignShortUrlToOriginalUrl = errors.New("could not assign short url to original url")
 	ErrCouldNotCreateNewSlugForShortUrl    = errors.New("could not create new slug for short url")
@@ -44,43 +58,56 @@ var (
 	ErrCouldNotStoreDocumentForShortUrl    = errors.New("could not store document for url")
 	ErrCouldNotFindDocumentForShortUrl     = errors.New("could not find document for short url")
 	ErrCouldNotParseDocumentJson		   = errors.New("could not parse document content json")
+	ErrCouldNotParseOriginalUrl            = errors.New("could not parse original url")
+	ErrCouldNotUpdateDocumentForShortUrl   = errors.New("could not update document for short url")
+	ErrShortUrlClickLimitReached           = errors.New("short url click limit reached")
+	ErrCouldNotRecordClickForShortUrl      = errors.New("could not record click for short url")
+	ErrShortUrlInOtherWorkspace            = errors.New("short url belongs to another workspace")
 )
 
-func (s urlShortenService) TestElasticsearchConnection() bool {
-	if infoErr := s.EsService.PrintInfo(); infoErr != nil {
-		log.Printf("Error testing Elasticsearch connection: %s", infoErr)
+func (s urlShortenService) TestLinkStoreConnection() bool {
+	if pingErr := s.Links.Ping(context.Background()); pingErr != nil {
+		slog.Error("Error testing link store connection", "error", pingErr)
 		return false
 	}
 	return true
 }
 
-func (s urlShortenService) RefreshElasticsearchIndex() error {
-	// Refresh Elasticsearch Index
-	if refreshErr := s.EsService.RefreshIndices([]string{s.EsIndex}); refreshErr != nil {
-		log.Printf("Error refreshing Elasticsearch index: %s", refreshErr)
-		return ErrCouldNotRefreshElasticsearchIndex
+// Creates whatever the link store needs on first start, such as an index or
+// tables, before anything writes to it
+func (s urlShortenService) InitLinkStore() error {
+	if initErr := s.Links.Init(context.Background()); initErr != nil {
+		slog.Error("Error initialising link store", "error", initErr)
+		return ErrCouldNotInitLinkStore
 	}
-	log.Printf("Successfully refreshed Elasticsearch index %s", s.EsIndex)
 	return nil
 }
 
 func (s urlShortenService) ConstructShortUrlAndAssignToOriginalUrl(
-	originalUrl string, shortHost string, customSlug string, slugLength int,
+	ctx context.Context, originalUrl string, shortHost string, customSlug string, slugLength int, attributes urlAttributes,
 ) (string, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.ConstructShortUrlAndAssignToOriginalUrl")
+	defer span.End()
+
 	// Construct short URL
 	shortUrl, constructErr := s.constructShortUrl(
-		shortHost, customSlug, slugLength,
+		ctx, shortHost, attributes.Workspace, customSlug, slugLength,
 	)
+	if constructErr == ErrKgsUnavailable {
+		// Passed on as is, so that callers can tell to come back later
+		return "", constructErr
+	}
 	if constructErr != nil {
-		log.Printf("Unable to construct short URL for %s: %s", originalUrl, constructErr)
+		slog.ErrorContext(ctx, "Unable to construct short URL", "original_url", originalUrl, "error", constructErr)
 		return "", ErrCouldNotConstructShortUrl
 	}
 
 	// Assign short URL
-	assignErr := s.assignShortUrlToOriginalUrl(originalUrl, shortUrl)
+	assignErr := s.assignShortUrlToOriginalUrl(ctx, originalUrl, shortUrl, attributes)
 	if assignErr != nil {
-		log.Printf(
-			"Unable to assign short URL %s to %s: %s", shortUrl, originalUrl, assignErr,
+		slog.ErrorContext(
+			ctx, "Unable to assign short URL",
+			"short_url", shortUrl, "original_url", originalUrl, "error", assignErr,
 		)
 		return "", ErrCouldNotAssignShortUrlToOriginalUrl
 	}
@@ -88,86 +115,354 @@ func (s urlShortenService) ConstructShortUrlAndAssignToOriginalUrl(
 	return shortUrl, nil
 }
 
-func (s urlShortenService) constructShortUrl(shortHost string, customSlug string, slugLength int) (string, error) {
+func (s urlShortenService) constructShortUrl(
+	ctx context.Context, shortHost string, workspace string, customSlug string, slugLength int,
+) (string, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.constructShortUrl")
+	defer span.End()
+
 	var slug string
 	var err error
+	sourceWorkspace := workspace
+	if shortHost == s.SharedShortHost {
+		sourceWorkspace = ""
+	}
 	if customSlug != "" {
 		// Create new slug for short URL
-		log.Print("Creating new slug for short URL...")
-		slug, err = s.KgsService.CreateNewKey(shortHost, customSlug)
+		slog.DebugContext(ctx, "Creating new slug for short URL...")
+		slug, err = s.KgsService.CreateNewKey(ctx, shortHost, sourceWorkspace, customSlug)
+		if err == ErrKgsUnavailable {
+			return "", err
+		}
 		if err != nil {
-			log.Printf(
-				"Error creating new slug to construct short URL for host %s: %s", shortHost, err,
-			)
+			slog.ErrorContext(ctx, "Error creating new slug to construct short URL", "short_host", shortHost, "error", err)
 			return "", ErrCouldNotCreateNewSlugForShortUrl
 		}
-		log.Printf("New slug created: %s", slug)
+		slog.DebugContext(ctx, "New slug created", "slug", slug)
 	} else {
 		// Generate new slug for short URL
-		log.Print("Retrieving new slug for short URL...")
-		slug, err = s.KgsService.GenerateKey(shortHost, slugLength)
+		slog.DebugContext(ctx, "Retrieving new slug for short URL...")
+		slug, err = s.KgsService.GenerateKey(ctx, shortHost, sourceWorkspace, slugLength)
+		if err == ErrKgsUnavailable {
+			return "", err
+		}
 		if err != nil {
-			log.Printf(
-				"Error generating new slug to construct short URL for host %s: %s", shortHost, err,
-			)
+			slog.ErrorContext(ctx, "Error generating new slug to construct short URL", "short_host", shortHost, "error", err)
 			return "", ErrCouldNotGenerateNewSlugForShortUrl
 		}
-		log.Printf("New slug retrieved: %s", slug)
+		slog.DebugContext(ctx, "New slug retrieved", "slug", slug)
 	}
 
 	// Return constructed short URL
 	return fmt.Sprintf("%s/%s", shortHost, slug), nil
 }
 
+type utmParameters struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// Query parameter names and values for each UTM field
+func (utm utmParameters) queryParams() [][2]string {
+	return [][2]string{
+		{"utm_source", utm.Source},
+		{"utm_medium", utm.Medium},
+		{"utm_campaign", utm.Campaign},
+		{"utm_term", utm.Term},
+		{"utm_content", utm.Content},
+	}
+}
+
+// Attributes stored alongside a link that can be edited without changing
+// the original URL it points to.
+type urlAttributes struct {
+	Title    string               `json:"title,omitempty"`
+	Tags     []string             `json:"tags,omitempty"`
+	Utm      *utmParameters       `json:"utm,omitempty"`
+	Params   map[string]string    `json:"params,omitempty"`
+	Rules    []redirectRule       `json:"rules,omitempty"`
+	Variants []destinationVariant `json:"variants,omitempty"`
+
+	PasswordHash string `json:"password_hash,omitempty"`
+	MaxClicks    int    `json:"max_clicks,omitempty"`
+
+	// Ownership, taken from the caller's API key rather than the request
+	Workspace string `json:"workspace,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
 type urlDocumentContent struct {
 	OriginalUrl string `json:"original_url"`
 	ShortUrl    string `json:"short_url"`
+	ClickCount  int    `json:"click_count,omitempty"`
+	// Unset on links created before it was recorded
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	urlAttributes
 }
 
-func (s urlShortenService) assignShortUrlToOriginalUrl(url string, shortUrl string) error {
-	// Construct new document
-	shortUrlHash := md5.Sum([]byte(shortUrl))
-	newId := hex.EncodeToString(shortUrlHash[:])
+func (c urlDocumentContent) IsClickLimited() bool {
+	return c.MaxClicks > 0
+}
 
-	content, _ := json.Marshal(
-		urlDocumentContent{OriginalUrl: url, ShortUrl: shortUrl},
-	)
-	document := Document{Id: newId, Content: content}
-	log.Printf("Constructed new document: hash %s", newId)
-
-	// Store document in Elasticsearch
-	id, indexErr := s.EsService.IndexDocument(s.EsIndex, document)
-	if indexErr != nil {
-		log.Printf(
-			"Error indexing given URL %s: %s; hash=%s", url, indexErr, newId,
-		)
+func (c urlDocumentContent) IsClickLimitReached() bool {
+	return c.IsClickLimited() && c.ClickCount >= c.MaxClicks
+}
+
+// Placeholders that may be used in parameter template values
+var paramTemplatePlaceholders = []string{"{slug}", "{short_host}", "{short_url}"}
+
+func (c urlDocumentContent) expandParamTemplate(value string) string {
+	shortHost, slug := c.ShortUrl, ""
+	if i := strings.LastIndex(c.ShortUrl, "/"); i >= 0 {
+		shortHost, slug = c.ShortUrl[:i], c.ShortUrl[i+1:]
+	}
+	return strings.NewReplacer(
+		"{slug}", slug,
+		"{short_host}", shortHost,
+		"{short_url}", c.ShortUrl,
+	).Replace(value)
+}
+
+// DestinationUrl merges UTM fields and parameter templates into the original
+// URL. Explicit parameters take precedence over UTM fields of the same name.
+func (c urlDocumentContent) DestinationUrl() (string, error) {
+	return c.mergeAttributesIntoUrl(c.OriginalUrl)
+}
+
+// Where a client is sent, and the split variant it was assigned if any
+type redirectDestination struct {
+	Url     string
+	Variant string
+}
+
+// DestinationForClient picks the destination from the first redirect rule
+// matching the client, then from the split variants, then the original URL,
+// before merging in tracking parameters.
+func (c urlDocumentContent) DestinationForClient(client *redirectClient) (redirectDestination, error) {
+	var destination redirectDestination
+	if ruleUrl, matched := c.matchRedirectRules(client); matched {
+		destination.Url = ruleUrl
+	} else if variant := c.pickVariant(client); variant != nil {
+		destination.Url, destination.Variant = variant.Url, variant.Name
+	} else {
+		destination.Url = c.OriginalUrl
+	}
+
+	mergedUrl, mergeErr := c.mergeAttributesIntoUrl(destination.Url)
+	if mergeErr != nil {
+		return redirectDestination{}, mergeErr
+	}
+	destination.Url = mergedUrl
+	return destination, nil
+}
+
+func (c urlDocumentContent) mergeAttributesIntoUrl(rawUrl string) (string, error) {
+	if c.Utm == nil && len(c.Params) == 0 {
+		return rawUrl, nil
+	}
+
+	destination, parseErr := url.Parse(rawUrl)
+	if parseErr != nil {
+		slog.Error("Error parsing destination URL", "raw_url", rawUrl, "error", parseErr)
+		return "", ErrCouldNotParseOriginalUrl
+	}
+
+	query := destination.Query()
+	if c.Utm != nil {
+		for _, param := range c.Utm.queryParams() {
+			if param[1] != "" {
+				query.Set(param[0], param[1])
+			}
+		}
+	}
+	for key, value := range c.Params {
+		query.Set(key, c.expandParamTemplate(value))
+	}
+	destination.RawQuery = query.Encode()
+
+	return destination.String(), nil
+}
+
+// Changes to apply to an existing link; nil fields are left untouched
+type urlUpdate struct {
+	Title    *string
+	Tags     []string
+	Utm      *utmParameters
+	Params   map[string]string
+	Rules    []redirectRule
+	Variants []destinationVariant
+
+	PasswordHash *string
+	MaxClicks    *int
+}
+
+func (u urlUpdate) applyTo(content *urlDocumentContent) {
+	if u.Title != nil {
+		content.Title = *u.Title
+	}
+	if u.Tags != nil {
+		if len(u.Tags) == 0 {
+			content.Tags = nil
+		} else {
+			content.Tags = u.Tags
+		}
+	}
+	if u.Utm != nil {
+		if *u.Utm == (utmParameters{}) {
+			content.Utm = nil
+		} else {
+			content.Utm = u.Utm
+		}
+	}
+	if u.Params != nil {
+		if len(u.Params) == 0 {
+			content.Params = nil
+		} else {
+			content.Params = u.Params
+		}
+	}
+	if u.Rules != nil {
+		if len(u.Rules) == 0 {
+			content.Rules = nil
+		} else {
+			content.Rules = u.Rules
+		}
+	}
+	if u.Variants != nil {
+		if len(u.Variants) == 0 {
+			content.Variants = nil
+		} else {
+			content.Variants = u.Variants
+		}
+	}
+	if u.PasswordHash != nil {
+		content.PasswordHash = *u.PasswordHash
+	}
+	if u.MaxClicks != nil {
+		content.MaxClicks = *u.MaxClicks
+	}
+}
+
+// Returns the short URL up to its slug, such as http://shrt.url
+func shortHostForShortUrl(shortUrl string) string {
+	i := strings.LastIndex(shortUrl, "/")
+	if i < 0 {
+		return ""
+	}
+	return shortUrl[:i]
+}
+
+func (s urlShortenService) assignShortUrlToOriginalUrl(
+	ctx context.Context,
+	url string, shortUrl string, attributes urlAttributes,
+) error {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.assignShortUrlToOriginalUrl")
+	defer span.End()
+
+	// Construct new link
+	createdAt := time.Now().UTC()
+	link := urlDocumentContent{
+		OriginalUrl:   url,
+		ShortUrl:      shortUrl,
+		CreatedAt:     &createdAt,
+		urlAttributes: attributes,
+	}
+
+	// Store link
+	if putErr := s.Links.Put(ctx, link); putErr != nil {
+		slog.Error("Error storing URL for short URL", "url", url, "short_url", shortUrl, "error", putErr)
 		return ErrCouldNotStoreDocumentForShortUrl
 	}
-	log.Printf("Indexed document: %s", id)
+	slog.Debug("Stored link for short URL", "short_url", shortUrl)
 
 	return nil
 }
 
-func (s urlShortenService) GetOriginalUrlForShortUrl(shortUrl string) (string, error) {
-	// Get hash id for short URL
-	shortUrlHash := md5.Sum([]byte(shortUrl))
-	id := hex.EncodeToString(shortUrlHash[:])
+func (s urlShortenService) getDocumentContentForShortUrl(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	content, getErr := s.Links.Get(ctx, shortUrl)
+	if getErr == ErrCouldNotParseDocumentJson {
+		slog.Error("Error parsing document content", "short_url", shortUrl)
+		return urlDocumentContent{}, getErr
+	}
+	if getErr != nil {
+		slog.Error("Error finding URL for short URL", "short_url", shortUrl, "error", getErr)
+		return urlDocumentContent{}, ErrCouldNotFindDocumentForShortUrl
+	}
+	return content, nil
+}
+
+func (s urlShortenService) GetOriginalUrlForShortUrl(ctx context.Context, shortUrl string) (string, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.GetOriginalUrlForShortUrl")
+	defer span.End()
 
-	// Fetch document from Elasticsearch
-	document, getErr := s.EsService.GetDocumentById(App.EnvVars.EsIndex, id)
+	// Fetch and parse document for short URL
+	content, getErr := s.getDocumentContentForShortUrl(ctx, shortUrl)
 	if getErr != nil {
-		log.Printf("Error finding URL for given short URL %s: %s", shortUrl, getErr)
-		return "", ErrCouldNotFindDocumentForShortUrl
+		return "", getErr
 	}
 
-	// Parse document content for URL
-	content := urlDocumentContent{}
-	parseContentErr := json.Unmarshal(document.Content, &content)
-	if parseContentErr != nil {
-		log.Printf("Error parsing document content for short URL: %s", shortUrl)
-		return "", ErrCouldNotParseDocumentJson
+	// Return document URL with tracking parameters merged in
+	return content.DestinationUrl()
+}
+
+// Callers without a workspace, such as admins, may act on every link
+func (c urlDocumentContent) BelongsToWorkspace(workspace string) bool {
+	return workspace == "" || c.Workspace == workspace
+}
+
+func (s urlShortenService) GetUrlDocumentForShortUrl(ctx context.Context, shortUrl string) (urlDocumentContent, error) {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.GetUrlDocumentForShortUrl")
+	defer span.End()
+
+	return s.getDocumentContentForShortUrl(ctx, shortUrl)
+}
+
+func (s urlShortenService) UpdateShortUrl(ctx context.Context, shortUrl string, workspace string, update urlUpdate) error {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.UpdateShortUrl")
+	defer span.End()
+
+	updateErr := s.Links.Update(ctx, shortUrl, func(content *urlDocumentContent) error {
+		if !content.BelongsToWorkspace(workspace) {
+			slog.Warn("Short URL does not belong to workspace", "short_url", shortUrl, "workspace", workspace)
+			return ErrShortUrlInOtherWorkspace
+		}
+		update.applyTo(content)
+		return nil
+	})
+	switch updateErr {
+	case nil:
+		return nil
+	case ErrShortUrlInOtherWorkspace, ErrCouldNotParseDocumentJson:
+		return updateErr
+	case ErrLinkNotFound:
+		slog.Error("Error finding URL for short URL", "short_url", shortUrl, "error", updateErr)
+		return ErrCouldNotFindDocumentForShortUrl
+	default:
+		slog.Error("Error updating document for short URL", "short_url", shortUrl, "error", updateErr)
+		return ErrCouldNotUpdateDocumentForShortUrl
 	}
+}
 
-	// Return document URL
-	return content.OriginalUrl, nil
+// Counted atomically by the link store, so concurrent redirects cannot
+// exceed the limit
+func (s urlShortenService) ConsumeClickForShortUrl(ctx context.Context, shortUrl string) error {
+	ctx, span := tracer.Start(ctx, "UrlShortenService.ConsumeClickForShortUrl")
+	defer span.End()
+
+	consumeErr := s.Links.ConsumeClick(ctx, shortUrl)
+	switch consumeErr {
+	case nil:
+		return nil
+	case ErrLinkNotFound:
+		return ErrCouldNotFindDocumentForShortUrl
+	case ErrShortUrlClickLimitReached:
+		slog.Info("Click limit reached for short URL", "short_url", shortUrl)
+		return consumeErr
+	default:
+		slog.Error("Error recording click for short URL", "short_url", shortUrl, "error", consumeErr)
+		return ErrCouldNotRecordClickForShortUrl
+	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"testing"
@@ -12,41 +13,102 @@ type MockEsService struct {
 	error error
 }
 
-func (m MockEsService) PrintInfo() error {
+func (m MockEsService) PrintInfo(_ context.Context) error {
 	return m.error
 }
 
-func (m MockEsService) RefreshIndices(_ []string) error {
+func (m MockEsService) ClusterHealth(_ context.Context) (string, error) {
+	return "green", m.error
+}
+
+func (m MockEsService) DeleteIndices(_ context.Context, _ []string) error {
+	return m.error
+}
+
+func (m MockEsService) CreateIndex(_ context.Context, _ string, _ json.RawMessage) error {
+	return m.error
+}
+
+func (m MockEsService) ResolveIndex(_ context.Context, _ string) ([]string, bool, error) {
+	return nil, false, m.error
+}
+
+func (m MockEsService) UpdateAliases(_ context.Context, _ []AliasAction) error {
 	return m.error
 }
 
-func (m MockEsService) IndexDocument(_ string, _ Document) (string, error) {
+func (m MockEsService) Reindex(_ context.Context, _ string, _ string) (int, error) {
+	return 0, m.error
+}
+
+func (m MockEsService) CountDocuments(_ context.Context, _ string) (int, error) {
+	return 0, m.error
+}
+
+func (m MockEsService) CreateSnapshot(_ context.Context, _ string, _ string, _ []string) error {
+	return m.error
+}
+
+func (m MockEsService) IndexDocument(_ context.Context, _ string, _ Document) (string, error) {
 	return m.id, m.error
 }
 
-func (m MockEsService) GetDocumentById(_ string, _ string) (Document, error) {
+func (m MockEsService) GetDocumentById(_ context.Context, _ string, _ string) (Document, error) {
 	return m.document, m.error
 }
 
+func (m MockEsService) DeleteDocument(_ context.Context, _ string, _ string) error {
+	return m.error
+}
+
+func (m MockEsService) BulkIndexDocuments(_ context.Context, _ string, _ []Document) error {
+	return m.error
+}
+
+func (m MockEsService) UpdateDocumentWithScript(_ context.Context, _ string, _ string, _ string, _ map[string]interface{}) (string, error) {
+	return m.id, m.error
+}
+
+func (m MockEsService) Search(_ context.Context, _ string, _ json.RawMessage) (SearchResult, error) {
+	if m.document.Id == "" {
+		return SearchResult{}, m.error
+	}
+	return SearchResult{Total: 1, Documents: []Document{m.document}, LastSort: json.RawMessage(`[1]`)}, m.error
+}
+
+func (m MockEsService) ScrollDocuments(_ context.Context, _ string, _ json.RawMessage, handlePage func([]Document) error) error {
+	if m.document.Id == "" {
+		return m.error
+	}
+	if handleErr := handlePage([]Document{m.document}); handleErr != nil {
+		return handleErr
+	}
+	return m.error
+}
+
 type MockKgsService struct {
 	key string
 	error error
 }
 
-func (m MockKgsService) GenerateKey(_ string, _ int) (string, error) {
+func (m MockKgsService) GenerateKey(_ context.Context, _ string, _ string, _ int) (string, error) {
 	return m.key, m.error
 }
 
-func (m MockKgsService) CreateNewKey(_ string, _ string) (string, error) {
+func (m MockKgsService) CreateNewKey(_ context.Context, _ string, _ string, _ string) (string, error) {
 	return m.key, m.error
 }
 
-func TestUrlShortenService_TestElasticsearchConnection(t *testing.T) {
+func (m MockKgsService) Ping(_ context.Context) error {
+	return m.error
+}
+
+func TestUrlShortenService_TestLinkStoreConnection(t *testing.T) {
 	t.Run("returns false when connection test fails", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, errors.New("failed")}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		res := urlSvc.TestElasticsearchConnection()
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		res := urlSvc.TestLinkStoreConnection()
 		if res != false {
 			t.Errorf("Received %t, expected %t", res, false)
 		}
@@ -54,42 +116,21 @@ func TestUrlShortenService_TestElasticsearchConnection(t *testing.T) {
 	t.Run("returns true when successful", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		res := urlSvc.TestElasticsearchConnection()
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		res := urlSvc.TestLinkStoreConnection()
 		if res != true {
 			t.Errorf("Received %t, expected %t", res, true)
 		}
 	})
 }
 
-func TestUrlShortenService_RefreshElasticsearchIndex(t *testing.T) {
-	t.Run("returns error when indices refresh fails", func(t *testing.T) {
-		mockEsService := MockEsService{"", Document{}, errors.New("failed")}
-		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		err := urlSvc.RefreshElasticsearchIndex()
-		if err != ErrCouldNotRefreshElasticsearchIndex {
-			t.Errorf("Received %s, expected %s", err, ErrCouldNotRefreshElasticsearchIndex)
-		}
-	})
-	t.Run("returns nil when successful", func(t *testing.T) {
-		mockEsService := MockEsService{"", Document{}, nil}
-		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		err := urlSvc.RefreshElasticsearchIndex()
-		if err != nil {
-			t.Errorf("Received %s, expected nil", err)
-		}
-	})
-}
-
 func TestUrlShortenService_ConstructShortUrlAndAssignToOriginalUrl(t *testing.T) {
 	t.Run("returns error when construction fails", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"", errors.New("failed")}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
 		_, err := urlSvc.ConstructShortUrlAndAssignToOriginalUrl(
-			"http://some-url","http://shortho.st", "custom-slug", 0,
+			context.Background(), "http://some-url","http://shortho.st", "custom-slug", 0, urlAttributes{},
 		)
 		if err != ErrCouldNotConstructShortUrl {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotConstructShortUrl)
@@ -98,9 +139,9 @@ func TestUrlShortenService_ConstructShortUrlAndAssignToOriginalUrl(t *testing.T)
 	t.Run("returns error when assignment fails", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, errors.New("failed")}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
 		_, err := urlSvc.ConstructShortUrlAndAssignToOriginalUrl(
-			"http://some-url","http://shortho.st", "custom-slug", 0,
+			context.Background(), "http://some-url","http://shortho.st", "custom-slug", 0, urlAttributes{},
 		)
 		if err != ErrCouldNotAssignShortUrlToOriginalUrl {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotAssignShortUrlToOriginalUrl)
@@ -109,9 +150,9 @@ func TestUrlShortenService_ConstructShortUrlAndAssignToOriginalUrl(t *testing.T)
 	t.Run("returns short url when successful", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"custom-slug", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
 		shortUrl, err := urlSvc.ConstructShortUrlAndAssignToOriginalUrl(
-			"http://some-url","http://shortho.st", "custom-slug", 0,
+			context.Background(), "http://some-url","http://shortho.st", "custom-slug", 0, urlAttributes{},
 		)
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
@@ -126,8 +167,8 @@ func TestUrlShortenService_constructShortUrl(t *testing.T) {
 	t.Run("returns error when new key cannot be created", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"", errors.New("failed")}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		_, err := urlSvc.constructShortUrl("http://shortho.st", "custom-slug", 0)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		_, err := urlSvc.constructShortUrl(context.Background(), "http://shortho.st", "", "custom-slug", 0)
 		if err != ErrCouldNotCreateNewSlugForShortUrl {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotCreateNewSlugForShortUrl)
 		}
@@ -135,17 +176,26 @@ func TestUrlShortenService_constructShortUrl(t *testing.T) {
 	t.Run("returns error when new key cannot be generated", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"", errors.New("failed")}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		_, err := urlSvc.constructShortUrl("http://shortho.st", "", 8)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		_, err := urlSvc.constructShortUrl(context.Background(), "http://shortho.st", "", "", 8)
 		if err != ErrCouldNotGenerateNewSlugForShortUrl {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotCreateNewSlugForShortUrl)
 		}
 	})
+	t.Run("returns ErrKgsUnavailable as is when keygensvc fails fast", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{}, nil}
+		mockKgsService := MockKgsService{"", ErrKgsUnavailable}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		_, err := urlSvc.constructShortUrl(context.Background(), "http://shortho.st", "", "", 8)
+		if err != ErrKgsUnavailable {
+			t.Errorf("Received %s, expected %s", err, ErrKgsUnavailable)
+		}
+	})
 	t.Run("returns short url when successfully constructing with custom slug", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"custom-slug", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		shortUrl, err := urlSvc.constructShortUrl("http://shortho.st", "custom-slug", 0)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		shortUrl, err := urlSvc.constructShortUrl(context.Background(), "http://shortho.st", "", "custom-slug", 0)
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
 		}
@@ -156,8 +206,8 @@ func TestUrlShortenService_constructShortUrl(t *testing.T) {
 	t.Run("returns short url when successfully constructing with generated slug", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"gen-slug", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		shortUrl, err := urlSvc.constructShortUrl("http://shortho.st", "", 8)
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		shortUrl, err := urlSvc.constructShortUrl(context.Background(), "http://shortho.st", "", "", 8)
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
 		}
@@ -171,8 +221,8 @@ func TestUrlShortenService_assignShortUrlToOriginalUrl(t *testing.T) {
 	t.Run("returns error when document cannot be indexed", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, errors.New("failed")}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		err := urlSvc.assignShortUrlToOriginalUrl("http://some-url", "http://shrt-url")
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.assignShortUrlToOriginalUrl(context.Background(), "http://some-url", "http://shrt-url", urlAttributes{})
 		if err != ErrCouldNotStoreDocumentForShortUrl {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotStoreDocumentForShortUrl)
 		}
@@ -180,8 +230,8 @@ func TestUrlShortenService_assignShortUrlToOriginalUrl(t *testing.T) {
 	t.Run("returns nil when successful", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, nil}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		err := urlSvc.assignShortUrlToOriginalUrl("http://some-url", "http://shrt-url")
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.assignShortUrlToOriginalUrl(context.Background(), "http://some-url", "http://shrt-url", urlAttributes{})
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
 		}
@@ -192,8 +242,8 @@ func TestUrlShortenService_GetOriginalUrlForShortUrl(t *testing.T) {
 	t.Run("returns error when document cannot be found", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{}, errors.New("not found")}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		_, err := urlSvc.GetOriginalUrlForShortUrl("http://shrt-url")
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		_, err := urlSvc.GetOriginalUrlForShortUrl(context.Background(), "http://shrt-url")
 		if err != ErrCouldNotFindDocumentForShortUrl {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotFindDocumentForShortUrl)
 		}
@@ -201,8 +251,8 @@ func TestUrlShortenService_GetOriginalUrlForShortUrl(t *testing.T) {
 	t.Run("returns error when document content JSON cannot be parsed", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{Id: "123", Content: json.RawMessage("{]")}, nil}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		_, err := urlSvc.GetOriginalUrlForShortUrl("http://shrt-url")
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		_, err := urlSvc.GetOriginalUrlForShortUrl(context.Background(), "http://shrt-url")
 		if err != ErrCouldNotParseDocumentJson {
 			t.Errorf("Received %s, expected %s", err, ErrCouldNotParseDocumentJson)
 		}
@@ -210,8 +260,8 @@ func TestUrlShortenService_GetOriginalUrlForShortUrl(t *testing.T) {
 	t.Run("returns nil when successful", func(t *testing.T) {
 		mockEsService := MockEsService{"", Document{Id: "123", Content: json.RawMessage(`{"original_url": "http://some-url"}`)}, nil}
 		mockKgsService := MockKgsService{"", nil}
-		urlSvc := NewUrlShortenService("some-index", mockEsService, mockKgsService)
-		url, err := urlSvc.GetOriginalUrlForShortUrl("http://shrt-url")
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		url, err := urlSvc.GetOriginalUrlForShortUrl(context.Background(), "http://shrt-url")
 		if err != nil {
 			t.Errorf("Received %s, expected nil", err)
 		}
@@ -220,3 +270,122 @@ func TestUrlShortenService_GetOriginalUrlForShortUrl(t *testing.T) {
 		}
 	})
 }
+
+func TestUrlShortenService_UpdateShortUrl(t *testing.T) {
+	t.Run("returns error when document belongs to another workspace", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{Id: "123", Content: json.RawMessage(`{"original_url": "http://some-url", "workspace": "team-a"}`)}, nil}
+		mockKgsService := MockKgsService{"", nil}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.UpdateShortUrl(context.Background(), "http://shrt-url", "team-b", urlUpdate{})
+		if err != ErrShortUrlInOtherWorkspace {
+			t.Errorf("Received %s, expected %s", err, ErrShortUrlInOtherWorkspace)
+		}
+	})
+	t.Run("returns error when document cannot be found", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{}, ErrEsDoesNotContainDocument}
+		mockKgsService := MockKgsService{"", nil}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.UpdateShortUrl(context.Background(), "http://shrt-url", "", urlUpdate{})
+		if err != ErrCouldNotFindDocumentForShortUrl {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotFindDocumentForShortUrl)
+		}
+	})
+	t.Run("returns nil when successful", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{Id: "123", Content: json.RawMessage(`{"original_url": "http://some-url"}`)}, nil}
+		mockKgsService := MockKgsService{"", nil}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.UpdateShortUrl(context.Background(), "http://shrt-url", "", urlUpdate{Params: map[string]string{"ref": "qr"}})
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
+
+func TestUrlDocumentContent_DestinationUrl(t *testing.T) {
+	t.Run("returns original url when no attributes are set", func(t *testing.T) {
+		content := urlDocumentContent{OriginalUrl: "http://some-url/path?a=1", ShortUrl: "http://shrt.url/abc123"}
+		url, err := content.DestinationUrl()
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+		if url != "http://some-url/path?a=1" {
+			t.Errorf("Received %s, expected %s", url, "http://some-url/path?a=1")
+		}
+	})
+	t.Run("merges utm fields and expands parameter templates", func(t *testing.T) {
+		content := urlDocumentContent{
+			OriginalUrl: "http://some-url/path?a=1",
+			ShortUrl:    "http://shrt.url/abc123",
+			urlAttributes: urlAttributes{
+				Utm:    &utmParameters{Source: "newsletter", Campaign: "spring"},
+				Params: map[string]string{"ref": "{slug}"},
+			},
+		}
+		url, err := content.DestinationUrl()
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+		expected := "http://some-url/path?a=1&ref=abc123&utm_campaign=spring&utm_source=newsletter"
+		if url != expected {
+			t.Errorf("Received %s, expected %s", url, expected)
+		}
+	})
+	t.Run("explicit parameters take precedence over utm fields", func(t *testing.T) {
+		content := urlDocumentContent{
+			OriginalUrl: "http://some-url",
+			ShortUrl:    "http://shrt.url/abc123",
+			urlAttributes: urlAttributes{
+				Utm:    &utmParameters{Source: "newsletter"},
+				Params: map[string]string{"utm_source": "print"},
+			},
+		}
+		url, _ := content.DestinationUrl()
+		if url != "http://some-url?utm_source=print" {
+			t.Errorf("Received %s, expected %s", url, "http://some-url?utm_source=print")
+		}
+	})
+}
+
+func TestUrlShortenService_ConsumeClickForShortUrl(t *testing.T) {
+	t.Run("returns error when document cannot be found", func(t *testing.T) {
+		mockEsService := MockEsService{"", Document{}, ErrEsDoesNotContainDocument}
+		mockKgsService := MockKgsService{"", nil}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.ConsumeClickForShortUrl(context.Background(), "http://shrt-url")
+		if err != ErrCouldNotFindDocumentForShortUrl {
+			t.Errorf("Received %s, expected %s", err, ErrCouldNotFindDocumentForShortUrl)
+		}
+	})
+	t.Run("returns error when click limit is reached", func(t *testing.T) {
+		mockEsService := MockEsService{"noop", Document{}, nil}
+		mockKgsService := MockKgsService{"", nil}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.ConsumeClickForShortUrl(context.Background(), "http://shrt-url")
+		if err != ErrShortUrlClickLimitReached {
+			t.Errorf("Received %s, expected %s", err, ErrShortUrlClickLimitReached)
+		}
+	})
+	t.Run("returns nil when click is counted", func(t *testing.T) {
+		mockEsService := MockEsService{"updated", Document{}, nil}
+		mockKgsService := MockKgsService{"", nil}
+		urlSvc := NewUrlShortenService(NewEsLinkStore("some-index", mockEsService, esIndexSettings{}), mockKgsService, "")
+		err := urlSvc.ConsumeClickForShortUrl(context.Background(), "http://shrt-url")
+		if err != nil {
+			t.Errorf("Received %s, expected nil", err)
+		}
+	})
+}
+
+func TestUrlDocumentContent_BelongsToWorkspace(t *testing.T) {
+	content := urlDocumentContent{urlAttributes: urlAttributes{Workspace: "team-a"}}
+	t.Run("returns true for the owning workspace and unconfined callers", func(t *testing.T) {
+		if !content.BelongsToWorkspace("team-a") || !content.BelongsToWorkspace("") {
+			t.Errorf("Received %t, expected %t", false, true)
+		}
+	})
+	t.Run("returns false for other workspaces", func(t *testing.T) {
+		if content.BelongsToWorkspace("team-b") {
+			t.Errorf("Received %t, expected %t", true, false)
+		}
+	})
+}
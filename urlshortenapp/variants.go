@@ -0,0 +1,74 @@
+package main
+
+// Weighted A/B split destinations with sticky assignment per client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const variantCookieMaxAge = 30 * 24 * time.Hour
+
+type destinationVariant struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Each link gets its own cookie so assignments do not leak between links
+func variantCookieName(shortUrl string) string {
+	return fmt.Sprintf("variant_%s", documentIdForShortUrl(shortUrl)[:12])
+}
+
+// Scoped to the slug path, which is where the short URL is served from
+func newVariantCookie(shortUrl string, variant string) *http.Cookie {
+	return &http.Cookie{
+		Name:     variantCookieName(shortUrl),
+		Value:    variant,
+		Path:     shortUrl[strings.LastIndex(shortUrl, "/"):],
+		MaxAge:   int(variantCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// Places the client on a point in the weight range derived from a hash of its
+// fingerprint, so clients without cookies still see a consistent variant.
+func (c *redirectClient) variantPoint(shortUrl string, totalWeight int) int {
+	hash := fnv.New32a()
+	_, _ = fmt.Fprintf(hash, "%s|%s|%s", shortUrl, c.Ip, c.UserAgent)
+	return int(hash.Sum32() % uint32(totalWeight))
+}
+
+// Returns the variant assigned to the client: the sticky variant if it is
+// still live, otherwise one picked by weight. Returns nil without variants.
+func (c urlDocumentContent) pickVariant(client *redirectClient) *destinationVariant {
+	totalWeight := 0
+	for i, variant := range c.Variants {
+		if variant.Weight <= 0 {
+			continue
+		}
+		if variant.Name == client.StickyVariant {
+			return &c.Variants[i]
+		}
+		totalWeight += variant.Weight
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+
+	point := client.variantPoint(c.ShortUrl, totalWeight)
+	for i, variant := range c.Variants {
+		if variant.Weight <= 0 {
+			continue
+		}
+		if point < variant.Weight {
+			return &c.Variants[i]
+		}
+		point -= variant.Weight
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUrlDocumentContent_pickVariant(t *testing.T) {
+	content := urlDocumentContent{
+		ShortUrl: "http://shrt.url/abc123",
+		urlAttributes: urlAttributes{
+			Variants: []destinationVariant{
+				{Name: "a", Url: "http://a.url", Weight: 1},
+				{Name: "b", Url: "http://b.url", Weight: 0},
+				{Name: "c", Url: "http://c.url", Weight: 3},
+			},
+		},
+	}
+	t.Run("returns nil without variants", func(t *testing.T) {
+		client := &redirectClient{Ip: net.ParseIP("198.51.100.4")}
+		if variant := (urlDocumentContent{}).pickVariant(client); variant != nil {
+			t.Errorf("Received %s, expected nil", variant.Name)
+		}
+	})
+	t.Run("returns sticky variant when it is still live", func(t *testing.T) {
+		client := &redirectClient{Ip: net.ParseIP("198.51.100.4"), StickyVariant: "a"}
+		if variant := content.pickVariant(client); variant == nil || variant.Name != "a" {
+			t.Errorf("Received %v, expected %s", variant, "a")
+		}
+	})
+	t.Run("ignores sticky variant when its weight is zero", func(t *testing.T) {
+		client := &redirectClient{Ip: net.ParseIP("198.51.100.4"), StickyVariant: "b"}
+		if variant := content.pickVariant(client); variant == nil || variant.Name == "b" {
+			t.Errorf("Received %v, expected a live variant", variant)
+		}
+	})
+	t.Run("assigns variants in proportion to weight", func(t *testing.T) {
+		counts := map[string]int{}
+		for i := 0; i < 2000; i++ {
+			client := &redirectClient{Ip: net.IPv4(10, 0, byte(i/256), byte(i%256))}
+			counts[content.pickVariant(client).Name]++
+		}
+		if counts["b"] != 0 {
+			t.Errorf("Received %d, expected 0 clients on zero-weight variant", counts["b"])
+		}
+		if counts["c"] < 2*counts["a"] {
+			t.Errorf("Received a=%d c=%d, expected roughly 1:3", counts["a"], counts["c"])
+		}
+	})
+}